@@ -9,18 +9,31 @@ import (
 	"github.com/aerofs/lipwig/ssmp"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Requests rejected before being sent return a PayloadError, IdentifierError
+// or RequestSizeError, which match these errors with errors.Is.
 var (
 	ErrInvalidPayload    error = fmt.Errorf("invalid payload")
 	ErrInvalidIdentifier error = fmt.Errorf("invalid identifier")
 	ErrRequestTooLarge   error = fmt.Errorf("request too large")
 )
 
+// Common LOGIN schemes.
+const (
+	// SchemeNone carries no credential, e.g. for anonymous login
+	SchemeNone = "none"
+	// SchemeCert authenticates with the TLS client certificate
+	SchemeCert = "cert"
+	// SchemeOpen is accepted by servers with open login enabled
+	SchemeOpen = "open"
+)
+
 // Response represents an SSMP response received by a client.
 type Response struct {
 	// Code specifies the response code (200, 400, ...)
@@ -55,11 +68,50 @@ type Client interface {
 	// network connection.
 	Close()
 
+	// Wait blocks until the connection is closed, by either side.
+	// This method is safe to call from multiple goroutines simultaneously.
+	Wait()
+
+	// Done returns a channel that is closed when the connection is closed,
+	// by either side.
+	// This method is safe to call from multiple goroutines simultaneously.
+	Done() <-chan struct{}
+
 	// Login makes a LOGIN request.
 	// An error is returned in case of network or protocol error. A non-2xx
 	// response doesn't cause an error.
 	Login(user string, scheme string, credential string) (Response, error)
 
+	// LoginAnonymous makes an anonymous LOGIN request, without credential.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	LoginAnonymous() (Response, error)
+
+	// LoginWithCert makes a LOGIN request authenticated by the TLS client
+	// certificate.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	LoginWithCert(user string) (Response, error)
+
+	// Relogin makes a RELOGIN request, to upgrade an anonymous connection to
+	// a named one.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	Relogin(user string, scheme string, credential string) (Response, error)
+
+	// Reauth makes a REAUTH request, to present fresh credentials for the
+	// user of the connection. The server closes the connection if they are
+	// rejected.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	Reauth(scheme string, credential string) (Response, error)
+
+	// Resume makes a RESUME request, to take over the session of a previous
+	// connection from an anonymous one. See ParseSession.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	Resume(token string) (Response, error)
+
 	// Subscribe makes a SUBSCRIBE request.
 	// An error is returned in case of network or protocol error. A non-2xx
 	// response doesn't cause an error.
@@ -70,35 +122,189 @@ type Client interface {
 	// response doesn't cause an error.
 	SubscribeWithPresence(topic string) (Response, error)
 
+	// SubscribeWithCount makes a SUBSCRIBE request with the COUNT flag.
+	// COUNT events carrying the number of subscribers are then received
+	// whenever it changes.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	SubscribeWithCount(topic string) (Response, error)
+
+	// SubscribeWithLease makes a SUBSCRIBE request with a lease, rounded up
+	// to the second. The subscription is removed by the server unless the
+	// lease is renewed in time by calling SubscribeWithLease again.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	SubscribeWithLease(topic string, ttl time.Duration) (Response, error)
+
+	// SubscribeWithOptions makes a SUBSCRIBE request with any combination
+	// of the PRESENCE, NOSELF, ECHO and COUNT flags, and LEASE option.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	SubscribeWithOptions(topic string, options ...string) (Response, error)
+
+	// SubscribeMulti makes a single SUBSCRIBE request for several topics.
+	// Either all subscriptions succeed or none is made.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	SubscribeMulti(topics []string) (Response, error)
+
+	// SubscribeMultiWithPresence makes a single SUBSCRIBE request for several
+	// topics with the PRESENCE flag.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	SubscribeMultiWithPresence(topics []string) (Response, error)
+
+	// Features returns the optional protocol features negotiated with the
+	// server, unless the client was created with WithHello(false). They are
+	// known once the response to the first request, e.g. LOGIN, is received.
+	Features() []string
+
 	// Unsubscribe makes a UNSUBSCRIBE request.
 	// An error is returned in case of network or protocol error. A non-2xx
 	// response doesn't cause an error.
 	Unsubscribe(topic string) (Response, error)
 
+	// Configure makes a CONFIGURE request, to change the options of a topic
+	// owned by the user, e.g. Configure("chat", "MaxSubscribers=100").
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	Configure(topic string, settings ...string) (Response, error)
+
 	// Ucast makes a UCAST request.
 	// An error is returned in case of network or protocol error. A non-2xx
 	// response doesn't cause an error.
 	Ucast(user string, payload string) (Response, error)
 
+	// UcastTraced makes a UCAST request wrapped in a TRACE request. The
+	// recipient receives a TRACED event carrying the trace ID before the
+	// message.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	UcastTraced(traceID string, user string, payload string) (Response, error)
+
+	// UcastReliable makes a UCAST request wrapped in a RELIABLE request with
+	// the given message ID, and waits until the recipient acknowledges it with
+	// an ACK request, see Ack. The recipient receives a TRACED event carrying
+	// the message ID before the message, as with UcastTraced.
+	// It returns false if the message was rejected by the server or not
+	// acknowledged within the timeout.
+	// An error is returned in case of network or protocol error.
+	UcastReliable(user string, msgid string, payload string, ackTimeout time.Duration) (bool, error)
+
+	// Ack makes an ACK request, to acknowledge the receipt of a message sent
+	// with UcastReliable. The message ID and sender are those of the
+	// preceding TRACED event. If from is empty, the oldest pending message
+	// with that ID is acknowledged, whoever sent it.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	Ack(msgid string, from string) (Response, error)
+
+	// UcastWithTTL makes a UCAST request wrapped in an EXPIRES request. The
+	// server discards the message with a 408 response if it is processed
+	// after the TTL elapsed.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	UcastWithTTL(user string, payload string, ttl time.Duration) (Response, error)
+
 	// Mcast makes a MCAST request.
 	// An error is returned in case of network or protocol error. A non-2xx
 	// response doesn't cause an error.
 	Mcast(topic string, payload string) (Response, error)
 
+	// McastWithReceipts makes a MCAST request with the payload prefixed by a
+	// message ID, as <msgid>:<payload>. The user of every subscriber with
+	// the RECEIPT option that the message is delivered to is sent on
+	// receipts before the response is returned. Receipts are dropped if the
+	// channel is not ready to receive them, and the message ID should not
+	// be reused until the response is returned.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	McastWithReceipts(topic, msgid, payload string, receipts chan<- string) (Response, error)
+
 	// Bcast makes a BCAST request.
 	// An error is returned in case of network or protocol error. A non-2xx
 	// response doesn't cause an error.
 	Bcast(payload string) (Response, error)
+
+	// UcastBytes makes a UCAST request with a binary payload.
+	// An error is returned in case of network or protocol error, or if the
+	// payload is empty or too large. A non-2xx response doesn't cause an error.
+	UcastBytes(user string, payload []byte) (Response, error)
+
+	// McastBytes makes a MCAST request with a binary payload.
+	// An error is returned in case of network or protocol error, or if the
+	// payload is empty or too large. A non-2xx response doesn't cause an error.
+	McastBytes(topic string, payload []byte) (Response, error)
+
+	// BcastBytes makes a BCAST request with a binary payload.
+	// An error is returned in case of network or protocol error, or if the
+	// payload is empty or too large. A non-2xx response doesn't cause an error.
+	BcastBytes(payload []byte) (Response, error)
+
+	// JoinGroup makes a GROUP request.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	JoinGroup(group string) (Response, error)
+
+	// LeaveGroup makes a GROUP request with the LEAVE flag.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	LeaveGroup(group string) (Response, error)
+
+	// ListUsers makes as many USERS requests as needed to retrieve all the
+	// connected named users starting with the given prefix.
+	// An error is returned in case of network or protocol error. A non-2xx
+	// response doesn't cause an error.
+	ListUsers(prefix string) ([]string, Response, error)
+}
+
+// ClientConfig controls the liveness checks of a Client.
+type ClientConfig struct {
+	// IdleTimeout is the time without any incoming message after which
+	// a PING is sent.
+	IdleTimeout time.Duration
+
+	// PingTimeout is the time to wait for any incoming message after a PING
+	// was sent.
+	PingTimeout time.Duration
+
+	// MaxIdleRounds is the number of consecutive PINGs left unanswered after
+	// which the connection is closed.
+	MaxIdleRounds int
+}
+
+// DefaultConfig returns the configuration used by NewClient.
+func DefaultConfig() ClientConfig {
+	return ClientConfig{
+		IdleTimeout:   30 * time.Second,
+		PingTimeout:   30 * time.Second,
+		MaxIdleRounds: 1,
+	}
 }
 
 type client struct {
 	RequestChecks bool
 
+	cfg ClientConfig
+
 	c  net.Conn
+	p  *ssmp.Protocol
 	h  atomic.Value
 	wg sync.WaitGroup
 
 	responses chan Response
+	done      chan struct{}
+
+	// pending UcastReliable, by message ID
+	acks sync.Map
+	// pending McastWithReceipts, by message ID
+	receipts sync.Map
+
+	// see WithHello
+	hello bool
+	// the first response answers HELLO, only accessed by the read loop
+	helloPending bool
+	features     atomic.Pointer[[]string]
 }
 
 type DiscardHandler struct{}
@@ -113,36 +319,111 @@ var bufPool *sync.Pool = &sync.Pool{
 	},
 }
 
+// A ClientOption configures optional behavior of a Client.
+type ClientOption func(*client)
+
+// WithRequestChecks enables or disables client-side validation of requests
+// before they are sent.
+func WithRequestChecks(enabled bool) ClientOption {
+	return func(c *client) {
+		c.RequestChecks = enabled
+	}
+}
+
+// features requested by HELLO, see WithHello
+var clientFeatures = []string{ssmp.COMPRESS, ssmp.LEASE}
+
+// WithHello enables or disables the HELLO request sent before any other,
+// to negotiate optional protocol features, see Client.Features. It is
+// enabled by default; disable it for servers that predate HELLO, or use a
+// custom handshake, as they reject it.
+func WithHello(enabled bool) ClientOption {
+	return func(c *client) {
+		c.hello = enabled
+	}
+}
+
 // NewClient creates a new SSMP client using the given network connection
 // and event handler.
-func NewClient(c net.Conn, h EventHandler) Client {
+func NewClient(c net.Conn, h EventHandler, opts ...ClientOption) Client {
+	return NewClientWithConfig(c, h, DefaultConfig(), opts...)
+}
+
+// NewClientWithConfig creates a new SSMP client using the given network
+// connection, event handler and liveness configuration.
+func NewClientWithConfig(c net.Conn, h EventHandler, cfg ClientConfig, opts ...ClientOption) Client {
 	cc := &client{
 		c:         c,
+		p:         ssmp.NewProtocol(c),
+		cfg:       cfg,
 		responses: make(chan Response),
+		done:      make(chan struct{}),
+		hello:     true,
+	}
+	for _, opt := range opts {
+		opt(cc)
 	}
 	cc.SetEventHandler(h)
+	if cc.hello {
+		// the response is handled by the read loop, without waiting
+		hello := ssmp.HELLO + " " + strconv.Itoa(ssmp.ProtocolVersion) + " " + strings.Join(clientFeatures, " ") + "\n"
+		if _, err := cc.p.Write([]byte(hello)); err == nil {
+			cc.helloPending = true
+		}
+	}
 	cc.wg.Add(1)
 	go cc.readLoop()
 	return cc
 }
 
+func (c *client) Features() []string {
+	if f := c.features.Load(); f != nil {
+		return *f
+	}
+	return nil
+}
+
+// negotiated records the features accepted in the response to HELLO:
+// HELLO <version> [<feature> ...]
+// Servers that don't support HELLO answer with an error code instead.
+func (c *client) negotiated(m ssmp.Message) {
+	if m.Code != ssmp.NoCode || !ssmp.Equal(m.Verb, ssmp.HELLO) {
+		fmt.Printf("Client[%p] HELLO rejected: %d\n", c, m.Code)
+		return
+	}
+	features := strings.Fields(string(m.Payload))
+	c.features.Store(&features)
+}
+
 func (c *client) Close() {
 	_, _ = c.request(ssmp.CLOSE, "", "")
 	c.c.Close()
 	c.wg.Wait()
 }
 
+func (c *client) Wait() {
+	c.wg.Wait()
+}
+
+func (c *client) Done() <-chan struct{} {
+	return c.done
+}
+
+// handlerBox gives all handlers the same concrete type, as required by
+// atomic.Value
+type handlerBox struct {
+	h EventHandler
+}
+
 func (c *client) EventHandler() EventHandler {
-	return c.h.Load().(EventHandler)
+	return c.h.Load().(handlerBox).h
 }
 
 func (c *client) SetEventHandler(h EventHandler) {
 	if h == nil {
-		// Value doesn't accept nil
-		c.h.Store(Discard)
-	} else {
-		c.h.Store(h)
+		h = Discard
 	}
+	c.h.Store(handlerBox{h})
 }
 
 func (c *client) Login(user string, scheme string, cred string) (Response, error) {
@@ -153,6 +434,34 @@ func (c *client) Login(user string, scheme string, cred string) (Response, error
 	return c.request(ssmp.LOGIN, user, payload)
 }
 
+func (c *client) LoginAnonymous() (Response, error) {
+	return c.Login(ssmp.Anonymous, SchemeNone, "")
+}
+
+func (c *client) LoginWithCert(user string) (Response, error) {
+	return c.Login(user, SchemeCert, "")
+}
+
+func (c *client) Relogin(user string, scheme string, cred string) (Response, error) {
+	payload := scheme
+	if len(cred) > 0 {
+		payload = scheme + " " + cred
+	}
+	return c.request(ssmp.RELOGIN, user, payload)
+}
+
+func (c *client) Reauth(scheme string, cred string) (Response, error) {
+	payload := scheme
+	if len(cred) > 0 {
+		payload = scheme + " " + cred
+	}
+	return c.request(ssmp.REAUTH, "", payload)
+}
+
+func (c *client) Resume(token string) (Response, error) {
+	return c.request(ssmp.RESUME, token, "")
+}
+
 func (c *client) Subscribe(topic string) (Response, error) {
 	return c.request(ssmp.SUBSCRIBE, topic, "")
 }
@@ -161,44 +470,172 @@ func (c *client) SubscribeWithPresence(topic string) (Response, error) {
 	return c.request(ssmp.SUBSCRIBE, topic, ssmp.PRESENCE)
 }
 
+func (c *client) SubscribeWithCount(topic string) (Response, error) {
+	return c.request(ssmp.SUBSCRIBE, topic, ssmp.COUNT)
+}
+
+func (c *client) SubscribeWithLease(topic string, ttl time.Duration) (Response, error) {
+	return c.request(ssmp.SUBSCRIBE, topic, leaseOption(ttl))
+}
+
+// leaseOption formats the LEASE option of a SUBSCRIBE request.
+func leaseOption(ttl time.Duration) string {
+	s := (ttl + time.Second - 1) / time.Second
+	if s < 1 {
+		s = 1
+	}
+	return ssmp.LEASE + " " + strconv.FormatInt(int64(s), 10)
+}
+
+func (c *client) SubscribeWithOptions(topic string, options ...string) (Response, error) {
+	return c.request(ssmp.SUBSCRIBE, topic, strings.Join(options, " "))
+}
+
+func (c *client) SubscribeMulti(topics []string) (Response, error) {
+	return c.requestList(ssmp.SUBSCRIBE, topics, "")
+}
+
+func (c *client) SubscribeMultiWithPresence(topics []string) (Response, error) {
+	return c.requestList(ssmp.SUBSCRIBE, topics, ssmp.PRESENCE)
+}
+
 func (c *client) Unsubscribe(topic string) (Response, error) {
 	return c.request(ssmp.UNSUBSCRIBE, topic, "")
 }
 
+func (c *client) Configure(topic string, settings ...string) (Response, error) {
+	return c.request(ssmp.CONFIGURE, topic, strings.Join(settings, " "))
+}
+
 func (c *client) Ucast(user string, payload string) (Response, error) {
 	return c.request(ssmp.UCAST, user, payload)
 }
 
+func (c *client) UcastTraced(traceID string, user string, payload string) (Response, error) {
+	if c.RequestChecks && !ssmp.IsValidIdentifier(traceID) {
+		return Response{}, IdentifierError{Identifier: traceID}
+	}
+	return c.request(ssmp.TRACE+" "+traceID+" "+ssmp.UCAST, user, payload)
+}
+
+func (c *client) UcastReliable(user string, msgid string, payload string, ackTimeout time.Duration) (bool, error) {
+	if c.RequestChecks && !ssmp.IsValidIdentifier(msgid) {
+		return false, IdentifierError{Identifier: msgid}
+	}
+	ack := make(chan struct{})
+	c.acks.Store(msgid, ack)
+	defer c.acks.Delete(msgid)
+	r, err := c.request(ssmp.RELIABLE+" "+msgid+" "+ssmp.UCAST, user, payload)
+	if err != nil || !r.IsOK() {
+		return false, err
+	}
+	t := time.NewTimer(ackTimeout)
+	defer t.Stop()
+	select {
+	case <-ack:
+		return true, nil
+	case <-t.C:
+		return false, nil
+	case <-c.done:
+		return false, fmt.Errorf("connection closed")
+	}
+}
+
+func (c *client) Ack(msgid string, from string) (Response, error) {
+	return c.request(ssmp.ACK, msgid, from)
+}
+
+func (c *client) UcastWithTTL(user string, payload string, ttl time.Duration) (Response, error) {
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return c.request(ssmp.EXPIRES+" "+expiry+" "+ssmp.UCAST, user, payload)
+}
+
 func (c *client) Mcast(topic string, payload string) (Response, error) {
 	return c.request(ssmp.MCAST, topic, payload)
 }
 
+func (c *client) McastWithReceipts(topic, msgid, payload string, receipts chan<- string) (Response, error) {
+	if c.RequestChecks && (!ssmp.IsValidIdentifier(msgid) || strings.IndexByte(msgid, ':') != -1) {
+		return Response{}, IdentifierError{Identifier: msgid}
+	}
+	c.receipts.Store(msgid, receipts)
+	defer c.receipts.Delete(msgid)
+	return c.request(ssmp.MCAST, topic, msgid+":"+payload)
+}
+
 func (c *client) Bcast(payload string) (Response, error) {
 	return c.request(ssmp.BCAST, "", payload)
 }
 
+func (c *client) JoinGroup(group string) (Response, error) {
+	return c.request(ssmp.GROUP, group, "")
+}
+
+func (c *client) LeaveGroup(group string) (Response, error) {
+	return c.request(ssmp.GROUP, group, ssmp.LEAVE)
+}
+
+func (c *client) ListUsers(prefix string) ([]string, Response, error) {
+	var users []string
+	option := prefix
+	for {
+		r, err := c.request(ssmp.USERS, "", option)
+		if err != nil || (!r.IsOK() && r.Code != ssmp.CodePartial) {
+			return users, r, err
+		}
+		page := ParseList(r)
+		users = append(users, page...)
+		if r.Code != ssmp.CodePartial || len(page) == 0 {
+			return users, r, nil
+		}
+		option = strings.TrimSpace(prefix + " >" + page[len(page)-1])
+	}
+}
+
+func (c *client) requestList(cmd string, to []string, payload string) (Response, error) {
+	if c.RequestChecks {
+		if len(to) == 0 {
+			return Response{}, IdentifierError{}
+		}
+		for _, id := range to {
+			if len(id) == 0 || !ssmp.IsValidIdentifier(id) {
+				return Response{}, IdentifierError{Identifier: id}
+			}
+		}
+	}
+	list := strings.Join(to, string(ssmp.IdListSeparator))
+	if c.RequestChecks && len(list) > ssmp.MaxIdentifierListLength {
+		return Response{}, RequestSizeError{Size: len(list), Max: ssmp.MaxIdentifierListLength}
+	}
+	return c.send(cmd, list, payload)
+}
+
 func (c *client) request(cmd string, to string, payload string) (Response, error) {
+	if c.RequestChecks && !ssmp.IsValidIdentifier(to) {
+		return Response{}, IdentifierError{Identifier: to}
+	}
+	return c.send(cmd, to, payload)
+}
+
+func (c *client) send(cmd string, to string, payload string) (Response, error) {
 	var r Response
 	if c.RequestChecks {
-		if !ssmp.IsValidIdentifier(to) {
-			return r, ErrInvalidIdentifier
-		}
 		n := len(payload)
 		if n > 0 {
 			b := payload[0]
 			if b >= 0 && b <= 3 {
 				// binary payload: length prefix must match
 				if n < 3 {
-					return r, ErrInvalidPayload
+					return r, PayloadError{Msg: "truncated binary payload", PayloadLen: n}
 				}
 				sz := 3 + (int(b) << 8) + (int(payload[1]) & 0xff)
 				if len(payload) != sz {
-					return r, ErrInvalidPayload
+					return r, PayloadError{Msg: "binary length prefix mismatch", PayloadLen: n}
 				}
-			} else if n > 1024 {
-				return r, ErrRequestTooLarge
+			} else if n > ssmp.MaxPayloadLength {
+				return r, RequestSizeError{Size: n, Max: ssmp.MaxPayloadLength}
 			} else if strings.ContainsAny(payload, "\x00\x01\x02\x03\n") {
-				return r, ErrInvalidPayload
+				return r, PayloadError{Msg: "control character in text payload", PayloadLen: n}
 			}
 		}
 	}
@@ -214,7 +651,7 @@ func (c *client) request(cmd string, to string, payload string) (Response, error
 		buf.WriteString(payload)
 	}
 	buf.WriteByte('\n')
-	_, err := c.c.Write(buf.Bytes())
+	_, err := c.p.Write(buf.Bytes())
 	bufPool.Put(buf)
 	if err != nil {
 		c.c.Close()
@@ -232,109 +669,85 @@ var pong []byte = []byte(ssmp.PONG + "\n")
 
 func (c *client) readLoop() {
 	defer c.wg.Done()
+	defer close(c.done)
 	defer close(c.responses)
 
-	idle := false
-	r := ssmp.NewDecoder(c.c)
+	idle := 0
 	for {
-		c.c.SetReadDeadline(time.Now().Add(30 * time.Second))
-		code, err := r.DecodeCode()
+		if idle == 0 {
+			c.c.SetReadDeadline(time.Now().Add(c.cfg.IdleTimeout))
+		} else {
+			c.c.SetReadDeadline(time.Now().Add(c.cfg.PingTimeout))
+		}
+		m, err := c.p.ReadMessage()
 		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && !idle {
-				idle = true
-				c.c.Write(ping)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && idle < c.cfg.MaxIdleRounds {
+				idle++
+				c.p.Write(ping)
 				continue
 			}
 			// unwrap network error
 			if oerr, ok := err.(*net.OpError); ok {
 				err = oerr.Err
 			}
-			if err != io.EOF && err.Error() != "use of closed network connection" {
+			if err != io.EOF && err != io.ErrClosedPipe && err.Error() != "use of closed network connection" {
 				fmt.Printf("Client[%p] Failed to read: %v\n", c, err)
 			}
 			break
 		}
-		idle = false
-		if code == ssmp.CodeEvent {
-			ev, err := parseEvent(r)
-			if err != nil {
-				fmt.Printf("Client[%p] Invalid event: %v\n", c, err)
+		idle = 0
+		if m.Code == ssmp.CodeEvent {
+			if _, ok := ssmp.VerbFields[string(m.Verb)]; !ok {
+				fmt.Printf("Client[%p] Invalid event: %v\n", c, ErrInvalidEvent)
 				break
 			}
-			r.Reset()
-			if ssmp.Equal(ev.Name, ssmp.PING) {
-				c.c.Write(pong)
+			if ssmp.Equal(m.Verb, ssmp.PING) {
+				c.p.Write(pong)
 				continue
 			}
-			if ssmp.Equal(ev.Name, ssmp.PONG) {
+			if ssmp.Equal(m.Verb, ssmp.PONG) {
 				continue
 			}
+			if ssmp.Equal(m.Verb, ssmp.ACK) {
+				if ack, ok := c.acks.LoadAndDelete(string(m.To)); ok {
+					close(ack.(chan struct{}))
+					continue
+				}
+			}
+			if ssmp.Equal(m.Verb, ssmp.RECEIPT) {
+				if r, ok := c.receipts.Load(string(m.From)); ok {
+					select {
+					case r.(chan<- string) <- string(m.To):
+					default:
+					}
+					continue
+				}
+			}
 			h := c.EventHandler()
 			if h == nil {
 				continue
 			}
-			h.HandleEvent(ev)
+			h.HandleEvent(Event{
+				From:    m.From,
+				Name:    m.Verb,
+				To:      m.To,
+				Payload: m.Payload,
+			})
 			continue
 		}
-		var payload string
-		if !r.AtEnd() {
-			d, err := r.DecodePayload()
-			if err != nil {
-				fmt.Printf("Client[%p] Invalid response: %v\n", c, err)
-				break
-			}
-			payload = string(d)
+		if c.helloPending {
+			c.helloPending = false
+			c.negotiated(m)
+			continue
+		}
+		if m.Code == ssmp.NoCode {
+			fmt.Printf("Client[%p] Invalid response: %v\n", c, ssmp.ErrInvalidMessage)
+			break
 		}
-		r.Reset()
 		c.responses <- Response{
-			Code:    code,
-			Message: payload,
+			Code:    m.Code,
+			Message: string(m.Payload),
 		}
 	}
 	c.c.Close()
 }
-
-func parseEvent(r *ssmp.Decoder) (Event, error) {
-	var e Event
-	from, err := r.DecodeId()
-	if err != nil {
-		return e, err
-	}
-	e.From = from
-	ev, err := r.DecodeVerb()
-	if err != nil {
-		return e, err
-	}
-	fields := events[string(ev)]
-	if fields == 0 {
-		return e, ErrInvalidEvent
-	}
-	e.Name = ev
-	if fields == noFields {
-		return e, nil
-	}
-	if (fields & fieldTo) != 0 {
-		to, err := r.DecodeId()
-		if err != nil {
-			return e, err
-		}
-		e.To = to
-	}
-	if (fields & fieldOption) != 0 {
-		e.Payload = []byte{}
-		if !r.AtEnd() {
-			payload, err := r.DecodePayload()
-			if err != nil {
-				return e, err
-			}
-			e.Payload = payload
-		}
-	} else if (fields & fieldPayload) != 0 {
-		payload, err := r.DecodePayload()
-		if err != nil {
-			return e, err
-		}
-		e.Payload = payload
-	}
-	return e, nil
-}
@@ -0,0 +1,46 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Dial connects to the given address and creates a new SSMP client.
+func Dial(network, address string, h EventHandler, opts ...ClientOption) (Client, error) {
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c, h, opts...), nil
+}
+
+// DialTLS connects to the given address using TLS and creates a new SSMP client.
+func DialTLS(network, address string, cfg *tls.Config, h EventHandler, opts ...ClientOption) (Client, error) {
+	c, err := tls.Dial(network, address, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c, h, opts...), nil
+}
+
+// DialContext connects to the given address and creates a new SSMP client.
+// The context only bounds the connection establishment, it has no effect on
+// the returned Client.
+func DialContext(ctx context.Context, network, address string, h EventHandler, opts ...ClientOption) (Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return NewClient(c, h, opts...), nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"fmt"
+)
+
+// A PayloadError is returned when a request is rejected before being sent
+// because of a malformed payload. It matches ErrInvalidPayload with
+// errors.Is.
+type PayloadError struct {
+	// Msg describes the problem.
+	Msg string
+	// PayloadLen is the length of the rejected payload, in bytes.
+	PayloadLen int
+}
+
+func (e PayloadError) Error() string {
+	return fmt.Sprintf("%s: %s (%d bytes)", ErrInvalidPayload.Error(), e.Msg, e.PayloadLen)
+}
+
+func (e PayloadError) Is(target error) bool {
+	return target == ErrInvalidPayload
+}
+
+// An IdentifierError is returned when a request is rejected before being
+// sent because of an invalid topic, user or group identifier. It matches
+// ErrInvalidIdentifier with errors.Is.
+type IdentifierError struct {
+	Identifier string
+}
+
+func (e IdentifierError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrInvalidIdentifier.Error(), e.Identifier)
+}
+
+func (e IdentifierError) Is(target error) bool {
+	return target == ErrInvalidIdentifier
+}
+
+// A RequestSizeError is returned when a request is rejected before being
+// sent because a field exceeds its maximum size. It matches
+// ErrRequestTooLarge with errors.Is.
+type RequestSizeError struct {
+	Size int
+	Max  int
+}
+
+func (e RequestSizeError) Error() string {
+	return fmt.Sprintf("%s: %d bytes, max %d", ErrRequestTooLarge.Error(), e.Size, e.Max)
+}
+
+func (e RequestSizeError) Is(target error) bool {
+	return target == ErrRequestTooLarge
+}
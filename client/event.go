@@ -4,8 +4,8 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/aerofs/lipwig/ssmp"
 )
 
 // Event represents a decoded SSMP server-sent event.
@@ -19,22 +19,9 @@ type Event struct {
 	Payload []byte
 }
 
-const (
-	fieldTo = 1 << iota
-	fieldPayload
-	fieldOption
-
-	noFields = -1
-)
+var ErrInvalidEvent error = fmt.Errorf("invalid event")
 
-var events map[string]int = map[string]int{
-	ssmp.SUBSCRIBE:   fieldTo | fieldOption,
-	ssmp.UNSUBSCRIBE: fieldTo,
-	ssmp.UCAST:       fieldTo | fieldPayload,
-	ssmp.MCAST:       fieldTo | fieldPayload,
-	ssmp.BCAST:       fieldPayload,
-	ssmp.PING:        noFields,
-	ssmp.PONG:        noFields,
+// DecodeJSON decodes the payload of the event as JSON into v.
+func (ev Event) DecodeJSON(v interface{}) error {
+	return json.Unmarshal(ev.Payload, v)
 }
-
-var ErrInvalidEvent error = fmt.Errorf("invalid event")
@@ -0,0 +1,155 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A DropCounter counts the events it didn't deliver. The handlers returned
+// by TimedEventHandler and BufferedEventHandler implement it.
+type DropCounter interface {
+	DroppedEvents() uint64
+}
+
+// copyEvent returns an event that remains valid after the handler returns.
+func copyEvent(ev Event) Event {
+	return Event{
+		From:    append([]byte(nil), ev.From...),
+		Name:    append([]byte(nil), ev.Name...),
+		To:      append([]byte(nil), ev.To...),
+		Payload: append([]byte(nil), ev.Payload...),
+	}
+}
+
+// TimedEventHandler bounds the time the client spends handing an event to
+// h, so that a slow handler doesn't stall the reception of other events and
+// responses. Events are passed to h in order and never concurrently, in a
+// separate goroutine. If h doesn't return within timeout, the client stops
+// waiting for it and the event is counted as dropped, although h may still
+// complete it. Events arriving while h is busy for longer than timeout are
+// dropped without being passed to h.
+func TimedEventHandler(h EventHandler, timeout time.Duration) EventHandler {
+	return &timedHandler{h: h, timeout: timeout, busy: make(chan struct{}, 1)}
+}
+
+type timedHandler struct {
+	h       EventHandler
+	timeout time.Duration
+	busy    chan struct{}
+	dropped atomic.Uint64
+}
+
+func (th *timedHandler) HandleEvent(ev Event) {
+	t := time.NewTimer(th.timeout)
+	defer t.Stop()
+	select {
+	case th.busy <- struct{}{}:
+	case <-t.C:
+		th.dropped.Add(1)
+		return
+	}
+	ev = copyEvent(ev)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { <-th.busy }()
+		th.h.HandleEvent(ev)
+	}()
+	select {
+	case <-done:
+	case <-t.C:
+		th.dropped.Add(1)
+	}
+}
+
+func (th *timedHandler) DroppedEvents() uint64 {
+	return th.dropped.Load()
+}
+
+// OverflowPolicy controls the behaviour of a BufferedEventHandler whose
+// buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops incoming events.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest buffered event to make room.
+	DropOldest
+	// Block waits for room in the buffer, stalling the client.
+	Block
+)
+
+// BufferedEventHandler passes events to h in order from a separate
+// goroutine, buffering up to bufferSize events while h is busy. Once the
+// buffer is full, events are dropped or the client blocks depending on the
+// overflow policy. The goroutine exits when the buffer is empty.
+func BufferedEventHandler(h EventHandler, bufferSize int, overflow OverflowPolicy) EventHandler {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	bh := &bufferedHandler{h: h, size: bufferSize, policy: overflow}
+	bh.notFull = sync.NewCond(&bh.l)
+	return bh
+}
+
+type bufferedHandler struct {
+	h      EventHandler
+	size   int
+	policy OverflowPolicy
+
+	l       sync.Mutex
+	notFull *sync.Cond
+	q       []Event
+	running bool
+	dropped uint64
+}
+
+func (bh *bufferedHandler) HandleEvent(ev Event) {
+	bh.l.Lock()
+	defer bh.l.Unlock()
+	if len(bh.q) >= bh.size {
+		switch bh.policy {
+		case DropOldest:
+			bh.q[0] = Event{}
+			bh.q = bh.q[1:]
+			bh.dropped++
+		case Block:
+			for len(bh.q) >= bh.size {
+				bh.notFull.Wait()
+			}
+		default:
+			bh.dropped++
+			return
+		}
+	}
+	bh.q = append(bh.q, copyEvent(ev))
+	if !bh.running {
+		bh.running = true
+		go bh.run()
+	}
+}
+
+func (bh *bufferedHandler) run() {
+	bh.l.Lock()
+	for len(bh.q) > 0 {
+		ev := bh.q[0]
+		bh.q[0] = Event{}
+		bh.q = bh.q[1:]
+		bh.notFull.Signal()
+		bh.l.Unlock()
+		bh.h.HandleEvent(ev)
+		bh.l.Lock()
+	}
+	bh.running = false
+	bh.l.Unlock()
+}
+
+func (bh *bufferedHandler) DroppedEvents() uint64 {
+	bh.l.Lock()
+	defer bh.l.Unlock()
+	return bh.dropped
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+)
+
+// An EventPredicate selects events.
+type EventPredicate func(Event) bool
+
+type eventFilter struct {
+	h       EventHandler
+	filters []EventPredicate
+}
+
+// NewEventFilter returns an EventHandler forwarding to h only the events
+// matching all the given predicates.
+func NewEventFilter(h EventHandler, filters ...EventPredicate) EventHandler {
+	return &eventFilter{h: h, filters: filters}
+}
+
+func (f *eventFilter) HandleEvent(ev Event) {
+	for _, p := range f.filters {
+		if !p(ev) {
+			return
+		}
+	}
+	f.h.HandleEvent(ev)
+}
+
+// FromUser matches events sent by the given user.
+func FromUser(user string) EventPredicate {
+	return func(ev Event) bool {
+		return ssmp.Equal(ev.From, user)
+	}
+}
+
+// ToTopic matches events targeted at the given topic (or user).
+func ToTopic(topic string) EventPredicate {
+	return func(ev Event) bool {
+		return ssmp.Equal(ev.To, topic)
+	}
+}
+
+// NameIs matches events with the given name, e.g. ssmp.MCAST.
+func NameIs(verb string) EventPredicate {
+	return func(ev Event) bool {
+		return ssmp.Equal(ev.Name, verb)
+	}
+}
+
+// Not matches events not matched by p.
+func Not(p EventPredicate) EventPredicate {
+	return func(ev Event) bool {
+		return !p(ev)
+	}
+}
+
+// Any matches events matched by at least one of the given predicates.
+func Any(ps ...EventPredicate) EventPredicate {
+	return func(ev Event) bool {
+		for _, p := range ps {
+			if p(ev) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package fragmentation transparently splits payloads larger than the SSMP
+// limit of 1024 bytes into multiple messages, and reassembles them on the
+// receiving end.
+//
+// Each fragment is sent as a binary payload prefixed with
+//
+//	frag:<id>:<seq>/<total>:
+//
+// where id identifies the original message for a given sender and seq ranges
+// from 1 to total. Fragments of a message are sent in order and, since SSMP
+// preserves ordering between two peers, are expected in order.
+package fragmentation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/ssmp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPayloadTooLarge error = fmt.Errorf("payload too large")
+
+// MaxFragments bounds the number of fragments of a single message, and
+// therefore the size of the payloads that can be sent.
+const MaxFragments = 4096
+
+// DefaultTimeout is the time after which incomplete messages are discarded
+// by handlers created with NewReassemblyHandler.
+const DefaultTimeout = 30 * time.Second
+
+const fragPrefix = "frag:"
+
+// smallest accepted fragment size, leaving room for the prefix
+const minFragSize = 64
+
+// NewFragmentingClient wraps a Client to fragment the payloads of UCAST,
+// MCAST and BCAST requests larger than maxFragSize. Smaller payloads are sent
+// unchanged. A maxFragSize outside of 64-1024 is treated as 1024.
+//
+// The response of a fragmented request is that of the last fragment sent:
+// the first fragment getting a non-2xx response stops the transmission.
+// Receivers must use a handler created with NewReassemblyHandler.
+func NewFragmentingClient(inner client.Client, maxFragSize int) client.Client {
+	if maxFragSize < minFragSize || maxFragSize > ssmp.MaxPayloadLength {
+		maxFragSize = ssmp.MaxPayloadLength
+	}
+	var seed [8]byte
+	rand.Read(seed[:])
+	return &fragmentingClient{
+		Client: inner,
+		max:    maxFragSize,
+		next:   binary.BigEndian.Uint64(seed[:]),
+	}
+}
+
+type fragmentingClient struct {
+	client.Client
+	max  int
+	next uint64
+}
+
+func (c *fragmentingClient) Ucast(user string, payload string) (client.Response, error) {
+	if len(payload) <= c.max {
+		return c.Client.Ucast(user, payload)
+	}
+	return c.fragment([]byte(payload), func(p []byte) (client.Response, error) {
+		return c.Client.UcastBytes(user, p)
+	})
+}
+
+func (c *fragmentingClient) Mcast(topic string, payload string) (client.Response, error) {
+	if len(payload) <= c.max {
+		return c.Client.Mcast(topic, payload)
+	}
+	return c.fragment([]byte(payload), func(p []byte) (client.Response, error) {
+		return c.Client.McastBytes(topic, p)
+	})
+}
+
+func (c *fragmentingClient) Bcast(payload string) (client.Response, error) {
+	if len(payload) <= c.max {
+		return c.Client.Bcast(payload)
+	}
+	return c.fragment([]byte(payload), c.Client.BcastBytes)
+}
+
+func (c *fragmentingClient) UcastBytes(user string, payload []byte) (client.Response, error) {
+	if len(payload) <= c.max {
+		return c.Client.UcastBytes(user, payload)
+	}
+	return c.fragment(payload, func(p []byte) (client.Response, error) {
+		return c.Client.UcastBytes(user, p)
+	})
+}
+
+func (c *fragmentingClient) McastBytes(topic string, payload []byte) (client.Response, error) {
+	if len(payload) <= c.max {
+		return c.Client.McastBytes(topic, payload)
+	}
+	return c.fragment(payload, func(p []byte) (client.Response, error) {
+		return c.Client.McastBytes(topic, p)
+	})
+}
+
+func (c *fragmentingClient) BcastBytes(payload []byte) (client.Response, error) {
+	if len(payload) <= c.max {
+		return c.Client.BcastBytes(payload)
+	}
+	return c.fragment(payload, c.Client.BcastBytes)
+}
+
+func (c *fragmentingClient) fragment(payload []byte, send func([]byte) (client.Response, error)) (client.Response, error) {
+	id := strconv.FormatUint(atomic.AddUint64(&c.next, 1), 36)
+	// room for the largest seq and total, so that every fragment fits
+	chunk := c.max - len(fragPrefix+id+"::/") - 2*len(strconv.Itoa(MaxFragments))
+	total := (len(payload) + chunk - 1) / chunk
+	if total > MaxFragments {
+		return client.Response{}, ErrPayloadTooLarge
+	}
+	buf := make([]byte, 0, c.max)
+	var r client.Response
+	for seq := 1; seq <= total; seq++ {
+		data := payload[(seq-1)*chunk:]
+		if len(data) > chunk {
+			data = data[:chunk]
+		}
+		buf = append(buf[:0], fragPrefix+id+":"...)
+		buf = strconv.AppendInt(buf, int64(seq), 10)
+		buf = append(buf, '/')
+		buf = strconv.AppendInt(buf, int64(total), 10)
+		buf = append(buf, ':')
+		buf = append(buf, data...)
+		var err error
+		if r, err = send(buf); err != nil || r.Code < 200 || r.Code >= 300 {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// NewReassemblyHandler wraps an EventHandler to reassemble the fragments sent
+// by a client created with NewFragmentingClient. A single event is passed to
+// h once all the fragments of a message are received, with the name and
+// recipient of the last fragment. Other events are passed unchanged.
+//
+// Incomplete messages are discarded after DefaultTimeout, see
+// NewReassemblyHandlerWithTimeout.
+func NewReassemblyHandler(h client.EventHandler) client.EventHandler {
+	return NewReassemblyHandlerWithTimeout(h, DefaultTimeout)
+}
+
+// NewReassemblyHandlerWithTimeout is like NewReassemblyHandler but discards
+// incomplete messages whose last fragment was received more than timeout
+// ago. Expired messages are only discarded when another fragment is
+// received.
+func NewReassemblyHandlerWithTimeout(h client.EventHandler, timeout time.Duration) client.EventHandler {
+	return &reassemblyHandler{
+		h:       h,
+		timeout: timeout,
+		pending: make(map[fragKey]*partial),
+	}
+}
+
+// fragments are identified by sender, verb and recipient, since ids are
+// only unique for a given sender
+type fragKey struct {
+	from, name, to, id string
+}
+
+type partial struct {
+	total   int
+	next    int
+	data    []byte
+	updated time.Time
+}
+
+type reassemblyHandler struct {
+	h       client.EventHandler
+	timeout time.Duration
+
+	l       sync.Mutex
+	pending map[fragKey]*partial
+}
+
+func (h *reassemblyHandler) HandleEvent(ev client.Event) {
+	id, seq, total, data, ok := parseFragment(ev.Payload)
+	if !ok {
+		h.h.HandleEvent(ev)
+		return
+	}
+	k := fragKey{from: string(ev.From), name: string(ev.Name), to: string(ev.To), id: id}
+	now := time.Now()
+
+	h.l.Lock()
+	h.expire(now)
+	p := h.pending[k]
+	if p == nil {
+		if seq != 1 {
+			// missing the start of the message
+			h.l.Unlock()
+			return
+		}
+		p = &partial{total: total, next: 1}
+		h.pending[k] = p
+	}
+	if seq != p.next || total != p.total {
+		// out of order or inconsistent: the message can't be recovered
+		delete(h.pending, k)
+		h.l.Unlock()
+		return
+	}
+	// the event is only valid for the duration of the call
+	p.data = append(p.data, data...)
+	p.next++
+	p.updated = now
+	if seq < total {
+		h.l.Unlock()
+		return
+	}
+	delete(h.pending, k)
+	h.l.Unlock()
+
+	ev.Payload = p.data
+	h.h.HandleEvent(ev)
+}
+
+// expire discards incomplete messages that timed out.
+// It must be called with the lock held.
+func (h *reassemblyHandler) expire(now time.Time) {
+	for k, p := range h.pending {
+		if now.Sub(p.updated) > h.timeout {
+			delete(h.pending, k)
+		}
+	}
+}
+
+// parseFragment splits a fragment into its header fields and data.
+func parseFragment(payload []byte) (string, int, int, []byte, bool) {
+	if !bytes.HasPrefix(payload, []byte(fragPrefix)) {
+		return "", 0, 0, nil, false
+	}
+	fields := bytes.SplitN(payload[len(fragPrefix):], []byte{':'}, 3)
+	if len(fields) != 3 || len(fields[0]) == 0 {
+		return "", 0, 0, nil, false
+	}
+	i := bytes.IndexByte(fields[1], '/')
+	if i == -1 {
+		return "", 0, 0, nil, false
+	}
+	seq, err := strconv.Atoi(string(fields[1][:i]))
+	if err != nil {
+		return "", 0, 0, nil, false
+	}
+	total, err := strconv.Atoi(string(fields[1][i+1:]))
+	if err != nil || seq < 1 || seq > total || total > MaxFragments {
+		return "", 0, 0, nil, false
+	}
+	return string(fields[0]), seq, total, fields[2], true
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package fragmentation
+
+import (
+	"crypto/rand"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/aerofs/lipwig/ssmptest"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+type eventQueue chan client.Event
+
+func (q eventQueue) HandleEvent(ev client.Event) {
+	// events are only valid for the duration of the call
+	q <- client.Event{
+		From:    append([]byte{}, ev.From...),
+		Name:    append([]byte{}, ev.Name...),
+		To:      append([]byte{}, ev.To...),
+		Payload: append([]byte{}, ev.Payload...),
+	}
+}
+
+func (q eventQueue) next(t *testing.T) client.Event {
+	t.Helper()
+	select {
+	case ev := <-q:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return client.Event{}
+}
+
+func TestFragmentation_should_reassemble_large_payloads(t *testing.T) {
+	s := ssmptest.NewServer(t, nil)
+	defer s.Close(t)
+	sender := s.ConnectClient(t, "foo")
+	defer sender.Close()
+	receiver := s.ConnectClient(t, "bar")
+	defer receiver.Close()
+	q := make(eventQueue, 10)
+	receiver.SetEventHandler(NewReassemblyHandler(q))
+
+	c := NewFragmentingClient(sender, 1024)
+	payload := make([]byte, 10*1024)
+	rand.Read(payload)
+	r, err := c.UcastBytes("bar", payload)
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+
+	ev := q.next(t)
+	require.Equal(t, ssmp.UCAST, string(ev.Name))
+	require.Equal(t, "foo", string(ev.From))
+	require.Equal(t, payload, ev.Payload)
+
+	// small payloads are sent unchanged
+	r, err = c.Ucast("bar", "hello")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	require.Equal(t, "hello", string(q.next(t).Payload))
+	require.Len(t, q, 0)
+}
+
+func TestFragmentation_should_reassemble_text_mcast(t *testing.T) {
+	s := ssmptest.NewServer(t, nil)
+	defer s.Close(t)
+	sender := s.ConnectClient(t, "foo")
+	defer sender.Close()
+	receiver := s.ConnectClient(t, "bar")
+	defer receiver.Close()
+	q := make(eventQueue, 10)
+	receiver.SetEventHandler(NewReassemblyHandler(q))
+	r, err := receiver.Subscribe("topic")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+
+	c := NewFragmentingClient(sender, 100)
+	payload := strings.Repeat("lorem ipsum ", 500)
+	r, err = c.Mcast("topic", payload)
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+
+	ev := q.next(t)
+	require.Equal(t, ssmp.MCAST, string(ev.Name))
+	require.Equal(t, "topic", string(ev.To))
+	require.Equal(t, payload, string(ev.Payload))
+}
+
+func TestFragmentation_should_discard_incomplete_messages(t *testing.T) {
+	q := make(eventQueue, 10)
+	h := NewReassemblyHandlerWithTimeout(q, 10*time.Millisecond)
+	ev := func(payload string) client.Event {
+		return client.Event{From: []byte("foo"), Name: []byte(ssmp.UCAST), To: []byte("bar"), Payload: []byte(payload)}
+	}
+
+	h.HandleEvent(ev("frag:a:1/2:hello "))
+	time.Sleep(20 * time.Millisecond)
+	h.HandleEvent(ev("frag:a:2/2:world"))
+	require.Len(t, q, 0)
+
+	h.HandleEvent(ev("frag:b:1/2:hello "))
+	h.HandleEvent(ev("frag:b:2/2:world"))
+	require.Equal(t, "hello world", string(q.next(t).Payload))
+
+	// not a fragment
+	h.HandleEvent(ev("frag:nope"))
+	require.Equal(t, "frag:nope", string(q.next(t).Payload))
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package loadgen generates SSMP traffic at configurable rates, for load
+// testing purposes.
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/ssmp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnsupportedVerb error = fmt.Errorf("unsupported verb")
+
+// maximum number of latency samples kept to compute percentiles
+const maxSamples = 8192
+
+// Pattern describes a stream of identical requests sent at a fixed rate.
+type Pattern struct {
+	// Rate is the number of requests sent per second.
+	Rate float64
+
+	// Verb is one of UCAST, MCAST or BCAST.
+	Verb string
+
+	// To is the destination user or topic, ignored for BCAST.
+	To string
+
+	// Payload is called once per request. It may replay recorded payloads
+	// or generate synthetic ones.
+	Payload func() string
+}
+
+// LoadStats summarizes the requests made by a LoadGenerator.
+type LoadStats struct {
+	MessagesSent uint64
+	Errors       uint64
+	P50Latency   time.Duration
+	P99Latency   time.Duration
+}
+
+// A LoadGenerator executes a set of Pattern over a pool of clients.
+//
+// Requests are spread over the pool so that a slow round-trip on one
+// connection does not throttle the others.
+type LoadGenerator struct {
+	patterns []Pattern
+	pool     chan client.Client
+
+	l       sync.Mutex
+	sent    uint64
+	errors  uint64
+	samples []time.Duration
+	next    int
+}
+
+// NewLoadGenerator creates a LoadGenerator sending requests over the given
+// clients, which should already be logged in.
+// The clients must not be used by the caller while the generator runs.
+func NewLoadGenerator(clients ...client.Client) *LoadGenerator {
+	g := &LoadGenerator{
+		pool:    make(chan client.Client, len(clients)),
+		samples: make([]time.Duration, 0, maxSamples),
+	}
+	for _, c := range clients {
+		g.pool <- c
+	}
+	return g
+}
+
+// AddPattern adds a Pattern to be executed by the next call to Run.
+// This method is not safe to call while Run is executing.
+func (g *LoadGenerator) AddPattern(p Pattern) {
+	g.patterns = append(g.patterns, p)
+}
+
+// Run executes all patterns until ctx is done, and waits for in-flight
+// requests to complete.
+func (g *LoadGenerator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range g.patterns {
+		if p.Rate <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(p Pattern) {
+			defer wg.Done()
+			g.runPattern(ctx, p, &wg)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (g *LoadGenerator) runPattern(ctx context.Context, p Pattern, wg *sync.WaitGroup) {
+	t := time.NewTicker(time.Duration(float64(time.Second) / p.Rate))
+	defer t.Stop()
+	start := time.Now()
+	var issued uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			// the ticker drops ticks when the receiver falls behind so
+			// catch up based on elapsed time instead of counting ticks
+			due := uint64(now.Sub(start).Seconds() * p.Rate)
+			for ; issued < due; issued++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					g.send(p)
+				}()
+			}
+		}
+	}
+}
+
+func (g *LoadGenerator) send(p Pattern) {
+	var payload string
+	if p.Payload != nil {
+		payload = p.Payload()
+	}
+	c := <-g.pool
+	start := time.Now()
+	var r client.Response
+	var err error
+	switch p.Verb {
+	case ssmp.UCAST:
+		r, err = c.Ucast(p.To, payload)
+	case ssmp.MCAST:
+		r, err = c.Mcast(p.To, payload)
+	case ssmp.BCAST:
+		r, err = c.Bcast(payload)
+	default:
+		err = ErrUnsupportedVerb
+	}
+	latency := time.Since(start)
+	g.pool <- c
+	g.record(latency, err == nil && r.Code == ssmp.CodeOk)
+}
+
+func (g *LoadGenerator) record(latency time.Duration, ok bool) {
+	g.l.Lock()
+	defer g.l.Unlock()
+	if !ok {
+		g.errors++
+		return
+	}
+	g.sent++
+	if len(g.samples) < maxSamples {
+		g.samples = append(g.samples, latency)
+	} else {
+		g.samples[g.next] = latency
+		g.next = (g.next + 1) % maxSamples
+	}
+}
+
+// Stats returns a snapshot of the requests made so far.
+// Latency percentiles are computed over the most recent requests.
+func (g *LoadGenerator) Stats() LoadStats {
+	g.l.Lock()
+	s := LoadStats{
+		MessagesSent: g.sent,
+		Errors:       g.errors,
+	}
+	samples := make([]time.Duration, len(g.samples))
+	copy(samples, g.samples)
+	g.l.Unlock()
+	if len(samples) > 0 {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		s.P50Latency = samples[len(samples)*50/100]
+		s.P99Latency = samples[len(samples)*99/100]
+	}
+	return s
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"strings"
+	"time"
+)
+
+// LogFields are the structured fields of a log entry.
+//
+// Requests are logged with "verb", "to" and "payload" fields, responses with
+// "verb", "code", "message", "duration" and, on failure, "error" fields, and
+// events with "event", "from", "to" and "payload" fields.
+type LogFields map[string]interface{}
+
+// The Logger interface is used by NewLoggingClient to record the exchanges
+// with the server.
+type Logger interface {
+	Log(fields LogFields)
+}
+
+// payloads longer than this are truncated in log entries
+const maxLoggedPayload = 64
+
+// NewLoggingClient wraps a Client to log every request made through it,
+// along with its response, and every event received.
+// Credentials are never logged.
+func NewLoggingClient(inner Client, l Logger) Client {
+	c := &loggingClient{Client: inner, l: l}
+	c.SetEventHandler(inner.EventHandler())
+	return c
+}
+
+type loggingClient struct {
+	Client
+	l Logger
+}
+
+type loggingEventHandler struct {
+	h EventHandler
+	l Logger
+}
+
+func (h *loggingEventHandler) HandleEvent(ev Event) {
+	h.l.Log(LogFields{
+		"event":   string(ev.Name),
+		"from":    string(ev.From),
+		"to":      string(ev.To),
+		"payload": truncate(string(ev.Payload)),
+	})
+	h.h.HandleEvent(ev)
+}
+
+func truncate(payload string) string {
+	if len(payload) <= maxLoggedPayload {
+		return payload
+	}
+	return payload[:maxLoggedPayload] + "..."
+}
+
+func (c *loggingClient) call(verb, to, payload string, f func() (Response, error)) (Response, error) {
+	c.l.Log(LogFields{"verb": verb, "to": to, "payload": truncate(payload)})
+	start := time.Now()
+	r, err := f()
+	fields := LogFields{
+		"verb":     verb,
+		"code":     r.Code,
+		"message":  r.Message,
+		"duration": time.Since(start),
+	}
+	if err != nil {
+		fields["error"] = err
+	}
+	c.l.Log(fields)
+	return r, err
+}
+
+func (c *loggingClient) EventHandler() EventHandler {
+	if h, ok := c.Client.EventHandler().(*loggingEventHandler); ok {
+		return h.h
+	}
+	return c.Client.EventHandler()
+}
+
+func (c *loggingClient) SetEventHandler(h EventHandler) {
+	c.Client.SetEventHandler(&loggingEventHandler{h: h, l: c.l})
+}
+
+func (c *loggingClient) Close() {
+	c.l.Log(LogFields{"verb": ssmp.CLOSE, "to": "", "payload": ""})
+	c.Client.Close()
+}
+
+func (c *loggingClient) Login(user string, scheme string, cred string) (Response, error) {
+	return c.call(ssmp.LOGIN, user, scheme, func() (Response, error) {
+		return c.Client.Login(user, scheme, cred)
+	})
+}
+
+func (c *loggingClient) LoginAnonymous() (Response, error) {
+	return c.call(ssmp.LOGIN, ssmp.Anonymous, SchemeNone, c.Client.LoginAnonymous)
+}
+
+func (c *loggingClient) LoginWithCert(user string) (Response, error) {
+	return c.call(ssmp.LOGIN, user, SchemeCert, func() (Response, error) {
+		return c.Client.LoginWithCert(user)
+	})
+}
+
+func (c *loggingClient) Relogin(user string, scheme string, cred string) (Response, error) {
+	return c.call(ssmp.RELOGIN, user, scheme, func() (Response, error) {
+		return c.Client.Relogin(user, scheme, cred)
+	})
+}
+
+func (c *loggingClient) Reauth(scheme string, cred string) (Response, error) {
+	return c.call(ssmp.REAUTH, "", scheme, func() (Response, error) {
+		return c.Client.Reauth(scheme, cred)
+	})
+}
+
+func (c *loggingClient) Resume(token string) (Response, error) {
+	// the session token is a credential
+	return c.call(ssmp.RESUME, "", "", func() (Response, error) {
+		return c.Client.Resume(token)
+	})
+}
+
+func (c *loggingClient) Subscribe(topic string) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, topic, "", func() (Response, error) {
+		return c.Client.Subscribe(topic)
+	})
+}
+
+func (c *loggingClient) SubscribeWithPresence(topic string) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, topic, ssmp.PRESENCE, func() (Response, error) {
+		return c.Client.SubscribeWithPresence(topic)
+	})
+}
+
+func (c *loggingClient) SubscribeWithCount(topic string) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, topic, ssmp.COUNT, func() (Response, error) {
+		return c.Client.SubscribeWithCount(topic)
+	})
+}
+
+func (c *loggingClient) SubscribeWithLease(topic string, ttl time.Duration) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, topic, leaseOption(ttl), func() (Response, error) {
+		return c.Client.SubscribeWithLease(topic, ttl)
+	})
+}
+
+func (c *loggingClient) SubscribeWithOptions(topic string, options ...string) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, topic, strings.Join(options, " "), func() (Response, error) {
+		return c.Client.SubscribeWithOptions(topic, options...)
+	})
+}
+
+func (c *loggingClient) SubscribeMulti(topics []string) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, strings.Join(topics, ","), "", func() (Response, error) {
+		return c.Client.SubscribeMulti(topics)
+	})
+}
+
+func (c *loggingClient) SubscribeMultiWithPresence(topics []string) (Response, error) {
+	return c.call(ssmp.SUBSCRIBE, strings.Join(topics, ","), ssmp.PRESENCE, func() (Response, error) {
+		return c.Client.SubscribeMultiWithPresence(topics)
+	})
+}
+
+func (c *loggingClient) Unsubscribe(topic string) (Response, error) {
+	return c.call(ssmp.UNSUBSCRIBE, topic, "", func() (Response, error) {
+		return c.Client.Unsubscribe(topic)
+	})
+}
+
+func (c *loggingClient) Configure(topic string, settings ...string) (Response, error) {
+	return c.call(ssmp.CONFIGURE, topic, strings.Join(settings, " "), func() (Response, error) {
+		return c.Client.Configure(topic, settings...)
+	})
+}
+
+func (c *loggingClient) Ucast(user string, payload string) (Response, error) {
+	return c.call(ssmp.UCAST, user, payload, func() (Response, error) {
+		return c.Client.Ucast(user, payload)
+	})
+}
+
+func (c *loggingClient) UcastTraced(traceID string, user string, payload string) (Response, error) {
+	return c.call(ssmp.TRACE, user, payload, func() (Response, error) {
+		return c.Client.UcastTraced(traceID, user, payload)
+	})
+}
+
+func (c *loggingClient) UcastReliable(user string, msgid string, payload string, ackTimeout time.Duration) (bool, error) {
+	var acked bool
+	_, err := c.call(ssmp.RELIABLE, user, payload, func() (Response, error) {
+		var err error
+		acked, err = c.Client.UcastReliable(user, msgid, payload, ackTimeout)
+		if acked {
+			return Response{Code: ssmp.CodeOk, Message: ssmp.ACK}, err
+		}
+		return Response{}, err
+	})
+	return acked, err
+}
+
+func (c *loggingClient) Ack(msgid string, from string) (Response, error) {
+	return c.call(ssmp.ACK, msgid, from, func() (Response, error) {
+		return c.Client.Ack(msgid, from)
+	})
+}
+
+func (c *loggingClient) UcastWithTTL(user string, payload string, ttl time.Duration) (Response, error) {
+	return c.call(ssmp.EXPIRES, user, payload, func() (Response, error) {
+		return c.Client.UcastWithTTL(user, payload, ttl)
+	})
+}
+
+func (c *loggingClient) Mcast(topic string, payload string) (Response, error) {
+	return c.call(ssmp.MCAST, topic, payload, func() (Response, error) {
+		return c.Client.Mcast(topic, payload)
+	})
+}
+
+func (c *loggingClient) McastWithReceipts(topic, msgid, payload string, receipts chan<- string) (Response, error) {
+	return c.call(ssmp.MCAST, topic, msgid+":"+payload, func() (Response, error) {
+		return c.Client.McastWithReceipts(topic, msgid, payload, receipts)
+	})
+}
+
+func (c *loggingClient) Bcast(payload string) (Response, error) {
+	return c.call(ssmp.BCAST, "", payload, func() (Response, error) {
+		return c.Client.Bcast(payload)
+	})
+}
+
+func (c *loggingClient) UcastBytes(user string, payload []byte) (Response, error) {
+	return c.call(ssmp.UCAST, user, string(payload), func() (Response, error) {
+		return c.Client.UcastBytes(user, payload)
+	})
+}
+
+func (c *loggingClient) McastBytes(topic string, payload []byte) (Response, error) {
+	return c.call(ssmp.MCAST, topic, string(payload), func() (Response, error) {
+		return c.Client.McastBytes(topic, payload)
+	})
+}
+
+func (c *loggingClient) BcastBytes(payload []byte) (Response, error) {
+	return c.call(ssmp.BCAST, "", string(payload), func() (Response, error) {
+		return c.Client.BcastBytes(payload)
+	})
+}
+
+func (c *loggingClient) JoinGroup(group string) (Response, error) {
+	return c.call(ssmp.GROUP, group, "", func() (Response, error) {
+		return c.Client.JoinGroup(group)
+	})
+}
+
+func (c *loggingClient) LeaveGroup(group string) (Response, error) {
+	return c.call(ssmp.GROUP, group, ssmp.LEAVE, func() (Response, error) {
+		return c.Client.LeaveGroup(group)
+	})
+}
+
+func (c *loggingClient) ListUsers(prefix string) ([]string, Response, error) {
+	var users []string
+	r, err := c.call(ssmp.USERS, "", prefix, func() (Response, error) {
+		var r Response
+		var err error
+		users, r, err = c.Client.ListUsers(prefix)
+		return r, err
+	})
+	return users, r, err
+}
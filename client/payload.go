@@ -0,0 +1,83 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"encoding/json"
+	"github.com/aerofs/lipwig/ssmp"
+	"strings"
+)
+
+// BinaryPayload encodes b as a SSMP binary payload, i.e. prefixed with its
+// length minus one as a two-byte big-endian integer.
+func BinaryPayload(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", PayloadError{Msg: "empty payload"}
+	}
+	if len(b) > ssmp.MaxPayloadLength {
+		return "", RequestSizeError{Size: len(b), Max: ssmp.MaxPayloadLength}
+	}
+	n := len(b) - 1
+	return string([]byte{byte(n >> 8), byte(n)}) + string(b), nil
+}
+
+// DecodeBinaryPayload is the inverse of BinaryPayload.
+func DecodeBinaryPayload(s string) ([]byte, error) {
+	if len(s) < ssmp.BinaryPayloadPrefix+1 || s[0] > 3 {
+		return nil, PayloadError{Msg: "not a binary payload", PayloadLen: len(s)}
+	}
+	n := 1 + (int(s[0]) << 8) + int(s[1])
+	if len(s) != ssmp.BinaryPayloadPrefix+n {
+		return nil, PayloadError{Msg: "binary length prefix mismatch", PayloadLen: len(s)}
+	}
+	return []byte(s[ssmp.BinaryPayloadPrefix:]), nil
+}
+
+// TextPayload validates s as a SSMP text payload: it must not start with
+// a byte in the range 0-3, must not contain any newline and must be at most
+// 1024 bytes long.
+func TextPayload(s string) (string, error) {
+	if len(s) > ssmp.MaxPayloadLength {
+		return "", RequestSizeError{Size: len(s), Max: ssmp.MaxPayloadLength}
+	}
+	if (len(s) > 0 && s[0] <= 3) || strings.IndexByte(s, '\n') != -1 {
+		return "", PayloadError{Msg: "control character in text payload", PayloadLen: len(s)}
+	}
+	return s, nil
+}
+
+// JSONPayload encodes v as JSON, validated as a SSMP text payload, see
+// TextPayload. Newlines and control bytes are always escaped by the JSON
+// encoding.
+func JSONPayload(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return TextPayload(string(b))
+}
+
+func (c *client) UcastBytes(user string, payload []byte) (Response, error) {
+	p, err := BinaryPayload(payload)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.request(ssmp.UCAST, user, p)
+}
+
+func (c *client) McastBytes(topic string, payload []byte) (Response, error) {
+	p, err := BinaryPayload(payload)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.request(ssmp.MCAST, topic, p)
+}
+
+func (c *client) BcastBytes(payload []byte) (Response, error) {
+	p, err := BinaryPayload(payload)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.request(ssmp.BCAST, "", p)
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrPoolExhausted error = fmt.Errorf("no idle connection in pool")
+	ErrPoolClosed    error = fmt.Errorf("pool closed")
+)
+
+// PoolStats summarizes the requests made through a Pool.
+type PoolStats struct {
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	AvgLatency time.Duration
+	// Requests is the number of requests made on each connection, in the
+	// order of creation. Retries count as separate requests.
+	Requests []uint64
+}
+
+// A Pool spreads requests over multiple connections to the same server, since
+// a Client waits for the response of a request before sending the next one.
+//
+// Connections are created by a dial function which must return a logged in
+// Client. Since the server only keeps one connection per user, each one
+// should log in as a different user. A connection failing with an error is
+// closed and dialed again before its next use.
+//
+// All methods are safe to call from multiple goroutines simultaneously.
+type Pool struct {
+	dial       func(i int) (Client, error)
+	maxRetries int
+	next       atomic.Uint64
+	closed     atomic.Bool
+	slots      []*poolSlot
+}
+
+type poolSlot struct {
+	i int
+	// number of pooled requests using the slot, or acquiredSlot
+	users    atomic.Int32
+	requests atomic.Uint64
+
+	l      sync.Mutex
+	c      Client
+	broken bool
+	total  time.Duration
+	timed  uint64
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewPool creates a Pool of size connections, calling dial with indices 0 to
+// size-1. Requests failing with an error are retried on other connections up
+// to maxRetries times.
+func NewPool(size int, maxRetries int, dial func(i int) (Client, error)) (*Pool, error) {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{
+		dial:       dial,
+		maxRetries: maxRetries,
+		slots:      make([]*poolSlot, size),
+	}
+	for i := range p.slots {
+		c, err := dial(i)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.slots[i] = &poolSlot{i: i, c: c}
+	}
+	return p, nil
+}
+
+// users of a slot obtained from Acquire
+const acquiredSlot = -1
+
+// A PoolConn is a connection acquired from a Pool for exclusive use, see
+// Pool.Acquire.
+type PoolConn struct {
+	Client
+	s *poolSlot
+}
+
+// Ucast makes a UCAST request on the next connection that isn't acquired, in
+// round-robin order, see Client.Ucast.
+// ErrPoolExhausted is returned if all connections are acquired.
+func (p *Pool) Ucast(user string, payload string) (Response, error) {
+	return p.do(func(c Client) (Response, error) {
+		return c.Ucast(user, payload)
+	})
+}
+
+func (p *Pool) do(f func(Client) (Response, error)) (Response, error) {
+	var r Response
+	var err error
+	for attempt := 0; attempt <= p.maxRetries; attempt++ {
+		if p.closed.Load() {
+			return Response{}, ErrPoolClosed
+		}
+		s := p.pick()
+		if s == nil {
+			return Response{}, ErrPoolExhausted
+		}
+		r, err = s.do(p.dial, f)
+		if err == nil {
+			return r, nil
+		}
+	}
+	return r, err
+}
+
+// pick claims the next slot in round-robin order for a pooled request,
+// skipping acquired ones, or returns nil if they all are. The slot must be
+// given back with done.
+func (p *Pool) pick() *poolSlot {
+	n := uint64(len(p.slots))
+	i := p.next.Add(1) - 1
+	for k := uint64(0); k < n; k++ {
+		s := p.slots[(i+k)%n]
+		for {
+			u := s.users.Load()
+			if u == acquiredSlot {
+				break
+			}
+			if s.users.CompareAndSwap(u, u+1) {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// Acquire returns a connection for exclusive use, which is skipped by the
+// requests made through the Pool until Release is called. Requests made
+// directly on the connection aren't counted in Stats.
+// ErrPoolExhausted is returned if all connections are acquired or used by
+// requests made through the Pool.
+func (p *Pool) Acquire() (*PoolConn, error) {
+	if p.closed.Load() {
+		return nil, ErrPoolClosed
+	}
+	i := p.next.Add(1) - 1
+	for k := 0; k < len(p.slots); k++ {
+		s := p.slots[(i+uint64(k))%uint64(len(p.slots))]
+		if !s.users.CompareAndSwap(0, acquiredSlot) {
+			continue
+		}
+		c, err := s.client(p.dial)
+		if err != nil {
+			s.users.Store(0)
+			return nil, err
+		}
+		return &PoolConn{Client: c, s: s}, nil
+	}
+	return nil, ErrPoolExhausted
+}
+
+// Release returns a connection obtained from Acquire to the Pool. The
+// connection must not be used afterwards. Releasing it again has no effect.
+func (p *Pool) Release(pc *PoolConn) {
+	if pc.s != nil {
+		pc.s.users.Store(0)
+		pc.s = nil
+	}
+}
+
+// Stats returns the latency of the requests made through the Pool and their
+// distribution over its connections.
+func (p *Pool) Stats() PoolStats {
+	var st PoolStats
+	var total time.Duration
+	var timed uint64
+	st.Requests = make([]uint64, len(p.slots))
+	for i, s := range p.slots {
+		st.Requests[i] = s.requests.Load()
+		s.l.Lock()
+		if s.timed > 0 {
+			if timed == 0 || s.min < st.MinLatency {
+				st.MinLatency = s.min
+			}
+			if s.max > st.MaxLatency {
+				st.MaxLatency = s.max
+			}
+		}
+		total += s.total
+		timed += s.timed
+		s.l.Unlock()
+	}
+	if timed > 0 {
+		st.AvgLatency = total / time.Duration(timed)
+	}
+	return st
+}
+
+// Close closes all connections. Subsequent requests fail with ErrPoolClosed.
+func (p *Pool) Close() {
+	p.closed.Store(true)
+	for _, s := range p.slots {
+		if s == nil {
+			continue
+		}
+		s.l.Lock()
+		c := s.c
+		s.l.Unlock()
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+// do makes a request on a slot claimed by pick, and gives it back.
+func (s *poolSlot) do(dial func(i int) (Client, error), f func(Client) (Response, error)) (Response, error) {
+	defer s.users.Add(-1)
+	c, err := s.client(dial)
+	if err != nil {
+		return Response{}, err
+	}
+	start := time.Now()
+	r, err := f(c)
+	s.record(time.Since(start))
+	if err != nil {
+		s.fail(c)
+	}
+	return r, err
+}
+
+// client returns the connection of the slot, dialing a new one if the
+// previous one failed. The lock isn't held while dialing or closing, as
+// both wait for the server.
+func (s *poolSlot) client(dial func(i int) (Client, error)) (Client, error) {
+	s.l.Lock()
+	c, broken := s.c, s.broken
+	s.l.Unlock()
+	if !broken {
+		return c, nil
+	}
+	nc, err := dial(s.i)
+	if err != nil {
+		return nil, err
+	}
+	s.l.Lock()
+	if s.c != c {
+		// replaced by a concurrent request
+		cur := s.c
+		s.l.Unlock()
+		nc.Close()
+		return cur, nil
+	}
+	s.c = nc
+	s.broken = false
+	s.l.Unlock()
+	c.Close()
+	return nc, nil
+}
+
+// fail marks the connection of the slot as broken, unless it was already
+// replaced.
+func (s *poolSlot) fail(c Client) {
+	s.l.Lock()
+	if s.c == c {
+		s.broken = true
+	}
+	s.l.Unlock()
+}
+
+func (s *poolSlot) record(d time.Duration) {
+	s.requests.Add(1)
+	s.l.Lock()
+	if s.timed == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+	s.total += d
+	s.timed++
+	s.l.Unlock()
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotConnected       error = fmt.Errorf("not connected")
+	ErrUnsupportedVerb    error = fmt.Errorf("unsupported verb")
+	ErrUnexpectedResponse error = fmt.Errorf("unexpected response")
+)
+
+// ReplayError describes a recorded request that could not be replayed
+// successfully.
+type ReplayError struct {
+	// Line is the 1-based line number of the request.
+	Line int
+	// Code is the response code, zero if no response was received.
+	Code int
+	Err  error
+}
+
+func (e ReplayError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("line %d: %v: %d", e.Line, e.Err, e.Code)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// ReplayClient replays a recorded SSMP session, one request per line, on a
+// new connection. The session typically starts with a LOGIN request.
+// Requests are sent sequentially, each waiting for the previous response.
+type ReplayClient struct {
+	r     io.Reader
+	h     EventHandler
+	c     Client
+	delay time.Duration
+
+	errors []ReplayError
+}
+
+// NewReplayClient creates a ReplayClient reading requests from r. Events
+// received during the replay are passed to h.
+func NewReplayClient(r io.Reader, h EventHandler) *ReplayClient {
+	return &ReplayClient{r: r, h: h}
+}
+
+// SetConn sets the connection on which the session is replayed. It must be
+// called before Run.
+func (rc *ReplayClient) SetConn(c net.Conn) {
+	rc.c = NewClient(c, rc.h)
+}
+
+// SetRateLimit limits the number of requests sent per second. Zero means no
+// limit, the default.
+func (rc *ReplayClient) SetRateLimit(msgsPerSec float64) {
+	if msgsPerSec <= 0 {
+		rc.delay = 0
+	} else {
+		rc.delay = time.Duration(float64(time.Second) / msgsPerSec)
+	}
+}
+
+// Errors returns the requests that failed or got a non-2xx response during
+// the last Run, in order.
+func (rc *ReplayClient) Errors() []ReplayError {
+	return rc.errors
+}
+
+// Run replays all requests and closes the connection. Failed requests do not
+// stop the replay, see Errors.
+// An error is returned if reading the recorded session fails or if ctx is
+// cancelled.
+func (rc *ReplayClient) Run(ctx context.Context) error {
+	if rc.c == nil {
+		return ErrNotConnected
+	}
+	defer rc.c.Close()
+	rc.errors = nil
+	var tick <-chan time.Time
+	if rc.delay > 0 {
+		t := time.NewTicker(rc.delay)
+		defer t.Stop()
+		tick = t.C
+	}
+	s := bufio.NewScanner(rc.r)
+	s.Buffer(make([]byte, ssmp.MaxMessageLength), ssmp.MaxMessageLength)
+	for n := 1; s.Scan(); n++ {
+		line := s.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		m, err := ssmp.ParseMessage(append(append([]byte(nil), line...), '\n'))
+		if err != nil || m.Code != ssmp.NoCode {
+			rc.errors = append(rc.errors, ReplayError{Line: n, Err: ssmp.ErrInvalidMessage})
+			continue
+		}
+		if ssmp.Equal(m.Verb, ssmp.PING) || ssmp.Equal(m.Verb, ssmp.PONG) || ssmp.Equal(m.Verb, ssmp.HELLO) {
+			// liveness and negotiation are handled by the client itself
+			continue
+		}
+		if ssmp.Equal(m.Verb, ssmp.CLOSE) {
+			break
+		}
+		r, err := rc.replay(m)
+		if err != nil {
+			rc.errors = append(rc.errors, ReplayError{Line: n, Err: err})
+		} else if r.Code/100 != 2 {
+			rc.errors = append(rc.errors, ReplayError{Line: n, Code: r.Code, Err: ErrUnexpectedResponse})
+		}
+	}
+	return s.Err()
+}
+
+func (rc *ReplayClient) replay(m ssmp.Message) (Response, error) {
+	to, payload := string(m.To), string(m.Payload)
+	switch string(m.Verb) {
+	case ssmp.LOGIN, ssmp.RELOGIN, ssmp.REAUTH:
+		scheme, cred := payload, ""
+		if i := strings.IndexByte(payload, ' '); i != -1 {
+			scheme, cred = payload[:i], payload[i+1:]
+		}
+		if ssmp.Equal(m.Verb, ssmp.LOGIN) {
+			return rc.c.Login(to, scheme, cred)
+		} else if ssmp.Equal(m.Verb, ssmp.REAUTH) {
+			return rc.c.Reauth(scheme, cred)
+		}
+		return rc.c.Relogin(to, scheme, cred)
+	case ssmp.SUBSCRIBE:
+		return rc.c.SubscribeWithOptions(to, strings.Fields(payload)...)
+	case ssmp.UNSUBSCRIBE:
+		return rc.c.Unsubscribe(to)
+	case ssmp.UCAST:
+		return rc.c.UcastBytes(to, m.Payload)
+	case ssmp.MCAST:
+		return rc.c.McastBytes(to, m.Payload)
+	case ssmp.BCAST:
+		return rc.c.BcastBytes(m.Payload)
+	case ssmp.GROUP:
+		if payload == ssmp.LEAVE {
+			return rc.c.LeaveGroup(to)
+		}
+		return rc.c.JoinGroup(to)
+	case ssmp.USERS:
+		_, r, err := rc.c.ListUsers(payload)
+		return r, err
+	case ssmp.RESUME:
+		return rc.c.Resume(to)
+	}
+	return Response{}, ErrUnsupportedVerb
+}
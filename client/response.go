@@ -0,0 +1,63 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package client
+
+import (
+	"encoding/json"
+	"github.com/aerofs/lipwig/ssmp"
+	"strconv"
+	"strings"
+)
+
+// IsOK reports whether the response has a 200 code.
+func (r Response) IsOK() bool {
+	return r.Code == ssmp.CodeOk
+}
+
+// IsRateLimited reports whether the response has a 429 code, i.e. a quota or
+// rate limit was exceeded. The request may succeed if retried later.
+func (r Response) IsRateLimited() bool {
+	return r.Code == ssmp.CodeTooManyRequests
+}
+
+// IsNotAllowed reports whether the response has a 405 code, i.e. the request
+// is not allowed for the user of the connection, e.g. anonymous users.
+func (r Response) IsNotAllowed() bool {
+	return r.Code == ssmp.CodeNotAllowed
+}
+
+// DecodeJSON decodes the message of the response as JSON into v.
+func (r Response) DecodeJSON(v interface{}) error {
+	return json.Unmarshal([]byte(r.Message), v)
+}
+
+// UnmarshalInto decodes the message of the response into v with a custom
+// unmarshal function, e.g. for msgpack or protobuf payloads.
+func (r Response) UnmarshalInto(v interface{}, unmarshal func([]byte, interface{}) error) error {
+	return unmarshal([]byte(r.Message), v)
+}
+
+// ParseList splits the message of a response carrying a space-separated list.
+// An empty message yields an empty list.
+func ParseList(r Response) []string {
+	return strings.Fields(r.Message)
+}
+
+// ParseCount parses the message of a response carrying a decimal count.
+// An empty message yields zero.
+func ParseCount(r Response) (int, error) {
+	if len(r.Message) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(r.Message)
+}
+
+// ParseSession extracts the session token from the response to a LOGIN or
+// RESUME request. An empty string is returned if there is none.
+func ParseSession(r Response) string {
+	if !r.IsOK() || !strings.HasPrefix(r.Message, ssmp.SessionPrefix) {
+		return ""
+	}
+	return r.Message[len(ssmp.SessionPrefix):]
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Command ssmp-cli is an interactive SSMP client, for debugging purposes.
+//
+// Commands are read from stdin, one per line:
+//
+//	subscribe <topic> [PRESENCE|NOSELF|ECHO|COUNT|LEASE <ttl>...]
+//	unsubscribe <topic>
+//	ucast <user> <payload>
+//	mcast <topic> <payload>
+//	bcast <payload>
+//	join <group>
+//	leave <group>
+//	users [prefix]
+//	quit
+//
+// Payloads extend to the end of the line. When stdin is not a terminal the
+// commands are replayed without prompt, which allows scripting.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/aerofs/lipwig/cfg"
+	"github.com/aerofs/lipwig/client"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnknownCommand error = fmt.Errorf("unknown command")
+var errMissingArgument error = fmt.Errorf("missing argument")
+
+func main() {
+	var address string
+	var user string
+	var scheme string
+	var cred string
+	var useTLS bool
+
+	cfg.InitConfig()
+
+	flag.StringVar(&address, "connect", "127.0.0.1:8787", "Server address")
+	flag.StringVar(&user, "user", "", "User to login as (anonymous if empty)")
+	flag.StringVar(&scheme, "scheme", "", "Login scheme (cert with -tls, open otherwise)")
+	flag.StringVar(&cred, "cred", "", "Login credential")
+	flag.BoolVar(&useTLS, "tls", false, "Enable TLS")
+	flag.Parse()
+
+	out := &syncWriter{w: os.Stdout}
+	h := &printingHandler{w: out}
+
+	var c client.Client
+	var err error
+	if useTLS {
+		var tlsCfg *tls.Config = cfg.TLSConfig()
+		c, err = client.DialTLS("tcp", address, tlsCfg, h)
+	} else {
+		c, err = client.Dial("tcp", address, h)
+	}
+	if err != nil {
+		fmt.Println("failed to connect:", err)
+		os.Exit(1)
+	}
+
+	if len(scheme) == 0 {
+		if useTLS {
+			scheme = client.SchemeCert
+		} else {
+			scheme = client.SchemeOpen
+		}
+	}
+	if scheme == "secret" && len(cred) == 0 && len(cfg.Secret) > 0 {
+		b, err := ioutil.ReadFile(cfg.Secret)
+		if err != nil {
+			fmt.Println("failed to read secret:", err)
+			os.Exit(1)
+		}
+		cred = string(bytes.TrimSpace(b))
+	}
+
+	var r client.Response
+	if len(user) == 0 {
+		r, err = c.LoginAnonymous()
+	} else {
+		r, err = c.Login(user, scheme, cred)
+	}
+	if err != nil || !r.IsOK() {
+		fmt.Println("failed to login:", r.Code, r.Message, err)
+		os.Exit(1)
+	}
+
+	err = run(c, os.Stdin, out, isTerminal(os.Stdin))
+	c.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && (fi.Mode()&os.ModeCharDevice) != 0
+}
+
+// run executes commands read from in until EOF or a quit command.
+// A prompt is written before each command in interactive mode, otherwise
+// commands are echoed so that the output of a script can be followed.
+func run(c client.Client, in io.Reader, out io.Writer, interactive bool) error {
+	s := bufio.NewScanner(in)
+	for {
+		if interactive {
+			fmt.Fprint(out, "> ")
+		}
+		if !s.Scan() {
+			return s.Err()
+		}
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if !interactive {
+			fmt.Fprintln(out, line)
+		}
+		if line == "quit" {
+			return nil
+		}
+		r, err := execute(c, line)
+		if err == errUnknownCommand || err == errMissingArgument {
+			fmt.Fprintln(out, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(r.Message) > 0 {
+			fmt.Fprintln(out, r.Code, r.Message)
+		} else {
+			fmt.Fprintln(out, r.Code)
+		}
+	}
+}
+
+// cut splits s around the first run of spaces.
+func cut(s string) (string, string) {
+	i := strings.IndexByte(s, ' ')
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeft(s[i+1:], " ")
+}
+
+// execute parses a single command and makes the matching request.
+func execute(c client.Client, line string) (client.Response, error) {
+	verb, args := cut(line)
+	to, payload := cut(args)
+	switch strings.ToLower(verb) {
+	case "bcast":
+		if len(args) == 0 {
+			return client.Response{}, errMissingArgument
+		}
+		return c.Bcast(args)
+	case "users":
+		users, r, err := c.ListUsers(args)
+		if err == nil && r.IsOK() {
+			r.Message = strings.Join(users, " ")
+		}
+		return r, err
+	case "subscribe", "unsubscribe", "join", "leave":
+		if len(to) == 0 {
+			return client.Response{}, errMissingArgument
+		}
+	case "ucast", "mcast":
+		if len(to) == 0 || len(payload) == 0 {
+			return client.Response{}, errMissingArgument
+		}
+	default:
+		return client.Response{}, errUnknownCommand
+	}
+	switch strings.ToLower(verb) {
+	case "subscribe":
+		return c.SubscribeWithOptions(to, strings.Fields(payload)...)
+	case "unsubscribe":
+		return c.Unsubscribe(to)
+	case "join":
+		return c.JoinGroup(to)
+	case "leave":
+		return c.LeaveGroup(to)
+	case "ucast":
+		return c.Ucast(to, payload)
+	default:
+		return c.Mcast(to, payload)
+	}
+}
+
+// printingHandler writes incoming events, prefixed with the time of receipt.
+type printingHandler struct {
+	w io.Writer
+}
+
+func (h *printingHandler) HandleEvent(ev client.Event) {
+	var b bytes.Buffer
+	b.WriteString(time.Now().Format("15:04:05.000"))
+	for _, f := range [][]byte{ev.From, ev.Name, ev.To, ev.Payload} {
+		if len(f) > 0 {
+			b.WriteByte(' ')
+			b.Write(f)
+		}
+	}
+	b.WriteByte('\n')
+	h.w.Write(b.Bytes())
+}
+
+// syncWriter serializes writes from the REPL and the event handler.
+type syncWriter struct {
+	l sync.Mutex
+	w io.Writer
+}
+
+func (w *syncWriter) Write(b []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.w.Write(b)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"github.com/aerofs/lipwig/ssmptest"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCut_should_keep_multi_word_payload(t *testing.T) {
+	verb, args := cut("mcast chat  hello  world")
+	require.Equal(t, "mcast", verb)
+	to, payload := cut(args)
+	require.Equal(t, "chat", to)
+	require.Equal(t, "hello  world", payload)
+}
+
+func TestRun_should_replay_script(t *testing.T) {
+	s := ssmptest.NewServer(t, nil)
+	defer s.Close(t)
+
+	var events bytes.Buffer
+	w := &syncWriter{w: &events}
+	bar := s.ConnectClient(t, "bar")
+	defer bar.Close()
+	bar.SetEventHandler(&printingHandler{w: w})
+	r, err := bar.Subscribe("chat")
+	require.Nil(t, err)
+	require.True(t, r.IsOK())
+
+	foo := s.ConnectClient(t, "foo")
+	defer foo.Close()
+
+	script := strings.Join([]string{
+		"# comment",
+		"subscribe chat NOSELF",
+		"",
+		"mcast chat hello  world",
+		"ucast bar",
+		"frob bar",
+		"users",
+		"quit",
+		"bcast never sent",
+	}, "\n")
+	var out bytes.Buffer
+	require.Nil(t, run(foo, strings.NewReader(script), &out, false))
+	require.Equal(t, strings.Join([]string{
+		"subscribe chat NOSELF", "200",
+		"mcast chat hello  world", "200",
+		"ucast bar", errMissingArgument.Error(),
+		"frob bar", errUnknownCommand.Error(),
+		"users", "200 bar foo",
+		"quit",
+	}, "\n")+"\n", out.String())
+
+	var line string
+	require.Eventually(t, func() bool {
+		w.l.Lock()
+		defer w.l.Unlock()
+		line = events.String()
+		return len(line) > 0
+	}, s.Timeout, time.Millisecond)
+	require.True(t, strings.HasSuffix(line, " foo MCAST chat hello  world\n"), line)
+	_, err = time.Parse("15:04:05.000", line[:12])
+	require.Nil(t, err)
+}
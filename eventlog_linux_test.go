@@ -0,0 +1,57 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build linux
+
+package main
+
+import (
+	"github.com/aerofs/lipwig/server"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// withFileSizeLimit runs f with writes limited to files of at most n bytes,
+// so that writes crossing the limit are partial.
+func withFileSizeLimit(t *testing.T, n uint64, f func()) {
+	var old syscall.Rlimit
+	require.Nil(t, syscall.Getrlimit(syscall.RLIMIT_FSIZE, &old))
+	lim := old
+	lim.Cur = n
+	require.Nil(t, syscall.Setrlimit(syscall.RLIMIT_FSIZE, &lim))
+	defer syscall.Setrlimit(syscall.RLIMIT_FSIZE, &old)
+	f()
+}
+
+func TestFileEventLog_should_drop_partial_entry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	l, err := server.NewFileEventLog(path)
+	require.Nil(t, err)
+	require.Nil(t, l.Append(server.LogEntry{Verb: ssmp.BCAST, From: "foo"}))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+
+	withFileSizeLimit(t, uint64(fi.Size())+8, func() {
+		err = l.Append(server.LogEntry{Verb: ssmp.BCAST, From: "bar"})
+	})
+	require.NotNil(t, err)
+	after, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, fi.Size(), after.Size())
+
+	// later entries survive reopening
+	require.Nil(t, l.Append(server.LogEntry{Verb: ssmp.BCAST, From: "baz"}))
+	require.Nil(t, l.Close())
+	l, err = server.NewFileEventLog(path)
+	require.Nil(t, err)
+	defer l.Close()
+	out := make(chan server.LogEntry, 10)
+	require.Nil(t, l.Read(0, out))
+	require.Len(t, out, 2)
+	require.Equal(t, "foo", (<-out).From)
+	require.Equal(t, "baz", (<-out).From)
+}
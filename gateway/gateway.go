@@ -0,0 +1,230 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package gateway bridges SSMP topics to external pub/sub systems.
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/aerofs/lipwig/server"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// User is the sender of the MCAST events delivered by a Gateway.
+const User = "gateway"
+
+// maximum age of a bridged message whose echo didn't come back, after which
+// it is forgotten
+const inflightTTL = 30 * time.Second
+
+// number of bridged messages awaiting their echo above which expired ones
+// are forgotten
+const maxInflight = 1024
+
+// Stats counts the messages bridged in each direction.
+type Stats struct {
+	// FromRedis is the number of Redis messages delivered to SSMP topics.
+	FromRedis uint64
+	// ToRedis is the number of SSMP MCAST messages published to Redis.
+	ToRedis uint64
+}
+
+// A Gateway bridges SSMP topics and Redis pub/sub channels: messages
+// published on a channel are delivered to the subscribers of the
+// corresponding topic, and MCAST messages sent to the topic are published on
+// the channel. Messages bridged by the gateway are recognized when they come
+// back from the other side, e.g. from its own Redis subscription, and are
+// not bridged again.
+type Gateway struct {
+	rdb *redis.Client
+	s   *server.Server
+
+	// SSMP topic to Redis channel, and back
+	channels map[string]string
+	topics   map[string]string
+
+	// Redis subscription, replaced in tests as redismock doesn't support it
+	subscribe func(ctx context.Context, channels ...string) (<-chan *redis.Message, func() error)
+	// Redis publication, replaced in tests to echo messages to subscribers
+	publish func(ctx context.Context, channel string, payload []byte) error
+
+	// messages bridged in each direction, which come back from the other
+	// side and must not be bridged again
+	published   inflight
+	broadcasted inflight
+
+	fromRedis atomic.Uint64
+	toRedis   atomic.Uint64
+}
+
+// NewRedisGateway creates a Gateway bridging the SSMP topics of s to the
+// Redis channels they are mapped to.
+func NewRedisGateway(rdb *redis.Client, s *server.Server, topicMapping map[string]string) *Gateway {
+	g := &Gateway{
+		rdb:      rdb,
+		s:        s,
+		channels: make(map[string]string, len(topicMapping)),
+		topics:   make(map[string]string, len(topicMapping)),
+
+		published:   inflight{m: make(map[inflightKey][]time.Time)},
+		broadcasted: inflight{m: make(map[inflightKey][]time.Time)},
+	}
+	for topic, channel := range topicMapping {
+		g.channels[topic] = channel
+		g.topics[channel] = topic
+	}
+	g.subscribe = func(ctx context.Context, channels ...string) (<-chan *redis.Message, func() error) {
+		ps := rdb.Subscribe(ctx, channels...)
+		return ps.Channel(), ps.Close
+	}
+	g.publish = func(ctx context.Context, channel string, payload []byte) error {
+		return rdb.Publish(ctx, channel, payload).Err()
+	}
+	return g
+}
+
+// Start subscribes to the mapped SSMP topics and Redis channels, and bridges
+// messages until ctx is done.
+// An error is returned if a topic name is invalid, in which case nothing is
+// bridged.
+func (g *Gateway) Start(ctx context.Context) error {
+	subs := make([]*server.InternalSubscription, 0, len(g.channels))
+	for topic, channel := range g.channels {
+		channel := channel
+		sub, err := g.s.SubscribeInternal(topic, func(from string, payload []byte) {
+			g.forward(ctx, channel, from, payload)
+		})
+		if err != nil {
+			for _, s := range subs {
+				s.Close()
+			}
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	channels := make([]string, 0, len(g.topics))
+	for channel := range g.topics {
+		channels = append(channels, channel)
+	}
+	msgs, closeRedis := g.subscribe(ctx, channels...)
+	go func() {
+		defer func() {
+			for _, s := range subs {
+				s.Close()
+			}
+			closeRedis()
+		}()
+		for {
+			select {
+			case m, ok := <-msgs:
+				if !ok {
+					return
+				}
+				g.deliver(m.Channel, m.Payload)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stats returns the number of messages bridged so far.
+func (g *Gateway) Stats() Stats {
+	return Stats{
+		FromRedis: g.fromRedis.Load(),
+		ToRedis:   g.toRedis.Load(),
+	}
+}
+
+func (g *Gateway) deliver(channel, payload string) {
+	topic, ok := g.topics[channel]
+	if !ok {
+		return
+	}
+	if g.published.take(channel, payload) {
+		// published by the gateway in the first place
+		return
+	}
+	g.broadcasted.add(topic, payload)
+	if err := g.s.BroadcastTopic(topic, User, payload); err != nil {
+		g.broadcasted.take(topic, payload)
+		fmt.Println("gateway delivery failed:", topic, err)
+		return
+	}
+	g.fromRedis.Add(1)
+}
+
+func (g *Gateway) forward(ctx context.Context, channel, from string, payload []byte) {
+	// a real user may be named like the gateway
+	if from == User && g.broadcasted.take(g.topics[channel], string(payload)) {
+		// delivered from Redis in the first place
+		return
+	}
+	// recorded first as the echo may arrive before Publish returns
+	g.published.add(channel, string(payload))
+	if err := g.publish(ctx, channel, payload); err != nil {
+		g.published.take(channel, string(payload))
+		fmt.Println("gateway publish failed:", channel, err)
+		return
+	}
+	g.toRedis.Add(1)
+}
+
+// inflight is a multiset of messages bridged to a channel or topic, which
+// the gateway receives back from the other side.
+type inflight struct {
+	l sync.Mutex
+	m map[inflightKey][]time.Time
+}
+
+type inflightKey struct {
+	dest, payload string
+}
+
+func (f *inflight) add(dest, payload string) {
+	now := time.Now()
+	f.l.Lock()
+	defer f.l.Unlock()
+	if len(f.m) >= maxInflight {
+		f.expire(now)
+	}
+	k := inflightKey{dest, payload}
+	f.m[k] = append(f.m[k], now)
+}
+
+// take removes a message and returns false if it wasn't bridged.
+func (f *inflight) take(dest, payload string) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	k := inflightKey{dest, payload}
+	l := f.m[k]
+	if len(l) == 0 {
+		return false
+	}
+	if len(l) == 1 {
+		delete(f.m, k)
+	} else {
+		f.m[k] = l[1:]
+	}
+	return true
+}
+
+// expire forgets messages whose echo was lost.
+// It must be called with the lock held.
+func (f *inflight) expire(now time.Time) {
+	for k, l := range f.m {
+		for len(l) > 0 && now.Sub(l[0]) > inflightTTL {
+			l = l[1:]
+		}
+		if len(l) == 0 {
+			delete(f.m, k)
+		} else {
+			f.m[k] = l
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package gateway
+
+import (
+	"context"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/aerofs/lipwig/ssmptest"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type eventQueue chan client.Event
+
+func (q eventQueue) HandleEvent(ev client.Event) {
+	q <- ev
+}
+
+func TestGateway_should_bridge_both_ways(t *testing.T) {
+	rdb, mock := redismock.NewClientMock()
+	s := ssmptest.NewServer(t, nil)
+	g := NewRedisGateway(rdb, s.Server, map[string]string{"chat": "redis-chat"})
+	msgs := make(chan *redis.Message, 1)
+	closed := make(chan struct{})
+	g.subscribe = func(_ context.Context, channels ...string) (<-chan *redis.Message, func() error) {
+		require.Equal(t, []string{"redis-chat"}, channels)
+		return msgs, func() error {
+			close(closed)
+			return nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	require.Nil(t, g.Start(ctx))
+
+	foo := s.ConnectClient(t, "foo")
+	q := make(eventQueue, 10)
+	foo.SetEventHandler(q)
+	r, err := foo.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+
+	msgs <- &redis.Message{Channel: "redis-chat", Payload: "from redis"}
+	select {
+	case ev := <-q:
+		require.Equal(t, ssmp.MCAST, string(ev.Name))
+		require.Equal(t, User, string(ev.From))
+		require.Equal(t, "chat", string(ev.To))
+		require.Equal(t, "from redis", string(ev.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	mock.ExpectPublish("redis-chat", []byte("from ssmp")).SetVal(1)
+	bar := s.ConnectClient(t, "bar")
+	r, err = bar.Mcast("chat", "from ssmp")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	require.Eventually(t, func() bool {
+		return g.Stats().ToRedis == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, Stats{FromRedis: 1, ToRedis: 1}, g.Stats())
+
+	cancel()
+	<-closed
+	foo.Close()
+	bar.Close()
+	s.Close(t)
+}
+
+func (q eventQueue) next(t *testing.T) client.Event {
+	t.Helper()
+	select {
+	case ev := <-q:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return client.Event{}
+}
+
+func TestGateway_should_not_bridge_echoed_messages(t *testing.T) {
+	rdb, mock := redismock.NewClientMock()
+	msgs := make(chan *redis.Message, 10)
+	s := ssmptest.NewServer(t, nil)
+	g := NewRedisGateway(rdb, s.Server, map[string]string{"chat": "redis-chat"})
+	publish := g.publish
+	g.publish = func(ctx context.Context, channel string, payload []byte) error {
+		err := publish(ctx, channel, payload)
+		if err == nil {
+			// as Redis does for a client subscribed to the channel
+			msgs <- &redis.Message{Channel: channel, Payload: string(payload)}
+		}
+		return err
+	}
+	closed := make(chan struct{})
+	g.subscribe = func(_ context.Context, channels ...string) (<-chan *redis.Message, func() error) {
+		return msgs, func() error {
+			close(closed)
+			return nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	require.Nil(t, g.Start(ctx))
+
+	foo := s.ConnectClient(t, "foo")
+	q := make(eventQueue, 10)
+	foo.SetEventHandler(q)
+	r, err := foo.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+
+	// published to Redis and echoed back to the gateway, but only delivered
+	// once to SSMP subscribers
+	mock.ExpectPublish("redis-chat", []byte("from ssmp")).SetVal(1)
+	bar := s.ConnectClient(t, "bar")
+	r, err = bar.Mcast("chat", "from ssmp")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	ev := q.next(t)
+	require.Equal(t, "bar", string(ev.From))
+	require.Equal(t, "from ssmp", string(ev.Payload))
+
+	// messages from Redis aren't published back to Redis
+	msgs <- &redis.Message{Channel: "redis-chat", Payload: "from redis"}
+	ev = q.next(t)
+	require.Equal(t, User, string(ev.From))
+	require.Equal(t, "from redis", string(ev.Payload))
+
+	// a real user named like the gateway is still bridged
+	mock.ExpectPublish("redis-chat", []byte("impostor")).SetVal(1)
+	gw := s.ConnectClient(t, User)
+	r, err = gw.Mcast("chat", "impostor")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	ev = q.next(t)
+	require.Equal(t, User, string(ev.From))
+	require.Equal(t, "impostor", string(ev.Payload))
+
+	require.Eventually(t, func() bool {
+		return g.Stats().ToRedis == 2
+	}, time.Second, 10*time.Millisecond)
+	// the echoes are processed in order, before this message
+	msgs <- &redis.Message{Channel: "redis-chat", Payload: "last"}
+	require.Equal(t, "last", string(q.next(t).Payload))
+	require.Len(t, q, 0)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Eventually(t, func() bool {
+		return g.Stats() == Stats{FromRedis: 2, ToRedis: 2}
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-closed
+	foo.Close()
+	bar.Close()
+	gw.Close()
+	s.Close(t)
+}
+
+func TestGateway_should_reject_invalid_topic(t *testing.T) {
+	rdb, _ := redismock.NewClientMock()
+	s := ssmptest.NewServer(t, nil)
+	g := NewRedisGateway(rdb, s.Server, map[string]string{"not valid": "c"})
+	require.NotNil(t, g.Start(context.Background()))
+	s.Close(t)
+}
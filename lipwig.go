@@ -12,18 +12,23 @@ import (
 	"github.com/aerofs/lipwig/server"
 	"io/ioutil"
 	"net"
+	"net/http"
 )
 
 func main() {
 	var address string
+	var adminAddress string
 	var insecure bool
 	var openLogin bool
+	var dualStack bool
 
 	cfg.InitConfig()
 
 	flag.StringVar(&address, "listen", "0.0.0.0:8787", "Listening address")
 	flag.BoolVar(&insecure, "insecure", false, "Disable TLS")
 	flag.BoolVar(&openLogin, "open", false, "Enable open login")
+	flag.BoolVar(&dualStack, "dual-stack", false, "Also accept IPv6 connections when listening on 0.0.0.0")
+	flag.StringVar(&adminAddress, "admin", "", "Admin HTTP listening address (disabled if empty)")
 	flag.Parse()
 
 	auth := &server.MultiSchemeAuthenticator{
@@ -54,8 +59,16 @@ func main() {
 		tlsCfg = cfg.TLSConfig()
 		auth.Schemes["cert"] = server.CertAuth
 	}
-	s := server.NewServer(l, auth, tlsCfg)
+	s := server.NewServer(l, auth, tlsCfg, server.WithDualStack(dualStack))
 	SetupSignalHandler(s)
+	if len(adminAddress) > 0 {
+		fmt.Println("WARN: admin endpoint is enabled at", adminAddress)
+		go func() {
+			if err := http.ListenAndServe(adminAddress, server.NewAdminHandler(s)); err != nil {
+				fmt.Println("admin endpoint failed:", err)
+			}
+		}()
+	}
 	fmt.Println("lipwig serving at", s.ListeningPort())
 	err = s.Serve()
 	if err != nil {
@@ -4,14 +4,41 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/client/loadgen"
 	"github.com/aerofs/lipwig/server"
 	"github.com/aerofs/lipwig/ssmp"
+	"github.com/aerofs/lipwig/ssmp/sse"
+	"github.com/aerofs/lipwig/ssmptest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -41,18 +68,34 @@ type TestClient struct {
 
 var ENDPOINT string
 
-func NewServer() *server.Server {
+var SERVER *server.Server
+
+func NewServer(opts ...server.ServerOption) *server.Server {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		panic(err)
 	}
-	s := server.NewServer(l, &test_auth{}, nil)
+	s := server.NewServer(l, &test_auth{}, nil, opts...)
 	ENDPOINT = "127.0.0.1:" + strconv.Itoa(s.ListeningPort())
+	SERVER = s
+	return s
+}
+
+// NewTestServer starts a ssmptest.TestServer, which becomes the target of
+// the client constructors below.
+func NewTestServer(t *testing.T, opts ...server.ServerOption) *ssmptest.TestServer {
+	s := ssmptest.NewServer(t, &test_auth{}, opts...)
+	ENDPOINT = s.Endpoint
+	SERVER = s.Server
 	return s
 }
 
 func NewClientWithHandler(h client.EventHandler) TestClient {
-	c, err := net.Dial("tcp", ENDPOINT)
+	return NewClientAt(ENDPOINT, h)
+}
+
+func NewClientAt(endpoint string, h client.EventHandler) TestClient {
+	c, err := net.Dial("tcp", endpoint)
 	if err != nil {
 		panic(err)
 	}
@@ -77,10 +120,29 @@ func NewLoggedInClientWithHandler(user string, h client.EventHandler) TestClient
 	return c
 }
 
-func NewLoggedInClient(user string) TestClient {
-	return NewLoggedInClientWithHandler(user, &EventQueue{
+// NewLoopbackClient connects an in-process client to the last server created
+// by NewServer.
+func NewLoopbackClient(user string) TestClient {
+	h := &EventQueue{
+		q: make(chan client.Event, 20),
+	}
+	c, err := ssmptest.NewLoopbackClient(SERVER, user)
+	if err != nil {
+		panic("failed to login")
+	}
+	c.SetEventHandler(h)
+	return TestClient{Client: c, h: h}
+}
+
+func NewLoggedInClientAt(s *server.Server, user string) TestClient {
+	c := NewClientAt("127.0.0.1:"+strconv.Itoa(s.ListeningPort()), &EventQueue{
 		q: make(chan client.Event, 20),
 	})
+	r, err := c.Login(user, "none", "")
+	if err != nil || r.Code != ssmp.CodeOk {
+		panic("failed to login")
+	}
+	return c
 }
 
 func NewDiscardingLoggedInClient(user string) TestClient {
@@ -137,7 +199,7 @@ func TestClient_should_reject_login(t *testing.T) {
 
 func TestClient_should_fail_unicast_to_invalid(t *testing.T) {
 	defer NewServer().Start().Stop()
-	c := NewLoggedInClient("foo")
+	c := NewLoopbackClient("foo")
 	defer c.Close()
 
 	expect(t, ssmp.CodeBadRequest, u(c.Ucast("!@#$%^&*", "hello")))
@@ -145,7 +207,7 @@ func TestClient_should_fail_unicast_to_invalid(t *testing.T) {
 
 func TestClient_should_fail_unicast_to_non_existent(t *testing.T) {
 	defer NewServer().Start().Stop()
-	c := NewLoggedInClient("foo")
+	c := NewLoopbackClient("foo")
 	defer c.Close()
 
 	expect(t, ssmp.CodeNotFound, u(c.Ucast("bar", "hello")))
@@ -153,7 +215,7 @@ func TestClient_should_fail_unicast_to_non_existent(t *testing.T) {
 
 func TestClient_should_unicast_self(t *testing.T) {
 	defer NewServer().Start().Stop()
-	c := NewLoggedInClient("foo")
+	c := NewLoopbackClient("foo")
 	defer c.Close()
 
 	w := c.expect(t, client.Event{
@@ -169,7 +231,7 @@ func TestClient_should_unicast_self(t *testing.T) {
 
 func TestClient_should_unicast_self_binary(t *testing.T) {
 	defer NewServer().Start().Stop()
-	c := NewLoggedInClient("foo")
+	c := NewLoopbackClient("foo")
 	defer c.Close()
 
 	w := c.expect(t, client.Event{
@@ -185,7 +247,7 @@ func TestClient_should_unicast_self_binary(t *testing.T) {
 
 func TestClient_should_reject_unicast_binary_short(t *testing.T) {
 	defer NewServer().Start().Stop()
-	c := NewLoggedInClient("foo")
+	c := NewLoopbackClient("foo")
 	defer c.Close()
 
 	expect(t, ssmp.CodeBadRequest, u(c.Ucast("foo", string([]byte{0, 3})+"hello")))
@@ -193,9 +255,9 @@ func TestClient_should_reject_unicast_binary_short(t *testing.T) {
 
 func TestClient_should_unicast_other(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewLoggedInClient("foo")
+	foo := NewLoopbackClient("foo")
 	defer foo.Close()
-	bar := NewLoggedInClient("bar")
+	bar := NewLoopbackClient("bar")
 	defer bar.Close()
 
 	w := bar.expect(t, client.Event{
@@ -221,9 +283,9 @@ func TestClient_should_unicast_other(t *testing.T) {
 
 func TestClient_should_multicast(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewLoggedInClient("foo")
+	foo := NewLoopbackClient("foo")
 	defer foo.Close()
-	bar := NewLoggedInClient("bar")
+	bar := NewLoopbackClient("bar")
 	defer bar.Close()
 
 	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
@@ -248,11 +310,60 @@ func TestClient_should_multicast(t *testing.T) {
 	w.Wait()
 }
 
+func TestDispatcher_should_simulate_multicast(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	results, err := s.Dispatcher().SimulateFromYAML([]byte(`
+- user: foo
+  line: SUBSCRIBE chat
+- user: bar
+  line: SUBSCRIBE chat
+- user: foo
+  line: MCAST chat hello
+- user: bar
+  line: MCAST chat world
+`))
+	require.Nil(t, err)
+	assert.Equal(t, []server.SimResult{
+		{Code: ssmp.CodeOk},
+		{Code: ssmp.CodeOk},
+		{Code: ssmp.CodeOk, Events: []server.SimEvent{
+			{User: "bar", From: "foo", Verb: ssmp.MCAST, To: "chat", Payload: "hello"},
+		}},
+		{Code: ssmp.CodeOk, Events: []server.SimEvent{
+			{User: "foo", From: "bar", Verb: ssmp.MCAST, To: "chat", Payload: "world"},
+		}},
+	}, results)
+	s.AssertUserNotConnected(t, "foo")
+	s.AssertTopicSubscribers(t, "chat", 0)
+
+	results = s.Dispatcher().Simulate([]server.SimStep{
+		{User: "foo", Line: "SUBSCRIBE chat PRESENCE"},
+		{User: "bar", Line: "SUBSCRIBE chat"},
+		{User: "bar", Line: "TRACE t1 UCAST foo hi"},
+		{User: "bar", Line: "FROB"},
+		{User: "bar", Line: "UCAST"},
+	})
+	assert.Equal(t, []server.SimResult{
+		{Code: ssmp.CodeOk},
+		{Code: ssmp.CodeOk, Events: []server.SimEvent{
+			{User: "foo", From: "bar", Verb: ssmp.SUBSCRIBE, To: "chat"},
+		}},
+		{Code: ssmp.CodeOk, Events: []server.SimEvent{
+			{User: "foo", From: "bar", Verb: ssmp.TRACED, To: "t1"},
+			{User: "foo", From: "bar", Verb: ssmp.UCAST, To: "foo", Payload: "hi"},
+		}},
+		{Code: 501},
+		{Code: ssmp.CodeBadRequest},
+	}, results)
+}
+
 func TestClient_should_get_presence(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewLoggedInClient("foo")
+	foo := NewLoopbackClient("foo")
 	defer foo.Close()
-	bar := NewLoggedInClient("bar")
+	bar := NewLoopbackClient("bar")
 	defer bar.Close()
 
 	w1 := foo.expect(t, client.Event{
@@ -284,10 +395,34 @@ func TestClient_should_get_presence(t *testing.T) {
 	w1.Wait()
 }
 
+func TestClient_should_get_sorted_presence_list(t *testing.T) {
+	defer NewServer().Start().Stop()
+	for _, user := range []string{"foo", "baz", "bar"} {
+		c := NewLoopbackClient(user)
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+	}
+	qux := NewLoopbackClient("qux")
+	defer qux.Close()
+
+	var events []client.Event
+	for _, user := range []string{"bar", "baz", "foo"} {
+		events = append(events, client.Event{
+			Name:    []byte(ssmp.SUBSCRIBE),
+			From:    []byte(user),
+			To:      []byte("chat"),
+			Payload: []byte{},
+		})
+	}
+	w := qux.expect(t, events...)
+	expect(t, ssmp.CodeOk, u(qux.SubscribeWithPresence("chat")))
+	w.Wait()
+}
+
 func TestClient_should_unsubscribe_on_close(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewLoggedInClient("foo")
-	bar := NewLoggedInClient("bar")
+	foo := NewLoopbackClient("foo")
+	bar := NewLoopbackClient("bar")
 	defer bar.Close()
 
 	w := bar.expect(t, client.Event{
@@ -313,11 +448,11 @@ func TestClient_should_unsubscribe_on_close(t *testing.T) {
 
 func TestClient_should_broadcast(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewLoggedInClient("foo")
+	foo := NewLoopbackClient("foo")
 	defer foo.Close()
-	bar := NewLoggedInClient("bar")
+	bar := NewLoopbackClient("bar")
 	defer bar.Close()
-	baz := NewLoggedInClient("baz")
+	baz := NewLoopbackClient("baz")
 	defer baz.Close()
 
 	expect(t, ssmp.CodeOk, u(foo.Subscribe("foo:bar")))
@@ -366,57 +501,4403 @@ func TestClient_should_broadcast(t *testing.T) {
 	w3.Wait()
 }
 
-func BenchmarkUCAST_self(b *testing.B) {
+func TestClient_should_accept_any_payload_without_validator(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewDiscardingLoggedInClient("foo")
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", "not json")))
+}
+
+func TestClient_should_reject_payload_failing_validation(t *testing.T) {
+	s := NewServer()
+	s.Dispatcher().SetPayloadValidator(server.JSONPayloadValidator())
+	defer s.Start().Stop()
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	expect(t, ssmp.CodeBadRequest, u(c.Ucast("foo", "not json")))
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", `{"hello":"world"}`)))
+	expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+}
+
+func TestClient_should_reject_payload_too_large(t *testing.T) {
+	s := NewServer()
+	s.Dispatcher().SetPayloadValidator(server.MaxPayloadSizeValidator(4))
+	defer s.Start().Stop()
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	expect(t, ssmp.CodeBadRequest, u(c.Ucast("foo", "hello")))
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", "hell")))
+}
+
+type codeError int
+
+func (e codeError) Error() string {
+	return "code " + strconv.Itoa(int(e))
+}
+
+func (e codeError) Code() int {
+	return int(e)
+}
+
+func TestClient_should_reject_payload_with_error_code(t *testing.T) {
+	s := NewServer()
+	s.Dispatcher().SetPayloadValidator(server.PayloadValidatorFunc(func(_ string, payload []byte) error {
+		if code, err := strconv.Atoi(string(payload)); err == nil {
+			return codeError(code)
+		}
+		return nil
+	}))
+	defer s.Start().Stop()
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	expect(t, 413, u(c.Ucast("foo", "413")))
+	// codes that can't be encoded are replaced by 400
+	expect(t, ssmp.CodeBadRequest, u(c.Ucast("foo", "0")))
+	expect(t, ssmp.CodeBadRequest, u(c.Ucast("foo", "1000")))
+	expect(t, ssmp.CodeBadRequest, u(c.Ucast("foo", "-1")))
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", "hello")))
+}
+
+func TestCluster_should_forward_unicast(t *testing.T) {
+	cl := server.NewCluster(3, &test_auth{})
+	defer cl.Stop()
+	foo := NewLoggedInClientAt(cl.Server(0), "foo")
 	defer foo.Close()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		foo.Ucast("foo", "hello world")
-	}
-	b.StopTimer()
+	bar := NewLoggedInClientAt(cl.Server(1), "bar")
+	defer bar.Close()
+	baz := NewLoggedInClientAt(cl.Server(2), "baz")
+	defer baz.Close()
+
+	w := baz.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("baz"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.Ucast("baz", "hello")))
+	w.Wait()
+
+	expect(t, ssmp.CodeNotFound, u(foo.Ucast("qux", "hello")))
 }
 
-func BenchmarkParallelUCAST_self(b *testing.B) {
+func TestClient_should_dial(t *testing.T) {
 	defer NewServer().Start().Stop()
-	foo := NewDiscardingLoggedInClient("foo")
-	defer foo.Close()
-	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			foo.Ucast("foo", "hello world")
+	c, err := client.Dial("tcp", ENDPOINT, client.Discard, client.WithRequestChecks(true))
+	require.Nil(t, err)
+	defer c.Close()
+
+	expect(t, ssmp.CodeOk, u(c.Login("foo", "none", "")))
+	_, err = c.Ucast("!@#$%^&*", "hello")
+	require.ErrorIs(t, err, client.ErrInvalidIdentifier)
+}
+
+func TestClient_should_not_dial_with_cancelled_context(t *testing.T) {
+	defer NewServer().Start().Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, err := client.DialContext(ctx, "tcp", ENDPOINT, client.Discard)
+	require.Nil(t, c)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestServer_should_flush_subscriptions(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	topics := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		n := "topic" + strconv.Itoa(i)
+		topics[n] = true
+		expect(t, ssmp.CodeOk, u(c.Subscribe(n)))
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, s.GetConnection([]byte("foo")).FlushSubscriptions(&buf))
+
+	r := ssmp.NewDecoder(&buf)
+	for i := 0; i < 5; i++ {
+		code, err := r.DecodeCode()
+		require.Nil(t, err)
+		require.Equal(t, ssmp.CodeEvent, code)
+		from, err := r.DecodeId()
+		require.Nil(t, err)
+		require.Equal(t, "foo", string(from))
+		verb, err := r.DecodeVerb()
+		require.Nil(t, err)
+		require.Equal(t, ssmp.SUBSCRIBE, string(verb))
+		n, err := r.DecodeId()
+		require.Nil(t, err)
+		require.True(t, topics[string(n)])
+		delete(topics, string(n))
+		r.Reset()
+	}
+	require.Empty(t, topics)
+}
+
+func TestServer_should_count_dispatched_verbs(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		expect(t, ssmp.CodeOk, u(c.Ucast("foo", "hello")))
+	}
+	for i := 0; i < 5; i++ {
+		expect(t, ssmp.CodeOk, u(c.Mcast("chat", "hello")))
+	}
+
+	st := s.Dispatcher().Stats()
+	require.Equal(t, uint64(10), st.Counts[ssmp.UCAST])
+	require.Equal(t, uint64(5), st.Counts[ssmp.MCAST])
+	require.Equal(t, uint64(0), st.Errors[ssmp.UCAST])
+
+	s.Dispatcher().ResetStats()
+	require.Equal(t, uint64(0), s.Dispatcher().Stats().Counts[ssmp.UCAST])
+}
+
+func TestServer_should_drop_messages_for_lagging_subscriber(t *testing.T) {
+	s := NewServer(server.WithWriteQueue(16))
+	defer s.Start().Stop()
+	q := &EventQueue{q: make(chan client.Event, 100)}
+	fast := NewLoggedInClientWithHandler("fast", q)
+	defer fast.Close()
+	pub := NewDiscardingLoggedInClient("pub")
+	defer pub.Close()
+
+	expect(t, ssmp.CodeOk, u(fast.Subscribe("chat")))
+
+	// unbuffered pipe: once the responses are read, nothing else is
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	go p2.Write([]byte("LOGIN slow none\nSUBSCRIBE chat\n"))
+	_, err := server.NewConnection(p1, &test_auth{}, s.Dispatcher())
+	require.Nil(t, err)
+	r := ssmp.NewDecoder(p2)
+	for i := 0; i < 2; i++ {
+		code, err := r.DecodeCode()
+		require.Nil(t, err)
+		require.Equal(t, ssmp.CodeOk, code)
+		r.Reset()
+	}
+
+	topic := s.GetTopic([]byte("chat"))
+	topic.SetLagPolicy(server.DropLagging)
+	for i := 0; i < 100; i++ {
+		expect(t, ssmp.CodeOk, u(pub.Mcast("chat", "hello")))
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case <-q.q:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "timed out waiting for event")
 		}
+	}
+	require.True(t, topic.DroppedMessages() > 0)
+	l := s.ListTopics()
+	require.Len(t, l, 1)
+	require.Equal(t, topic.DroppedMessages(), l[0].DroppedMessages)
+}
+
+func NewRawConnection(t *testing.T, user string) (net.Conn, *ssmp.Decoder) {
+	c, err := net.Dial("tcp", ENDPOINT)
+	require.Nil(t, err)
+	_, err = c.Write([]byte(ssmp.LOGIN + " " + user + " none\n"))
+	require.Nil(t, err)
+	r := ssmp.NewDecoder(c)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+	r.Reset()
+	return c, r
+}
+
+func TestServer_should_dispatch_registered_verb(t *testing.T) {
+	s := NewServer()
+	d := s.Dispatcher()
+	require.Nil(t, d.RegisterVerb("STATUS", 0,
+		func(c *server.Connection, _, _, _ []byte, _ *server.Dispatcher) {
+			c.Write([]byte("200 ok\n"))
+		}))
+	require.Equal(t, server.ErrVerbConflict, d.RegisterVerb("STATUS", 0,
+		func(_ *server.Connection, _, _, _ []byte, _ *server.Dispatcher) {}))
+	require.Equal(t, server.ErrInvalidVerb, d.RegisterVerb("status", 0,
+		func(_ *server.Connection, _, _, _ []byte, _ *server.Dispatcher) {}))
+	for _, verb := range []string{ssmp.LOGIN, ssmp.TRACE, ssmp.EXPIRES, ssmp.RELIABLE} {
+		require.Equal(t, server.ErrVerbConflict, d.RegisterVerb(verb, 0,
+			func(_ *server.Connection, _, _, _ []byte, _ *server.Dispatcher) {}))
+	}
+	defer s.Start().Stop()
+
+	c, r := NewRawConnection(t, "foo")
+	defer c.Close()
+
+	_, err := c.Write([]byte("STATUS\n"))
+	require.Nil(t, err)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+	payload, err := r.DecodePayload()
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(payload))
+	r.Reset()
+
+	require.Nil(t, d.UnregisterVerb("STATUS"))
+	require.Equal(t, server.ErrUnknownVerb, d.UnregisterVerb("STATUS"))
+
+	_, err = c.Write([]byte("STATUS\n"))
+	require.Nil(t, err)
+	code, err = r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, 501, code)
+}
+
+func TestServer_should_count_topic_messages(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	pub := NewDiscardingLoggedInClient("pub")
+	defer pub.Close()
+	for i := 0; i < 3; i++ {
+		c := NewDiscardingLoggedInClient("sub" + strconv.Itoa(i))
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+	}
+
+	for i := 0; i < 100; i++ {
+		expect(t, ssmp.CodeOk, u(pub.Mcast("chat", "hello")))
+	}
+
+	topic := s.GetTopic([]byte("chat"))
+	require.Equal(t, uint64(300), topic.MessageCount())
+	require.Equal(t, uint64(300), s.ListTopics()[0].MessageCount)
+	topic.ResetMessageCount()
+	require.Equal(t, uint64(0), topic.MessageCount())
+}
+
+func NewSelfSignedCert(t *testing.T, cn string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: cn},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       []string{"foo.example.com"},
+		EmailAddresses: []string{"foo@example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert
+}
+
+func TestAuth_should_validate_cert(t *testing.T) {
+	cert := NewSelfSignedCert(t, "foo")
+
+	cn := server.CommonNameValidator()
+	require.True(t, cn.ValidateCert([]byte("foo"), cert))
+	require.False(t, cn.ValidateCert([]byte("bar"), cert))
+	require.False(t, cn.ValidateCert([]byte("foo.example.com"), cert))
+
+	require.True(t, server.SANDNSValidator().ValidateCert([]byte("foo.example.com"), cert))
+	require.True(t, server.SANEmailValidator().ValidateCert([]byte("foo@example.com"), cert))
+
+	either := server.AnyValidator(cn, server.SANDNSValidator())
+	require.True(t, either.ValidateCert([]byte("foo"), cert))
+	require.True(t, either.ValidateCert([]byte("foo.example.com"), cert))
+	require.False(t, either.ValidateCert([]byte("foo@example.com"), cert))
+
+	all := server.AllValidators(cn, server.SANDNSValidator())
+	require.False(t, all.ValidateCert([]byte("foo"), cert))
+	require.True(t, server.AllValidators(cn).ValidateCert([]byte("foo"), cert))
+}
+
+// NewSelfSignedKeyPair creates a certificate valid for both ends of a TLS
+// connection to a loopback address.
+func NewSelfSignedKeyPair(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func listenIPv6(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+	return l
+}
+
+func TestServer_should_listen_on_ipv6(t *testing.T) {
+	l := listenIPv6(t)
+	s := server.NewServer(l, &test_auth{}, nil)
+	defer s.Start().Stop()
+	require.NotZero(t, s.ListeningPort())
+	require.Equal(t, l.Addr().(*net.TCPAddr).Port, s.ListeningPort())
+
+	c := NewClientAt(l.Addr().String(), client.Discard)
+	defer c.Close()
+	expect(t, ssmp.CodeOk, u(c.Login("foo", "none", "")))
+}
+
+func TestAuth_should_accept_cert_over_ipv6(t *testing.T) {
+	l := listenIPv6(t)
+	serverPair, serverCert := NewSelfSignedKeyPair(t, "server")
+	clientPair, clientCert := NewSelfSignedKeyPair(t, "foo")
+	serverRoots := x509.NewCertPool()
+	serverRoots.AddCert(serverCert)
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(clientCert)
+	auth := &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"cert": server.CertAuth,
+		},
+	}
+	s := server.NewServer(l, auth, &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientRoots,
 	})
-	b.StopTimer()
+	defer s.Start().Stop()
+
+	login := func(user string) int {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{clientPair},
+			RootCAs:      serverRoots,
+		})
+		require.Nil(t, err)
+		cl := client.NewClient(c, client.Discard)
+		defer cl.Close()
+		r, err := cl.Login(user, "cert", "")
+		require.Nil(t, err)
+		return r.Code
+	}
+	require.Equal(t, ssmp.CodeOk, login("foo"))
+	require.Equal(t, ssmp.CodeOk, login("foo/device"))
+	require.Equal(t, ssmp.CodeUnauthorized, login("bar"))
 }
 
-func BenchmarkMCAST_100(b *testing.B) {
-	defer NewServer().Start().Stop()
-	var c [100]TestClient
-	for i := 0; i < len(c); i++ {
-		c[i] = NewDiscardingLoggedInClient("foo" + strconv.Itoa(i))
-		c[i].Subscribe("topic")
-		defer c[i].Close()
+func TestAuth_should_chain_cert_and_secret(t *testing.T) {
+	serverPair, serverCert := NewSelfSignedKeyPair(t, "server")
+	clientPair, clientCert := NewSelfSignedKeyPair(t, "foo")
+	serverRoots := x509.NewCertPool()
+	serverRoots.AddCert(serverCert)
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(clientCert)
+	auth := &server.MultiSchemeAuthenticator{}
+	auth.AddScheme("mfa", server.ChainAuthenticator(server.CertAuth, server.SecretAuth([]byte("s3cr3t"))))
+	auth.AddScheme("either", server.AnyAuthenticator(server.CertAuth, server.SecretAuth([]byte("s3cr3t"))))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := server.NewServer(l, auth, &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientRoots,
+	})
+	defer s.Start().Stop()
+
+	login := func(withCert bool, user, scheme, cred string) client.Response {
+		cfg := &tls.Config{RootCAs: serverRoots}
+		if withCert {
+			cfg.Certificates = []tls.Certificate{clientPair}
+		}
+		c, err := tls.Dial("tcp", l.Addr().String(), cfg)
+		require.Nil(t, err)
+		cl := client.NewClient(c, client.Discard)
+		defer cl.Close()
+		r, err := cl.Login(user, scheme, cred)
+		require.Nil(t, err)
+		return r
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		c[i%len(c)].Mcast("topic", "hello world")
+	require.Equal(t, ssmp.CodeOk, login(true, "foo", "mfa", "s3cr3t").Code)
+	require.Equal(t, ssmp.CodeUnauthorized, login(true, "foo", "mfa", "wrong").Code)
+	require.Equal(t, ssmp.CodeUnauthorized, login(false, "foo", "mfa", "s3cr3t").Code)
+	require.Equal(t, ssmp.CodeUnauthorized, login(true, "bar", "mfa", "s3cr3t").Code)
+
+	require.Equal(t, ssmp.CodeOk, login(true, "foo", "either", "wrong").Code)
+	require.Equal(t, ssmp.CodeOk, login(false, "foo", "either", "s3cr3t").Code)
+	r := login(false, "foo", "either", "wrong")
+	require.Equal(t, ssmp.CodeUnauthorized, r.Code)
+	require.Equal(t, "either mfa", r.Message)
+
+	require.False(t, server.ChainAuthenticator()(nil, nil, nil, nil))
+	require.False(t, server.AnyAuthenticator()(nil, nil, nil, nil))
+}
+
+func TestServer_should_accept_ipv4_and_ipv6_with_dual_stack(t *testing.T) {
+	listenIPv6(t).Close()
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	require.Nil(t, err)
+	s := server.NewServer(l, &test_auth{}, nil, server.WithDualStack(true))
+	defer s.Start().Stop()
+	port := strconv.Itoa(s.ListeningPort())
+
+	for i, addr := range []string{"127.0.0.1:" + port, "[::1]:" + port} {
+		c := NewClientAt(addr, client.Discard)
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(c.Login("user"+strconv.Itoa(i), "none", "")))
 	}
-	b.StopTimer()
+	require.Nil(t, s.WaitForConnections(2, time.Second))
 }
 
-func BenchmarkPRESENCE_100(b *testing.B) {
-	defer NewServer().Start().Stop()
-	var c [100]TestClient
-	for i := 0; i < len(c); i++ {
-		c[i] = NewDiscardingLoggedInClient("foo" + strconv.Itoa(i))
-		c[i].SubscribeWithPresence("topic")
-		defer c[i].Close()
+// closedWithin reports whether the peer closes c within the given time.
+func closedWithin(c net.Conn, d time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(d))
+	defer c.SetReadDeadline(time.Time{})
+	_, err := c.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return false
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		c[i%len(c)].Unsubscribe("topic")
-		c[i%len(c)].SubscribeWithPresence("topic")
+	return err != nil
+}
+
+func TestServer_should_close_connection_after_tls_handshake_timeout(t *testing.T) {
+	pair, _ := NewSelfSignedKeyPair(t, "server")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := server.NewServer(l, &test_auth{}, &tls.Config{Certificates: []tls.Certificate{pair}},
+		server.WithTLSHandshakeTimeout(100*time.Millisecond))
+	defer s.Start().Stop()
+
+	// never sends a ClientHello
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+	start := time.Now()
+	require.True(t, closedWithin(c, 5*time.Second))
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestServer_should_close_connection_after_handshake_timeout(t *testing.T) {
+	defer NewServer(server.WithHandshakeTimeout(100 * time.Millisecond)).Start().Stop()
+
+	c, err := net.Dial("tcp", ENDPOINT)
+	require.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("LOGIN foo"))
+	require.Nil(t, err)
+	require.True(t, closedWithin(c, time.Second))
+
+	// the deadline no longer applies once logged in
+	foo, r := NewRawConnection(t, "foo")
+	defer foo.Close()
+	require.False(t, closedWithin(foo, 300*time.Millisecond))
+	_, err = foo.Write([]byte("UCAST foo hello\n"))
+	require.Nil(t, err)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeEvent, code)
+}
+
+func TestServer_should_count_bytes(t *testing.T) {
+	s := NewServer(server.WithByteMetrics(true))
+	defer s.Start().Stop()
+	foo := NewDiscardingLoggedInClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	payload := strings.Repeat("x", 1000)
+	w := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte(payload),
+	})
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", payload)))
+	w.Wait()
+
+	var fooInfo, barInfo server.ConnectionInfo
+	for _, ci := range s.ListConnections() {
+		if ci.User == "foo" {
+			fooInfo = ci
+		} else if ci.User == "bar" {
+			barInfo = ci
+		}
+	}
+	// allow for framing and LOGIN overhead
+	require.InDelta(t, len(payload), fooInfo.BytesReceived, 64)
+	require.InDelta(t, len(payload), barInfo.BytesSent, 64)
+	require.True(t, s.TotalBytesSent() >= barInfo.BytesSent+fooInfo.BytesSent)
+	require.True(t, s.TotalBytesReceived() >= barInfo.BytesReceived+fooInfo.BytesReceived)
+}
+
+func TestClient_should_ping_when_idle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	cfg := client.DefaultConfig()
+	cfg.IdleTimeout = 100 * time.Millisecond
+	cfg.PingTimeout = 100 * time.Millisecond
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	client.NewClientWithConfig(c, client.Discard, cfg, client.WithHello(false))
+
+	s, err := l.Accept()
+	require.Nil(t, err)
+	defer s.Close()
+
+	start := time.Now()
+	s.SetReadDeadline(start.Add(5 * time.Second))
+	r := ssmp.NewDecoder(s)
+	verb, err := r.DecodeVerb()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.PING, string(verb))
+	r.Reset()
+
+	// no PONG: client gives up after PingTimeout
+	_, err = r.DecodeVerb()
+	require.Equal(t, io.EOF, err)
+	require.True(t, time.Since(start) < 1*time.Second)
+}
+
+func TestServer_should_restore_persisted_subscriptions(t *testing.T) {
+	p := server.NewInMemoryPersister()
+	s := NewServer(server.WithPersister(p))
+	s.Start()
+	foo := NewDiscardingLoggedInClient("foo")
+	bar := NewDiscardingLoggedInClient("bar")
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(bar.SubscribeWithPresence("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("news")))
+	expect(t, ssmp.CodeOk, u(bar.Unsubscribe("news")))
+	foo.Close()
+	bar.Close()
+	s.Stop()
+
+	s = NewServer(server.WithPersister(p))
+	defer s.Start().Stop()
+
+	// topics are recreated before their subscribers log back in
+	topics := s.ListTopics()
+	require.Len(t, topics, 1)
+	require.Equal(t, "chat", topics[0].Name)
+	require.Equal(t, 0, topics[0].Subscribers)
+
+	bar = NewLoopbackClient("bar")
+	defer bar.Close()
+	require.Len(t, s.ListTopics(), 1)
+	w := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.SUBSCRIBE),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte{},
+	})
+	foo = NewLoopbackClient("foo")
+	w.Wait()
+
+	w = foo.expect(t, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("baz"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	})
+	baz := NewDiscardingLoggedInClient("baz")
+	defer baz.Close()
+	expect(t, ssmp.CodeOk, u(baz.Mcast("chat", "hello")))
+	w.Wait()
+
+	// restored subscriptions are harvested like any other
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Unsubscribe("chat")))
+	require.Empty(t, s.ListTopics())
+	foo.Close()
+}
+
+type blockingPersister struct {
+	*server.InMemoryPersister
+	unblock chan struct{}
+}
+
+func (p *blockingPersister) SaveSubscription(user, topic string, presence bool) {
+	<-p.unblock
+	p.InMemoryPersister.SaveSubscription(user, topic, presence)
+}
+
+func TestServer_should_not_block_on_slow_persister(t *testing.T) {
+	p := &blockingPersister{server.NewInMemoryPersister(), make(chan struct{})}
+	s := NewServer(server.WithPersister(p))
+	s.Start()
+	foo := NewDiscardingLoggedInClient("foo")
+	for i := 0; i < 300; i++ {
+		expect(t, ssmp.CodeOk, u(foo.Subscribe(fmt.Sprintf("topic%d", i))))
+	}
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("topic0")))
+	foo.Close()
+
+	// pending changes are saved on stop, none is lost
+	close(p.unblock)
+	s.Stop()
+	subs, err := p.LoadSubscriptions()
+	require.Nil(t, err)
+	require.Len(t, subs, 299)
+}
+
+func TestResponse_should_parse_count(t *testing.T) {
+	n, err := client.ParseCount(client.Response{Code: ssmp.CodeOk, Message: "5"})
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
+
+	n, err = client.ParseCount(client.Response{Code: ssmp.CodeOk})
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	_, err = client.ParseCount(client.Response{Code: ssmp.CodeOk, Message: "five"})
+	require.NotNil(t, err)
+}
+
+func TestResponse_should_parse_list(t *testing.T) {
+	require.Equal(t, []string{"foo", "bar"},
+		client.ParseList(client.Response{Code: ssmp.CodeOk, Message: "foo bar"}))
+	require.Empty(t, client.ParseList(client.Response{Code: ssmp.CodeOk}))
+	require.True(t, client.Response{Code: ssmp.CodeOk}.IsOK())
+	require.False(t, client.Response{Code: ssmp.CodeNotFound}.IsOK())
+}
+
+// flushRecorder sends the body of the response on every Flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (r *flushRecorder) Flush() {
+	r.ResponseRecorder.Flush()
+	r.flushed <- r.Body.String()
+}
+
+func TestSSE_should_stream_multicast(t *testing.T) {
+	// network clients are rejected, in-process ones are not affected
+	s := NewServer(server.WithPreLoginHandler(server.PreLoginHandlerFunc(
+		func(_ net.Conn, _ *ssmp.Decoder) ([]byte, []byte, []byte, error) {
+			return nil, nil, nil, fmt.Errorf("nope")
+		})))
+	defer s.Start().Stop()
+	h := sse.Handler(func(r *http.Request) (string, error) {
+		return r.Header.Get("X-User"), nil
+	}, s.Dispatcher())
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	web := NewLoopbackClient("web")
+	defer web.Close()
+	native := s.GetConnection([]byte("web"))
+	// sent on SUBSCRIBE, before the stream is started
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(foo.Configure("chat", "History=1")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "earlier")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/events?topics=chat,news", nil).WithContext(ctx)
+	req.Header.Set("X-User", "web")
+	rec := &flushRecorder{httptest.NewRecorder(), make(chan string, 10)}
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	require.Nil(t, s.WaitForTopic("news", 1, 5*time.Second))
+	// the stream doesn't replace the native connection of its user
+	require.Len(t, s.ListConnections(), 3)
+	require.Same(t, native, s.GetConnection([]byte("web")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.Ucast("foo", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("news", "world")))
+	expected := `data: {"from":"foo","name":"MCAST","to":"chat","payload":"earlier"}` + "\n\n" +
+		`data: {"from":"foo","name":"MCAST","to":"chat","payload":"hello"}` + "\n\n" +
+		`data: {"from":"foo","name":"MCAST","to":"news","payload":"world"}` + "\n\n"
+	// events may be flushed along with the headers
+	for body := ""; body != expected; {
+		select {
+		case body = <-rec.flushed:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "timeout", body)
+		}
+	}
+	cancel()
+	<-done
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	require.Equal(t, expected, rec.Body.String())
+}
+
+func TestSSE_should_reject_unauthorized(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	h := sse.Handler(func(r *http.Request) (string, error) {
+		return "", fmt.Errorf("nope")
+	}, s.Dispatcher())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/events?topics=chat", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestServer_should_drop_duplicate_messages(t *testing.T) {
+	s := NewServer()
+	s.Dispatcher().SetDeduplicationWindow(time.Minute)
+	defer s.Start().Stop()
+	foo := NewDiscardingLoggedInClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	w := bar.expect(t, client.Event{
+		Name: []byte(ssmp.TRACED),
+		From: []byte("foo"),
+		To:   []byte("m1"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}, client.Event{
+		Name: []byte(ssmp.TRACED),
+		From: []byte("foo"),
+		To:   []byte("m2"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("world"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("m1:x"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("m1:y"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.UcastTraced("m1", "bar", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.UcastTraced("m1", "bar", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.UcastTraced("m2", "bar", "world")))
+	// payloads are never parsed for a message id
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "m1:x")))
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "m1:y")))
+	w.Wait()
+
+	select {
+	case ev := <-bar.h.(*EventQueue).q:
+		require.Fail(t, "unexpected event", string(ev.Payload))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClient_should_filter_events(t *testing.T) {
+	defer NewServer().Start().Stop()
+	q := &EventQueue{q: make(chan client.Event, 20)}
+	foo := NewLoggedInClientWithHandler("foo", client.NewEventFilter(q, client.NameIs(ssmp.MCAST)))
+	defer foo.Close()
+	bar := NewDiscardingLoggedInClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Ucast("foo", "hello")))
+	expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "world")))
+
+	select {
+	case ev := <-q.q:
+		require.Equal(t, ssmp.MCAST, string(ev.Name))
+		require.Equal(t, "world", string(ev.Payload))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for event")
+	}
+	select {
+	case ev := <-q.q:
+		require.Fail(t, "unexpected event", string(ev.Name))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClient_should_combine_event_predicates(t *testing.T) {
+	ev := client.Event{
+		From: []byte("foo"),
+		Name: []byte(ssmp.MCAST),
+		To:   []byte("chat"),
+	}
+	require.True(t, client.FromUser("foo")(ev))
+	require.True(t, client.ToTopic("chat")(ev))
+	require.False(t, client.Not(client.ToTopic("chat"))(ev))
+	require.True(t, client.Any(client.NameIs(ssmp.UCAST), client.FromUser("foo"))(ev))
+	require.False(t, client.Any(client.NameIs(ssmp.UCAST), client.FromUser("bar"))(ev))
+	require.False(t, client.Any()(ev))
+}
+
+func TestClient_should_unicast_group(t *testing.T) {
+	defer NewServer().Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	baz := NewLoopbackClient("baz")
+	defer baz.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.JoinGroup("team")))
+	expect(t, ssmp.CodeOk, u(bar.JoinGroup("team")))
+	expect(t, ssmp.CodeConflict, u(bar.JoinGroup("team")))
+
+	event := client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("baz"),
+		To:      []byte("@team"),
+		Payload: []byte("hello"),
+	}
+	wfoo := foo.expect(t, event)
+	wbar := bar.expect(t, event)
+	expect(t, ssmp.CodeOk, u(baz.Ucast("@team", "hello")))
+	wfoo.Wait()
+	wbar.Wait()
+}
+
+func TestClient_should_fail_unicast_to_empty_group(t *testing.T) {
+	defer NewServer().Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	expect(t, ssmp.CodeNotFound, u(foo.Ucast("@team", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.JoinGroup("team")))
+	expect(t, ssmp.CodeOk, u(foo.LeaveGroup("team")))
+	expect(t, ssmp.CodeNotFound, u(foo.LeaveGroup("team")))
+	expect(t, ssmp.CodeNotFound, u(foo.Ucast("@team", "hello")))
+}
+
+func TestServer_should_not_join_removed_group(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.JoinGroup("team")))
+	stale := s.GetGroup([]byte("team"))
+	expect(t, ssmp.CodeOk, u(foo.LeaveGroup("team")))
+	require.Nil(t, s.GetGroup([]byte("team")))
+	require.False(t, stale.Join(s.GetConnection([]byte("bar"))))
+
+	expect(t, ssmp.CodeOk, u(bar.JoinGroup("team")))
+	// removing the stale group leaves the new one alone
+	stale.Leave(s.GetConnection([]byte("bar")))
+	require.NotNil(t, s.GetGroup([]byte("team")))
+	require.NotSame(t, stale, s.GetGroup([]byte("team")))
+}
+
+func TestServer_should_reject_users_with_group_prefix(t *testing.T) {
+	defer NewServer().Start().Stop()
+	c := NewClient()
+	defer c.Close()
+	expect(t, ssmp.CodeBadRequest, u(c.Login("@team", "none", "")))
+
+	anon := NewLoopbackClient(ssmp.Anonymous)
+	defer anon.Close()
+	expect(t, ssmp.CodeBadRequest, u(anon.Relogin("@team", "none", "")))
+}
+
+func TestServer_should_drain_topic(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	unsub := client.Event{
+		Name: []byte(ssmp.UNSUBSCRIBE),
+		From: []byte(ssmp.Anonymous),
+		To:   []byte("chat"),
+	}
+	var wg []*sync.WaitGroup
+	for _, user := range []string{"foo", "bar", "baz"} {
+		c := NewLoopbackClient(user)
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+		wg = append(wg, c.expect(t, unsub))
+	}
+
+	n, ok := s.DrainTopic("chat")
+	require.True(t, ok)
+	assert.Equal(t, 3, n)
+	for _, w := range wg {
+		w.Wait()
+	}
+	assert.Empty(t, s.ListTopics())
+
+	_, ok = s.DrainTopic("chat")
+	assert.False(t, ok)
+}
+
+func TestServer_should_free_subscriptions_of_drained_topic(t *testing.T) {
+	s := NewTestServer(t, server.WithMaxSubscriptions(2))
+	defer s.Close(t)
+	c := NewLoopbackClient("foo")
+	defer c.Close()
+	unsub := c.expect(t, client.Event{
+		Name: []byte(ssmp.UNSUBSCRIBE),
+		From: []byte(ssmp.Anonymous),
+		To:   []byte("a"),
+	})
+
+	expect(t, ssmp.CodeOk, u(c.Subscribe("a")))
+	expect(t, ssmp.CodeOk, u(c.Subscribe("b")))
+	expect(t, ssmp.CodeTooManyRequests, u(c.Subscribe("c")))
+
+	n, ok := s.DrainTopic("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, n)
+	unsub.Wait()
+
+	expect(t, ssmp.CodeOk, u(c.Subscribe("c")))
+	expect(t, ssmp.CodeTooManyRequests, u(c.Subscribe("a")))
+}
+
+func TestAdmin_should_drain_topic(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	admin := httptest.NewServer(server.NewAdminHandler(s))
+	defer admin.Close()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+
+	del := func(url string) int {
+		req, err := http.NewRequest("DELETE", admin.URL+url, nil)
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusConflict, del("/topics/chat"))
+	assert.Equal(t, http.StatusOK, del("/topics/chat?force=true"))
+	assert.Equal(t, http.StatusNotFound, del("/topics/chat"))
+}
+
+func TestAdmin_should_list_subscriptions(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	admin := httptest.NewServer(server.NewAdminHandler(s))
+	defer admin.Close()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("news")))
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+
+	resp, err := http.Get(admin.URL + "/connections/foo/subscriptions")
+	require.Nil(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "000 foo SUBSCRIBE chat\n000 foo SUBSCRIBE news\n", string(b))
+
+	resp, err = http.Get(admin.URL + "/connections/bar/subscriptions")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdmin_should_report_topic_stats(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	admin := httptest.NewServer(server.NewAdminHandler(s))
+	defer admin.Close()
+	var c []TestClient
+	for _, user := range []string{"foo", "bar", "baz"} {
+		cc := NewLoopbackClient(user)
+		defer cc.Close()
+		c = append(c, cc)
+	}
+	expect(t, ssmp.CodeOk, u(c[2].SubscribeWithPresence("chat")))
+	w := c[2].expect(t, client.Event{
+		Name:    []byte(ssmp.SUBSCRIBE),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte{},
+	}, client.Event{
+		Name:    []byte(ssmp.SUBSCRIBE),
+		From:    []byte("bar"),
+		To:      []byte("chat"),
+		Payload: []byte{},
+	})
+	expect(t, ssmp.CodeOk, u(c[0].Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(c[1].Subscribe("chat")))
+	w.Wait()
+	pub := NewLoopbackClient("pub")
+	defer pub.Close()
+
+	ev := client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("pub"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	}
+	var wg []*sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, cc := range c {
+			wg = append(wg, cc.expect(t, ev))
+		}
+	}
+	for i := 0; i < 10; i++ {
+		expect(t, ssmp.CodeOk, u(pub.Mcast("chat", "hello")))
+	}
+	for _, w := range wg {
+		w.Wait()
+	}
+
+	size := len("000 pub MCAST chat hello\n")
+	expected := []server.TopicStats{{
+		Name:                "chat",
+		SubscriberCount:     3,
+		PresenceSubscribers: 1,
+		MessageCount:        10,
+		BytesDelivered:      uint64(30 * size),
+	}}
+	assert.Equal(t, expected, s.TopicManager.Stats())
+
+	resp, err := http.Get(admin.URL + "/topics/stats")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var st []server.TopicStats
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&st))
+	assert.Equal(t, expected, st)
+}
+
+func TestServer_should_force_close(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+	admin := httptest.NewServer(server.NewAdminHandler(s.Server))
+	defer admin.Close()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	w := foo.expect(t, client.Event{
+		Name: []byte(ssmp.CLOSE),
+		From: []byte(ssmp.Anonymous),
+	})
+	require.Nil(t, s.ForceClose("foo"))
+	w.Wait()
+	s.AssertUserNotConnected(t, "foo")
+	assert.Equal(t, server.ErrUserNotFound, s.ForceClose("baz"))
+
+	req, err := http.NewRequest("DELETE", admin.URL+"/connections/bar", nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	s.AssertUserNotConnected(t, "bar")
+}
+
+func TestServer_should_force_close_by_prefix(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+	for _, user := range []string{"tenant-a/foo", "tenant-a/bar", "tenant-b/foo"} {
+		defer s.ConnectClient(t, user).Close()
+	}
+	assert.Equal(t, 2, s.ForceCloseAll("tenant-a/"))
+	s.AssertUserNotConnected(t, "tenant-a/foo")
+	s.AssertUserNotConnected(t, "tenant-a/bar")
+	s.AssertUserConnected(t, "tenant-b/foo")
+}
+
+func TestLoadGenerator_should_sustain_rate(t *testing.T) {
+	defer NewServer().Start().Stop()
+	var pool []client.Client
+	for _, user := range []string{"foo", "bar", "baz", "qux"} {
+		c := NewLoopbackClient(user)
+		defer c.Close()
+		pool = append(pool, c)
+	}
+	sink := NewLoopbackClient("sink")
+	defer sink.Close()
+	go func() {
+		for range sink.h.(*EventQueue).q {
+		}
+	}()
+
+	g := loadgen.NewLoadGenerator(pool...)
+	g.AddPattern(loadgen.Pattern{
+		Rate:    1000,
+		Verb:    ssmp.UCAST,
+		To:      "sink",
+		Payload: func() string { return "hello" },
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Run(ctx)
+
+	s := g.Stats()
+	assert.Equal(t, uint64(0), s.Errors)
+	assert.True(t, s.MessagesSent >= 950, "sent %d", s.MessagesSent)
+	assert.True(t, s.P50Latency <= s.P99Latency)
+}
+
+// NewPipeClient connects a client directly to a Dispatcher, bypassing the
+// ConnectionManager, which allows multiple connections for the same user.
+func NewPipeClient(d *server.Dispatcher, user string) TestClient {
+	return newPipeClient(func(c net.Conn) {
+		go server.NewConnection(c, &test_auth{}, d)
+	}, user)
+}
+
+func newPipeClient(serve func(c net.Conn), user string) TestClient {
+	sc, cc := net.Pipe()
+	serve(sc)
+	h := &EventQueue{
+		q: make(chan client.Event, 20),
+	}
+	c := TestClient{
+		Client: client.NewClient(cc, h),
+		h:      h,
+	}
+	r, err := c.Login(user, "none", "")
+	if err != nil || r.Code != ssmp.CodeOk {
+		panic("failed to login")
+	}
+	return c
+}
+
+func TestClient_should_not_multicast_to_self_with_noself(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo1 := NewPipeClient(s.Dispatcher(), "foo")
+	defer foo1.Close()
+	foo2 := NewPipeClient(s.Dispatcher(), "foo")
+	defer foo2.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeBadRequest, u(foo2.SubscribeWithOptions("chat", "NOPE")))
+	expect(t, ssmp.CodeOk, u(foo2.SubscribeWithOptions("chat", ssmp.PRESENCE, ssmp.NOSELF)))
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+
+	wbar := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(foo1.Mcast("chat", "hello")))
+	wbar.Wait()
+
+	// the first MCAST received by foo2 is the one from bar
+	wfoo := foo2.expect(t, client.Event{
+		Name:    []byte(ssmp.SUBSCRIBE),
+		From:    []byte("bar"),
+		To:      []byte("chat"),
+		Payload: []byte{},
+	}, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("bar"),
+		To:      []byte("chat"),
+		Payload: []byte("world"),
+	})
+	expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "world")))
+	wfoo.Wait()
+}
+
+func TestServer_should_wait_for_connections(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+	require.Equal(t, server.ErrTimeout, s.WaitForConnections(1, 10*time.Millisecond))
+	require.Equal(t, server.ErrTimeout, s.WaitForTopic("chat", 1, 10*time.Millisecond))
+
+	clients := make(chan TestClient, 2)
+	go func() {
+		for _, user := range []string{"foo", "bar"} {
+			c := NewLoopbackClient(user)
+			c.Subscribe("chat")
+			clients <- c
+		}
+	}()
+	require.Nil(t, s.WaitForConnections(2, 5*time.Second))
+	require.Nil(t, s.WaitForTopic("chat", 2, 5*time.Second))
+	s.AssertTopicSubscribers(t, "chat", 2)
+	(<-clients).Close()
+	(<-clients).Close()
+	s.AssertTopicSubscribers(t, "chat", 0)
+}
+
+func TestClient_should_encode_binary_payload(t *testing.T) {
+	p, err := client.BinaryPayload([]byte("hello"))
+	require.Nil(t, err)
+	require.Equal(t, string([]byte{0, 4})+"hello", p)
+	b, err := client.DecodeBinaryPayload(p)
+	require.Nil(t, err)
+	require.Equal(t, []byte("hello"), b)
+
+	_, err = client.BinaryPayload(nil)
+	require.ErrorIs(t, err, client.ErrInvalidPayload)
+	_, err = client.BinaryPayload(make([]byte, 1025))
+	require.ErrorIs(t, err, client.ErrRequestTooLarge)
+	_, err = client.DecodeBinaryPayload(string([]byte{0, 3}) + "hello")
+	require.ErrorIs(t, err, client.ErrInvalidPayload)
+
+	_, err = client.TextPayload("hello world")
+	require.Nil(t, err)
+	_, err = client.TextPayload("\x01hello")
+	require.ErrorIs(t, err, client.ErrInvalidPayload)
+	_, err = client.TextPayload("hello\nworld")
+	require.ErrorIs(t, err, client.ErrInvalidPayload)
+	_, err = client.TextPayload(strings.Repeat("a", 1025))
+	require.ErrorIs(t, err, client.ErrRequestTooLarge)
+}
+
+func TestClient_should_unicast_bytes(t *testing.T) {
+	defer NewServer().Start().Stop()
+	c := NewLoopbackClient("foo")
+	defer c.Close()
+
+	w := c.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("foo"),
+		Payload: []byte{0, '\n', 255},
+	})
+	expect(t, ssmp.CodeOk, u(c.UcastBytes("foo", []byte{0, '\n', 255})))
+	w.Wait()
+}
+
+func NewHandledClient(s *server.Server, user string) TestClient {
+	return newPipeClient(s.Handle, user)
+}
+
+func TestServer_should_handle_external_connection(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewHandledClient(s, "foo")
+	defer foo.Close()
+	bar := NewHandledClient(s, "bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+
+	w := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	w.Wait()
+	require.Nil(t, s.WaitForConnections(2, time.Second))
+}
+
+func TestServer_should_audit_frames(t *testing.T) {
+	var buf bytes.Buffer
+	defer NewServer(server.WithAuditLogger(server.FileAuditLogger(&buf, 3))).Start().Stop()
+	c := NewLoopbackClient("foo")
+	defer c.Close()
+
+	w := c.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("foo"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", "hello")))
+	w.Wait()
+
+	var frames []server.AuditFrame
+	var id string
+	d := json.NewDecoder(&buf)
+	for d.More() {
+		var f server.AuditFrame
+		require.Nil(t, d.Decode(&f))
+		require.Equal(t, "foo", f.User)
+		if id == "" {
+			id = f.ConnectionID
+		}
+		require.Equal(t, id, f.ConnectionID)
+		f.Timestamp, f.ConnectionID, f.RemoteAddr, f.User = time.Time{}, "", "", ""
+		frames = append(frames, f)
+	}
+	require.Equal(t, []server.AuditFrame{
+		// truncated "loopback" auth scheme
+		{Direction: server.AuditIn, Verb: ssmp.LOGIN, To: "foo", Payload: []byte("loo")},
+		{Direction: server.AuditOut, Verb: "200"},
+		{Direction: server.AuditIn, Verb: ssmp.UCAST, To: "foo", Payload: []byte("hel")},
+		{Direction: server.AuditOut, Verb: ssmp.UCAST, To: "foo", Payload: []byte("hel")},
+		{Direction: server.AuditOut, Verb: "200"},
+	}, frames)
+}
+
+func TestServer_should_audit_each_frame_of_a_write(t *testing.T) {
+	var buf bytes.Buffer
+	defer NewServer(server.WithAuditLogger(server.FileAuditLogger(&buf, 0))).Start().Stop()
+	c := NewLoopbackClient("foo")
+	defer c.Close()
+
+	payload := "\x00\x02a\nb"
+	w := c.expect(t, client.Event{
+		Name: []byte(ssmp.TRACED),
+		From: []byte("foo"),
+		To:   []byte("t1"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("foo"),
+		Payload: []byte("hello"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("foo"),
+		Payload: []byte("a\nb"),
+	})
+	expect(t, ssmp.CodeOk, u(c.UcastTraced("t1", "foo", "hello")))
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", payload)))
+	w.Wait()
+
+	var frames []server.AuditFrame
+	d := json.NewDecoder(&buf)
+	for d.More() {
+		var f server.AuditFrame
+		require.Nil(t, d.Decode(&f))
+		f.Timestamp, f.ConnectionID, f.RemoteAddr, f.User = time.Time{}, "", "", ""
+		frames = append(frames, f)
+	}
+	require.Equal(t, []server.AuditFrame{
+		{Direction: server.AuditIn, Verb: ssmp.LOGIN, To: "foo", Payload: []byte("loopback")},
+		{Direction: server.AuditOut, Verb: "200"},
+		{Direction: server.AuditIn, Verb: ssmp.UCAST, To: "foo", Payload: []byte("hello")},
+		{Direction: server.AuditOut, Verb: ssmp.TRACED, To: "t1"},
+		{Direction: server.AuditOut, Verb: ssmp.UCAST, To: "foo", Payload: []byte("hello")},
+		{Direction: server.AuditOut, Verb: "200"},
+		{Direction: server.AuditIn, Verb: ssmp.UCAST, To: "foo", Payload: []byte("a\nb")},
+		{Direction: server.AuditOut, Verb: ssmp.UCAST, To: "foo", Payload: []byte("a\nb")},
+		{Direction: server.AuditOut, Verb: "200"},
+	}, frames)
+}
+
+func TestClient_should_multicast_to_self_with_echo(t *testing.T) {
+	defer NewServer().Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithOptions("chat", ssmp.ECHO)))
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+
+	event := client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	}
+	wfoo := foo.expect(t, event)
+	wbar := bar.expect(t, event)
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	wfoo.Wait()
+	wbar.Wait()
+}
+
+func TestClient_should_list_users(t *testing.T) {
+	defer NewServer().Start().Stop()
+	for _, user := range []string{"foo1", "foo2", "foo3", "bar", "baz"} {
+		c := NewDiscardingLoggedInClient(user)
+		defer c.Close()
+	}
+	anon := NewLoopbackClient(ssmp.Anonymous)
+	defer anon.Close()
+
+	users, r, err := anon.ListUsers("")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	require.Equal(t, []string{"bar", "baz", "foo1", "foo2", "foo3"}, users)
+
+	users, _, err = anon.ListUsers("foo")
+	require.Nil(t, err)
+	require.Equal(t, []string{"foo1", "foo2", "foo3"}, users)
+
+	users, r, err = anon.ListUsers("qux")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	require.Empty(t, users)
+}
+
+func TestClient_should_list_users_paginated(t *testing.T) {
+	defer NewServer().Start().Stop()
+	var expected []string
+	for i := 0; i < 40; i++ {
+		user := fmt.Sprintf("user%02d-%s", i, strings.Repeat("x", 40))
+		c := NewDiscardingLoggedInClient(user)
+		defer c.Close()
+		expected = append(expected, user)
+	}
+	raw, r := NewRawConnection(t, "foo")
+	defer raw.Close()
+	_, err := raw.Write([]byte(ssmp.USERS + " user\n"))
+	require.Nil(t, err)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodePartial, code)
+
+	bar := NewDiscardingLoggedInClient("bar")
+	defer bar.Close()
+	users, resp, err := bar.ListUsers("user")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, resp.Code)
+	require.Equal(t, expected, users)
+}
+
+func TestReplica_should_replay_log_after_primary_failure(t *testing.T) {
+	primary := NewServer()
+	standby := NewServer().Start()
+	defer standby.Stop()
+	r := server.NewReplica(primary, standby, 16)
+	primary.EnableReplication(r)
+	primary.Start()
+
+	foo := NewLoggedInClientAt(primary, "foo")
+	defer foo.Close()
+	bar := NewLoggedInClientAt(primary, "bar")
+	defer bar.Close()
+	standbyBar := NewLoggedInClientAt(standby, "bar")
+	defer standbyBar.Close()
+	expect(t, ssmp.CodeOk, u(standbyBar.Subscribe("chat")))
+
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "world")))
+	primary.Stop()
+
+	w := standbyBar.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte("world"),
+	})
+	r.Start()
+	w.Wait()
+	r.Stop()
+	require.Equal(t, uint64(0), r.Dropped())
+}
+
+func TestServer_should_limit_topic_subscribers(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	s.SetDefaultMaxSubscribers(3)
+
+	for _, user := range []string{"foo", "bar", "baz"} {
+		c := NewLoopbackClient(user)
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+	}
+	qux := NewLoopbackClient("qux")
+	defer qux.Close()
+	expect(t, ssmp.CodeConflict, u(qux.Subscribe("chat")))
+
+	topics := s.ListTopics()
+	require.Len(t, topics, 1)
+	require.Equal(t, 3, topics[0].Subscribers)
+}
+
+func TestServer_should_invoke_middleware(t *testing.T) {
+	s := NewServer()
+	var l sync.Mutex
+	var verbs []string
+	s.Dispatcher().Use(func(c *server.Connection, verb []byte, to, payload, raw []byte, next server.HandlerFunc) {
+		l.Lock()
+		verbs = append(verbs, string(verb))
+		l.Unlock()
+		next(c, to, payload, raw, nil)
+	}, func(c *server.Connection, verb []byte, to, payload, raw []byte, next server.HandlerFunc) {
+		if string(to) == "forbidden" {
+			c.Write([]byte("403\n"))
+			return
+		}
+		next(c, to, payload, raw, nil)
+	})
+	defer s.Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("chat")))
+	expect(t, 403, u(foo.Subscribe("forbidden")))
+
+	l.Lock()
+	defer l.Unlock()
+	require.Equal(t, []string{ssmp.SUBSCRIBE, ssmp.MCAST, ssmp.UNSUBSCRIBE, ssmp.SUBSCRIBE}, verbs)
+}
+
+func TestServer_should_deliver_to_internal_subscription(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	received := make(chan string, 10)
+	sub, err := s.SubscribeInternal("chat", func(from string, payload []byte) {
+		received <- from + ":" + string(payload)
+	})
+	require.NoError(t, err)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	for i := 0; i < 5; i++ {
+		expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello"+strconv.Itoa(i))))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case m := <-received:
+			assert.Equal(t, "foo:hello"+strconv.Itoa(i), m)
+		case <-time.After(time.Second):
+			t.Fatal("internal subscriber not called")
+		}
+	}
+
+	sub.Close()
+	assert.Empty(t, s.ListTopics())
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "bye")))
+	assert.Empty(t, received)
+}
+
+func TestClient_should_subscribe_multiple_topics(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.SubscribeWithPresence("topic3")))
+	w := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.SUBSCRIBE),
+		From:    []byte("foo"),
+		To:      []byte("topic3"),
+		Payload: []byte{},
+	})
+
+	var topics []string
+	for i := 0; i < 10; i++ {
+		topics = append(topics, "topic"+strconv.Itoa(i))
+	}
+	expect(t, ssmp.CodeOk, u(foo.SubscribeMulti(topics)))
+	w.Wait()
+
+	l := s.ListTopics()
+	require.Len(t, l, 10)
+	for _, ti := range l {
+		if ti.Name == "topic3" {
+			assert.Equal(t, 2, ti.Subscribers)
+		} else {
+			assert.Equal(t, 1, ti.Subscribers, ti.Name)
+		}
+	}
+	for _, topic := range topics {
+		expect(t, ssmp.CodeOk, u(foo.Unsubscribe(topic)))
+	}
+}
+
+func TestClient_should_rollback_multiple_topics(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("b")))
+
+	expect(t, ssmp.CodeConflict, u(foo.SubscribeMulti([]string{"a", "b", "c"})))
+	l := s.ListTopics()
+	require.Len(t, l, 1)
+	assert.Equal(t, "b", l[0].Name)
+	expect(t, ssmp.CodeNotFound, u(foo.Unsubscribe("a")))
+}
+
+func TestServer_should_recover_from_handler_panic(t *testing.T) {
+	s := NewServer(server.WithRecovery(true))
+	require.Nil(t, s.Dispatcher().RegisterVerb("CRASH", 0,
+		func(_ *server.Connection, _, _, _ []byte, _ *server.Dispatcher) {
+			panic("boom")
+		}))
+	defer s.Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	c, r := NewRawConnection(t, "bar")
+	defer c.Close()
+	_, err := c.Write([]byte("CRASH\n"))
+	require.Nil(t, err)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, 501, code)
+	r.Reset()
+
+	_, err = c.Write([]byte("UCAST foo hello\n"))
+	require.Nil(t, err)
+	code, err = r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+}
+
+func TestServer_should_broadcast_to_all(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	ev := client.Event{
+		Name:    []byte(ssmp.BCAST),
+		From:    []byte(ssmp.Anonymous),
+		Payload: []byte("maintenance at noon"),
+	}
+	var wg []*sync.WaitGroup
+	for _, user := range []string{"foo", "bar", "baz"} {
+		c := NewLoopbackClient(user)
+		defer c.Close()
+		wg = append(wg, c.expect(t, ev))
+	}
+	require.Nil(t, s.WaitForConnections(3, time.Second))
+
+	require.Nil(t, s.BroadcastAll(ssmp.BCAST, ssmp.Anonymous, "maintenance at noon"))
+	for _, w := range wg {
+		w.Wait()
+	}
+	assert.Equal(t, server.ErrInvalidVerb, s.BroadcastAll("NOTICE", ssmp.Anonymous, "hi"))
+	assert.Equal(t, server.ErrInvalidVerb, s.BroadcastAll(ssmp.MCAST, ssmp.Anonymous, "hi"))
+	assert.Equal(t, ssmp.ErrInvalidMessage, s.BroadcastAll(ssmp.BCAST, "f!o", "hi"))
+}
+
+func TestServer_should_broadcast_to_topic(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	w := foo.expect(t, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("admin"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	})
+
+	require.Nil(t, s.BroadcastTopic("chat", "admin", "hello"))
+	w.Wait()
+	assert.Equal(t, server.ErrTopicNotFound, s.BroadcastTopic("nope", "admin", "hello"))
+}
+
+func TestServer_should_keep_connection_after_bad_request(t *testing.T) {
+	defer NewServer().Start().Stop()
+	c, r := NewRawConnection(t, "foo")
+	defer c.Close()
+
+	for _, req := range []string{
+		"UCAST f!o hello\n",
+		"ucast foo hello\n",
+		"UCAST foo \x00\x03hello\n",
+		"LOGIN foo none\n",
+	} {
+		_, err := c.Write([]byte(req))
+		require.Nil(t, err)
+		code, err := r.DecodeCode()
+		require.Nil(t, err)
+		require.NotEqual(t, ssmp.CodeOk, code, "%q", req)
+		require.Nil(t, r.SkipMessage())
+		r.Reset()
+	}
+
+	_, err := c.Write([]byte("UCAST foo hello\n"))
+	require.Nil(t, err)
+	_, err = r.DecodeCode()
+	require.Nil(t, err)
+	require.Nil(t, r.SkipMessage())
+	r.Reset()
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+}
+
+func TestClient_should_be_done_when_server_closes(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	select {
+	case <-foo.Done():
+		t.Fatal("done before close")
+	default:
+	}
+	s.GetConnection([]byte("foo")).Close()
+	select {
+	case <-foo.Done():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("not done after close")
+	}
+	foo.Wait()
+}
+
+func TestServer_should_rename_topic(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	unsub := client.Event{
+		Name: []byte(ssmp.UNSUBSCRIBE),
+		From: []byte(ssmp.Anonymous),
+		To:   []byte("chat"),
+	}
+	sub := client.Event{
+		Name:    []byte(ssmp.SUBSCRIBE),
+		From:    []byte(ssmp.Anonymous),
+		To:      []byte("ns:chat"),
+		Payload: []byte{},
+	}
+	mcast := client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("foo"),
+		To:      []byte("ns:chat"),
+		Payload: []byte("hello"),
+	}
+	presence := func(from string) client.Event {
+		return client.Event{
+			Name:    []byte(ssmp.SUBSCRIBE),
+			From:    []byte(from),
+			To:      []byte("chat"),
+			Payload: []byte(ssmp.PRESENCE),
+		}
+	}
+	var c []TestClient
+	for _, user := range []string{"foo", "bar", "baz"} {
+		cc := NewLoopbackClient(user)
+		defer cc.Close()
+		expect(t, ssmp.CodeOk, u(cc.SubscribeWithPresence("chat")))
+		c = append(c, cc)
+	}
+	// consume presence events of the subscriptions
+	var wg []*sync.WaitGroup
+	wg = append(wg, c[0].expect(t, presence("bar"), presence("baz")))
+	wg = append(wg, c[1].expect(t, presence("foo"), presence("baz")))
+	wg = append(wg, c[2].expect(t, presence("bar"), presence("foo")))
+	for _, w := range wg {
+		w.Wait()
+	}
+	wg = wg[:0]
+	for _, cc := range c {
+		wg = append(wg, cc.expect(t, unsub, sub))
+	}
+
+	assert.Equal(t, server.ErrTopicNotFound, s.RenameTopic("nope", "ns:chat"))
+	assert.Equal(t, server.ErrInvalidTopic, s.RenameTopic("chat", "n s"))
+	require.Nil(t, s.RenameTopic("chat", "ns:chat"))
+	for _, w := range wg {
+		w.Wait()
+	}
+	topics := s.ListTopics()
+	require.Len(t, topics, 1)
+	assert.Equal(t, "ns:chat", topics[0].Name)
+
+	wg = wg[:0]
+	for _, cc := range c[1:] {
+		wg = append(wg, cc.expect(t, mcast))
+	}
+	expect(t, ssmp.CodeOk, u(c[0].Mcast("ns:chat", "hello")))
+	for _, w := range wg {
+		w.Wait()
+	}
+	expect(t, ssmp.CodeOk, u(c[1].Unsubscribe("ns:chat")))
+}
+
+func TestServer_should_rename_persisted_subscriptions(t *testing.T) {
+	p := server.NewInMemoryPersister()
+	s := NewServer(server.WithPersister(p))
+	s.Start()
+	foo := NewDiscardingLoggedInClient("foo")
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithPresence("chat")))
+	require.Nil(t, s.RenameTopic("chat", "room"))
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("room")))
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithPresence("room")))
+	require.Nil(t, s.RenameTopic("room", "ns:room"))
+	foo.Close()
+	s.Stop()
+
+	l, err := p.LoadSubscriptions()
+	require.Nil(t, err)
+	require.Equal(t, []server.StoredSubscription{
+		{User: "foo", Topic: "ns:room", Presence: true},
+	}, l)
+}
+
+func TestClient_should_upgrade_anonymous_connection(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	c := NewLoopbackClient(ssmp.Anonymous)
+	defer c.Close()
+
+	expect(t, 405, u(c.Subscribe("chat")))
+	expect(t, ssmp.CodeUnauthorized, u(c.Relogin("reject", "none", "")))
+	expect(t, ssmp.CodeBadRequest, u(c.Relogin(ssmp.Anonymous, "none", "")))
+
+	w := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(c.Relogin("foo", "none", "")))
+	expect(t, ssmp.CodeOk, u(c.Ucast("bar", "hello")))
+	w.Wait()
+	expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+
+	var users []string
+	for _, ci := range s.ListConnections() {
+		users = append(users, ci.User)
+	}
+	assert.ElementsMatch(t, []string{"foo", "bar"}, users)
+	expect(t, 405, u(c.Relogin("baz", "none", "")))
+}
+
+func TestServer_should_read_user_while_upgrading_connection(t *testing.T) {
+	s := NewServer()
+	conns := make(chan *server.Connection, 1)
+	s.Dispatcher().Use(func(c *server.Connection, verb []byte, to, payload, raw []byte, next server.HandlerFunc) {
+		select {
+		case conns <- c:
+		default:
+		}
+		next(c, to, payload, raw, nil)
+	})
+	s.Start()
+	defer s.Stop()
+	c := NewLoopbackClient(ssmp.Anonymous)
+	defer c.Close()
+	expect(t, 405, u(c.Subscribe("chat")))
+	cc := <-conns
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			require.Contains(t, []string{ssmp.Anonymous, "foo"}, cc.User())
+		}
+	}()
+	expect(t, ssmp.CodeOk, u(c.Relogin("foo", "none", "")))
+	<-done
+	require.Equal(t, "foo", cc.User())
+}
+
+func TestServer_should_resume_session(t *testing.T) {
+	s := NewTestServer(t, server.WithSessions(time.Minute))
+	defer s.Close(t)
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+
+	foo := NewClientWithHandler(client.Discard)
+	r, err := foo.Login("foo", "none", "")
+	require.Nil(t, err)
+	token := client.ParseSession(r)
+	require.Len(t, token, 64)
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	foo.Close()
+	s.AssertUserNotConnected(t, "foo")
+	s.AssertTopicSubscribers(t, "chat", 2)
+
+	// buffered while disconnected
+	expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "hello")))
+
+	c := NewLoopbackClient(ssmp.Anonymous)
+	defer c.Close()
+	hello := client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("bar"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	}
+	w := c.expect(t, hello)
+	r, err = c.Resume(token)
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	next := client.ParseSession(r)
+	require.Len(t, next, 64)
+	require.NotEqual(t, token, next)
+	w.Wait()
+
+	// subscription carried over
+	w = c.expect(t, client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("bar"),
+		To:      []byte("chat"),
+		Payload: []byte("world"),
+	})
+	expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "world")))
+	w.Wait()
+	expect(t, ssmp.CodeConflict, u(c.Subscribe("chat")))
+
+	// tokens are single-use
+	d := NewLoopbackClient(ssmp.Anonymous)
+	defer d.Close()
+	expect(t, ssmp.CodeNotFound, u(d.Resume(token)))
+	expect(t, 405, u(c.Resume(next)))
+}
+
+func TestServer_should_not_log_session_tokens(t *testing.T) {
+	var audit, logs bytes.Buffer
+	ts := server.NewTraceStore(16)
+	s := NewServer(server.WithSessions(time.Minute), server.WithAuditLogger(server.FileAuditLogger(&audit, 0)), server.WithTraceStore(ts))
+	s.Dispatcher().Use(server.LoggingMiddleware(log.New(&logs, "", 0)))
+	s.Start()
+
+	foo := NewClientWithHandler(client.Discard)
+	r, err := foo.Login("foo", "none", "")
+	require.Nil(t, err)
+	token := client.ParseSession(r)
+	require.Len(t, token, 64)
+	foo.Close()
+
+	c, err := net.Dial("tcp", ENDPOINT)
+	require.Nil(t, err)
+	defer c.Close()
+	dec := ssmp.NewDecoder(c)
+	_, err = c.Write([]byte(ssmp.LOGIN + " . none\n" + ssmp.TRACE + " t-1 " + ssmp.RESUME + " " + token + "\n"))
+	require.Nil(t, err)
+	code, err := dec.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+	dec.Reset()
+	code, payload, err := dec.DecodeResponse()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+	next := client.ParseSession(client.Response{Code: code, Message: string(payload)})
+	require.Len(t, next, 64)
+	c.Close()
+	s.Stop()
+
+	require.Contains(t, audit.String(), ssmp.RESUME)
+	require.Contains(t, logs.String(), ssmp.RESUME)
+	l := ts.Lookup("t-1")
+	require.Len(t, l, 1)
+	require.Equal(t, ssmp.RESUME, l[0].Verb)
+	for _, secret := range []string{token, next} {
+		require.NotContains(t, audit.String(), secret)
+		require.NotContains(t, logs.String(), secret)
+		require.NotEqual(t, secret, l[0].To)
+	}
+}
+
+func TestServer_should_trace_ucast(t *testing.T) {
+	ts := server.NewTraceStore(16)
+	s := NewServer(server.WithTraceStore(ts)).Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	w := bar.expect(t, client.Event{
+		Name: []byte(ssmp.TRACED),
+		From: []byte("foo"),
+		To:   []byte("t-42"),
+	}, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.UcastTraced("t-42", "bar", "hello")))
+	w.Wait()
+	expect(t, ssmp.CodeNotFound, u(foo.UcastTraced("t-43", "baz", "hello")))
+
+	// untraced messages are delivered as usual
+	w = bar.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("world"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "world")))
+	w.Wait()
+
+	l := ts.Lookup("t-42")
+	require.Len(t, l, 1)
+	assert.Equal(t, "foo", l[0].From)
+	assert.Equal(t, ssmp.UCAST, l[0].Verb)
+	assert.Equal(t, "bar", l[0].To)
+	assert.False(t, l[0].Time.IsZero())
+	assert.Len(t, ts.Entries(), 2)
+}
+
+type recordingConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c recordingConn) Write(b []byte) (int, error) {
+	c.w.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestReplayClient_should_replay_recorded_session(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+	hello := client.Event{
+		Name:    []byte(ssmp.MCAST),
+		From:    []byte("foo"),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	}
+
+	var rec bytes.Buffer
+	p1, p2 := net.Pipe()
+	s.Handle(p1)
+	foo := client.NewClient(recordingConn{Conn: p2, w: &rec}, client.Discard)
+	w := bar.expect(t, hello)
+	expect(t, ssmp.CodeOk, u(foo.Login("foo", "none", "")))
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("chat")))
+	w.Wait()
+	foo.Close()
+
+	p1, p2 = net.Pipe()
+	s.Handle(p1)
+	rc := client.NewReplayClient(&rec, client.Discard)
+	rc.SetConn(p2)
+	rc.SetRateLimit(100)
+	w = bar.expect(t, hello)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, rc.Run(ctx))
+	w.Wait()
+	assert.Empty(t, rc.Errors())
+}
+
+func TestReplayClient_should_report_errors(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	p1, p2 := net.Pipe()
+	s.Handle(p1)
+	rc := client.NewReplayClient(strings.NewReader(
+		"LOGIN foo none\n\nUCAST nobody hello\nSUBSCRIBE chat\nfoo bar\nMCAST chat hello\n"),
+		client.Discard)
+	rc.SetConn(p2)
+	require.Nil(t, rc.Run(context.Background()))
+	assert.Equal(t, []client.ReplayError{
+		{Line: 3, Code: ssmp.CodeNotFound, Err: client.ErrUnexpectedResponse},
+		{Line: 5, Err: ssmp.ErrInvalidMessage},
+	}, rc.Errors())
+}
+
+// flakyConn fails the first writes with EAGAIN
+type flakyConn struct {
+	net.Conn
+	failures int32
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		return 0, &net.OpError{Op: "write", Net: "pipe", Err: os.NewSyscallError("write", syscall.EAGAIN)}
+	}
+	return c.Conn.Write(b)
+}
+
+func TestServer_should_retry_temporary_write_errors(t *testing.T) {
+	s := NewTestServer(t, server.WithWriteTimeout(100*time.Millisecond))
+	defer s.Close(t)
+	p1, p2 := net.Pipe()
+	s.Handle(&flakyConn{Conn: p1, failures: 2})
+	c := client.NewClient(p2, client.Discard)
+	defer c.Close()
+	expect(t, ssmp.CodeOk, u(c.Login("foo", "none", "")))
+	s.AssertUserConnected(t, "foo")
+	expect(t, ssmp.CodeOk, u(c.Ucast("foo", "hello")))
+	assert.Equal(t, uint64(2), s.GetConnection([]byte("foo")).WriteRetries())
+}
+
+func TestServer_should_give_up_on_write_errors(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	p1, p2 := net.Pipe()
+	s.Handle(&flakyConn{Conn: p1, failures: 4})
+	c := client.NewClient(p2, client.Discard)
+	defer c.Close()
+	_, err := c.Login("foo", "none", "")
+	assert.NotNil(t, err)
+}
+
+func TestServer_should_append_to_event_log(t *testing.T) {
+	l := server.NewMemoryEventLog(16)
+	defer NewServer(server.WithEventLog(l)).Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithPresence("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "hello")))
+	expect(t, ssmp.CodeOk, u(bar.Ucast("foo", "hi")))
+	expect(t, ssmp.CodeNotFound, u(bar.Ucast("baz", "hi")))
+	expect(t, ssmp.CodeOk, u(bar.Bcast("all")))
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("chat")))
+
+	out := make(chan server.LogEntry, 16)
+	require.Nil(t, l.Read(0, out))
+	close(out)
+	var entries []server.LogEntry
+	for e := range out {
+		assert.False(t, e.Timestamp.IsZero())
+		e.Timestamp = time.Time{}
+		entries = append(entries, e)
+	}
+	assert.Equal(t, []server.LogEntry{
+		{Seq: 1, Verb: ssmp.SUBSCRIBE, From: "foo", To: "chat", Payload: []byte("PRESENCE")},
+		{Seq: 2, Verb: ssmp.MCAST, From: "bar", To: "chat", Payload: []byte("hello")},
+		{Seq: 3, Verb: ssmp.UCAST, From: "bar", To: "foo", Payload: []byte("hi")},
+		{Seq: 4, Verb: ssmp.BCAST, From: "bar", Payload: []byte("all")},
+		{Seq: 5, Verb: ssmp.UNSUBSCRIBE, From: "foo", To: "chat"},
+	}, entries)
+}
+
+func TestFileEventLog_should_persist_entries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	l, err := server.NewFileEventLog(path)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, l.Append(server.LogEntry{
+			Timestamp: time.Now(),
+			Verb:      ssmp.MCAST,
+			From:      "foo",
+			To:        "chat",
+			Payload:   []byte(strconv.Itoa(i)),
+		}))
+	}
+	require.Nil(t, l.Close())
+
+	l, err = server.NewFileEventLog(path)
+	require.Nil(t, err)
+	defer l.Close()
+	out := make(chan server.LogEntry, 16)
+	require.Nil(t, l.Read(0, out))
+	require.Len(t, out, 10)
+	for i := 0; i < 10; i++ {
+		e := <-out
+		assert.Equal(t, uint64(i+1), e.Seq)
+		assert.Equal(t, strconv.Itoa(i), string(e.Payload))
+	}
+
+	// numbering resumes after reopening
+	require.Nil(t, l.Append(server.LogEntry{Verb: ssmp.BCAST, From: "foo"}))
+	require.Nil(t, l.Read(9, out))
+	require.Len(t, out, 2)
+	assert.Equal(t, uint64(10), (<-out).Seq)
+	assert.Equal(t, uint64(11), (<-out).Seq)
+}
+
+func TestFileEventLog_should_only_discard_torn_tail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	l, err := server.NewFileEventLog(path)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, l.Append(server.LogEntry{Verb: ssmp.BCAST, From: "foo", Payload: []byte(strconv.Itoa(i))}))
+	}
+	require.Nil(t, l.Close())
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+
+	// torn tail: a header and part of an entry
+	require.Nil(t, os.WriteFile(path, append(append([]byte(nil), b...), 0, 0, 0, 100, '{'), 0644))
+	l, err = server.NewFileEventLog(path)
+	require.Nil(t, err)
+	require.Nil(t, l.Close())
+	torn, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, b, torn)
+
+	// corrupt entry in the middle of the file
+	n := int(binary.BigEndian.Uint32(b))
+	corrupt := append([]byte(nil), b...)
+	corrupt[4+n+4] = 'x'
+	require.Nil(t, os.WriteFile(path, corrupt, 0644))
+	_, err = server.NewFileEventLog(path)
+	require.ErrorIs(t, err, server.ErrLogCorrupt)
+	after, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, corrupt, after)
+
+	// corrupt length
+	corrupt = append([]byte(nil), b...)
+	binary.BigEndian.PutUint32(corrupt, 0xffffffff)
+	require.Nil(t, os.WriteFile(path, corrupt, 0644))
+	_, err = server.NewFileEventLog(path)
+	require.ErrorIs(t, err, server.ErrLogCorrupt)
+}
+
+func TestDispatcher_should_benchmark_verb(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	r, err := s.Dispatcher().BenchmarkVerb(ssmp.PING, "foo", "", "", 10000)
+	require.Nil(t, err)
+	require.Equal(t, 10000, r.N)
+	// a single pause may push the mean above P99
+	require.True(t, r.Min <= r.Mean && r.Mean <= r.Max, "%+v", r)
+	require.True(t, r.Min <= r.P99 && r.P99 <= r.Max, "%+v", r)
+	if !raceEnabled && !testing.Short() {
+		require.True(t, r.Mean < time.Microsecond, "mean PING latency: %v", r.Mean)
+	}
+
+	_, err = s.Dispatcher().BenchmarkVerb("FOO", "foo", "", "", 1)
+	require.Equal(t, server.ErrUnknownVerb, err)
+}
+
+type capturingLogger struct {
+	l       sync.Mutex
+	entries []client.LogFields
+}
+
+func (l *capturingLogger) Log(fields client.LogFields) {
+	l.l.Lock()
+	l.entries = append(l.entries, fields)
+	l.l.Unlock()
+}
+
+func TestLoggingClient_should_log_requests_responses_and_events(t *testing.T) {
+	defer NewServer().Start().Stop()
+	l := &capturingLogger{}
+	raw := NewClient()
+	c := TestClient{Client: client.NewLoggingClient(raw.Client, l), h: raw.h}
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(c.Login("foo", "none", "secret")))
+	expect(t, ssmp.CodeOk, u(c.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(c.Mcast("chat", "hello")))
+	w := c.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("bar"),
+		To:      []byte("foo"),
+		Payload: []byte("hi"),
+	})
+	expect(t, ssmp.CodeOk, u(bar.Ucast("foo", "hi")))
+	w.Wait()
+	c.Close()
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	require.Len(t, l.entries, 8)
+	requests := []client.LogFields{
+		{"verb": ssmp.LOGIN, "to": "foo", "payload": "none"},
+		{"verb": ssmp.SUBSCRIBE, "to": "chat", "payload": ""},
+		{"verb": ssmp.MCAST, "to": "chat", "payload": "hello"},
+	}
+	for i, r := range requests {
+		require.Equal(t, r, l.entries[2*i])
+		require.Equal(t, r["verb"], l.entries[2*i+1]["verb"])
+		require.Equal(t, ssmp.CodeOk, l.entries[2*i+1]["code"])
+		require.NotContains(t, l.entries[2*i+1], "error")
+	}
+	require.Equal(t, client.LogFields{
+		"event":   ssmp.UCAST,
+		"from":    "bar",
+		"to":      "foo",
+		"payload": "hi",
+	}, l.entries[6])
+	require.Equal(t, ssmp.CLOSE, l.entries[7]["verb"])
+}
+
+func TestServer_should_limit_subscriptions(t *testing.T) {
+	s := NewTestServer(t, server.WithMaxSubscriptions(3))
+	defer s.Close(t)
+	c := NewLoopbackClient("foo")
+	defer c.Close()
+
+	for _, topic := range []string{"a", "b", "c"} {
+		expect(t, ssmp.CodeOk, u(c.Subscribe(topic)))
+	}
+	r, err := c.Subscribe("d")
+	require.Nil(t, err)
+	assert.Equal(t, ssmp.CodeTooManyRequests, r.Code)
+	assert.True(t, r.IsRateLimited())
+	assert.False(t, r.IsNotAllowed())
+	for _, topic := range []string{"a", "b", "c"} {
+		s.AssertTopicSubscribers(t, topic, 1)
+	}
+	s.AssertTopicSubscribers(t, "d", 0)
+
+	expect(t, ssmp.CodeOk, u(c.Unsubscribe("a")))
+	expect(t, ssmp.CodeTooManyRequests, u(c.SubscribeMulti([]string{"d", "e"})))
+	s.AssertTopicSubscribers(t, "d", 0)
+	expect(t, ssmp.CodeOk, u(c.Subscribe("d")))
+
+	anon := NewLoopbackClient(ssmp.Anonymous)
+	defer anon.Close()
+	r, err = anon.Subscribe("a")
+	require.Nil(t, err)
+	assert.True(t, r.IsNotAllowed())
+	assert.False(t, r.IsRateLimited())
+}
+
+func TestClient_should_not_deliver_expired_ucast(t *testing.T) {
+	defer NewServer().Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeRequestTimeout, u(foo.UcastWithTTL("bar", "stale", -time.Second)))
+	w := bar.expect(t, client.Event{
+		Name:    []byte(ssmp.UCAST),
+		From:    []byte("foo"),
+		To:      []byte("bar"),
+		Payload: []byte("fresh"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.UcastWithTTL("bar", "fresh", time.Minute)))
+	w.Wait()
+}
+
+func TestServer_should_not_deliver_expired_mcast(t *testing.T) {
+	defer NewServer().Start().Stop()
+	c, r := NewRawConnection(t, "bar")
+	defer c.Close()
+
+	_, err := c.Write([]byte("SUBSCRIBE chat\n"))
+	require.Nil(t, err)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+	r.Reset()
+
+	_, err = c.Write([]byte("EXPIRES 0 MCAST chat stale\n"))
+	require.Nil(t, err)
+	code, err = r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeRequestTimeout, code)
+	r.Reset()
+
+	// the connection is still usable and nothing was delivered
+	_, err = c.Write([]byte("PING\n"))
+	require.Nil(t, err)
+	code, err = r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeEvent, code)
+	_, verb, err := r.DecodeEvent()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.PONG, string(verb))
+}
+
+func TestClient_should_login_with_convenience_methods(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	login := func(f func(c client.Client) (client.Response, error)) string {
+		var rec bytes.Buffer
+		p1, p2 := net.Pipe()
+		s.Handle(p1)
+		c := client.NewClient(recordingConn{Conn: p2, w: &rec}, client.Discard, client.WithHello(false))
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(f(c)))
+		return rec.String()
+	}
+
+	anonymous := login(client.Client.LoginAnonymous)
+	require.Equal(t, "LOGIN . none\n", anonymous)
+	require.Equal(t, anonymous, login(func(c client.Client) (client.Response, error) {
+		return c.Login(".", "none", "")
+	}))
+	require.Equal(t, "LOGIN foo cert\n", login(func(c client.Client) (client.Response, error) {
+		return c.LoginWithCert("foo")
+	}))
+}
+
+func TestAuth_should_list_schemes_when_unauthorized(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	reject := func(_ net.Conn, _, _, _ []byte) bool { return false }
+	auth := &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"secret": reject,
+			"cert":   reject,
+			"hmac":   reject,
+			"none":   func(_ net.Conn, user, _, _ []byte) bool { return ssmp.Equal(user, ".") },
+		},
+		Challenges: map[string]func() []byte{
+			"hmac": func() []byte { return []byte("nonce") },
+		},
+	}
+	s := server.NewServer(l, auth, nil)
+	defer s.Start().Stop()
+	endpoint := l.Addr().String()
+
+	c := NewClientAt(endpoint, client.Discard)
+	defer c.Close()
+	r, err := c.Login("foo", "secret", "wrong")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeUnauthorized, r.Code)
+	require.Equal(t, "cert hmac none secret", r.Message)
+
+	c = NewClientAt(endpoint, client.Discard)
+	defer c.Close()
+	r, err = c.Login("foo", "hmac", "wrong")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeUnauthorized, r.Code)
+	require.Equal(t, "hmac nonce", r.Message)
+
+	c = NewClientAt(endpoint, client.Discard)
+	defer c.Close()
+	expect(t, ssmp.CodeOk, u(c.LoginAnonymous()))
+	r, err = c.Relogin("foo", "hmac", "wrong")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeUnauthorized, r.Code)
+	require.Equal(t, "hmac nonce", r.Message)
+	r, err = c.Relogin("foo", "cert", "")
+	require.Nil(t, err)
+	require.Equal(t, "cert hmac none secret", r.Message)
+}
+
+func TestServer_should_gc_empty_topics(t *testing.T) {
+	s := NewTestServer(t, server.WithGCInterval(0))
+	defer s.Close(t)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	for i := 0; i < 100; i++ {
+		topic := "topic" + strconv.Itoa(i)
+		s.GetOrCreateTopic([]byte(topic))
+		if i%2 == 0 {
+			expect(t, ssmp.CodeOk, u(foo.Subscribe(topic)))
+		}
+	}
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("topic0")))
+	require.Len(t, s.ListTopics(), 100)
+
+	for i := 0; i < 100; i += 2 {
+		expect(t, ssmp.CodeOk, u(foo.Unsubscribe("topic"+strconv.Itoa(i))))
+	}
+	assert.Equal(t, 50, s.GCEmptyTopics())
+	l := s.ListTopics()
+	require.Len(t, l, 1)
+	assert.Equal(t, "topic0", l[0].Name)
+
+	expect(t, ssmp.CodeOk, u(bar.Unsubscribe("topic0")))
+	assert.Equal(t, 0, s.GCEmptyTopics())
+	assert.Empty(t, s.ListTopics())
+}
+
+func TestServer_should_not_subscribe_to_collected_topics(t *testing.T) {
+	s := NewTestServer(t, server.WithGCInterval(0))
+	defer s.Close(t)
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	topic := s.GetOrCreateTopic([]byte("chat"))
+	require.Equal(t, 1, s.GCEmptyTopics())
+	assert.Equal(t, server.ErrTopicRemoved, topic.Subscribe(s.GetConnection([]byte("foo")), 0))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.GCEmptyTopics()
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		name := "topic" + strconv.Itoa(i)
+		expect(t, ssmp.CodeOk, u(foo.Subscribe(name)))
+		topic := s.GetTopic([]byte(name))
+		require.NotNil(t, topic)
+		require.Equal(t, 1, topic.SubscriberCount())
+	}
+	close(stop)
+	<-done
+}
+
+func TestServer_should_periodically_gc_empty_topics(t *testing.T) {
+	s := NewTestServer(t, server.WithGCInterval(10*time.Millisecond))
+	defer s.Close(t)
+
+	for i := 0; i < 100; i++ {
+		s.GetOrCreateTopic([]byte("topic" + strconv.Itoa(i)))
+	}
+	require.Eventually(t, func() bool {
+		return len(s.ListTopics()) == 0
+	}, s.Timeout, 10*time.Millisecond)
+}
+
+func TestServer_should_ucast_through_webhook_fallback(t *testing.T) {
+	bodies := make(chan map[string]string, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body map[string]string
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		bodies <- body
+		if body["to"] == "nobody" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hook.Close()
+
+	// keep-alive connections to the webhook outlive the test server
+	defer NewServer(server.WithUcastFallback(server.WebhookFallback(hook.URL, hook.Client()))).Start().Stop()
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "hello world")))
+	assert.Equal(t, map[string]string{
+		"from":    "foo",
+		"to":      "bar",
+		"payload": "hello world",
+	}, <-bodies)
+
+	expect(t, ssmp.CodeNotFound, u(foo.Ucast("nobody", "hello")))
+	<-bodies
+
+	// connected users are not affected
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	w := bar.expect(t, client.Event{From: []byte("foo"), Name: []byte(ssmp.UCAST), To: []byte("bar"), Payload: []byte("hi")})
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "hi")))
+	w.Wait()
+	assert.Empty(t, bodies)
+}
+
+func TestServer_should_bound_webhook_fallback(t *testing.T) {
+	unblock := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer hook.Close()
+	defer close(unblock)
+
+	defer NewServer(server.WithUcastFallback(server.WebhookFallback(hook.URL, nil,
+		server.WebhookFallbackTimeout(50*time.Millisecond)))).Start().Stop()
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	start := time.Now()
+	expect(t, ssmp.CodeNotFound, u(foo.Ucast("bar", "hello")))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// slowHandler takes a while to process each MCAST event, and signals the
+// reception of a CLOSE event.
+type slowHandler struct {
+	delay  time.Duration
+	closed chan struct{}
+}
+
+func (h *slowHandler) HandleEvent(ev client.Event) {
+	if string(ev.Name) == ssmp.CLOSE {
+		close(h.closed)
+	} else {
+		time.Sleep(h.delay)
+	}
+}
+
+func drainAfterSlowMcast(t *testing.T, s *ssmptest.TestServer, delay time.Duration) (TestClient, *slowHandler, chan error) {
+	foo := NewLoopbackClient("foo")
+	h := &slowHandler{delay: delay, closed: make(chan struct{})}
+	foo.SetEventHandler(h)
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	for i := 0; i < 20; i++ {
+		expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "hello")))
+	}
+
+	c := s.GetConnection([]byte("foo"))
+	require.NotNil(t, c)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Drain(500 * time.Millisecond)
+	}()
+	require.Eventually(t, c.IsDraining, s.Timeout, time.Millisecond)
+	assert.Equal(t, server.ErrConnectionDraining, c.Write([]byte("000 . PING\n")))
+	expect(t, ssmp.CodeOk, u(bar.Mcast("chat", "dropped")))
+	return foo, h, done
+}
+
+func TestServer_should_drain_connection(t *testing.T) {
+	s := NewTestServer(t, server.WithWriteQueue(32))
+	defer s.Close(t)
+
+	foo, h, done := drainAfterSlowMcast(t, s, 5*time.Millisecond)
+	select {
+	case <-h.closed:
+	case <-time.After(s.Timeout):
+		t.Fatal("CLOSE event not received")
+	}
+	foo.Close()
+	assert.Nil(t, <-done)
+	s.AssertUserNotConnected(t, "foo")
+}
+
+func TestServer_should_force_close_connection_after_drain_timeout(t *testing.T) {
+	s := NewTestServer(t, server.WithWriteQueue(32))
+	defer s.Close(t)
+
+	foo, h, done := drainAfterSlowMcast(t, s, 50*time.Millisecond)
+	defer foo.Close()
+	assert.Equal(t, context.DeadlineExceeded, <-done)
+	s.AssertUserNotConnected(t, "foo")
+	select {
+	case <-h.closed:
+		t.Fatal("CLOSE event should not be received")
+	default:
+	}
+}
+
+func TestServer_should_filter_mcast(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	s.GetOrCreateTopic([]byte("chat")).SetFilter(func(from string, payload []byte) ([]byte, bool) {
+		if string(payload) == "spam" {
+			return nil, true
+		}
+		return bytes.ToUpper(payload), false
+	})
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+
+	w := bar.expect(t, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.MCAST),
+		To:      []byte("chat"),
+		Payload: []byte("HELLO WORLD"),
+	}, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.MCAST),
+		To:      []byte("chat"),
+		Payload: []byte("BYE"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello world")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "spam")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "BYE")))
+	w.Wait()
+}
+
+func newSecretTestServer(t *testing.T, opts ...server.ServerOption) *ssmptest.TestServer {
+	return ssmptest.NewServer(t, &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"secret": server.SecretAuth([]byte("s3cr3t")),
+		},
+	}, opts...)
+}
+
+// fakeClock is a clock for server.WithClock that only moves when advanced.
+type fakeClock struct {
+	l   sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.l.Lock()
+	c.now = c.now.Add(d)
+	c.l.Unlock()
+}
+
+// expectClosed waits for the CLOSE event received by a client with a
+// slowHandler.
+func expectClosed(t *testing.T, closed chan struct{}) {
+	t.Helper()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CLOSE event not received")
+	}
+}
+
+func TestServer_should_close_connection_with_expired_credentials(t *testing.T) {
+	clock := newFakeClock()
+	s := newSecretTestServer(t, server.WithCredentialExpiry(time.Minute), server.WithClock(clock.Now))
+	defer s.Close(t)
+
+	foo := s.ConnectClient(t, "foo")
+	defer foo.Close()
+	closed := make(chan struct{})
+	foo.SetEventHandler(&slowHandler{closed: closed})
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+
+	// expired credentials are checked before serving the next request
+	clock.Advance(time.Minute)
+	foo.Subscribe("other")
+	expectClosed(t, closed)
+	s.AssertUserNotConnected(t, "foo")
+	s.AssertTopicSubscribers(t, "other", 0)
+}
+
+func TestServer_should_extend_session_on_reauth(t *testing.T) {
+	clock := newFakeClock()
+	s := newSecretTestServer(t, server.WithCredentialExpiry(time.Minute), server.WithClock(clock.Now))
+	defer s.Close(t)
+
+	foo := s.ConnectClient(t, "foo")
+	defer foo.Close()
+	closed := make(chan struct{})
+	foo.SetEventHandler(&slowHandler{closed: closed})
+	for i := 0; i < 6; i++ {
+		clock.Advance(40 * time.Second)
+		expect(t, ssmp.CodeOk, u(foo.Reauth("secret", "s3cr3t")))
+	}
+	s.AssertUserConnected(t, "foo")
+
+	// no more REAUTH
+	clock.Advance(time.Minute)
+	foo.Subscribe("chat")
+	expectClosed(t, closed)
+	s.AssertUserNotConnected(t, "foo")
+}
+
+func TestServer_should_not_renew_credentials_on_resume(t *testing.T) {
+	clock := newFakeClock()
+	s := newSecretTestServer(t, server.WithCredentialExpiry(time.Minute), server.WithClock(clock.Now), server.WithSessions(time.Hour))
+	defer s.Close(t)
+
+	foo, err := client.Dial("tcp", s.Endpoint, client.Discard)
+	require.Nil(t, err)
+	r, err := foo.Login("foo", "secret", "s3cr3t")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	token := client.ParseSession(r)
+	require.Len(t, token, 64)
+	clock.Advance(40 * time.Second)
+	foo.Close()
+	s.AssertUserNotConnected(t, "foo")
+
+	c := s.ConnectClient(t, ssmp.Anonymous)
+	defer c.Close()
+	closed := make(chan struct{})
+	c.SetEventHandler(&slowHandler{closed: closed})
+	r, err = c.Resume(token)
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	next := client.ParseSession(r)
+	s.AssertUserConnected(t, "foo")
+
+	// the credentials still expire a minute after LOGIN
+	clock.Advance(20 * time.Second)
+	c.Subscribe("chat")
+	expectClosed(t, closed)
+	s.AssertUserNotConnected(t, "foo")
+
+	// and the session is gone
+	d := s.ConnectClient(t, ssmp.Anonymous)
+	defer d.Close()
+	expect(t, ssmp.CodeNotFound, u(d.Resume(next)))
+}
+
+func TestServer_should_close_connection_on_rejected_reauth(t *testing.T) {
+	s := newSecretTestServer(t)
+	defer s.Close(t)
+
+	foo := s.ConnectClient(t, "foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeBadRequest, u(foo.Reauth("", "")))
+	expect(t, ssmp.CodeOk, u(foo.Reauth("secret", "s3cr3t")))
+	expect(t, ssmp.CodeUnauthorized, u(foo.Reauth("secret", "wrong")))
+	s.AssertUserNotConnected(t, "foo")
+
+	anon := s.ConnectClient(t, ssmp.Anonymous)
+	defer anon.Close()
+	expect(t, 405, u(anon.Reauth("secret", "s3cr3t")))
+}
+
+func TestServer_should_send_count_events(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	count := func(n string) client.Event {
+		return client.Event{
+			From:    []byte("chat"),
+			Name:    []byte(ssmp.COUNT),
+			Payload: []byte(n),
+		}
+	}
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	w := foo.expect(t, count("1"), count("2"), count("3"), count("2"))
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithCount("chat")))
+
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("chat")))
+	baz := NewLoopbackClient("baz")
+	defer baz.Close()
+	expect(t, ssmp.CodeOk, u(baz.Subscribe("chat")))
+	expect(t, ssmp.CodeOk, u(bar.Unsubscribe("chat")))
+	w.Wait()
+
+	// non-listeners receive nothing
+	w = baz.expect(t, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.MCAST),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	w.Wait()
+}
+
+func TestClient_should_ucast_reliably(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	acked := make(chan bool, 1)
+	go func() {
+		ok, err := foo.UcastReliable("bar", "m1", "hello", s.Timeout)
+		assert.Nil(t, err)
+		acked <- ok
+	}()
+	bar.expect(t, client.Event{
+		From: []byte("foo"),
+		Name: []byte(ssmp.TRACED),
+		To:   []byte("m1"),
+	}, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.UCAST),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}).Wait()
+	expect(t, ssmp.CodeOk, u(bar.Ack("m1", "foo")))
+	assert.True(t, <-acked)
+
+	// only the first ACK is forwarded
+	expect(t, ssmp.CodeNotFound, u(bar.Ack("m1", "foo")))
+
+	ok, err := foo.UcastReliable("bar", "m2", "hello", 50*time.Millisecond)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	bar.expect(t, client.Event{
+		From: []byte("foo"),
+		Name: []byte(ssmp.TRACED),
+		To:   []byte("m2"),
+	}, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.UCAST),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}).Wait()
+
+	// late ACKs reach the event handler
+	w := foo.expect(t, client.Event{
+		From:    []byte("bar"),
+		Name:    []byte(ssmp.ACK),
+		To:      []byte("m2"),
+		Payload: []byte{},
+	})
+	expect(t, ssmp.CodeOk, u(bar.Ack("m2", "")))
+	w.Wait()
+
+	ok, err = foo.UcastReliable("baz", "m3", "hello", s.Timeout)
+	require.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestServer_should_only_ack_reliable_messages(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	baz := NewLoopbackClient("baz")
+	defer baz.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	// traced messages don't expect an ACK
+	w := bar.expect(t, client.Event{
+		From: []byte("foo"),
+		Name: []byte(ssmp.TRACED),
+		To:   []byte("m1"),
+	}, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.UCAST),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.UcastTraced("m1", "bar", "hello")))
+	w.Wait()
+	expect(t, ssmp.CodeNotFound, u(bar.Ack("m1", "")))
+
+	// another sender reusing a message ID doesn't get its ACK
+	acked := make(chan bool, 1)
+	go func() {
+		ok, err := foo.UcastReliable("bar", "m2", "hello", s.Timeout)
+		assert.Nil(t, err)
+		acked <- ok
+	}()
+	bar.expect(t, client.Event{
+		From: []byte("foo"),
+		Name: []byte(ssmp.TRACED),
+		To:   []byte("m2"),
+	}, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.UCAST),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}).Wait()
+	ok, err := baz.UcastReliable("bar", "m2", "hello", 50*time.Millisecond)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	bar.expect(t, client.Event{
+		From: []byte("baz"),
+		Name: []byte(ssmp.TRACED),
+		To:   []byte("m2"),
+	}, client.Event{
+		From:    []byte("baz"),
+		Name:    []byte(ssmp.UCAST),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}).Wait()
+
+	w = baz.expect(t, client.Event{
+		From:    []byte("bar"),
+		Name:    []byte(ssmp.ACK),
+		To:      []byte("m2"),
+		Payload: []byte{},
+	})
+	expect(t, ssmp.CodeOk, u(bar.Ack("m2", "baz")))
+	w.Wait()
+	expect(t, ssmp.CodeOk, u(bar.Ack("m2", "")))
+	assert.True(t, <-acked)
+	expect(t, ssmp.CodeNotFound, u(bar.Ack("m2", "")))
+}
+
+func TestServer_should_reject_oversized_login(t *testing.T) {
+	var calls atomic.Int32
+	s := ssmptest.NewServer(t, &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"secret": func(_ net.Conn, _, _, _ []byte) bool {
+				calls.Add(1)
+				return false
+			},
+		},
+	}, server.WithMaxCredentialLength(100))
+	defer s.Close(t)
+
+	login := func(cred string) int {
+		c, err := net.Dial("tcp", s.Endpoint)
+		require.Nil(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte(ssmp.LOGIN + " foo secret " + cred + "\n"))
+		require.Nil(t, err)
+		code, err := ssmp.NewDecoder(c).DecodeCode()
+		require.Nil(t, err)
+		require.True(t, closedWithin(c, s.Timeout))
+		return code
+	}
+
+	require.Equal(t, ssmp.CodeBadRequest, login(strings.Repeat("x", 1500)))
+	require.Equal(t, ssmp.CodeBadRequest, login(strings.Repeat("x", 101)))
+	require.Equal(t, ssmp.CodeBadRequest, login("x "+strings.Repeat("y", 100)))
+	require.Equal(t, int32(0), calls.Load())
+
+	require.Equal(t, ssmp.CodeUnauthorized, login(strings.Repeat("x", 100)))
+	require.Equal(t, int32(1), calls.Load())
+
+	anon := s.ConnectClient(t, ssmp.Anonymous)
+	defer anon.Close()
+	expect(t, ssmp.CodeBadRequest, u(anon.Relogin("foo", "secret", strings.Repeat("x", 101))))
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestServer_should_expire_subscription_lease(t *testing.T) {
+	clock := newFakeClock()
+	s := NewTestServer(t, server.WithLeaseScanInterval(10*time.Millisecond), server.WithClock(clock.Now))
+	defer s.Close(t)
+
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.SubscribeWithPresence("chat")))
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	w := bar.expect(t, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.SUBSCRIBE),
+		To:      []byte("chat"),
+		Payload: []byte(ssmp.LEASE + " 1"),
+	}, client.Event{
+		From: []byte("foo"),
+		Name: []byte(ssmp.UNSUBSCRIBE),
+		To:   []byte("chat"),
+	})
+	wf := foo.expect(t, client.Event{
+		From: []byte(ssmp.Anonymous),
+		Name: []byte(ssmp.UNSUBSCRIBE),
+		To:   []byte("chat"),
+	})
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithLease("chat", time.Second)))
+	s.AssertTopicSubscribers(t, "chat", 2)
+
+	clock.Advance(2 * time.Second)
+	w.Wait()
+	wf.Wait()
+	s.AssertTopicSubscribers(t, "chat", 1)
+
+	// the connection may subscribe again
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+}
+
+func TestServer_should_renew_subscription_lease(t *testing.T) {
+	clock := newFakeClock()
+	s := NewTestServer(t, server.WithLeaseScanInterval(0), server.WithClock(clock.Now))
+	defer s.Close(t)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.SubscribeWithLease("chat", time.Second)))
+	for i := 0; i < 4; i++ {
+		clock.Advance(500 * time.Millisecond)
+		require.Equal(t, 0, s.Dispatcher().ReapLeases())
+		expect(t, ssmp.CodeOk, u(foo.SubscribeWithLease("chat", time.Second)))
+	}
+	s.AssertTopicSubscribers(t, "chat", 1)
+	clock.Advance(2 * time.Second)
+	require.Equal(t, 1, s.Dispatcher().ReapLeases())
+	s.AssertTopicSubscribers(t, "chat", 0)
+
+	// subscriptions without lease cannot be renewed
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("other")))
+	expect(t, ssmp.CodeConflict, u(foo.SubscribeWithLease("other", time.Second)))
+	expect(t, ssmp.CodeBadRequest, u(foo.SubscribeWithOptions("other", ssmp.LEASE)))
+	expect(t, ssmp.CodeBadRequest, u(foo.SubscribeWithOptions("other", ssmp.LEASE, "0")))
+}
+
+func TestServer_should_deliver_ucast_to_virtual_user(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	frames := make(chan string, 10)
+	_, err := s.RegisterVirtual("bot", func(b []byte) error {
+		frames <- string(b)
+		return nil
+	})
+	require.Nil(t, err)
+	s.AssertUserConnected(t, "bot")
+	_, err = s.RegisterVirtual("bot", func(b []byte) error { return nil })
+	require.Equal(t, server.ErrAlreadyConnected, err)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bot", "hello")))
+	select {
+	case f := <-frames:
+		require.Equal(t, "000 foo UCAST bot hello\n", f)
+	case <-time.After(s.Timeout):
+		t.Fatal("frame not written")
+	}
+
+	require.Nil(t, s.DeregisterVirtual("bot"))
+	s.AssertUserNotConnected(t, "bot")
+	expect(t, ssmp.CodeNotFound, u(foo.Ucast("bot", "hello")))
+	require.Equal(t, server.ErrUserNotFound, s.DeregisterVirtual("bot"))
+	require.Equal(t, server.ErrUserNotFound, s.DeregisterVirtual("foo"))
+}
+
+func TestServer_should_record_payload_sizes(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	c := NewDiscardingLoggedInClient("foo")
+	defer c.Close()
+
+	for _, n := range []int{10, 16, 17, 100, 1000} {
+		expect(t, ssmp.CodeOk, u(c.Ucast("foo", strings.Repeat("x", n))))
+	}
+	raw, r := NewRawConnection(t, "bar")
+	defer raw.Close()
+	_, err := raw.Write([]byte("UCAST foo\n"))
+	require.Nil(t, err)
+	code, err := r.DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeBadRequest, code)
+
+	st := s.Dispatcher().Stats()
+	require.Equal(t, server.PayloadHistogram{
+		Buckets: [len(server.PayloadBuckets)]uint64{2, 3, 4, 4, 4, 5},
+		Count:   5,
+		Sum:     1143,
+	}, st.PayloadSizes[ssmp.UCAST])
+	require.Equal(t, uint64(1), st.Errors[ssmp.UCAST])
+
+	var b bytes.Buffer
+	require.Nil(t, s.Dispatcher().WriteMetrics(&b))
+	require.Contains(t, b.String(), "ssmp_payload_bytes_histogram_bucket{verb=\"UCAST\",le=\"128\"} 4\n")
+	require.Contains(t, b.String(), "ssmp_payload_bytes_histogram_bucket{verb=\"UCAST\",le=\"+Inf\"} 5\n")
+	require.Contains(t, b.String(), "ssmp_payload_bytes_histogram_sum{verb=\"UCAST\"} 1143\n")
+	require.Contains(t, b.String(), "ssmp_message_parse_errors_total{verb=\"UCAST\"} 1\n")
+	require.NotContains(t, b.String(), "ssmp_payload_bytes_histogram_count{verb=\"MCAST\"}")
+
+	s.Dispatcher().ResetStats()
+	require.Empty(t, s.Dispatcher().Stats().PayloadSizes)
+}
+
+func TestClient_should_round_trip_json_payload(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	type request struct {
+		Method string
+		Args   []int
+		Note   string
+	}
+	sent := request{Method: "sum", Args: []int{1, 2, 3}, Note: "multi\nline"}
+	p, err := client.JSONPayload(sent)
+	require.Nil(t, err)
+
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", p)))
+
+	select {
+	case ev := <-bar.h.(*EventQueue).q:
+		var received request
+		require.Nil(t, ev.DecodeJSON(&received))
+		require.Equal(t, sent, received)
+	case <-time.After(s.Timeout):
+		t.Fatal("event not received")
+	}
+
+	var v map[string]int
+	require.Nil(t, client.Response{Code: ssmp.CodeOk, Message: `{"n":42}`}.DecodeJSON(&v))
+	require.Equal(t, map[string]int{"n": 42}, v)
+	v = nil
+	require.Nil(t, client.Response{Message: `{"n":7}`}.UnmarshalInto(&v, json.Unmarshal))
+	require.Equal(t, map[string]int{"n": 7}, v)
+
+	_, err = client.JSONPayload(strings.Repeat("x", ssmp.MaxPayloadLength))
+	require.ErrorIs(t, err, client.ErrRequestTooLarge)
+	_, err = client.JSONPayload(func() {})
+	require.NotNil(t, err)
+}
+
+func TestServer_should_upgrade_http_connection(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	h := httptest.NewServer(server.NewUpgrader(s, []string{"https://example.com"}))
+	defer h.Close()
+
+	dial := func(headers string) (net.Conn, *http.Response) {
+		c, err := net.Dial("tcp", h.Listener.Addr().String())
+		require.Nil(t, err)
+		_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: lipwig\r\n" + headers + "\r\n"))
+		require.Nil(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return c, resp
+	}
+
+	c, resp := dial("Connection: keep-alive, Upgrade\r\nUpgrade: ssmp\r\nOrigin: https://example.com\r\n")
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, "ssmp", resp.Header.Get("Upgrade"))
+	foo := client.NewClient(c, &EventQueue{q: make(chan client.Event, 10)})
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Login("foo", "none", "")))
+	expect(t, ssmp.CodeOk, u(foo.Ucast("foo", "hello")))
+
+	// LOGIN sent without waiting for the upgrade
+	c, err := net.Dial("tcp", h.Listener.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: lipwig\r\nConnection: Upgrade\r\nUpgrade: ssmp\r\n\r\n" +
+		ssmp.LOGIN + " bar none\n"))
+	require.Nil(t, err)
+	br := bufio.NewReader(c)
+	resp, err = http.ReadResponse(br, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	code, err := ssmp.NewDecoder(br).DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+
+	c, resp = dial("Upgrade: ssmp\r\n")
+	c.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	c, resp = dial("Connection: Upgrade\r\nUpgrade: websocket\r\n")
+	c.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	c, resp = dial("Connection: Upgrade\r\nUpgrade: ssmp\r\nOrigin: https://evil.com\r\n")
+	c.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestServer_should_authenticate_cert_of_pipelined_upgrade(t *testing.T) {
+	testCertOfPipelinedUpgrade(t)
+}
+
+func TestServer_should_authenticate_cert_of_pipelined_upgrade_with_byte_metrics(t *testing.T) {
+	testCertOfPipelinedUpgrade(t, server.WithByteMetrics(true))
+}
+
+func testCertOfPipelinedUpgrade(t *testing.T, opts ...server.ServerOption) {
+	serverPair, serverCert := NewSelfSignedKeyPair(t, "server")
+	clientPair, clientCert := NewSelfSignedKeyPair(t, "foo")
+	serverRoots := x509.NewCertPool()
+	serverRoots.AddCert(serverCert)
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(clientCert)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := server.NewServer(l, &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"cert": server.CertAuth,
+		},
+	}, nil, opts...)
+	defer s.Start().Stop()
+	h := httptest.NewUnstartedServer(server.NewUpgrader(s, nil))
+	h.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientRoots,
+	}
+	h.StartTLS()
+	defer h.Close()
+
+	login := func(user string) int {
+		c, err := tls.Dial("tcp", h.Listener.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{clientPair},
+			RootCAs:      serverRoots,
+		})
+		require.Nil(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: lipwig\r\nConnection: Upgrade\r\nUpgrade: ssmp\r\n\r\n" +
+			ssmp.LOGIN + " " + user + " cert\n"))
+		require.Nil(t, err)
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		code, err := ssmp.NewDecoder(br).DecodeCode()
+		require.Nil(t, err)
+		return code
+	}
+	require.Equal(t, ssmp.CodeOk, login("foo"))
+	require.Equal(t, ssmp.CodeUnauthorized, login("bar"))
+}
+
+func TestRollingStats_should_average_over_last_minute(t *testing.T) {
+	now := time.Unix(1000, 0)
+	st := server.NewRollingStats(func() time.Time { return now })
+
+	// 300 messages over the first 10 seconds
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 30; j++ {
+			st.Record(1)
+		}
+		now = now.Add(time.Second)
+	}
+	require.InDelta(t, 5.0, st.RateLastMinute(), 0.001)
+
+	// idle until the end of the first minute
+	now = now.Add(49 * time.Second)
+	require.InDelta(t, 5.0, st.RateLastMinute(), 0.001)
+
+	// the first seconds leave the window one by one
+	now = now.Add(time.Second)
+	require.InDelta(t, 4.5, st.RateLastMinute(), 0.001)
+	now = now.Add(10 * time.Second)
+	require.Equal(t, 0.0, st.RateLastMinute())
+
+	st.Record(60)
+	now = now.Add(time.Hour)
+	require.Equal(t, uint64(0), st.CountLastMinute())
+}
+
+func TestTopic_should_report_message_rate(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("chat")))
+	for i := 0; i < 30; i++ {
+		expect(t, ssmp.CodeOk, u(foo.Mcast("chat", "hello")))
+	}
+	require.InDelta(t, 0.5, s.GetTopic([]byte("chat")).MessagesPerSecond(), 0.001)
+	l := s.ListTopics()
+	require.Len(t, l, 1)
+	require.InDelta(t, 0.5, l[0].MessagesPerSecond, 0.001)
+}
+
+func TestTopicManager_should_import_and_export_topics(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+
+	path := filepath.Join(t.TempDir(), "topics.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(`
+- name: chat
+  maxSubscribers: 1000
+- name: ticker
+  dropLagging: true
+- name: alerts
+  maxSubscribers: 1
+- name: logs
+- name: presence
+  maxSubscribers: 50
+  dropLagging: true
+`), 0644))
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	require.Nil(t, s.Import(f))
+
+	var names []string
+	for _, ti := range s.ListTopics() {
+		names = append(names, ti.Name)
+	}
+	require.ElementsMatch(t, []string{"chat", "ticker", "alerts", "logs", "presence"}, names)
+	require.Equal(t, 1000, s.GetTopic([]byte("chat")).MaxSubscribers())
+	require.Equal(t, server.DropLagging, s.GetTopic([]byte("ticker")).LagPolicy())
+
+	// imported topics outlive their subscribers
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("alerts")))
+	expect(t, ssmp.CodeConflict, u(bar.Subscribe("alerts")))
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("alerts")))
+	require.Equal(t, 0, s.GCEmptyTopics())
+	require.Len(t, s.ListTopics(), 5)
+
+	// JSON is accepted as well
+	require.Nil(t, s.Import(strings.NewReader(`[{"name": "json", "maxSubscribers": 3}]`)))
+	require.Equal(t, 3, s.GetTopic([]byte("json")).MaxSubscribers())
+
+	var exported bytes.Buffer
+	require.Nil(t, s.Export(&exported))
+	other := NewServer().Start()
+	defer other.Stop()
+	require.Nil(t, other.Import(bytes.NewReader(exported.Bytes())))
+	var again bytes.Buffer
+	require.Nil(t, other.Export(&again))
+	require.Equal(t, exported.String(), again.String())
+	require.Len(t, other.ListTopics(), 6)
+
+	require.NotNil(t, s.Import(strings.NewReader(`[{"name": "history", "historySize": 50}]`)))
+	require.NotNil(t, s.Import(strings.NewReader(`[{"name": "ok"}, {"name": "not ok"}]`)))
+	require.Nil(t, s.GetTopic([]byte("ok")))
+	require.Nil(t, s.GetTopic([]byte("history")))
+}
+
+func TestServer_should_run_pre_login_handshake(t *testing.T) {
+	const banner = "000 . BANNER lipwig\n"
+	h := func(c net.Conn, r *ssmp.Decoder) ([]byte, []byte, []byte, error) {
+		if _, err := c.Write([]byte(banner)); err != nil {
+			return nil, nil, nil, err
+		}
+		verb, err := r.DecodeVerb()
+		if err != nil || !ssmp.Equal(verb, "BANNERACK") || !r.AtEnd() {
+			return nil, nil, nil, server.ErrInvalidLogin
+		}
+		r.Reset()
+		return server.DecodeLogin(r)
+	}
+	s := NewTestServer(t, server.WithPreLoginHandler(server.PreLoginHandlerFunc(h)))
+	defer s.Close(t)
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", s.Endpoint)
+		require.Nil(t, err)
+		b := make([]byte, len(banner))
+		_, err = io.ReadFull(c, b)
+		require.Nil(t, err)
+		require.Equal(t, banner, string(b))
+		return c
+	}
+
+	c := dial()
+	_, err := c.Write([]byte("BANNERACK\n"))
+	require.Nil(t, err)
+	// HELLO is left to the handler
+	foo := client.NewClient(c, client.Discard, client.WithHello(false))
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Login("foo", "none", "")))
+	s.AssertUserConnected(t, "foo")
+	expect(t, ssmp.CodeOk, u(foo.Ucast("foo", "hello")))
+
+	// LOGIN without acknowledging the banner
+	c = dial()
+	defer c.Close()
+	_, err = c.Write([]byte(ssmp.LOGIN + " bar none\n"))
+	require.Nil(t, err)
+	code, err := ssmp.NewDecoder(c).DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeBadRequest, code)
+	s.AssertUserNotConnected(t, "bar")
+
+	// loopback clients skip the handshake
+	baz := NewLoopbackClient("baz")
+	defer baz.Close()
+	s.AssertUserConnected(t, "baz")
+}
+
+func TestTopicManager_should_iterate_topics_outside_lock(t *testing.T) {
+	s := NewServer()
+	defer s.Start().Stop()
+	for _, n := range []string{"a", "b", "c"} {
+		s.GetOrCreateTopic([]byte(n))
+	}
+
+	visited := make(map[string]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ForEach(func(name string, _ *server.Topic) {
+			visited[name] = true
+			// may create and remove topics without deadlock
+			s.GetOrCreateTopic([]byte(name + "-new"))
+			for _, n := range []string{"a", "b", "c"} {
+				if n != name && !visited[n] {
+					s.RemoveTopic(n)
+				}
+			}
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ForEach deadlocked")
+	}
+	// the first topic visited removed the others
+	require.Len(t, visited, 1)
+
+	var b bytes.Buffer
+	s.DumpStats(&b)
+	require.Contains(t, b.String(), "active topics\n")
+}
+
+func TestDispatcher_should_dump_handlers(t *testing.T) {
+	d := server.NewDispatcher(&server.TopicManager{}, &server.ConnectionManager{})
+	fields := func() map[string]string {
+		var b bytes.Buffer
+		d.DumpHandlers(&b)
+		m := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			if strings.HasPrefix(line, "---") {
+				continue
+			}
+			f := strings.Fields(line)
+			require.True(t, len(f) >= 2, line)
+			m[f[0]] = strings.Join(f[1:], " ")
+		}
+		return m
+	}
+
+	m := fields()
+	for _, verb := range []string{ssmp.SUBSCRIBE, ssmp.UNSUBSCRIBE, ssmp.UCAST, ssmp.MCAST,
+		ssmp.BCAST, ssmp.PING, ssmp.PONG, ssmp.CLOSE} {
+		require.Contains(t, m, verb)
+	}
+	require.Equal(t, "TO,PAYLOAD", m[ssmp.UCAST])
+	require.Equal(t, "TO,LIST,OPTION", m[ssmp.SUBSCRIBE])
+	require.Equal(t, "-", m[ssmp.PING])
+	require.NotContains(t, m, "STATUS")
+
+	require.Nil(t, d.RegisterVerb("STATUS", server.FieldTo,
+		func(_ *server.Connection, _, _, _ []byte, _ *server.Dispatcher) {}, "report the status of a user"))
+	m = fields()
+	require.Equal(t, "TO report the status of a user", m["STATUS"])
+	names := d.HandlerNames()
+	require.True(t, sort.StringsAreSorted(names))
+	require.Contains(t, names, "STATUS")
+	require.Len(t, names, len(m))
+}
+
+func TestClient_should_return_typed_request_errors(t *testing.T) {
+	defer NewServer().Start().Stop()
+	c, err := client.Dial("tcp", ENDPOINT, client.Discard, client.WithRequestChecks(true))
+	require.Nil(t, err)
+	defer c.Close()
+	expect(t, ssmp.CodeOk, u(c.Login("foo", "none", "")))
+
+	_, err = c.Ucast("bar", "hello\nworld")
+	var perr client.PayloadError
+	require.True(t, errors.As(err, &perr))
+	require.Equal(t, 11, perr.PayloadLen)
+	require.ErrorIs(t, err, client.ErrInvalidPayload)
+	require.NotErrorIs(t, err, client.ErrRequestTooLarge)
+
+	_, err = c.Mcast("!@#", "hello")
+	var ierr client.IdentifierError
+	require.True(t, errors.As(err, &ierr))
+	require.Equal(t, "!@#", ierr.Identifier)
+	require.ErrorIs(t, err, client.ErrInvalidIdentifier)
+
+	_, err = c.Bcast(strings.Repeat("a", 2000))
+	var serr client.RequestSizeError
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, client.RequestSizeError{Size: 2000, Max: ssmp.MaxPayloadLength}, serr)
+	require.ErrorIs(t, err, client.ErrRequestTooLarge)
+}
+
+func TestServer_should_take_over_unix_socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssmp.sock")
+	l1, err := server.ListenReusePortUnix(path)
+	require.Nil(t, err)
+	require.Equal(t, path, l1.Addr().String())
+	s1 := server.NewServer(l1, &test_auth{}, nil).Start()
+	c1, err := client.Dial("unix", path, client.Discard)
+	require.Nil(t, err)
+	defer c1.Close()
+	expect(t, ssmp.CodeOk, u(c1.Login("foo", "none", "")))
+
+	l2, err := server.ListenReusePortUnix(path)
+	require.Nil(t, err)
+	s2 := server.NewServer(l2, &test_auth{}, nil)
+	defer s2.Start().Stop()
+	c2, err := client.Dial("unix", path, client.Discard)
+	require.Nil(t, err)
+	defer c2.Close()
+	expect(t, ssmp.CodeOk, u(c2.Login("bar", "none", "")))
+
+	// new connections reach the new server, the old one keeps its own
+	require.Nil(t, s2.WaitForConnections(1, 5*time.Second))
+	require.Len(t, s1.ListConnections(), 1)
+	require.Len(t, s2.ListConnections(), 1)
+	expect(t, ssmp.CodeOk, u(c1.Ucast("foo", "still served")))
+	s1.Stop()
+	_, err = os.Stat(path)
+	require.Nil(t, err)
+}
+
+type blockingHandler struct {
+	started chan client.Event
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan client.Event, 10), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) HandleEvent(ev client.Event) {
+	h.started <- ev
+	<-h.release
+}
+
+func TestClient_should_not_stall_on_timed_handler(t *testing.T) {
+	defer NewServer().Start().Stop()
+	const timeout = 100 * time.Millisecond
+	bh := newBlockingHandler()
+	defer close(bh.release)
+	h := client.TimedEventHandler(bh, timeout)
+	bar, err := client.Dial("tcp", ENDPOINT, h)
+	require.Nil(t, err)
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.Login("bar", "none", "")))
+	foo, err := client.Dial("tcp", ENDPOINT, client.Discard)
+	require.Nil(t, err)
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Login("foo", "none", "")))
+
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "hello")))
+	// the response follows the event, which the handler never completes
+	start := time.Now()
+	expect(t, ssmp.CodeOk, u(bar.Ucast("foo", "ping")))
+	require.Less(t, time.Since(start), 2*timeout)
+	require.Equal(t, "hello", string((<-bh.started).Payload))
+	require.Equal(t, uint64(1), h.(client.DropCounter).DroppedEvents())
+
+	// the handler is still busy: new events are dropped
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "world")))
+	start = time.Now()
+	expect(t, ssmp.CodeOk, u(bar.Ucast("foo", "ping")))
+	require.Less(t, time.Since(start), 2*timeout)
+	require.Equal(t, uint64(2), h.(client.DropCounter).DroppedEvents())
+	require.Len(t, bh.started, 0)
+}
+
+func TestClient_should_buffer_events(t *testing.T) {
+	ev := func(payload string) client.Event {
+		return client.Event{From: []byte("foo"), Name: []byte(ssmp.UCAST), To: []byte("bar"), Payload: []byte(payload)}
+	}
+	for _, tc := range []struct {
+		policy   client.OverflowPolicy
+		expected []string
+	}{
+		{client.DropNewest, []string{"1", "2", "3"}},
+		{client.DropOldest, []string{"1", "3", "4"}},
+	} {
+		bh := newBlockingHandler()
+		h := client.BufferedEventHandler(bh, 2, tc.policy)
+		h.HandleEvent(ev("1"))
+		// wait for the first event to leave the buffer
+		require.Equal(t, "1", string((<-bh.started).Payload))
+		h.HandleEvent(ev("2"))
+		h.HandleEvent(ev("3"))
+		h.HandleEvent(ev("4"))
+		require.Equal(t, uint64(1), h.(client.DropCounter).DroppedEvents())
+		close(bh.release)
+		for _, p := range tc.expected[1:] {
+			require.Equal(t, p, string((<-bh.started).Payload))
+		}
+	}
+
+	bh := newBlockingHandler()
+	h := client.BufferedEventHandler(bh, 1, client.Block)
+	h.HandleEvent(ev("1"))
+	<-bh.started
+	h.HandleEvent(ev("2"))
+	done := make(chan struct{})
+	go func() {
+		h.HandleEvent(ev("3"))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("full buffer did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(bh.release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still blocked after the buffer was drained")
+	}
+	require.Equal(t, "2", string((<-bh.started).Payload))
+	require.Equal(t, "3", string((<-bh.started).Payload))
+	require.Equal(t, uint64(0), h.(client.DropCounter).DroppedEvents())
+}
+
+func TestServer_should_deliver_mcast_in_batches(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+	const n = 300
+	var received sync.Map
+	topic := s.GetOrCreateTopic([]byte("topic"))
+	for i := 0; i < n; i++ {
+		user := "sub" + strconv.Itoa(i)
+		c, err := s.RegisterVirtual(user, func(b []byte) error {
+			v, _ := received.LoadOrStore(user, new(int32))
+			atomic.AddInt32(v.(*int32), 1)
+			return nil
+		})
+		require.Nil(t, err)
+		defer s.DeregisterVirtual(user)
+		require.Nil(t, topic.Subscribe(c, 0))
+	}
+
+	batches := topic.Batch(128)
+	require.Len(t, batches, 3)
+	users := make(map[string]bool)
+	for i, b := range batches {
+		if i < 2 {
+			require.Len(t, b, 128)
+		}
+		for _, sub := range b {
+			users[sub.User] = true
+		}
+	}
+	require.Len(t, users, n)
+	require.Len(t, topic.Batch(0), 1)
+
+	foo := NewDiscardingLoggedInClient("foo")
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Mcast("topic", "hello")))
+	for i := 0; i < n; i++ {
+		v, ok := received.Load("sub" + strconv.Itoa(i))
+		require.True(t, ok)
+		require.Equal(t, int32(1), atomic.LoadInt32(v.(*int32)))
+	}
+	require.Equal(t, uint64(n), topic.MessageCount())
+}
+
+func TestServer_should_let_topic_owner_configure(t *testing.T) {
+	defer NewServer().Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+	zed := NewLoopbackClient("zed")
+	defer zed.Close()
+	baz := NewLoopbackClient("baz")
+	defer baz.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("topic")))
+	require.Equal(t, "foo", SERVER.GetTopic([]byte("topic")).Owner())
+	expect(t, ssmp.CodeOk, u(foo.Configure("topic", "MaxSubscribers=3")))
+	expect(t, ssmp.CodeOk, u(zed.Subscribe("topic")))
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("topic")))
+	expect(t, ssmp.CodeConflict, u(baz.Subscribe("topic")))
+	expect(t, ssmp.CodeNotAllowed, u(zed.Configure("topic", "MaxSubscribers=4")))
+	expect(t, ssmp.CodeBadRequest, u(foo.Configure("topic", "Color=blue")))
+	expect(t, ssmp.CodeBadRequest, u(foo.Configure("topic", "History=-1")))
+	expect(t, ssmp.CodeNotFound, u(foo.Configure("nope", "History=1")))
+
+	// ownership goes to the first remaining subscriber alphabetically
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("topic")))
+	require.Equal(t, "bar", SERVER.GetTopic([]byte("topic")).Owner())
+	expect(t, ssmp.CodeNotAllowed, u(foo.Configure("topic", "MaxSubscribers=4")))
+	expect(t, ssmp.CodeNotAllowed, u(zed.Configure("topic", "MaxSubscribers=4")))
+	expect(t, ssmp.CodeOk, u(bar.Configure("topic", "MaxSubscribers=2")))
+	expect(t, ssmp.CodeConflict, u(baz.Subscribe("topic")))
+	expect(t, ssmp.CodeOk, u(bar.Configure("topic", "maxsubscribers=0")))
+	expect(t, ssmp.CodeOk, u(baz.Subscribe("topic")))
+}
+
+func TestServer_should_not_give_ownership_to_internal_subscribers(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	sub, err := s.SubscribeInternal("topic", func(string, []byte) {})
+	require.Nil(t, err)
+	defer sub.Close()
+	require.Equal(t, "", s.GetTopic([]byte("topic")).Owner())
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("topic")))
+	require.Equal(t, "foo", s.GetTopic([]byte("topic")).Owner())
+	expect(t, ssmp.CodeOk, u(foo.Unsubscribe("topic")))
+	require.Equal(t, "", s.GetTopic([]byte("topic")).Owner())
+}
+
+func TestServer_should_not_give_ownership_of_imported_topics(t *testing.T) {
+	s := NewServer().Start()
+	defer s.Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("topic")))
+	require.Equal(t, "foo", s.GetTopic([]byte("topic")).Owner())
+	require.Nil(t, s.Import(strings.NewReader(
+		`[{"name": "topic", "maxSubscribers": 2, "rateLimit": 5, "history": 3}]`)))
+	require.Equal(t, "", s.GetTopic([]byte("topic")).Owner())
+	expect(t, ssmp.CodeNotAllowed, u(foo.Configure("topic", "MaxSubscribers=10")))
+
+	// options are reapplied when the topic is re-created
+	_, ok := s.DrainTopic("topic")
+	require.True(t, ok)
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("topic")))
+	topic := s.GetTopic([]byte("topic"))
+	require.Equal(t, "", topic.Owner())
+	require.Equal(t, 2, topic.MaxSubscribers())
+	require.Equal(t, 5, topic.RateLimit())
+	require.Equal(t, 3, topic.History())
+	expect(t, ssmp.CodeNotAllowed, u(foo.Configure("topic", "MaxSubscribers=10")))
+}
+
+func TestServer_should_apply_topic_rate_limit_and_history(t *testing.T) {
+	clock := newFakeClock()
+	defer NewServer(server.WithClock(clock.Now)).Start().Stop()
+	foo := NewLoopbackClient("foo")
+	defer foo.Close()
+	bar := NewLoopbackClient("bar")
+	defer bar.Close()
+
+	expect(t, ssmp.CodeOk, u(foo.Subscribe("topic")))
+	expect(t, ssmp.CodeOk, u(foo.Configure("topic", "History=2")))
+	for _, p := range []string{"one", "two", "three"} {
+		expect(t, ssmp.CodeOk, u(foo.Mcast("topic", p)))
+	}
+	w := bar.expect(t, client.Event{
+		From: []byte("foo"), Name: []byte(ssmp.MCAST), To: []byte("topic"), Payload: []byte("two"),
+	}, client.Event{
+		From: []byte("foo"), Name: []byte(ssmp.MCAST), To: []byte("topic"), Payload: []byte("three"),
+	})
+	expect(t, ssmp.CodeOk, u(bar.Subscribe("topic")))
+	w.Wait()
+
+	// the 1-second windows follow the clock of the server
+	expect(t, ssmp.CodeOk, u(foo.Configure("topic", "RateLimit=2", "History=0")))
+	clock.Advance(time.Second - time.Duration(clock.Now().Nanosecond()))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("topic", "hello")))
+	expect(t, ssmp.CodeOk, u(foo.Mcast("topic", "hello")))
+	expect(t, ssmp.CodeTooManyRequests, u(foo.Mcast("topic", "hello")))
+	clock.Advance(time.Second)
+	expect(t, ssmp.CodeOk, u(foo.Mcast("topic", "hello")))
+}
+
+func TestServer_should_negotiate_features(t *testing.T) {
+	s := NewTestServer(t, server.WithFeatures(ssmp.LEASE, ssmp.ECHO))
+	defer s.Close(t)
+
+	c, err := net.Dial("tcp", s.Endpoint)
+	require.Nil(t, err)
+	defer c.Close()
+	p := ssmp.NewProtocol(c)
+	_, err = c.Write([]byte("HELLO 2 COMPRESS LEASE\n"))
+	require.Nil(t, err)
+	m, err := p.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.HELLO, string(m.Verb))
+	require.Equal(t, "1", string(m.To))
+	require.Equal(t, ssmp.LEASE, string(m.Payload))
+	_, err = c.Write([]byte(ssmp.LOGIN + " foo none\n"))
+	require.Nil(t, err)
+	m, err = p.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, m.Code)
+	s.AssertUserConnected(t, "foo")
+	require.Equal(t, []string{ssmp.LEASE}, s.GetConnection([]byte("foo")).Features())
+
+	// clients send HELLO by default
+	var rec bytes.Buffer
+	c1, err := net.Dial("tcp", s.Endpoint)
+	require.Nil(t, err)
+	bar := client.NewClient(recordingConn{Conn: c1, w: &rec}, client.Discard)
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.Login("bar", "none", "")))
+	require.Equal(t, "HELLO 1 COMPRESS LEASE\nLOGIN bar none\n", rec.String())
+	require.Equal(t, []string{ssmp.LEASE}, bar.Features())
+	require.True(t, s.GetConnection([]byte("bar")).HasFeature(ssmp.LEASE))
+	require.False(t, s.GetConnection([]byte("bar")).HasFeature(ssmp.COMPRESS))
+
+	// without HELLO, the base protocol is used
+	baz, err := client.Dial("tcp", s.Endpoint, client.Discard, client.WithHello(false))
+	require.Nil(t, err)
+	defer baz.Close()
+	expect(t, ssmp.CodeOk, u(baz.Login("baz", "none", "")))
+	require.Nil(t, baz.Features())
+	require.Nil(t, s.GetConnection([]byte("baz")).Features())
+
+	// invalid version
+	c2, err := net.Dial("tcp", s.Endpoint)
+	require.Nil(t, err)
+	defer c2.Close()
+	_, err = c2.Write([]byte("HELLO x\n"))
+	require.Nil(t, err)
+	code, err := ssmp.NewDecoder(c2).DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeBadRequest, code)
+	require.True(t, closedWithin(c2, time.Second))
+}
+
+func TestServer_should_wait_for_login_after_hello_timeout(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	c, err := net.Dial("tcp", s.Endpoint)
+	require.Nil(t, err)
+	defer c.Close()
+	time.Sleep(1200 * time.Millisecond)
+	_, err = c.Write([]byte(ssmp.LOGIN + " foo none\n"))
+	require.Nil(t, err)
+	code, err := ssmp.NewDecoder(c).DecodeCode()
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, code)
+	require.Nil(t, s.GetConnection([]byte("foo")).Features())
+}
+
+func TestServer_should_send_delivery_receipts(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	for _, user := range []string{"bar", "baz", "qux"} {
+		c, err := client.Dial("tcp", s.Endpoint, client.Discard)
+		require.Nil(t, err)
+		defer c.Close()
+		expect(t, ssmp.CodeOk, u(c.Login(user, "none", "")))
+		expect(t, ssmp.CodeOk, u(c.SubscribeWithOptions("topic", ssmp.RECEIPT)))
+	}
+	// no receipt without the RECEIPT option
+	quux, err := client.Dial("tcp", s.Endpoint, client.Discard)
+	require.Nil(t, err)
+	defer quux.Close()
+	expect(t, ssmp.CodeOk, u(quux.Login("quux", "none", "")))
+	expect(t, ssmp.CodeOk, u(quux.Subscribe("topic")))
+
+	foo, err := client.Dial("tcp", s.Endpoint, client.Discard, client.WithRequestChecks(true))
+	require.Nil(t, err)
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Login("foo", "none", "")))
+	_, err = foo.McastWithReceipts("topic", "not:valid", "hello", nil)
+	require.ErrorIs(t, err, client.ErrInvalidIdentifier)
+
+	receipts := make(chan string, 10)
+	expect(t, ssmp.CodeOk, u(foo.McastWithReceipts("topic", "m1", "hello", receipts)))
+	require.Len(t, receipts, 3)
+	var users []string
+	for i := 0; i < 3; i++ {
+		users = append(users, <-receipts)
+	}
+	sort.Strings(users)
+	require.Equal(t, []string{"bar", "baz", "qux"}, users)
+
+	// receipts are sent as events to a sender that didn't register a channel
+	c := NewLoopbackClient("fred")
+	defer c.Close()
+	expect(t, ssmp.CodeOk, u(c.Mcast("topic", "m2:hello")))
+	users = users[:0]
+	for i := 0; i < 3; i++ {
+		ev := <-c.h.(*EventQueue).q
+		require.Equal(t, ssmp.RECEIPT, string(ev.Name))
+		require.Equal(t, "m2", string(ev.From))
+		users = append(users, string(ev.To))
+	}
+	sort.Strings(users)
+	require.Equal(t, []string{"bar", "baz", "qux"}, users)
+}
+
+// panickingListener panics on the given Accept call, counted from 1.
+type panickingListener struct {
+	net.Listener
+	panicOn int32
+	accepts atomic.Int32
+}
+
+func (l *panickingListener) Accept() (net.Conn, error) {
+	if l.accepts.Add(1) == l.panicOn {
+		panic("boom")
+	}
+	return l.Listener.Accept()
+}
+
+func TestServer_should_restart_accepting_after_panic(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	pl := &panickingListener{Listener: l, panicOn: 2}
+	s := server.NewServer(pl, &test_auth{}, nil, server.WithWatchdog(10*time.Millisecond, 3, time.Minute)).Start()
+	defer s.Stop()
+	endpoint := l.Addr().String()
+
+	// the first Accept succeeds, the second one panics
+	foo, err := client.Dial("tcp", endpoint, client.Discard)
+	require.Nil(t, err)
+	defer foo.Close()
+	expect(t, ssmp.CodeOk, u(foo.Login("foo", "none", "")))
+	require.Eventually(t, func() bool { return pl.accepts.Load() == 2 }, time.Second, time.Millisecond)
+
+	// the third Accept happens on a new Listener bound to the same address
+	bar := TestClient{h: &EventQueue{q: make(chan client.Event, 10)}}
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", endpoint)
+		if err != nil {
+			return false
+		}
+		bar.Client = client.NewClient(c, bar.h)
+		r, err := bar.Login("bar", "none", "")
+		if err != nil || r.Code != ssmp.CodeOk {
+			bar.Close()
+			return false
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	defer bar.Close()
+	require.Equal(t, s.ListeningPort(), l.Addr().(*net.TCPAddr).Port)
+
+	// connections made before and after the restart still work
+	expect(t, ssmp.CodeOk, u(foo.Ucast("bar", "hello")))
+	bar.expect(t, client.Event{
+		From:    []byte("foo"),
+		Name:    []byte(ssmp.UCAST),
+		To:      []byte("bar"),
+		Payload: []byte("hello"),
+	}).Wait()
+}
+
+// flakyListener panics on every other Accept call, and is re-created by the
+// watchdog as a new flakyListener.
+type flakyListener struct {
+	net.Listener
+	accepts   int
+	relistens *atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if l.accepts%2 == 0 {
+		panic("boom")
+	}
+	return l.Listener.Accept()
+}
+
+func (l *flakyListener) Relisten() (net.Listener, error) {
+	nl, err := net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	l.relistens.Add(1)
+	return &flakyListener{Listener: nl, relistens: l.relistens}, nil
+}
+
+func TestServer_should_only_limit_consecutive_restarts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	var relistens atomic.Int32
+	s := server.NewServer(&flakyListener{Listener: l, relistens: &relistens}, &test_auth{},
+		nil, server.WithWatchdog(time.Millisecond, 1, time.Minute)).Start()
+	defer s.Stop()
+	endpoint := l.Addr().String()
+
+	// every connection is followed by a restart
+	for i := 0; i < 4; i++ {
+		var c client.Client
+		require.Eventually(t, func() bool {
+			if c, err = client.Dial("tcp", endpoint, client.Discard); err != nil {
+				return false
+			}
+			if r, err := c.Login("user"+strconv.Itoa(i), "none", ""); err != nil || r.Code != ssmp.CodeOk {
+				c.Close()
+				return false
+			}
+			return true
+		}, 5*time.Second, 5*time.Millisecond)
+		defer c.Close()
+	}
+	require.GreaterOrEqual(t, relistens.Load(), int32(3))
+}
+
+func TestServer_should_stop_twice(t *testing.T) {
+	s := NewServer().Start()
+	s.Stop()
+	s.Stop()
+}
+
+func TestClientPool_should_balance_concurrent_requests(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+	bar, err := client.Dial("tcp", s.Endpoint, client.Discard)
+	require.Nil(t, err)
+	defer bar.Close()
+	expect(t, ssmp.CodeOk, u(bar.Login("bar", "none", "")))
+
+	p, err := client.NewPool(5, 2, func(i int) (client.Client, error) {
+		c, err := client.Dial("tcp", s.Endpoint, client.Discard)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = c.Login("pool."+strconv.Itoa(i), "none", ""); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	})
+	require.Nil(t, err)
+	defer p.Close()
+
+	var w sync.WaitGroup
+	var failed atomic.Int32
+	for i := 0; i < 1000; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			if r, err := p.Ucast("bar", "hello"); err != nil || r.Code != ssmp.CodeOk {
+				failed.Add(1)
+			}
+		}()
+	}
+	w.Wait()
+	require.Equal(t, int32(0), failed.Load())
+
+	st := p.Stats()
+	require.Len(t, st.Requests, 5)
+	var total uint64
+	for _, n := range st.Requests {
+		require.InDelta(t, 200, n, 50)
+		total += n
+	}
+	require.Equal(t, uint64(1000), total)
+	require.True(t, st.MinLatency > 0 && st.MinLatency <= st.AvgLatency && st.AvgLatency <= st.MaxLatency)
+
+	// acquired connections are skipped by pooled requests
+	var acquired []*client.PoolConn
+	for i := 0; i < 5; i++ {
+		c, err := p.Acquire()
+		require.Nil(t, err)
+		acquired = append(acquired, c)
+	}
+	_, err = p.Acquire()
+	require.ErrorIs(t, err, client.ErrPoolExhausted)
+	_, err = p.Ucast("bar", "hello")
+	require.ErrorIs(t, err, client.ErrPoolExhausted)
+	expect(t, ssmp.CodeOk, u(acquired[0].Ucast("bar", "direct")))
+	p.Release(acquired[2])
+	for i := 0; i < 3; i++ {
+		expect(t, ssmp.CodeOk, u(p.Ucast("bar", "hello")))
+	}
+	require.Equal(t, st.Requests[2]+3, p.Stats().Requests[2])
+
+	// failed connections are replaced
+	for _, c := range acquired {
+		p.Release(c)
+	}
+	require.Nil(t, s.ForceClose("pool.0"))
+	s.AssertUserNotConnected(t, "pool.0")
+	for i := 0; i < 10; i++ {
+		expect(t, ssmp.CodeOk, u(p.Ucast("bar", "hello")))
+	}
+	s.AssertUserConnected(t, "pool.0")
+}
+
+type fakePoolClient struct {
+	client.Client
+	ucast func() (client.Response, error)
+	close func()
+}
+
+func (c *fakePoolClient) Ucast(_, _ string) (client.Response, error) {
+	return c.ucast()
+}
+
+func (c *fakePoolClient) Close() {
+	c.close()
+}
+
+func TestClientPool_should_claim_slots_of_pending_requests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	closing, closed := make(chan struct{}), make(chan struct{})
+	var calls, dials atomic.Int32
+	p, err := client.NewPool(1, 0, func(i int) (client.Client, error) {
+		first := dials.Add(1) == 1
+		return &fakePoolClient{
+			ucast: func() (client.Response, error) {
+				switch calls.Add(1) {
+				case 1:
+					close(started)
+					<-release
+				case 2:
+					return client.Response{}, io.EOF
+				}
+				return client.Response{Code: ssmp.CodeOk}, nil
+			},
+			close: func() {
+				if first {
+					close(closing)
+					<-closed
+				}
+			},
+		}, nil
+	})
+	require.Nil(t, err)
+
+	// the slot of a pending request isn't handed out
+	done := make(chan error)
+	go func() {
+		_, err := p.Ucast("bar", "hello")
+		done <- err
+	}()
+	<-started
+	_, err = p.Acquire()
+	require.ErrorIs(t, err, client.ErrPoolExhausted)
+	close(release)
+	require.Nil(t, <-done)
+	pc, err := p.Acquire()
+	require.Nil(t, err)
+	p.Release(pc)
+
+	// the failed connection is closed without blocking Stats
+	_, err = p.Ucast("bar", "hello")
+	require.Equal(t, io.EOF, err)
+	go func() {
+		_, err := p.Ucast("bar", "hello")
+		done <- err
+	}()
+	<-closing
+	stats := make(chan client.PoolStats)
+	go func() {
+		stats <- p.Stats()
+	}()
+	select {
+	case st := <-stats:
+		require.Equal(t, []uint64{2}, st.Requests)
+	case <-time.After(time.Second):
+		t.Fatal("Stats blocked by Close")
+	}
+	close(closed)
+	require.Nil(t, <-done)
+	require.Equal(t, int32(2), dials.Load())
+}
+
+func BenchmarkUCAST_self(b *testing.B) {
+	defer NewServer().Start().Stop()
+	foo := NewDiscardingLoggedInClient("foo")
+	defer foo.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		foo.Ucast("foo", "hello world")
+	}
+	b.StopTimer()
+}
+
+func BenchmarkParallelUCAST_self(b *testing.B) {
+	defer NewServer().Start().Stop()
+	foo := NewDiscardingLoggedInClient("foo")
+	defer foo.Close()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			foo.Ucast("foo", "hello world")
+		}
+	})
+	b.StopTimer()
+}
+
+func BenchmarkMCAST_100(b *testing.B) {
+	defer NewServer().Start().Stop()
+	var c [100]TestClient
+	for i := 0; i < len(c); i++ {
+		c[i] = NewDiscardingLoggedInClient("foo" + strconv.Itoa(i))
+		c[i].Subscribe("topic")
+		defer c[i].Close()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c[i%len(c)].Mcast("topic", "hello world")
+	}
+	b.StopTimer()
+}
+
+func BenchmarkMCAST_1000_churn(b *testing.B) {
+	s := NewServer()
+	defer s.Start().Stop()
+	topic := s.GetOrCreateTopic([]byte("topic"))
+	for i := 0; i < 1000; i++ {
+		user := "sub" + strconv.Itoa(i)
+		c, err := s.RegisterVirtual(user, func([]byte) error { return nil })
+		require.Nil(b, err)
+		defer s.DeregisterVirtual(user)
+		require.Nil(b, topic.Subscribe(c, 0))
+	}
+	foo := NewDiscardingLoggedInClient("foo")
+	defer foo.Close()
+	churn := NewDiscardingLoggedInClient("churn")
+	defer churn.Close()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			churn.Subscribe("topic")
+			churn.Unsubscribe("topic")
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		foo.Mcast("topic", "hello world")
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkPRESENCE_100(b *testing.B) {
+	defer NewServer().Start().Stop()
+	var c [100]TestClient
+	for i := 0; i < len(c); i++ {
+		c[i] = NewDiscardingLoggedInClient("foo" + strconv.Itoa(i))
+		c[i].SubscribeWithPresence("topic")
+		defer c[i].Close()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c[i%len(c)].Unsubscribe("topic")
+		c[i%len(c)].SubscribeWithPresence("topic")
+	}
+	b.StopTimer()
+}
+
+type countingListener struct {
+	net.Listener
+	writes *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: c, writes: l.writes}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func BenchmarkPRESENCE_list_500(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(b, err)
+	var writes int64
+	s := server.NewServer(countingListener{Listener: l, writes: &writes}, &test_auth{}, nil)
+	defer s.Start().Stop()
+	var c [500]TestClient
+	for i := 0; i < len(c); i++ {
+		c[i] = NewLoggedInClientAt(s, "subscriber-with-a-long-name-"+strconv.Itoa(i))
+		c[i].Subscribe("topic")
+		defer c[i].Close()
+	}
+	foo := NewClientAt("127.0.0.1:"+strconv.Itoa(s.ListeningPort()), client.Discard)
+	defer foo.Close()
+	r, err := foo.Login("foo", "none", "")
+	require.Nil(b, err)
+	require.Equal(b, ssmp.CodeOk, r.Code)
+	atomic.StoreInt64(&writes, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		foo.SubscribeWithPresence("topic")
+		foo.Unsubscribe("topic")
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N), "writes/op")
+}
+
+func BenchmarkEventFilter(b *testing.B) {
+	f := client.NewEventFilter(client.Discard,
+		client.NameIs(ssmp.MCAST),
+		client.Not(client.FromUser("foo")),
+	)
+	ev := client.Event{
+		From:    []byte("bar"),
+		Name:    []byte(ssmp.MCAST),
+		To:      []byte("chat"),
+		Payload: []byte("hello"),
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.HandleEvent(ev)
 	}
-	b.StopTimer()
 }
@@ -0,0 +1,8 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build !race
+
+package main
+
+const raceEnabled = false
@@ -0,0 +1,10 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build race
+
+package main
+
+// the race detector slows everything down, latency and throughput bounds
+// don't hold
+const raceEnabled = true
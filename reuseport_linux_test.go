@@ -0,0 +1,50 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build linux
+
+package main
+
+import (
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/server"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServer_should_share_port_with_reuseport(t *testing.T) {
+	l1, err := server.ListenReusePort("127.0.0.1:0")
+	require.Nil(t, err)
+	addr := l1.Addr().String()
+	l2, err := server.ListenReusePort(addr)
+	require.Nil(t, err)
+	s1 := server.NewServer(l1, &test_auth{}, nil).Start()
+	s2 := server.NewServer(l2, &test_auth{}, nil)
+	defer s2.Start().Stop()
+
+	const n = 40
+	for i := 0; i < n; i++ {
+		c, err := client.Dial("tcp", addr, client.Discard)
+		require.Nil(t, err)
+		defer c.Close()
+		r, err := c.Login("user"+strconv.Itoa(i), "none", "")
+		require.Nil(t, err)
+		require.Equal(t, ssmp.CodeOk, r.Code)
+	}
+	n1, n2 := len(s1.ListConnections()), len(s2.ListConnections())
+	require.Equal(t, n, n1+n2)
+	// the kernel hashes connections across listeners: both get a share
+	require.NotZero(t, n1)
+	require.NotZero(t, n2)
+
+	// the port stays open while one of the servers remains
+	s1.Stop()
+	c, err := client.Dial("tcp", addr, client.Discard)
+	require.Nil(t, err)
+	defer c.Close()
+	expect(t, ssmp.CodeOk, u(c.Login("late", "none", "")))
+	require.Nil(t, s2.WaitForConnections(n2+1, 5*time.Second))
+}
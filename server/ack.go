@@ -0,0 +1,134 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"time"
+)
+
+// maximum number of unacknowledged messages tracked per recipient
+const maxPendingAcks = 1024
+
+// maximum age of an unacknowledged message, after which its ACK is rejected
+const maxAckAge = 10 * time.Minute
+
+type ackKey struct {
+	from  string
+	msgid string
+}
+
+type pendingAck struct {
+	sender *Connection
+	t      time.Time
+}
+
+// dispatchReliable unwraps a RELIABLE request and dispatches the inner UCAST
+// as if it was wrapped in a TRACE request, see WithTraceStore. Additionally,
+// the recipient may acknowledge it, see onAck:
+//
+//	RELIABLE <msgid> UCAST <user> <payload>
+func (d *Dispatcher) dispatchReliable(c *Connection) bool {
+	id, err := c.r.DecodeId()
+	if err != nil {
+		return false
+	}
+	c.r.DiscardPrefix()
+	verb, err := c.r.DecodeVerb()
+	if err != nil || !ssmp.Equal(verb, ssmp.UCAST) {
+		return false
+	}
+	c.trace = string(id)
+	c.reliable = true
+	defer func() {
+		c.trace = ""
+		c.reliable = false
+	}()
+	return d.Dispatch(c, verb)
+}
+
+// expectAck records that a RELIABLE UCAST was delivered to c, so that its
+// acknowledgement may be forwarded to the sender. Messages older than
+// maxAckAge are forgotten when the table is full. A message that is already
+// pending, or that doesn't fit in the table, cannot be acknowledged.
+func (c *Connection) expectAck(msgid string, sender *Connection) {
+	now := time.Now()
+	k := ackKey{from: sender.User(), msgid: msgid}
+	c.ackl.Lock()
+	defer c.ackl.Unlock()
+	if c.acks == nil {
+		c.acks = make(map[ackKey]pendingAck)
+	}
+	if _, ok := c.acks[k]; ok {
+		return
+	}
+	if len(c.acks) >= maxPendingAcks {
+		for k, a := range c.acks {
+			if now.Sub(a.t) > maxAckAge {
+				delete(c.acks, k)
+			}
+		}
+		if len(c.acks) >= maxPendingAcks {
+			return
+		}
+	}
+	c.acks[k] = pendingAck{sender: sender, t: now}
+}
+
+// takeAck removes a pending acknowledgement and returns its sender, or nil
+// if there is none or it is older than maxAckAge. If from is empty, the oldest
+// message with the given ID is acknowledged.
+func (c *Connection) takeAck(msgid string, from string) *Connection {
+	now := time.Now()
+	c.ackl.Lock()
+	defer c.ackl.Unlock()
+	k := ackKey{from: from, msgid: msgid}
+	if from == "" {
+		var oldest time.Time
+		for ak, a := range c.acks {
+			if ak.msgid == msgid && (oldest.IsZero() || a.t.Before(oldest)) {
+				k, oldest = ak, a.t
+			}
+		}
+	}
+	a, ok := c.acks[k]
+	if !ok {
+		return nil
+	}
+	delete(c.acks, k)
+	if now.Sub(a.t) > maxAckAge {
+		return nil
+	}
+	return a.sender
+}
+
+// onAck forwards the acknowledgement of a RELIABLE UCAST to its sender:
+//
+//	ACK <msgid> [<sender>]
+//
+// The sender receives:
+//
+//	000 <recipient> ACK <msgid>
+//
+// Without a sender, the oldest pending message with that ID is acknowledged.
+// Only the first ACK of a message is forwarded, unknown or expired message
+// IDs get a 404 response. Messages delivered through a Forwarder or to a group
+// cannot be acknowledged.
+func onAck(c *Connection, msgid, from, _ []byte, d *Dispatcher) {
+	if c.User() == ssmp.Anonymous {
+		c.Write(respNotAllowed)
+		return
+	}
+	if len(from) > 0 && !ssmp.IsValidIdentifier(string(from)) {
+		c.Write(respBadRequest)
+		return
+	}
+	sender := c.takeAck(string(msgid), string(from))
+	if sender == nil {
+		c.Write(respNotFound)
+		return
+	}
+	sender.Write([]byte(respEvent + c.User() + " " + ssmp.ACK + " " + string(msgid) + "\n"))
+	c.Write(respOk)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// NewAdminHandler returns an HTTP handler exposing administrative endpoints:
+//
+//	GET    /topics                   list active topics
+//	GET    /topics/stats             counters of active topics
+//	DELETE /topics/{name}?force=true evict all subscribers from a topic
+//	DELETE /connections/{user}       close the connection of a user
+//	GET    /connections/{user}/subscriptions
+//	                                 SUBSCRIBE events for the topics of a user
+//	GET    /metrics                  dispatch metrics, in Prometheus format
+//
+// The handler performs no authentication and should not be exposed publicly.
+func NewAdminHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.ListTopics())
+	})
+	mux.HandleFunc("GET /topics/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.TopicManager.Stats())
+	})
+	mux.HandleFunc("DELETE /topics/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if s.GetTopic([]byte(name)) == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("force") != "true" {
+			// topics only exist while they have subscribers
+			http.Error(w, "topic has subscribers", http.StatusConflict)
+			return
+		}
+		n, ok := s.DrainTopic(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, struct {
+			Evicted int
+		}{n})
+	})
+	mux.HandleFunc("DELETE /connections/{user}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ForceClose(r.PathValue("user")); err != nil {
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("GET /connections/{user}/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		c := s.GetConnection([]byte(r.PathValue("user")))
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		c.FlushSubscriptions(w)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.dispatcher.WriteMetrics(w)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"io"
+	"sync"
+	"time"
+)
+
+// Directions of an AuditFrame
+const (
+	AuditIn  = "in"
+	AuditOut = "out"
+)
+
+// AuditFrame describes a single SSMP frame sent or received by the server.
+//
+// For inbound frames Verb is the request verb. For outbound frames Verb is
+// the verb of the event, or the response code for responses.
+type AuditFrame struct {
+	Timestamp    time.Time
+	ConnectionID string
+	User         string
+	RemoteAddr   string
+	Direction    string
+	Verb         string
+	To           string `json:",omitempty"`
+	Payload      []byte `json:",omitempty"`
+}
+
+// The AuditLogger interface is used to record every frame exchanged with
+// authenticated clients.
+//
+// LogFrame is called synchronously from the connection goroutines and must
+// be safe to call from multiple goroutines simultaneously.
+type AuditLogger interface {
+	LogFrame(frame AuditFrame)
+}
+
+// WithAuditLogger records all inbound and outbound frames to l.
+func WithAuditLogger(l AuditLogger) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.audit = l
+	}
+}
+
+// newConnectionID returns a random UUID (version 4).
+func newConnectionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (c *Connection) frame(dir string, verb, to, payload []byte) AuditFrame {
+	return AuditFrame{
+		Timestamp:    time.Now(),
+		ConnectionID: c.id,
+		User:         c.User(),
+		RemoteAddr:   c.c.RemoteAddr().String(),
+		Direction:    dir,
+		Verb:         string(verb),
+		To:           string(to),
+		Payload:      append([]byte(nil), payload...),
+	}
+}
+
+func (c *Connection) auditIn(verb, to, payload []byte) {
+	if c.d.audit != nil {
+		c.d.audit.LogFrame(c.frame(AuditIn, verb, to, payload))
+	}
+}
+
+// auditOut logs the frames of an outbound buffer, which may hold several of
+// them, e.g. for BufferedWrite or traced UCAST.
+func (c *Connection) auditOut(b []byte) {
+	if c.d == nil || c.d.audit == nil {
+		return
+	}
+	for len(b) > 0 {
+		b = c.auditOutFrame(b)
+	}
+}
+
+// auditOutFrame splits the first frame of b into its fields before logging
+// it, and returns the rest of b.
+func (c *Connection) auditOutFrame(b []byte) []byte {
+	var end bool
+	if !bytes.HasPrefix(b, []byte(respEvent)) {
+		// response: code and optional payload
+		var code, payload []byte
+		if code, b, end = splitField(b); !end {
+			payload, b = splitPayload(b)
+		}
+		c.d.audit.LogFrame(c.frame(AuditOut, code, nil, redactSession(payload)))
+		return b
+	}
+	// event: origin, verb, then the fields of the original request
+	var verb, to, payload []byte
+	if _, b, end = splitField(b[len(respEvent):]); !end {
+		verb, b, end = splitField(b)
+	}
+	if !end && ((c.d.fields(verb)&fieldTo) != 0 || (ssmp.VerbFields[string(verb)]&ssmp.FieldTo) != 0) {
+		to, b, end = splitField(b)
+	}
+	if !end {
+		payload, b = splitPayload(b)
+	}
+	c.d.audit.LogFrame(c.frame(AuditOut, verb, to, payload))
+	return b
+}
+
+// redacted replaces secrets in audited, traced and logged frames
+var redacted []byte = []byte("<redacted>")
+
+// redactTo masks the IDENTIFIER field of verbs flagged with fieldSecret.
+func redactTo(f int32, to []byte) []byte {
+	if (f&fieldSecret) != 0 && to != nil {
+		return redacted
+	}
+	return to
+}
+
+// redactSession masks the session token carried by LOGIN and RESUME
+// responses, see WithSessions.
+func redactSession(payload []byte) []byte {
+	if bytes.HasPrefix(payload, []byte(ssmp.SessionPrefix)) {
+		return append([]byte(ssmp.SessionPrefix), redacted...)
+	}
+	return payload
+}
+
+// splitField returns the field at the start of a frame, the rest of the
+// buffer, and whether the field ends the frame.
+func splitField(b []byte) ([]byte, []byte, bool) {
+	i := bytes.IndexAny(b, " \n")
+	if i == -1 {
+		return b, nil, true
+	}
+	return b[:i], b[i+1:], b[i] == '\n'
+}
+
+// splitPayload returns the text or binary payload ending a frame, without
+// its length prefix, and the rest of the buffer.
+func splitPayload(b []byte) ([]byte, []byte) {
+	if len(b) > ssmp.BinaryPayloadPrefix && b[0] <= 3 {
+		end := ssmp.BinaryPayloadPrefix + 1 + int(b[0])<<8 + int(b[1])
+		if end < len(b) && b[end] == '\n' {
+			return b[ssmp.BinaryPayloadPrefix:end], b[end+1:]
+		}
+	}
+	if i := bytes.IndexByte(b, '\n'); i != -1 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+func split(b []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(b, ' '); i != -1 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// FileAuditLogger returns an AuditLogger writing one JSON object per frame
+// to w, separated by newlines.
+// If redactAfter is positive, payload bytes beyond that index are dropped.
+func FileAuditLogger(w io.Writer, redactAfter int) AuditLogger {
+	return &fileAuditLogger{w: w, redactAfter: redactAfter}
+}
+
+type fileAuditLogger struct {
+	l           sync.Mutex
+	w           io.Writer
+	redactAfter int
+}
+
+func (l *fileAuditLogger) LogFrame(f AuditFrame) {
+	if l.redactAfter > 0 && len(f.Payload) > l.redactAfter {
+		f.Payload = f.Payload[:l.redactAfter]
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		fmt.Println("failed to encode audit frame:", err)
+		return
+	}
+	b = append(b, '\n')
+	l.l.Lock()
+	defer l.l.Unlock()
+	if _, err := l.w.Write(b); err != nil {
+		fmt.Println("failed to write audit frame:", err)
+	}
+}
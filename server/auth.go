@@ -7,8 +7,11 @@ import (
 	"bytes"
 	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"github.com/aerofs/lipwig/ssmp"
 	"net"
+	"sort"
 )
 
 // The Authenticator interface is used to accpet or reject LOGIN attempts.
@@ -24,15 +27,43 @@ type Authenticator interface {
 	Unauthorized() []byte
 }
 
+// A SchemeChallenger is an Authenticator providing scheme-specific data, e.g.
+// a nonce for challenge/response schemes, along with the 401 response to a
+// failed LOGIN or RELOGIN. The response is then:
+//
+//	401 <scheme> <challenge>
+type SchemeChallenger interface {
+	Authenticator
+
+	// SchemeChallenge returns the challenge for the given scheme, or nil if
+	// there is none. It must be a valid PAYLOAD, without newline.
+	SchemeChallenge(scheme string) []byte
+}
+
 type AuthenticatorFunc func(net.Conn, []byte, []byte, []byte) bool
 
 // MultiSchemeAuthenticator maps authentication schems to corresponding AuthenticatorFunc
 type MultiSchemeAuthenticator struct {
 	Schemes map[string]AuthenticatorFunc
 
+	// Challenges optionally maps schemes to a generator of challenges, see
+	// SchemeChallenger.
+	Challenges map[string]func() []byte
+
 	unauthorized []byte
 }
 
+// AddScheme registers the AuthenticatorFunc of a scheme, replacing any
+// previous one. This method is not safe to call once the Authenticator is in
+// use by a Server.
+func (a *MultiSchemeAuthenticator) AddScheme(name string, f AuthenticatorFunc) {
+	if a.Schemes == nil {
+		a.Schemes = make(map[string]AuthenticatorFunc)
+	}
+	a.Schemes[name] = f
+	a.unauthorized = nil
+}
+
 func (a *MultiSchemeAuthenticator) Auth(c net.Conn, user, scheme, cred []byte) bool {
 	f := a.Schemes[string(scheme)]
 	return f != nil && f(c, user, scheme, cred)
@@ -40,9 +71,14 @@ func (a *MultiSchemeAuthenticator) Auth(c net.Conn, user, scheme, cred []byte) b
 
 func (a *MultiSchemeAuthenticator) Unauthorized() []byte {
 	if a.unauthorized == nil {
+		schemes := make([]string, 0, len(a.Schemes))
+		for k := range a.Schemes {
+			schemes = append(schemes, k)
+		}
+		sort.Strings(schemes)
 		var b bytes.Buffer
 		b.WriteString("401")
-		for k := range a.Schemes {
+		for _, k := range schemes {
 			b.WriteByte(' ')
 			b.WriteString(k)
 		}
@@ -52,14 +88,174 @@ func (a *MultiSchemeAuthenticator) Unauthorized() []byte {
 	return a.unauthorized
 }
 
+func (a *MultiSchemeAuthenticator) SchemeChallenge(scheme string) []byte {
+	if f := a.Challenges[scheme]; f != nil {
+		return f()
+	}
+	return nil
+}
+
+// unauthorizedResponse returns the response to a LOGIN or RELOGIN in the
+// given scheme rejected by the Authenticator of the Dispatcher.
+func (d *Dispatcher) unauthorizedResponse(scheme []byte) []byte {
+	if sc, ok := d.auth.(SchemeChallenger); ok {
+		if ch := sc.SchemeChallenge(string(scheme)); ch != nil {
+			r, err := ssmp.NewMessage().Code(ssmp.CodeUnauthorized).Payload(string(scheme) + " " + string(ch)).Build()
+			if err == nil {
+				return r
+			}
+			fmt.Println("invalid challenge for", string(scheme))
+		}
+	}
+	if d.unauthorized != nil {
+		return d.unauthorized
+	}
+	return d.auth.Unauthorized()
+}
+
+// ChainAuthenticator accepts a LOGIN if all of the functions do, e.g. to
+// require both a client certificate and a shared secret in a single scheme.
+// The functions are called in order, until one rejects the LOGIN.
+func ChainAuthenticator(auths ...AuthenticatorFunc) AuthenticatorFunc {
+	return func(c net.Conn, user, scheme, cred []byte) bool {
+		for _, f := range auths {
+			if !f(c, user, scheme, cred) {
+				return false
+			}
+		}
+		return len(auths) > 0
+	}
+}
+
+// AnyAuthenticator accepts a LOGIN if at least one of the functions does.
+// The functions are called in order, until one accepts the LOGIN.
+func AnyAuthenticator(auths ...AuthenticatorFunc) AuthenticatorFunc {
+	return func(c net.Conn, user, scheme, cred []byte) bool {
+		for _, f := range auths {
+			if f(c, user, scheme, cred) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 func SecretAuth(sharedSecret []byte) AuthenticatorFunc {
 	return func(_ net.Conn, _, _, cred []byte) bool {
 		return subtle.ConstantTimeCompare(cred, sharedSecret) == 1
 	}
 }
 
-func CertAuth(c net.Conn, user, _, cred []byte) bool {
-	tc, ok := c.(*tls.Conn)
+// A CertValidator decides whether a verified client certificate matches a user.
+type CertValidator interface {
+	ValidateCert(user []byte, cert *x509.Certificate) bool
+}
+
+// CertValidatorFunc is an adapter to use ordinary functions as CertValidator.
+type CertValidatorFunc func([]byte, *x509.Certificate) bool
+
+func (f CertValidatorFunc) ValidateCert(user []byte, cert *x509.Certificate) bool {
+	return f(user, cert)
+}
+
+// CommonNameValidator matches the user against the certificate CN.
+func CommonNameValidator() CertValidator {
+	return CertValidatorFunc(func(user []byte, cert *x509.Certificate) bool {
+		return ssmp.Equal(user, cert.Subject.CommonName)
+	})
+}
+
+// SANDNSValidator matches the user against the certificate DNS SANs.
+func SANDNSValidator() CertValidator {
+	return CertValidatorFunc(func(user []byte, cert *x509.Certificate) bool {
+		for _, altName := range cert.DNSNames {
+			if ssmp.Equal(user, altName) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// SANEmailValidator matches the user against the certificate email SANs.
+func SANEmailValidator() CertValidator {
+	return CertValidatorFunc(func(user []byte, cert *x509.Certificate) bool {
+		for _, altName := range cert.EmailAddresses {
+			if ssmp.Equal(user, altName) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AnyValidator accepts a certificate if at least one of the validators does.
+func AnyValidator(vs ...CertValidator) CertValidator {
+	return CertValidatorFunc(func(user []byte, cert *x509.Certificate) bool {
+		for _, v := range vs {
+			if v.ValidateCert(user, cert) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AllValidators accepts a certificate if all of the validators do.
+func AllValidators(vs ...CertValidator) CertValidator {
+	return CertValidatorFunc(func(user []byte, cert *x509.Certificate) bool {
+		for _, v := range vs {
+			if !v.ValidateCert(user, cert) {
+				return false
+			}
+		}
+		return len(vs) > 0
+	})
+}
+
+// An OCSPStapler checks the revocation status of a client certificate.
+type OCSPStapler interface {
+	// Revoked reports whether cert, issued by issuer, has been revoked.
+	// The OCSP response stapled to the TLS connection, if any, is provided.
+	// An error indicates that the revocation status could not be determined.
+	Revoked(cert, issuer *x509.Certificate, staple []byte) (bool, error)
+}
+
+var defaultCertValidator = AnyValidator(
+	CommonNameValidator(),
+	SANDNSValidator(),
+	SANEmailValidator(),
+)
+
+// CertAuth accepts users matching the CN, DNS SANs or email SANs of a verified
+// client certificate. Any path suffix in the user is ignored.
+func CertAuth(c net.Conn, user, scheme, cred []byte) bool {
+	return certAuth(c, user, defaultCertValidator, nil)
+}
+
+// CertAuthWithValidator is similar to CertAuth but uses a custom CertValidator
+// to match users against verified client certificates.
+func CertAuthWithValidator(v CertValidator) AuthenticatorFunc {
+	return func(c net.Conn, user, _, _ []byte) bool {
+		return certAuth(c, user, v, nil)
+	}
+}
+
+// CertAuthWithOCSP is similar to CertAuthWithValidator but also rejects
+// certificates that are revoked or whose revocation status is unknown.
+func CertAuthWithOCSP(v CertValidator, stapler OCSPStapler) AuthenticatorFunc {
+	return func(c net.Conn, user, _, _ []byte) bool {
+		return certAuth(c, user, v, stapler)
+	}
+}
+
+// implemented by *tls.Conn and by transports with built-in TLS, e.g. QUIC
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+func certAuth(c net.Conn, user []byte, v CertValidator, stapler OCSPStapler) bool {
+	tc, ok := c.(tlsConn)
 	if !ok {
 		return false
 	}
@@ -71,18 +267,18 @@ func CertAuth(c net.Conn, user, _, cred []byte) bool {
 	s := tc.ConnectionState()
 	for _, chain := range s.VerifiedChains {
 		cert := chain[0]
-		if ssmp.Equal(user, cert.Subject.CommonName) {
+		if !v.ValidateCert(user, cert) {
+			continue
+		}
+		if stapler == nil {
 			return true
 		}
-		for _, altName := range cert.DNSNames {
-			if ssmp.Equal(user, altName) {
-				return true
-			}
+		issuer := cert
+		if len(chain) > 1 {
+			issuer = chain[1]
 		}
-		for _, altName := range cert.EmailAddresses {
-			if ssmp.Equal(user, altName) {
-				return true
-			}
+		if revoked, err := stapler.Revoked(cert, issuer, s.OCSPResponse); err == nil && !revoked {
+			return true
 		}
 	}
 	return false
@@ -0,0 +1,110 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"runtime"
+	"sync"
+)
+
+// number of subscribers an MCAST is delivered to by a single goroutine
+const deliveryBatchSize = 128
+
+// A SubscriberSnapshot is a subscriber of a Topic, as of the time Batch was
+// called. Writing to a subscriber that has since unsubscribed or
+// disconnected is harmless but the message may not be delivered.
+type SubscriberSnapshot struct {
+	User  string
+	Flags SubscriberFlags
+	// Write sends a message to the subscriber, see Connection.Write.
+	Write func([]byte) error
+	// TryWrite is like Write but fails with ErrWriteQueueFull instead of
+	// blocking on a full outbound queue, see Connection.TryWrite.
+	TryWrite func([]byte) error
+}
+
+// Batch returns the subscribers of the topic, partitioned into groups of at
+// most batchSize, e.g. to deliver a message to each group concurrently.
+// The lock of the topic is only held to take the snapshot, so that the
+// delivery doesn't block subscriptions. A batchSize of zero or less returns
+// a single group.
+func (t *Topic) Batch(batchSize int) [][]SubscriberSnapshot {
+	l := t.recipients(nil, "")
+	if len(l) == 0 {
+		return nil
+	}
+	if batchSize <= 0 {
+		batchSize = len(l)
+	}
+	b := make([][]SubscriberSnapshot, 0, (len(l)+batchSize-1)/batchSize)
+	for i, s := range l {
+		if i%batchSize == 0 {
+			b = append(b, make([]SubscriberSnapshot, 0, batchSize))
+		}
+		b[len(b)-1] = append(b[len(b)-1], SubscriberSnapshot{
+			User:     s.c.User(),
+			Flags:    s.flags,
+			Write:    s.c.Write,
+			TryWrite: s.c.TryWrite,
+		})
+	}
+	return b
+}
+
+type recipient struct {
+	c     *Connection
+	flags SubscriberFlags
+}
+
+// recipients takes a snapshot of the subscribers that must receive the
+// MCAST messages sent by a connection, see Echo and NoSelf. A nil sender
+// selects all subscribers not excluded by NoSelf.
+func (t *Topic) recipients(sender *Connection, from string) []recipient {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	l := make([]recipient, 0, len(t.c))
+	for c, flags := range t.c {
+		if c.isClosed() {
+			continue
+		}
+		if sender == c {
+			if !flags.Has(Echo) {
+				continue
+			}
+		} else if flags.Has(NoSelf) && c.User() == from {
+			continue
+		}
+		l = append(l, recipient{c, flags})
+	}
+	return l
+}
+
+// deliverBatches calls deliver on consecutive groups of at most
+// deliveryBatchSize recipients, concurrently when multiple CPUs are
+// available, and waits for all of them to return.
+func deliverBatches(l []recipient, deliver func([]recipient)) {
+	workers := (len(l) + deliveryBatchSize - 1) / deliveryBatchSize
+	if n := runtime.GOMAXPROCS(0); workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		deliver(l)
+		return
+	}
+	size := (len(l) + workers - 1) / workers
+	var w sync.WaitGroup
+	for len(l) > 0 {
+		b := l
+		if len(b) > size {
+			b = b[:size]
+		}
+		l = l[len(b):]
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			deliver(b)
+		}()
+	}
+	w.Wait()
+}
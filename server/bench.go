@@ -0,0 +1,86 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"sort"
+	"time"
+)
+
+// BenchmarkResult summarizes the latencies measured by BenchmarkVerb.
+type BenchmarkResult struct {
+	N    int
+	Min  time.Duration
+	Mean time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// BenchmarkVerb runs the handler of a verb n times on behalf of user from,
+// over a local connection whose output is discarded, and reports the latency
+// of each run.
+//
+// Handlers are called directly, parsing is not measured. Side effects, such
+// as subscriptions or deliveries to other connections, are not undone.
+// This is a profiling tool, not meant to be used on a production server.
+func (d *Dispatcher) BenchmarkVerb(verb, from, to, payload string, n int) (BenchmarkResult, error) {
+	d.handler.RLock()
+	h := d.handlers[verb]
+	d.handler.RUnlock()
+	if h.h == nil {
+		return BenchmarkResult{}, ErrUnknownVerb
+	}
+	b := ssmp.NewMessage().Verb(verb)
+	var t, p []byte
+	if (h.f & fieldTo) != 0 {
+		b.Id(to)
+		t = []byte(to)
+	}
+	if (h.f & fieldPayload) != 0 {
+		b.Payload(payload)
+		p = []byte(payload)
+	}
+	s, err := b.Build()
+	if err != nil {
+		return BenchmarkResult{}, err
+	}
+	dc := &discardConn{newLocalConn()}
+	c := newLocalConnection(dc, from)
+	defer c.Close()
+
+	l := make([]time.Duration, n)
+	for i := range l {
+		start := time.Now()
+		h.w(c, t, p, s, d)
+		l[i] = time.Since(start)
+	}
+	return summarize(l), nil
+}
+
+func summarize(l []time.Duration) BenchmarkResult {
+	r := BenchmarkResult{N: len(l)}
+	if len(l) == 0 {
+		return r
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	var total time.Duration
+	for _, v := range l {
+		total += v
+	}
+	r.Min = l[0]
+	r.Max = l[len(l)-1]
+	r.Mean = total / time.Duration(len(l))
+	r.P99 = l[(len(l)*99-1)/100]
+	return r
+}
+
+// discardConn is a local connection that drops everything written to it.
+type discardConn struct {
+	*localConn
+}
+
+func (dc *discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"strings"
+)
+
+// BroadcastAll sends a server-initiated event to every named connection,
+// regardless of their subscriptions. Anonymous connections are left out.
+// The verb must be a builtin verb without IDENTIFIER field, typically BCAST,
+// or ErrInvalidVerb is returned. An error is also returned if the event
+// cannot be encoded.
+func (s *ConnectionManager) BroadcastAll(verb, from, payload string) error {
+	if fields, ok := ssmp.VerbFields[verb]; !ok || (fields&ssmp.FieldTo) != 0 {
+		return ErrInvalidVerb
+	}
+	event, err := serverEvent(from, verb, "", payload)
+	if err != nil {
+		return err
+	}
+	s.connection.Lock()
+	l := make([]*Connection, 0, len(s.connections))
+	for _, c := range s.connections {
+		l = append(l, c)
+	}
+	s.connection.Unlock()
+	for _, c := range l {
+		c.Write(event)
+	}
+	return nil
+}
+
+// BroadcastTopic sends a server-initiated MCAST event to all subscribers of a
+// topic, as if it had been sent by the given user.
+// ErrTopicNotFound is returned if the topic doesn't exist.
+func (s *TopicManager) BroadcastTopic(topic, from, payload string) error {
+	event, err := serverEvent(from, ssmp.MCAST, topic, payload)
+	if err != nil {
+		return err
+	}
+	t := s.GetTopic([]byte(topic))
+	if t == nil {
+		return ErrTopicNotFound
+	}
+	t.publish(nil, from, event, "")
+	return nil
+}
+
+func serverEvent(from, verb, to, payload string) ([]byte, error) {
+	b := ssmp.NewMessage().Code(ssmp.CodeEvent).Id(from).Verb(verb)
+	if len(to) > 0 {
+		b.Id(to)
+	}
+	if len(payload) > 0 {
+		if payload[0] <= 3 || strings.IndexByte(payload, '\n') != -1 {
+			b.BinaryPayload([]byte(payload))
+		} else {
+			b.Payload(payload)
+		}
+	}
+	return b.Build()
+}
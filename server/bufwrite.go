@@ -0,0 +1,73 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// BufferedWrite accumulates messages to a Connection and writes them at once,
+// without interleaving with other messages.
+// It is not safe to use from multiple goroutines simultaneously, nor after
+// Flush.
+type BufferedWrite struct {
+	c   *Connection
+	buf *bytes.Buffer
+}
+
+var errFlushed error = fmt.Errorf("buffered write already flushed")
+
+// BeginWrite starts a BufferedWrite. Concurrent buffered writes to the same
+// connection wait for the previous one to be flushed.
+func (c *Connection) BeginWrite() *BufferedWrite {
+	c.bufl.Lock()
+	var buf *bytes.Buffer
+	if c.d != nil {
+		buf = c.d.buffer()
+	} else {
+		buf = new(bytes.Buffer)
+	}
+	return &BufferedWrite{c: c, buf: buf}
+}
+
+// Append adds a message to the buffer.
+// The payload MUST be a valid encoding of a SSMP response or event.
+func (w *BufferedWrite) Append(payload []byte) error {
+	if w.buf == nil {
+		return errFlushed
+	}
+	if err := w.c.checkWrite(payload); err != nil {
+		return err
+	}
+	w.buf.Write(payload)
+	return nil
+}
+
+// Len returns the number of buffered bytes.
+func (w *BufferedWrite) Len() int {
+	if w.buf == nil {
+		return 0
+	}
+	return w.buf.Len()
+}
+
+// Flush writes all buffered messages in a single call to the underlying
+// network connection, or as a single item of the outbound queue, and ends
+// the BufferedWrite.
+func (w *BufferedWrite) Flush() error {
+	if w.buf == nil {
+		return errFlushed
+	}
+	var err error
+	if w.buf.Len() > 0 {
+		err = w.c.Write(w.buf.Bytes())
+	}
+	if w.c.d != nil {
+		w.c.d.release(w.buf)
+	}
+	w.buf = nil
+	w.c.bufl.Unlock()
+	return err
+}
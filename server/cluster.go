@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"net"
+)
+
+// The Forwarder interface is used to deliver UCAST events to users that are
+// not connected to the local server.
+type Forwarder interface {
+	// Forward attempts to deliver a fully encoded event to the given user.
+	// It returns true if the event was delivered.
+	Forward(user []byte, event []byte) bool
+}
+
+// A Cluster is a set of in-process servers forwarding UCAST to each other.
+//
+// It is primarily intended for testing of multi-instance scenarios.
+type Cluster struct {
+	servers []*Server
+}
+
+// NewCluster creates and starts n servers listening on the loopback interface
+// and sharing the same Authenticator.
+// UCAST for users unknown to a member are forwarded to its peers.
+func NewCluster(n int, auth Authenticator) *Cluster {
+	cl := &Cluster{servers: make([]*Server, n)}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			cl.Stop()
+			panic(err)
+		}
+		cl.servers[i] = NewServer(l, auth, nil)
+	}
+	for i, s := range cl.servers {
+		s.dispatcher.SetForwarder(&peerForwarder{cl: cl, self: i})
+		s.Start()
+	}
+	return cl
+}
+
+// Server returns the i-th member of the cluster.
+func (cl *Cluster) Server(i int) *Server {
+	return cl.servers[i]
+}
+
+// Stop stops all members of the cluster.
+func (cl *Cluster) Stop() {
+	for _, s := range cl.servers {
+		if s != nil {
+			s.Stop()
+		}
+	}
+}
+
+type peerForwarder struct {
+	cl   *Cluster
+	self int
+}
+
+func (f *peerForwarder) Forward(user []byte, event []byte) bool {
+	for i, s := range f.cl.servers {
+		if i == f.self {
+			continue
+		}
+		if c := s.GetConnection(user); c != nil {
+			return c.Write(event) == nil
+		}
+	}
+	return false
+}
@@ -4,10 +4,13 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/aerofs/lipwig/ssmp"
 	"io"
 	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,25 +18,65 @@ import (
 // Connection represents an open client connection to an SSMP server after
 // a successful LOGIN.
 type Connection struct {
-	c net.Conn
-	r *ssmp.Decoder
+	c  net.Conn
+	rc *retryConn
+	p  *ssmp.Protocol
+	r  *ssmp.Decoder
+	d  *Dispatcher
+	id string
 
-	User string
+	// see User, only modified by RELOGIN
+	user atomic.Pointer[string]
 
-	sub map[string]*Topic
+	// token of the resumable session, if any
+	session string
+	// ID of the TRACE request being dispatched, if any
+	trace string
+	// whether the request being dispatched is wrapped in RELIABLE
+	reliable bool
+	// time of the last successful authentication, zero for anonymous users
+	// only accessed from the read goroutine, see WithCredentialExpiry
+	lastAuth time.Time
+	// negotiated by HELLO, see Features
+	features []string
+
+	// sub is only modified from the read goroutine, except on topic rename
+	subl   sync.Mutex
+	sub    map[string]*Topic
+	groups map[string]*Group
 
 	closed int32
+	// see Drain
+	draining atomic.Bool
+	// closed when the read goroutine exits, nil for local connections
+	readDone chan struct{}
+
+	// senders of RELIABLE UCAST awaiting an ACK, see expectAck
+	ackl sync.Mutex
+	acks map[ackKey]pendingAck
+
+	// held by the current BufferedWrite
+	bufl sync.Mutex
+
+	// outbound queue, nil if writes are synchronous
+	q    chan []byte
+	done chan struct{}
 }
 
 var (
-	ErrInvalidLogin error = fmt.Errorf("invalid LOGIN")
-	ErrUnauthorized error = fmt.Errorf("unauthorized")
+	ErrInvalidLogin     error = fmt.Errorf("invalid LOGIN")
+	ErrUnauthorized     error = fmt.Errorf("unauthorized")
+	ErrWriteQueueFull   error = fmt.Errorf("write queue full")
+	errConnectionClosed error = fmt.Errorf("connection closed")
 )
 
+// how long queued messages may take to be flushed after Close
+const flushTimeout = 1 * time.Second
+
 // NewConnection creates a SSMP connection out of a streaming netwrok connection.
 //
-// This method blocks until either a first message is received or a 10s timeout
-// elapses.
+// This method blocks until either a first message is received or the handshake
+// timeout elapses, see WithHandshakeTimeout.
 //
 // Each accepted connection spawns a goroutine continuously reading from the
 // underlying network connection and triggering the Dispatcher. The caller must
@@ -45,57 +88,225 @@ var (
 // errUnauthorized is returned if the authenticator doesn't accept the provided
 // credentials.
 func NewConnection(c net.Conn, a Authenticator, d *Dispatcher) (*Connection, error) {
-	r := ssmp.NewDecoder(c)
-	c.SetReadDeadline(time.Now().Add(10 * time.Second))
-	verb, err := r.DecodeVerb()
-	if err != nil || !ssmp.Equal(verb, ssmp.LOGIN) {
-		return nil, ErrInvalidLogin
-	}
-	user, err := r.DecodeId()
+	cc, _, err := newConnection(c, a, d, time.Now().Add(d.handshakeTimeout))
+	return cc, err
+}
+
+// Connect is like NewConnection for in-process connections, e.g. bridges
+// from other protocols, whose LOGIN request doesn't go through the
+// PreLoginHandler. The connection is also registered with the
+// ConnectionManager of the Dispatcher, so that it is listed by the admin API
+// and closed by Server.Stop. Unlike connections accepted by a Server, it
+// doesn't replace the connection of its user, and therefore cannot be reached
+// by UCAST.
+func (d *Dispatcher) Connect(c net.Conn, a Authenticator) (*Connection, error) {
+	cc, _, err := newConnection(c, inProcessAuth{a}, d, time.Now().Add(d.handshakeTimeout))
 	if err != nil {
-		return nil, ErrInvalidLogin
+		return nil, err
 	}
-	scheme, err := r.DecodeId()
-	if err != nil {
-		return nil, ErrInvalidLogin
+	d.connections.registerSecondary(cc)
+	return cc, nil
+}
+
+// inProcessAuth wraps the Authenticator of in-process connections, see
+// Dispatcher.Connect.
+type inProcessAuth struct {
+	Authenticator
+}
+
+func (inProcessAuth) inProcess() {}
+
+// implemented by the Authenticators of in-process connections, which skip
+// the PreLoginHandler
+type inProcess interface {
+	inProcess()
+}
+
+// newConnection is NewConnection with an explicit deadline. It also returns
+// the scheme of the LOGIN request, if any, to answer rejected ones.
+func newConnection(c net.Conn, a Authenticator, d *Dispatcher, deadline time.Time) (*Connection, []byte, error) {
+	rc := &retryConn{Conn: c, timeout: d.writeTimeout}
+	p := ssmp.NewProtocol(rc)
+	r := p.Decoder()
+	c.SetDeadline(deadline)
+	var features []string
+	var user, scheme, cred []byte
+	var err error
+	if _, local := a.(inProcess); d.preLogin != nil && !local {
+		user, scheme, cred, err = d.preLogin.Handle(rc, r)
+		if err == nil && !isValidLogin(r, user, scheme) {
+			err = ErrInvalidLogin
+		}
+		if err != nil {
+			return nil, nil, ErrInvalidLogin
+		}
+		if cred == nil {
+			cred = []byte{}
+		}
+	} else if features, err = d.negotiate(rc, r, deadline); err != nil {
+		return nil, nil, err
+	} else if user, scheme, cred, err = DecodeLogin(r); err != nil {
+		return nil, scheme, err
 	}
-	var cred []byte
-	if r.AtEnd() {
-		cred = []byte{}
-	} else if cred, err = r.DecodePayload(); err != nil {
-		return nil, ErrInvalidLogin
+	if !d.validLogin(user, scheme, cred) {
+		return nil, nil, ErrInvalidLogin
 	}
 	if !a.Auth(c, user, scheme, cred) {
-		return nil, ErrUnauthorized
+		return nil, scheme, ErrUnauthorized
 	}
+	// the read loop maintains its own idle deadline
+	c.SetDeadline(time.Time{})
 	r.Reset()
 	cc := &Connection{
-		c:    c,
-		r:    r,
-		User: string(user),
+		c:  c,
+		rc: rc,
+		p:  p,
+		r:  r,
+		d:  d,
+		id: newConnectionID(),
+
+		features: features,
+	}
+	cc.setUser(string(user))
+	if cc.User() != ssmp.Anonymous {
+		cc.lastAuth = d.now()
+	}
+	// credentials are deliberately left out
+	cc.auditIn([]byte(ssmp.LOGIN), user, scheme)
+	if d.writeQueue > 0 {
+		cc.q = make(chan []byte, d.writeQueue)
+		cc.done = make(chan struct{})
+		go cc.writeLoop()
 	}
+	d.restore(cc)
+	cc.readDone = make(chan struct{})
 	go cc.readLoop(d)
-	cc.Write(respOk)
-	return cc, nil
+	if d.sessions != nil && cc.User() != ssmp.Anonymous {
+		cc.Write(d.sessions.create(cc))
+	} else {
+		cc.Write(respOk)
+	}
+	return cc, scheme, nil
+}
+
+// User returns the name of the user the connection is logged in as, or
+// ssmp.Anonymous. It may change once, from ssmp.Anonymous, on RELOGIN.
+func (c *Connection) User() string {
+	return *c.user.Load()
+}
+
+func (c *Connection) setUser(user string) {
+	c.user.Store(&user)
 }
 
 // Subscribe adds a Topic to the list of subscriptions for the connection.
 // This method is not safe to call from multiple goroutines simultaneously.
 // It should only be called from the connection's read goroutine.
 func (c *Connection) Subscribe(t *Topic) {
+	c.subl.Lock()
 	if c.sub == nil {
 		c.sub = make(map[string]*Topic)
 	}
+	// the topic may have been renamed since the connection subscribed to it,
+	// otherwise renameSubscription is called once this returns
+	t = t.current()
 	c.sub[t.Name] = t
+	c.subl.Unlock()
 }
 
 // Unsubscribe removes a topic from the list of subscriptions for the connection.
 // This method is not safe to call from multiple goroutines simultaneously.
 // It should only be called from the connection's read goroutine.
 func (c *Connection) Unsubscribe(n []byte) {
+	c.subl.Lock()
 	if c.sub != nil {
 		delete(c.sub, string(n))
 	}
+	c.subl.Unlock()
+}
+
+// unsubscribeFrom removes a topic from the list of subscriptions for the
+// connection, unless the connection has since subscribed to another topic of
+// the same name.
+// This method is safe to call from any goroutine.
+func (c *Connection) unsubscribeFrom(t *Topic) {
+	c.subl.Lock()
+	if c.sub[t.Name] == t {
+		delete(c.sub, t.Name)
+	}
+	c.subl.Unlock()
+}
+
+// renameSubscription updates the list of subscriptions after a topic rename,
+// see Topic.moveTo.
+// This method is safe to call from any goroutine.
+func (c *Connection) renameSubscription(old, t *Topic) {
+	c.subl.Lock()
+	if c.sub[old.Name] == old {
+		delete(c.sub, old.Name)
+		c.sub[t.Name] = t
+	}
+	c.subl.Unlock()
+}
+
+// subscriptions returns a snapshot of the list of subscriptions.
+func (c *Connection) subscriptions() map[string]*Topic {
+	c.subl.Lock()
+	defer c.subl.Unlock()
+	sub := make(map[string]*Topic, len(c.sub))
+	for n, t := range c.sub {
+		sub[n] = t
+	}
+	return sub
+}
+
+// subscriptionCount returns the number of topics the connection is
+// subscribed to.
+func (c *Connection) subscriptionCount() int {
+	c.subl.Lock()
+	defer c.subl.Unlock()
+	return len(c.sub)
+}
+
+// join adds a Group to the list of groups for the connection.
+// It should only be called from the connection's read goroutine.
+func (c *Connection) join(g *Group) {
+	if c.groups == nil {
+		c.groups = make(map[string]*Group)
+	}
+	c.groups[g.Name] = g
+}
+
+// leave removes a Group from the list of groups for the connection.
+// It should only be called from the connection's read goroutine.
+func (c *Connection) leave(g *Group) {
+	delete(c.groups, g.Name)
+}
+
+// FlushSubscriptions writes one SUBSCRIBE event per subscribed topic to w,
+// in the order of topic names, e.g. for the admin API.
+// This method is safe to call from any goroutine.
+func (c *Connection) FlushSubscriptions(w io.Writer) error {
+	c.subl.Lock()
+	names := make([]string, 0, len(c.sub))
+	for n, t := range c.sub {
+		// drained topics are removed asynchronously
+		if t.has(c) {
+			names = append(names, n)
+		}
+	}
+	c.subl.Unlock()
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, n := range names {
+		buf.WriteString(respEvent)
+		buf.WriteString(c.User())
+		buf.WriteString(" " + ssmp.SUBSCRIBE + " ")
+		buf.WriteString(n)
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // Broadcast sends an identical payload to all users sharing at least one topic.
@@ -103,8 +314,8 @@ func (c *Connection) Unsubscribe(n []byte) {
 // It should only be called from the connection's read goroutine.
 func (c *Connection) Broadcast(payload []byte) {
 	v := make(map[*Connection]bool)
-	for _, t := range c.sub {
-		t.ForAll(func(cc *Connection, _ bool) {
+	for _, t := range c.subscriptions() {
+		t.ForAll(func(cc *Connection, _ SubscriberFlags) {
 			if cc != c && !v[cc] {
 				v[cc] = true
 				cc.Write(payload)
@@ -116,47 +327,140 @@ func (c *Connection) Broadcast(payload []byte) {
 var ping []byte = []byte(respEvent + ". " + ssmp.PING + "\n")
 
 func (c *Connection) readLoop(d *Dispatcher) {
+	defer close(c.readDone)
 	defer d.RemoveConnection(c)
 	defer c.Cleanup()
 	idle := false
 	for !c.isClosed() {
-		c.c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		deadline := time.Now().Add(30 * time.Second)
+		if exp, ok := c.credentialDeadline(d); ok {
+			if c.expireCredentials(d) {
+				break
+			}
+			// the deadline is in real time, the expiry by the clock of d
+			if e := time.Now().Add(exp.Sub(d.now())); e.Before(deadline) {
+				deadline = e
+			}
+		}
+		c.c.SetReadDeadline(deadline)
 		v, err := c.r.DecodeVerb()
 		if c.isClosed() {
 			break
 		}
+		if err == ssmp.ErrInvalidMessage {
+			idle = false
+			c.badRequest()
+			continue
+		}
 		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.credentialsExpired(d) {
+				continue
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && !idle {
 				idle = true
 				c.Write(ping)
 				continue
 			}
 			if err != io.EOF {
-				fmt.Println("read failed", c.User, err)
+				fmt.Println("read failed", c.User(), err)
 			}
 			c.Close()
 			break
 		}
 		idle = false
+		if c.expireCredentials(d) {
+			break
+		}
 		if d.Dispatch(c, v) {
-			c.r.Reset()
+			// already reset if the request was recovered from a panic
+			if c.r.CanReset() {
+				c.r.Reset()
+			}
 		} else {
-			c.Write(respBadRequest)
-			c.Close()
+			c.badRequest()
 		}
 	}
 }
 
+// badRequest skips the rest of a malformed request so that the following
+// ones can still be processed. The connection is closed if the request
+// cannot be skipped.
+func (c *Connection) badRequest() {
+	if err := c.r.SkipMessage(); err != nil {
+		c.Write(respBadRequest)
+		c.Close()
+		return
+	}
+	c.r.Reset()
+	c.Write(respBadRequest)
+}
+
+func (c *Connection) info() ConnectionInfo {
+	ci := ConnectionInfo{
+		User:       c.User(),
+		RemoteAddr: c.c.RemoteAddr().String(),
+	}
+	if sc := statsOf(c.c); sc != nil {
+		ci.BytesSent = sc.BytesSent()
+		ci.BytesReceived = sc.BytesReceived()
+	}
+	return ci
+}
+
 func (c *Connection) isClosed() bool {
 	return atomic.LoadInt32(&c.closed) != 0
 }
 
 // Write writes an arbitrary payload to the underlying network connection.
 // The payload MUST be a valid encoding of a SSMP response or event.
+// If the connection has an outbound queue, the payload is copied and this
+// method blocks until there is room in the queue.
 // This method us safe to call from multiple goroutines simultaneously.
 func (c *Connection) Write(payload []byte) error {
+	if err := c.checkWrite(payload); err != nil {
+		return err
+	}
+	if c.IsDraining() {
+		return ErrConnectionDraining
+	}
+	if c.q == nil {
+		return c.write(payload)
+	}
+	select {
+	case c.q <- append([]byte(nil), payload...):
+		return nil
+	case <-c.done:
+		return errConnectionClosed
+	}
+}
+
+// TryWrite is similar to Write but never blocks on a full outbound queue.
+// ErrWriteQueueFull is returned if the payload could not be queued.
+// If the connection doesn't have an outbound queue it behaves exactly like Write.
+// This method us safe to call from multiple goroutines simultaneously.
+func (c *Connection) TryWrite(payload []byte) error {
+	if err := c.checkWrite(payload); err != nil {
+		return err
+	}
+	if c.IsDraining() {
+		return ErrConnectionDraining
+	}
+	if c.q == nil {
+		return c.write(payload)
+	}
+	select {
+	case c.q <- append([]byte(nil), payload...):
+		return nil
+	case <-c.done:
+		return errConnectionClosed
+	default:
+		return ErrWriteQueueFull
+	}
+}
+
+func (c *Connection) checkWrite(payload []byte) error {
 	if c.isClosed() {
-		return fmt.Errorf("connection closed %s", c.User)
+		return fmt.Errorf("connection closed %s", c.User())
 	}
 	n := len(payload)
 	if n < 2 {
@@ -165,43 +469,91 @@ func (c *Connection) Write(payload []byte) error {
 	if payload[n-1] != '\n' {
 		return fmt.Errorf("missing message delimiter")
 	}
-	if _, err := c.c.Write(payload); err != nil {
+	return nil
+}
+
+func (c *Connection) write(payload []byte) error {
+	c.auditOut(payload)
+	if _, err := c.p.Write(payload); err != nil {
 		c.c.Close()
 		return err
 	}
 	return nil
 }
 
+// writeLoop drains the outbound queue until the connection is closed.
+// Messages still queued when the connection is closed are flushed before
+// the underlying network connection is closed.
+func (c *Connection) writeLoop() {
+	for {
+		select {
+		case b := <-c.q:
+			c.write(b)
+		case <-c.done:
+			for {
+				select {
+				case b := <-c.q:
+					if c.write(b) != nil {
+						return
+					}
+				default:
+					c.c.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
 // Close unsubscribes from all topics and closes the underlying network connection.
 // This method us safe to call from multiple goroutines simultaneously.
 func (c *Connection) Close() {
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return
 	}
-	c.c.Close()
+	if c.q == nil {
+		c.c.Close()
+		return
+	}
+	// unblock the read goroutine and let the write goroutine flush the queue
+	c.c.SetReadDeadline(time.Now())
+	c.c.SetWriteDeadline(time.Now().Add(flushTimeout))
+	close(c.done)
 }
 
 // Cleanup logic, called from the read goroutine to avoid races
 func (c *Connection) Cleanup() {
-	if len(c.sub) == 0 {
+	for _, g := range c.groups {
+		g.Leave(c)
+	}
+	c.groups = nil
+	c.subl.Lock()
+	sub := c.sub
+	c.sub = nil
+	c.subl.Unlock()
+	if len(sub) == 0 {
+		return
+	}
+	if c.d != nil && c.d.sessions != nil && c.d.sessions.detach(c, sub) {
+		// subscriptions kept alive until the session is resumed or expires
 		return
 	}
-	buf := make([]byte, 18+len(c.User)+ssmp.MaxIdentifierLength)
+	user := c.User()
+	buf := make([]byte, 18+len(user)+ssmp.MaxIdentifierLength)
 	copy(buf[:], "000 ")
-	copy(buf[4:], c.User)
-	copy(buf[4+len(c.User):], " UNSUBSCRIBE ")
-	for n, t := range c.sub {
+	copy(buf[4:], user)
+	copy(buf[4+len(user):], " UNSUBSCRIBE ")
+	for n, t := range sub {
 		if !t.Unsubscribe(c) {
 			continue
 		}
-		copy(buf[17+len(c.User):], n)
-		buf[17+len(c.User)+len(n)] = '\n'
-		event := buf[0 : 18+len(c.User)+len(n)]
-		t.ForAll(func(cc *Connection, wantsPresence bool) {
-			if wantsPresence {
+		copy(buf[17+len(user):], n)
+		buf[17+len(user)+len(n)] = '\n'
+		event := buf[0 : 18+len(user)+len(n)]
+		t.ForAll(func(cc *Connection, flags SubscriberFlags) {
+			if flags.Has(Presence) {
 				cc.Write(event)
 			}
 		})
 	}
-	c.sub = nil
 }
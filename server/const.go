@@ -3,14 +3,21 @@
 
 package server
 
+import (
+	"github.com/aerofs/lipwig/ssmp"
+)
+
 const respEvent = "000 "
 
 var (
-	respOk             = []byte("200\n")
-	respBadRequest     = []byte("400\n")
-	respUnauthorized   = []byte("401\n")
-	respNotFound       = []byte("404\n")
-	respNotAllowed     = []byte("405\n")
-	respConflict       = []byte("409\n")
-	respNotImplemented = []byte("501\n")
+	respOk             = ssmp.NewMessage().Code(200).MustBuild()
+	respBadRequest     = ssmp.NewMessage().Code(400).MustBuild()
+	respUnauthorized   = ssmp.NewMessage().Code(401).MustBuild()
+	respNotFound       = ssmp.NewMessage().Code(404).MustBuild()
+	respNotAllowed     = ssmp.NewMessage().Code(405).MustBuild()
+	respRequestTimeout = ssmp.NewMessage().Code(408).MustBuild()
+	respConflict       = ssmp.NewMessage().Code(409).MustBuild()
+	respNotImplemented = ssmp.NewMessage().Code(501).MustBuild()
+
+	respTooManyRequests = ssmp.NewMessage().Code(ssmp.CodeTooManyRequests).MustBuild()
 )
@@ -0,0 +1,84 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maximum number of message ids remembered for deduplication
+const maxDedupEntries = 65536
+
+type dedupKey struct {
+	from  string
+	msgid string
+}
+
+type dedupEntry struct {
+	key dedupKey
+	t   time.Time
+}
+
+// dedupCache remembers recently seen message ids, bounded both in size and
+// in age. Entries are evicted in insertion order.
+type dedupCache struct {
+	l       sync.Mutex
+	window  time.Duration
+	entries map[dedupKey]*list.Element
+	order   list.List
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		entries: make(map[dedupKey]*list.Element),
+	}
+}
+
+// seen records a message id and reports whether it was already recorded
+// within the deduplication window.
+func (dc *dedupCache) seen(from string, id string) bool {
+	now := time.Now()
+	k := dedupKey{from: from, msgid: id}
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	for e := dc.order.Front(); e != nil; e = dc.order.Front() {
+		de := e.Value.(*dedupEntry)
+		if now.Sub(de.t) < dc.window && dc.order.Len() < maxDedupEntries {
+			break
+		}
+		delete(dc.entries, de.key)
+		dc.order.Remove(e)
+	}
+	if _, ok := dc.entries[k]; ok {
+		return true
+	}
+	dc.entries[k] = dc.order.PushBack(&dedupEntry{key: k, t: now})
+	return false
+}
+
+// SetDeduplicationWindow enables deduplication of UCAST and MCAST messages.
+// The message id is the trace ID of a TRACE request wrapping the message:
+//
+//	TRACE <msgid> UCAST <user> <payload>
+//
+// A message is dropped if a message with the same id was received from the
+// same user within the window. Dropped messages are still acknowledged with a
+// 200. RELIABLE requests are deduplicated likewise, messages sent without
+// TRACE or RELIABLE are never considered duplicates.
+// A zero window disables deduplication.
+// This method is not safe to call once the server has started.
+func (d *Dispatcher) SetDeduplicationWindow(window time.Duration) {
+	if window <= 0 {
+		d.dedup = nil
+	} else {
+		d.dedup = newDedupCache(window)
+	}
+}
+
+func (d *Dispatcher) isDuplicate(c *Connection) bool {
+	return d.dedup != nil && c.trace != "" && d.dedup.seen(c.User(), c.trace)
+}
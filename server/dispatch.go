@@ -7,7 +7,11 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/aerofs/lipwig/ssmp"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // A Dispatcher parses incoming requests and reacts to them appropriately.
@@ -15,18 +19,62 @@ import (
 type Dispatcher struct {
 	topics      *TopicManager
 	connections *ConnectionManager
+	groups      *GroupManager
+	auth        Authenticator
 	handlers    map[string]handler
+	handler     sync.RWMutex
+	validator   PayloadValidator
+	forwarder   Forwarder
+	audit       AuditLogger
+	replica     *Replica
+	middleware  []DispatchMiddleware
+	writeQueue  int
+	dedup       *dedupCache
+	sessions    *sessionStore
+	traces      *TraceStore
+	log         EventLog
+
+	// cached 401 response of auth
+	unauthorized []byte
+
+	// bound on the time spent retrying a write, see WithWriteTimeout
+	writeTimeout time.Duration
+	// bound on the login, see WithHandshakeTimeout
+	handshakeTimeout time.Duration
+	// per-connection limit, see WithMaxSubscriptions
+	maxSubscriptions int
+	// delivery to disconnected users, see WithUcastFallback
+	ucastFallback UcastFallback
+	// maximum time between two REAUTH, see WithCredentialExpiry
+	credentialExpiry time.Duration
+	// see WithClock
+	now func() time.Time
+	// see SetPreLoginHandler
+	preLogin PreLoginHandler
+	// bounds on login fields, see WithMaxCredentialLength
+	maxUserLength       int
+	maxSchemeLength     int
+	maxCredentialLength int
+	// accepted by HELLO, see WithFeatures
+	features []string
+
+	persister TopicPersister
+	pending   pendingSubscriptions
+	persist   persistQueue
+
+	stats verbCounters
 
 	bufPool sync.Pool
 }
 
 // NewDispatcher creates a SSMP dispatcher using the given TopicManager and ConnectionManager.
 func NewDispatcher(topics *TopicManager, connections *ConnectionManager) *Dispatcher {
-	return &Dispatcher{
+	d := &Dispatcher{
 		topics:      topics,
 		connections: connections,
+		groups:      &GroupManager{},
 		handlers: map[string]handler{
-			ssmp.SUBSCRIBE:   h(onSubscribe, fieldTo|fieldOption),
+			ssmp.SUBSCRIBE:   h(onSubscribe, fieldTo|fieldOption|fieldList),
 			ssmp.UNSUBSCRIBE: h(onUnsubscribe, fieldTo),
 			ssmp.UCAST:       h(onUcast, fieldTo|fieldPayload),
 			ssmp.MCAST:       h(onMcast, fieldTo|fieldPayload),
@@ -34,36 +82,81 @@ func NewDispatcher(topics *TopicManager, connections *ConnectionManager) *Dispat
 			ssmp.PING:        h(onPing, 0),
 			ssmp.PONG:        h(onPong, 0),
 			ssmp.CLOSE:       h(onClose, 0),
+			ssmp.GROUP:       h(onGroup, fieldTo|fieldOption),
+			ssmp.USERS:       h(onUsers, fieldOption),
+			ssmp.RELOGIN:     h(onRelogin, fieldTo|fieldOption|fieldCredentials),
+			ssmp.RESUME:      h(onResume, fieldTo|fieldSecret),
+			ssmp.REAUTH:      h(onReauth, fieldOption|fieldCredentials),
+			ssmp.ACK:         h(onAck, fieldTo|fieldOption),
+			ssmp.CONFIGURE:   h(onConfigure, fieldTo|fieldPayload),
 		},
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
 			},
 		},
+		handshakeTimeout:    defaultHandshakeTimeout,
+		maxUserLength:       defaultMaxUserLength,
+		maxSchemeLength:     defaultMaxSchemeLength,
+		maxCredentialLength: defaultMaxCredentialLength,
+		features:            defaultFeatures,
+		now:                 time.Now,
+	}
+	for _, verb := range builtinVerbs {
+		h := d.handlers[verb]
+		h.i = d.stats.index(verb)
+		h.w = h.h
+		d.handlers[verb] = h
 	}
+	return d
 }
 
 // Dispatch parses req, reacts appropriately and sends a response to c.
+// It returns false if the request is malformed, in which case no response is
+// sent and the rest of the request may be left unread, see
+// ssmp.Decoder.SkipMessage.
 func (d *Dispatcher) Dispatch(c *Connection, verb []byte) bool {
 	if ssmp.Equal(verb, ssmp.LOGIN) {
 		fmt.Println("attempted re-login")
 		c.Write(respNotAllowed)
-		return false
+		return c.r.SkipMessage() == nil
 	}
+	if ssmp.Equal(verb, ssmp.TRACE) {
+		return d.dispatchTraced(c)
+	}
+	if ssmp.Equal(verb, ssmp.EXPIRES) {
+		return d.dispatchExpiring(c)
+	}
+	if ssmp.Equal(verb, ssmp.RELIABLE) {
+		return d.dispatchReliable(c)
+	}
+	d.handler.RLock()
 	h := d.handlers[string(verb)]
+	d.handler.RUnlock()
 	if h.h == nil {
 		// discard unknown command
 		if _, err := c.r.DecodeCompat(); err != nil {
 			return false
 		}
+		c.auditIn(verb, nil, nil)
 		fmt.Println("unsupported command:", string(verb))
 		c.Write(respNotImplemented)
 		return true
 	}
+	ok := d.dispatch(c, verb, h)
+	d.stats.record(h.i, ok)
+	return ok
+}
+
+func (d *Dispatcher) dispatch(c *Connection, verb []byte, h handler) bool {
 	var err error
 	var to []byte
 	var payload []byte
-	if (h.f & fieldTo) != 0 {
+	if (h.f & fieldList) != 0 {
+		if to, err = c.r.DecodeIdList(); err != nil {
+			return false
+		}
+	} else if (h.f & fieldTo) != 0 {
 		if to, err = c.r.DecodeId(); err != nil {
 			return false
 		}
@@ -78,10 +171,173 @@ func (d *Dispatcher) Dispatch(c *Connection, verb []byte) bool {
 	if !c.r.AtEnd() {
 		return false
 	}
-	h.h(c, to, payload, c.r.RawMessage(), d)
+	if (h.f & fieldPayload) != 0 {
+		d.stats.recordPayload(h.i, len(payload))
+	}
+	logged := redactTo(h.f, to)
+	if (h.f & fieldCredentials) != 0 {
+		scheme, _ := split(payload)
+		c.auditIn(verb, logged, scheme)
+	} else {
+		c.auditIn(verb, logged, payload)
+	}
+	if c.trace != "" {
+		d.traced(c, verb, logged)
+	}
+	if d.validator != nil && (h.f&fieldOption) != fieldOption && (h.f&fieldPayload) != 0 {
+		if err := d.validator.Validate(string(verb), payload); err != nil {
+			c.Write(errorResponse(err))
+			return true
+		}
+	}
+	h.w(c, to, payload, c.r.RawMessage(), d)
 	return true
 }
 
+// RegisterVerb adds a handler for a custom verb.
+// The fields flags specify which fields the request carries, and therefore
+// which arguments are passed to the handler. An optional description is
+// listed by DumpHandlers.
+// An error is returned if the verb is invalid or already registered. Verbs
+// intercepted by Dispatch, e.g. LOGIN or TRACE, cannot be registered.
+func (d *Dispatcher) RegisterVerb(verb string, fields int32, h HandlerFunc, description ...string) error {
+	if !isValidVerb(verb) {
+		return ErrInvalidVerb
+	}
+	if h == nil || (fields & ^int32(fieldTo|fieldOption)) != 0 {
+		return ErrInvalidHandler
+	}
+	if isInterceptedVerb(verb) {
+		return ErrVerbConflict
+	}
+	d.handler.Lock()
+	defer d.handler.Unlock()
+	if d.handlers[verb].h != nil {
+		return ErrVerbConflict
+	}
+	d.handlers[verb] = handler{
+		f:    fields,
+		h:    h,
+		w:    d.wrap(verb, h),
+		i:    d.stats.index(verb),
+		desc: strings.Join(description, " "),
+	}
+	return nil
+}
+
+// isInterceptedVerb reports whether a verb is handled by Dispatch before
+// looking up registered handlers.
+func isInterceptedVerb(verb string) bool {
+	switch verb {
+	case ssmp.LOGIN, ssmp.TRACE, ssmp.EXPIRES, ssmp.RELIABLE:
+		return true
+	}
+	return false
+}
+
+// UnregisterVerb removes the handler for a verb.
+// An error is returned if no handler is registered for that verb.
+func (d *Dispatcher) UnregisterVerb(verb string) error {
+	d.handler.Lock()
+	defer d.handler.Unlock()
+	if d.handlers[verb].h == nil {
+		return ErrUnknownVerb
+	}
+	delete(d.handlers, verb)
+	return nil
+}
+
+// fields returns the field flags of a verb, or zero if it is unknown.
+func (d *Dispatcher) fields(verb []byte) int32 {
+	d.handler.RLock()
+	defer d.handler.RUnlock()
+	return d.handlers[string(verb)].f
+}
+
+// HandlerNames returns the sorted list of verbs for which a handler is
+// registered, built-in or custom. LOGIN is handled separately and isn't
+// listed.
+func (d *Dispatcher) HandlerNames() []string {
+	d.handler.RLock()
+	l := make([]string, 0, len(d.handlers))
+	for verb := range d.handlers {
+		l = append(l, verb)
+	}
+	d.handler.RUnlock()
+	sort.Strings(l)
+	return l
+}
+
+// DumpHandlers writes a table of the registered verbs, sorted by name, with
+// the fields they carry and the description given to RegisterVerb, if any.
+func (d *Dispatcher) DumpHandlers(w io.Writer) {
+	io.WriteString(w, "------- handlers -------\n")
+	for _, verb := range d.HandlerNames() {
+		d.handler.RLock()
+		h, ok := d.handlers[verb]
+		d.handler.RUnlock()
+		if !ok {
+			// unregistered in the meantime
+			continue
+		}
+		fmt.Fprintf(w, "%-16s %-32s %s\n", verb, fieldNames(h.f), h.desc)
+	}
+	io.WriteString(w, "------------------------\n")
+}
+
+// fieldNames formats field flags for DumpHandlers.
+func fieldNames(f int32) string {
+	var l []string
+	if (f & fieldTo) != 0 {
+		l = append(l, "TO")
+	}
+	if (f & fieldList) != 0 {
+		l = append(l, "LIST")
+	}
+	// an optional payload is flagged as a payload too
+	if (f & fieldOption) == fieldOption {
+		l = append(l, "OPTION")
+	} else if (f & fieldPayload) != 0 {
+		l = append(l, "PAYLOAD")
+	}
+	if (f & fieldCredentials) != 0 {
+		l = append(l, "CREDENTIALS")
+	}
+	if (f & fieldSecret) != 0 {
+		l = append(l, "SECRET")
+	}
+	if len(l) == 0 {
+		return "-"
+	}
+	return strings.Join(l, ",")
+}
+
+func isValidVerb(verb string) bool {
+	if len(verb) == 0 || len(verb) > ssmp.MaxVerbLength {
+		return false
+	}
+	for i := 0; i < len(verb); i++ {
+		if !ssmp.VERB_CHARSET.Contains(verb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetForwarder sets the Forwarder used to deliver UCAST to users that are not
+// connected locally. A nil forwarder disables forwarding.
+// This method is not safe to call once the server has started.
+func (d *Dispatcher) SetForwarder(f Forwarder) {
+	d.forwarder = f
+}
+
+// SetPayloadValidator sets the PayloadValidator used to accept or reject
+// payloads before dispatch. A nil validator accepts all payloads.
+// This method is not safe to call once the server has started.
+func (d *Dispatcher) SetPayloadValidator(v PayloadValidator) {
+	d.validator = v
+}
+
 func (d *Dispatcher) GetConnection(user []byte) *Connection {
 	return d.connections.GetConnection(user)
 }
@@ -104,15 +360,52 @@ func (d *Dispatcher) release(b *bytes.Buffer) {
 
 type handlerFunc func(*Connection, []byte, []byte, []byte, *Dispatcher)
 
+// HandlerFunc is the signature of verb handlers.
+// The arguments are, in order: the connection from which the request was
+// received, the IDENTIFIER field, the PAYLOAD field, the raw request and the
+// Dispatcher. Absent fields are nil.
+type HandlerFunc = handlerFunc
+
+const (
+	fieldTo      = ssmp.FieldTo
+	fieldPayload = ssmp.FieldPayload
+	fieldOption  = ssmp.FieldOption
+
+	// the IDENTIFIER field may be a comma-separated list
+	fieldList = 8
+	// the PAYLOAD field is an auth scheme followed by credentials, which
+	// must not be audited
+	fieldCredentials = 16
+	// the IDENTIFIER field is a secret, e.g. a session token, which must
+	// not be audited, traced or logged
+	fieldSecret = 32
+)
+
+// Field flags for RegisterVerb
 const (
-	fieldTo      = 1
-	fieldPayload = 2
-	fieldOption  = 6
+	// FieldTo indicates a mandatory IDENTIFIER field
+	FieldTo = fieldTo
+	// FieldPayload indicates a mandatory PAYLOAD field
+	FieldPayload = fieldPayload
+	// FieldOption indicates an optional PAYLOAD field
+	FieldOption = fieldOption
+)
+
+var (
+	ErrInvalidVerb    error = fmt.Errorf("invalid verb")
+	ErrInvalidHandler error = fmt.Errorf("invalid handler")
+	ErrVerbConflict   error = fmt.Errorf("verb already registered")
+	ErrUnknownVerb    error = fmt.Errorf("unknown verb")
 )
 
 type handler struct {
 	f int32
 	h handlerFunc
+	// h wrapped in the middleware chain
+	w handlerFunc
+	i int
+	// see RegisterVerb
+	desc string
 }
 
 func h(h handlerFunc, f int32) handler {
@@ -120,26 +413,109 @@ func h(h handlerFunc, f int32) handler {
 }
 
 func onSubscribe(c *Connection, n, option, s []byte, d *Dispatcher) {
-	from := c.User
+	from := c.User()
 	if from == ssmp.Anonymous {
 		c.Write(respNotAllowed)
 		return
 	}
-	presence := ssmp.Equal(option, ssmp.PRESENCE)
-	if len(option) > 0 && !presence {
-		fmt.Println("unrecognized option:", option)
+	flags, lease, ok := parseSubscribeOptions(option)
+	if !ok {
+		fmt.Println("unrecognized option:", string(option))
 		c.Write(respBadRequest)
 		return
 	}
-	t := d.topics.GetOrCreateTopic(n)
-	if !t.Subscribe(c, presence) {
-		// already subscribed
+	if bytes.IndexByte(n, ssmp.IdListSeparator) != -1 {
+		d.subscribeMulti(c, ssmp.SplitIdList(n), option, flags, lease)
+		return
+	}
+	if lease > 0 {
+		// subscribing again renews the lease, with the original options
+		if t := d.topics.GetTopic(n); t != nil && t.renewLease(c, d.now().Add(lease)) {
+			c.Write(respOk)
+			return
+		}
+	}
+	if !d.canSubscribe(c, 1) {
+		c.Write(respTooManyRequests)
+		return
+	}
+	t, err := d.topics.subscribe(n, c, flags)
+	if err != nil {
+		// already subscribed or full
 		c.Write(respConflict)
 		return
 	}
+	if lease > 0 {
+		t.setLease(c, d.now().Add(lease))
+	}
 
 	c.Subscribe(t)
-	c.Write(respOk)
+	d.logEvent(ssmp.SUBSCRIBE, c, n, option)
+	d.subscribed(c, t, n, flags, s, respOk)
+}
+
+// subscribeMulti subscribes to a list of topics atomically: if any
+// subscription fails, those already made are rolled back.
+func (d *Dispatcher) subscribeMulti(c *Connection, names [][]byte, option []byte, flags SubscriberFlags, lease time.Duration) {
+	if !d.canSubscribe(c, len(names)) {
+		c.Write(respTooManyRequests)
+		return
+	}
+	topics := make([]*Topic, 0, len(names))
+	for _, n := range names {
+		t, err := d.topics.subscribe(n, c, flags)
+		if err != nil {
+			// already subscribed, full or duplicate
+			for _, tt := range topics {
+				tt.Unsubscribe(c)
+			}
+			c.Write(respConflict)
+			return
+		}
+		topics = append(topics, t)
+	}
+	for i, t := range topics {
+		if lease > 0 {
+			t.setLease(c, d.now().Add(lease))
+		}
+		c.Subscribe(t)
+		d.logEvent(ssmp.SUBSCRIBE, c, names[i], option)
+	}
+
+	var s bytes.Buffer
+	resp := respOk
+	for i, t := range topics {
+		// presence events carry a single topic
+		s.Reset()
+		s.WriteString(ssmp.SUBSCRIBE + " ")
+		s.Write(names[i])
+		if len(option) > 0 {
+			s.WriteByte(' ')
+			s.Write(option)
+		}
+		s.WriteByte('\n')
+		d.subscribed(c, t, names[i], flags, s.Bytes(), resp)
+		resp = nil
+	}
+}
+
+// canSubscribe reports whether c may subscribe to n more topics without
+// exceeding the limit set by WithMaxSubscriptions.
+// Subscriptions are only made from the read goroutine of the connection, so
+// the count cannot increase between the check and the subscription.
+func (d *Dispatcher) canSubscribe(c *Connection, n int) bool {
+	return d.maxSubscriptions <= 0 || c.subscriptionCount()+n <= d.maxSubscriptions
+}
+
+// subscribed persists a new subscription, notifies existing subscribers of
+// the topic and, if requested, sends the list of subscribers.
+// s is the raw SUBSCRIBE request for the topic. The response resp, if any, is
+// sent along with the list, once existing subscribers were notified, so that
+// the client cannot subscribe anyone else before that.
+func (d *Dispatcher) subscribed(c *Connection, t *Topic, n []byte, flags SubscriberFlags, s []byte, resp []byte) {
+	from := c.User()
+	presence := flags.Has(Presence)
+	d.save(from, n, flags, false)
 
 	// notify existing subscribers of new sub
 	buf := d.buffer()
@@ -151,44 +527,44 @@ func onSubscribe(c *Connection, n, option, s []byte, d *Dispatcher) {
 	event := buf.Bytes()
 	batch := event[4+len(from) : 15+len(from)+len(n)]
 
-	var buf2 *bytes.Buffer = nil
-	if presence {
-		buf2 = d.buffer()
+	var line []byte
+	w := c.BeginWrite()
+	if resp != nil {
+		w.Append(resp)
 	}
 
-	t.ForAll(func(cc *Connection, wantsPresence bool) {
+	forAll := t.ForAll
+	if presence {
+		// the list of subscribers is sent in a deterministic order
+		forAll = t.ForAllSorted
+	}
+	forAll(func(cc *Connection, ccFlags SubscriberFlags) {
 		if c == cc {
 			return
 		}
+		wantsPresence := ccFlags.Has(Presence)
 		if wantsPresence {
 			cc.Write(event)
 		}
 		if presence {
-			buf2.WriteString(respEvent)
-			buf2.WriteString(cc.User)
-			buf2.Write(batch)
+			line = append(append(append(line[:0], respEvent...), cc.User()...), batch...)
 			if wantsPresence {
-				buf2.WriteString(" PRESENCE\n")
+				line = append(line, " PRESENCE\n"...)
 			} else {
-				buf2.WriteByte('\n')
-			}
-			if buf2.Len() > 512 {
-				c.Write(buf2.Bytes())
-				buf2.Reset()
+				line = append(line, '\n')
 			}
+			w.Append(line)
 		}
 	})
 	d.release(buf)
-	if buf2 != nil {
-		if buf2.Len() > 0 {
-			c.Write(buf2.Bytes())
-		}
-		d.release(buf2)
+	for _, e := range t.recentEvents() {
+		w.Append(e)
 	}
+	w.Flush()
 }
 
 func onUnsubscribe(c *Connection, n, _, s []byte, d *Dispatcher) {
-	from := c.User
+	from := c.User()
 	if from == ssmp.Anonymous {
 		c.Write(respNotAllowed)
 		return
@@ -199,6 +575,7 @@ func onUnsubscribe(c *Connection, n, _, s []byte, d *Dispatcher) {
 		return
 	}
 	c.Unsubscribe(n)
+	d.save(from, n, 0, true)
 	buf := d.buffer()
 	buf.Grow(5 + len(from) + len(s))
 	buf.WriteString(respEvent)
@@ -206,17 +583,18 @@ func onUnsubscribe(c *Connection, n, _, s []byte, d *Dispatcher) {
 	buf.WriteByte(' ')
 	buf.Write(s)
 	event := buf.Bytes()
-	t.ForAll(func(cc *Connection, wantsPresence bool) {
-		if wantsPresence {
+	t.ForAll(func(cc *Connection, flags SubscriberFlags) {
+		if flags.Has(Presence) {
 			cc.Write(event)
 		}
 	})
 	d.release(buf)
+	d.logEvent(ssmp.UNSUBSCRIBE, c, n, nil)
 	c.Write(respOk)
 }
 
-func onBcast(c *Connection, _, _, s []byte, d *Dispatcher) {
-	from := c.User
+func onBcast(c *Connection, _, payload, s []byte, d *Dispatcher) {
+	from := c.User()
 	if from == ssmp.Anonymous {
 		c.Write(respNotAllowed)
 		return
@@ -229,48 +607,176 @@ func onBcast(c *Connection, _, _, s []byte, d *Dispatcher) {
 	buf.Write(s)
 	c.Broadcast(buf.Bytes())
 	d.release(buf)
+	d.logEvent(ssmp.BCAST, c, nil, payload)
 	c.Write(respOk)
 }
 
-func onUcast(c *Connection, u, _, s []byte, d *Dispatcher) {
-	from := c.User
-	cc := d.connections.GetConnection(u)
-	if cc == nil {
-		c.Write(respNotFound)
-	} else {
-		buf := d.buffer()
-		buf.Grow(5 + len(from) + len(s))
-		buf.WriteString(respEvent)
-		buf.WriteString(from)
-		buf.WriteByte(' ')
-		buf.Write(s)
-		cc.Write(buf.Bytes())
-		d.release(buf)
+func onUcast(c *Connection, u, payload, s []byte, d *Dispatcher) {
+	from := c.User()
+	if d.isDuplicate(c) {
 		c.Write(respOk)
+		return
+	}
+	var cc *Connection
+	group := u[0] == GroupPrefix
+	if !group {
+		cc = d.connections.GetConnection(u)
+		if cc == nil && d.forwarder == nil && d.ucastFallback == nil {
+			c.Write(respNotFound)
+			return
+		}
 	}
+	buf := d.buffer()
+	buf.Grow(5 + len(from) + len(s))
+	buf.WriteString(respEvent)
+	buf.WriteString(from)
+	buf.WriteByte(' ')
+	buf.Write(s)
+	ok := true
+	if group {
+		if ok = d.ucastGroup(c, u[1:], buf.Bytes()); ok {
+			d.replicate(buf.Bytes())
+		}
+	} else if cc != nil && c.trace != "" {
+		if c.reliable {
+			cc.expectAck(c.trace, c)
+		}
+		w := cc.BeginWrite()
+		w.Append(tracedEvent(c))
+		w.Append(buf.Bytes())
+		w.Flush()
+		d.replicate(buf.Bytes())
+	} else if cc != nil {
+		cc.Write(buf.Bytes())
+		d.replicate(buf.Bytes())
+	} else {
+		ok = d.forwarder != nil && d.forwarder.Forward(u, buf.Bytes())
+		if !ok && d.ucastFallback != nil {
+			ok = d.ucastFallback(from, string(u), string(payload)) == nil
+		}
+	}
+	d.release(buf)
+	if !ok {
+		c.Write(respNotFound)
+		return
+	}
+	d.logEvent(ssmp.UCAST, c, u, payload)
+	c.Write(respOk)
 }
 
-func onMcast(c *Connection, n, _, s []byte, d *Dispatcher) {
-	from := c.User
+func onMcast(c *Connection, n, payload, s []byte, d *Dispatcher) {
+	from := c.User()
+	if d.isDuplicate(c) {
+		c.Write(respOk)
+		return
+	}
 	t := d.topics.GetTopic(n)
+	if t == nil && d.replica == nil {
+		c.Write(respOk)
+		return
+	}
+	if t != nil && !t.allowPublish(d.now()) {
+		c.Write(respTooManyRequests)
+		return
+	}
+	// the message ID is that of the payload as sent, before any filter
+	msgid := parseMsgid(payload)
+	var filtered []byte
 	if t != nil {
-		buf := d.buffer()
+		p, drop := t.filter(from, payload)
+		if drop {
+			c.Write(respOk)
+			return
+		}
+		if !bytes.Equal(p, payload) {
+			var err error
+			if filtered, err = serverEvent(from, ssmp.MCAST, string(n), string(p)); err != nil {
+				fmt.Println("invalid filtered payload", string(n), err)
+				c.Write(respBadRequest)
+				return
+			}
+			payload = p
+		}
+	}
+	buf := d.buffer()
+	msg := filtered
+	if msg == nil {
 		buf.Grow(5 + len(from) + len(s))
 		buf.WriteString(respEvent)
 		buf.WriteString(from)
 		buf.WriteByte(' ')
 		buf.Write(s)
-		msg := buf.Bytes()
-		t.ForAll(func(cc *Connection, _ bool) {
-			if c != cc {
-				cc.Write(msg)
-			}
-		})
-		d.release(buf)
+		msg = buf.Bytes()
+	}
+	if t != nil {
+		t.publish(c, from, msg, msgid)
 	}
+	d.replicate(msg)
+	d.release(buf)
+	d.logEvent(ssmp.MCAST, c, n, payload)
 	c.Write(respOk)
 }
 
+// parseSubscribeOptions parses the space-separated options of a SUBSCRIBE
+// request into flags and a lease duration, zero if there is none.
+// It returns false if any option is not recognized.
+func parseSubscribeOptions(option []byte) (SubscriberFlags, time.Duration, bool) {
+	option, lease, ok := parseLease(option)
+	if !ok {
+		return 0, 0, false
+	}
+	flags, ok := parseSubscriberFlags(option)
+	return flags, lease, ok
+}
+
+// parseSubscriberFlags parses the space-separated options of a SUBSCRIBE
+// request. It returns false if any option is not recognized.
+func parseSubscriberFlags(option []byte) (SubscriberFlags, bool) {
+	var flags SubscriberFlags
+	if len(option) == 0 {
+		return flags, true
+	}
+	for _, o := range bytes.Split(option, []byte{' '}) {
+		if ssmp.Equal(o, ssmp.PRESENCE) {
+			flags |= Presence
+		} else if ssmp.Equal(o, ssmp.NOSELF) {
+			flags |= NoSelf
+		} else if ssmp.Equal(o, ssmp.ECHO) {
+			flags |= Echo
+		} else if ssmp.Equal(o, ssmp.COUNT) {
+			flags |= Count
+		} else if ssmp.Equal(o, ssmp.RECEIPT) {
+			flags |= Receipt
+		} else {
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+// formatSubscriberFlags is the inverse of parseSubscriberFlags.
+func formatSubscriberFlags(flags SubscriberFlags) []byte {
+	var option []byte
+	for _, f := range []struct {
+		f SubscriberFlags
+		o string
+	}{
+		{Presence, ssmp.PRESENCE},
+		{NoSelf, ssmp.NOSELF},
+		{Echo, ssmp.ECHO},
+		{Count, ssmp.COUNT},
+		{Receipt, ssmp.RECEIPT},
+	} {
+		if flags.Has(f.f) {
+			if len(option) > 0 {
+				option = append(option, ' ')
+			}
+			option = append(option, f.o...)
+		}
+	}
+	return option
+}
+
 var pong []byte = []byte(respEvent + ". " + ssmp.PONG + "\n")
 
 func onPing(c *Connection, _, _, _ []byte, _ *Dispatcher) {
@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var ErrConnectionDraining error = fmt.Errorf("connection draining")
+
+// interval at which Drain checks whether the outbound queue is empty
+const drainPollInterval = 10 * time.Millisecond
+
+// IsDraining reports whether Drain was called. Writes to a draining
+// connection fail with ErrConnectionDraining.
+// This method is safe to call from multiple goroutines simultaneously.
+func (c *Connection) IsDraining() bool {
+	return c.draining.Load()
+}
+
+// Drain gracefully terminates the connection: a CLOSE event from the
+// anonymous user is sent, after which no other message may be written, and
+// the client is given until the timeout to flush the outbound queue, if any,
+// and close the connection. The connection is forcibly closed when the
+// timeout expires, in which case context.DeadlineExceeded is returned.
+// As with ForceClose, the session of the connection cannot be resumed.
+// This method is safe to call from multiple goroutines simultaneously.
+func (c *Connection) Drain(timeout time.Duration) error {
+	if !c.draining.CompareAndSwap(false, true) {
+		return ErrConnectionDraining
+	}
+	if c.d != nil && c.d.sessions != nil {
+		c.d.sessions.m.Delete(c.session)
+	}
+	if c.checkWrite(closeEvent) != nil || c.readDone == nil {
+		c.Close()
+		return nil
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	if c.q == nil {
+		c.write(closeEvent)
+	} else {
+		select {
+		case c.q <- closeEvent:
+		case <-c.done:
+		case <-deadline.C:
+			c.Close()
+			return context.DeadlineExceeded
+		}
+		poll := time.NewTicker(drainPollInterval)
+		defer poll.Stop()
+		for len(c.q) > 0 {
+			select {
+			case <-poll.C:
+			case <-c.readDone:
+				return nil
+			case <-deadline.C:
+				c.Close()
+				return context.DeadlineExceeded
+			}
+		}
+	}
+	select {
+	case <-c.readDone:
+		return nil
+	case <-deadline.C:
+		c.Close()
+		return context.DeadlineExceeded
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// WithDualStack makes a TCP listener bound to the IPv4 wildcard address,
+// e.g. 0.0.0.0:8787, accept IPv6 connections on the same port as well.
+// Other listeners are left untouched: specific addresses are bound to a
+// single family and the IPv6 wildcard address is usually dual-stack already.
+func WithDualStack(enabled bool) ServerOption {
+	return func(s *Server) {
+		if !enabled {
+			return
+		}
+		a, ok := s.l.Addr().(*net.TCPAddr)
+		if !ok || a.IP.To4() == nil || !a.IP.IsUnspecified() {
+			return
+		}
+		// tcp6 wildcard listeners are IPv6-only, and can therefore share
+		// the port with the IPv4 listener
+		v6, err := net.Listen("tcp6", net.JoinHostPort("::", strconv.Itoa(a.Port)))
+		if err != nil {
+			fmt.Println("IPv6 listen failed:", err)
+			return
+		}
+		s.l = newDualListener(s.l, v6)
+	}
+}
+
+type accepted struct {
+	c   net.Conn
+	err error
+}
+
+// dualListener merges an IPv4 and an IPv6 listener.
+// Its Addr is that of the IPv4 listener.
+type dualListener struct {
+	net.Listener
+	v6 net.Listener
+
+	conns chan accepted
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newDualListener(v4, v6 net.Listener) *dualListener {
+	l := &dualListener{
+		Listener: v4,
+		v6:       v6,
+		conns:    make(chan accepted),
+		done:     make(chan struct{}),
+	}
+	go l.accept(v4)
+	go l.accept(v6)
+	return l
+}
+
+func (l *dualListener) accept(from net.Listener) {
+	for {
+		c, err := from.Accept()
+		select {
+		case l.conns <- accepted{c: c, err: err}:
+		case <-l.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (l *dualListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.conns:
+		return a.c, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Relisten re-creates both listeners, see Relistener.
+func (l *dualListener) Relisten() (net.Listener, error) {
+	var v4 net.Listener
+	var err error
+	if r, ok := l.Listener.(Relistener); ok {
+		v4, err = r.Relisten()
+	} else {
+		v4, err = net.Listen("tcp4", l.Listener.Addr().String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	v6, err := net.Listen("tcp6", l.v6.Addr().String())
+	if err != nil {
+		v4.Close()
+		return nil, err
+	}
+	return newDualListener(v4, v6), nil
+}
+
+func (l *dualListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	l.v6.Close()
+	return l.Listener.Close()
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogEntry is a successfully processed request, as recorded by an EventLog.
+type LogEntry struct {
+	// Seq is assigned by the EventLog, starting at 1.
+	Seq       uint64
+	Timestamp time.Time
+	Verb      string
+	From      string
+	To        string
+	Payload   []byte
+}
+
+// An EventLog is an append-only log of the UCAST, MCAST, BCAST, SUBSCRIBE
+// and UNSUBSCRIBE requests processed by a server.
+// All methods must be safe to call from multiple goroutines simultaneously.
+type EventLog interface {
+	// Append assigns the next sequence number to an entry and records it.
+	Append(entry LogEntry) error
+
+	// Read sends all entries with a sequence number greater than after to
+	// out, in order, and returns. The channel is not closed.
+	Read(after uint64, out chan<- LogEntry) error
+
+	// Close releases the resources held by the log.
+	Close() error
+}
+
+var (
+	ErrLogClosed     error = fmt.Errorf("event log closed")
+	ErrLogCorrupt    error = fmt.Errorf("event log corrupt")
+	ErrEntryTooLarge error = fmt.Errorf("event log entry too large")
+)
+
+// maximum encoded size of an entry in a file EventLog, well above that of
+// the largest request, so that a corrupt length can't exhaust memory
+const maxLogEntrySize = 64 * 1024
+
+// WithEventLog records processed requests in an EventLog. Requests are
+// appended once processed, so that the log never contains a request that
+// was not, but before the response is sent.
+func WithEventLog(l EventLog) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.log = l
+	}
+}
+
+func (d *Dispatcher) logEvent(verb string, c *Connection, to, payload []byte) {
+	if d.log == nil {
+		return
+	}
+	err := d.log.Append(LogEntry{
+		Timestamp: time.Now(),
+		Verb:      verb,
+		From:      c.User(),
+		To:        string(to),
+		Payload:   append([]byte(nil), payload...),
+	})
+	if err != nil {
+		fmt.Println("event log append failed:", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type memoryEventLog struct {
+	l    sync.Mutex
+	e    []LogEntry
+	next int
+	seq  uint64
+}
+
+// NewMemoryEventLog creates an EventLog keeping the last cap entries in
+// memory. Older entries are dropped.
+func NewMemoryEventLog(cap int) EventLog {
+	return &memoryEventLog{e: make([]LogEntry, 0, cap)}
+}
+
+func (l *memoryEventLog) Append(entry LogEntry) error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if cap(l.e) == 0 {
+		return nil
+	}
+	l.seq++
+	entry.Seq = l.seq
+	if len(l.e) < cap(l.e) {
+		l.e = append(l.e, entry)
+	} else {
+		l.e[l.next] = entry
+		l.next = (l.next + 1) % len(l.e)
+	}
+	return nil
+}
+
+func (l *memoryEventLog) Read(after uint64, out chan<- LogEntry) error {
+	l.l.Lock()
+	e := append(append([]LogEntry(nil), l.e[l.next:]...), l.e[:l.next]...)
+	l.l.Unlock()
+	for _, entry := range e {
+		if entry.Seq > after {
+			out <- entry
+		}
+	}
+	return nil
+}
+
+func (l *memoryEventLog) Close() error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fileEventLog stores JSON-encoded entries, each prefixed by its length as a
+// 32-bit big-endian integer.
+type fileEventLog struct {
+	path string
+	l    sync.Mutex
+	f    *os.File
+	seq  uint64
+	// offset past the last complete entry
+	end int64
+}
+
+// NewFileEventLog opens or creates an EventLog stored in a file.
+// An incomplete entry at the end of an existing file, e.g. after a crash, is
+// discarded. Any other corruption fails with ErrLogCorrupt, leaving the file
+// untouched.
+func NewFileEventLog(path string) (EventLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &fileEventLog{path: path, f: f}
+	var end int64
+	err = readEntries(bufio.NewReader(f), func(entry LogEntry, n int64) {
+		l.seq = entry.Seq
+		end += n
+	})
+	if err == nil {
+		// drop the torn tail, if any
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.end = end
+	return l, nil
+}
+
+func (l *fileEventLog) Append(entry LogEntry) error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.f == nil {
+		return ErrLogClosed
+	}
+	entry.Seq = l.seq + 1
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxLogEntrySize {
+		return ErrEntryTooLarge
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	if _, err = l.f.Write(buf); err != nil {
+		// a partial entry would hide any later one on reopen, stop appending
+		// if it can't be dropped
+		if l.rollback() != nil {
+			l.f.Close()
+			l.f = nil
+		}
+		return err
+	}
+	l.end += int64(len(buf))
+	l.seq = entry.Seq
+	return nil
+}
+
+// rollback drops anything written past the last complete entry.
+func (l *fileEventLog) rollback() error {
+	if err := l.f.Truncate(l.end); err != nil {
+		return err
+	}
+	_, err := l.f.Seek(l.end, io.SeekStart)
+	return err
+}
+
+func (l *fileEventLog) Read(after uint64, out chan<- LogEntry) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readEntries(bufio.NewReader(f), func(entry LogEntry, _ int64) {
+		if entry.Seq > after {
+			out <- entry
+		}
+	})
+}
+
+func (l *fileEventLog) Close() error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.f == nil {
+		return ErrLogClosed
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// readEntries calls fn with every complete entry and its encoded size.
+// It stops without error at an entry truncated by the end of the file, and
+// fails with ErrLogCorrupt on an invalid entry.
+func readEntries(r io.Reader, fn func(LogEntry, int64)) error {
+	var hdr [4]byte
+	var off int64
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n > maxLogEntrySize {
+			return fmt.Errorf("%w: entry length %d at offset %d", ErrLogCorrupt, n, off)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var entry LogEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return fmt.Errorf("%w: invalid entry at offset %d: %v", ErrLogCorrupt, off, err)
+		}
+		fn(entry, int64(4+len(b)))
+		off += int64(4 + len(b))
+	}
+}
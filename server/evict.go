@@ -0,0 +1,53 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"strings"
+)
+
+var ErrUserNotFound error = fmt.Errorf("user not found")
+
+var closeEvent []byte = []byte(respEvent + ssmp.Anonymous + " " + ssmp.CLOSE + "\n")
+
+// ForceClose terminates the connection of a user, after sending it a CLOSE
+// event from the anonymous user. The session of the connection, if any,
+// cannot be resumed.
+// ErrUserNotFound is returned if the user is not connected.
+func (s *ConnectionManager) ForceClose(user string) error {
+	c := s.GetConnection([]byte(user))
+	if c == nil {
+		return ErrUserNotFound
+	}
+	c.forceClose()
+	return nil
+}
+
+// ForceCloseAll terminates the connections of all users whose name starts
+// with the given prefix, e.g. all users of a tenant, like ForceClose.
+// It returns the number of closed connections.
+func (s *ConnectionManager) ForceCloseAll(prefix string) int {
+	s.connection.Lock()
+	var l []*Connection
+	for u, c := range s.connections {
+		if strings.HasPrefix(u, prefix) {
+			l = append(l, c)
+		}
+	}
+	s.connection.Unlock()
+	for _, c := range l {
+		c.forceClose()
+	}
+	return len(l)
+}
+
+func (c *Connection) forceClose() {
+	if c.d != nil && c.d.sessions != nil {
+		c.d.sessions.m.Delete(c.session)
+	}
+	c.Write(closeEvent)
+	c.Close()
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"strconv"
+	"time"
+)
+
+// dispatchExpiring unwraps an EXPIRES request and dispatches the inner UCAST
+// or MCAST unless it expired, in which case it is discarded with a 408
+// response:
+//
+//	EXPIRES <unix seconds> UCAST <user> <payload>
+func (d *Dispatcher) dispatchExpiring(c *Connection) bool {
+	id, err := c.r.DecodeId()
+	if err != nil {
+		return false
+	}
+	expiry, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return false
+	}
+	c.r.DiscardPrefix()
+	verb, err := c.r.DecodeVerb()
+	if err != nil || !(ssmp.Equal(verb, ssmp.UCAST) || ssmp.Equal(verb, ssmp.MCAST)) {
+		return false
+	}
+	if time.Now().Unix() > expiry {
+		c.Write(respRequestTimeout)
+		return c.r.SkipMessage() == nil
+	}
+	return d.Dispatch(c, verb)
+}
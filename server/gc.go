@@ -0,0 +1,81 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"time"
+)
+
+// default interval between two sweeps of empty topics
+const defaultGCInterval = 5 * time.Minute
+
+// WithGCInterval sets the interval at which empty topics are removed, see
+// TopicManager.GCEmptyTopics. Zero disables the periodic sweep.
+// The default is 5 minutes.
+func WithGCInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.gcInterval = d
+	}
+}
+
+// GCEmptyTopics removes all topics without subscribers, e.g. topics created
+// when restoring persisted subscriptions whose users never logged back in.
+// Topics normally self-harvest when their last subscriber leaves. Imported
+// topics are kept, see Import.
+// It returns the number of removed topics.
+func (s *TopicManager) GCEmptyTopics() int {
+	s.topic.Lock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, t := range s.topics {
+		topics = append(topics, t)
+	}
+	s.topic.Unlock()
+	n := 0
+	for _, t := range topics {
+		// same lock order as Topic.Unsubscribe
+		t.l.Lock()
+		s.topic.Lock()
+		if len(t.c) == 0 && s.topics[t.Name] == t && !s.isConfigured(t.Name) {
+			delete(s.topics, t.Name)
+			t.removed = true
+			n++
+		}
+		s.topic.Unlock()
+		t.l.Unlock()
+	}
+	return n
+}
+
+// startGC starts the goroutine that periodically removes empty topics.
+func (s *Server) startGC() {
+	if s.gcInterval <= 0 || s.gcStop != nil {
+		return
+	}
+	s.gcStop = make(chan struct{})
+	s.gcDone = make(chan struct{})
+	go s.gcLoop(s.gcInterval)
+}
+
+// stopGC waits for the goroutine started by startGC to exit.
+func (s *Server) stopGC() {
+	if s.gcStop == nil {
+		return
+	}
+	close(s.gcStop)
+	<-s.gcDone
+}
+
+func (s *Server) gcLoop(interval time.Duration) {
+	defer close(s.gcDone)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.GCEmptyTopics()
+		case <-s.gcStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"sync"
+)
+
+// GroupPrefix distinguishes group addresses from user addresses in UCAST.
+const GroupPrefix = '@'
+
+// A GroupManager manages a set of Group.
+// All methods are safe to call from multiple goroutines simultaneously.
+type GroupManager struct {
+	group  sync.Mutex
+	groups map[string]*Group
+}
+
+// Group represents a named set of connections, targeted by UCAST to
+// "@<name>".
+//
+// All methods can be safely called from multiple goroutines simultaneously.
+type Group struct {
+	Name string
+	gm   *GroupManager
+	l    sync.RWMutex
+	c    map[*Connection]bool
+	// set once the group is no longer in its GroupManager, after which
+	// nobody may join it
+	removed bool
+}
+
+func (s *GroupManager) GetOrCreateGroup(name []byte) *Group {
+	s.group.Lock()
+	if s.groups == nil {
+		s.groups = make(map[string]*Group)
+	}
+	g := s.groups[string(name)]
+	if g == nil {
+		g = &Group{
+			Name: string(name),
+			gm:   s,
+			c:    make(map[*Connection]bool),
+		}
+		s.groups[string(name)] = g
+	}
+	s.group.Unlock()
+	return g
+}
+
+func (s *GroupManager) GetGroup(name []byte) *Group {
+	s.group.Lock()
+	g := s.groups[string(name)]
+	s.group.Unlock()
+	return g
+}
+
+// RemoveGroup removes a group, which can no longer be joined.
+func (s *GroupManager) RemoveGroup(name string) {
+	g := s.GetGroup([]byte(name))
+	if g == nil {
+		return
+	}
+	g.l.Lock()
+	s.remove(g)
+	g.l.Unlock()
+}
+
+// remove removes g from the GroupManager, unless it was already replaced by
+// another group of the same name. It must be called with the lock of g held.
+func (s *GroupManager) remove(g *Group) {
+	s.group.Lock()
+	if s.groups[g.Name] == g {
+		delete(s.groups, g.Name)
+	}
+	s.group.Unlock()
+	g.removed = true
+}
+
+// join adds a connection to the named group, creating it if needed, or
+// again if it was removed concurrently.
+// It returns false if the connection was already a member.
+func (s *GroupManager) join(name []byte, c *Connection) (*Group, bool) {
+	for {
+		g := s.GetOrCreateGroup(name)
+		if added, ok := g.join(c); ok {
+			return g, added
+		}
+	}
+}
+
+// Join adds a connection to the group.
+// It returns false if the connection was already a member, or if the group
+// was removed since it was obtained from its GroupManager.
+func (g *Group) Join(c *Connection) bool {
+	added, ok := g.join(c)
+	return added && ok
+}
+
+func (g *Group) join(c *Connection) (added bool, ok bool) {
+	g.l.Lock()
+	defer g.l.Unlock()
+	if g.removed {
+		return false, false
+	}
+	member := g.c[c]
+	g.c[c] = true
+	return !member, true
+}
+
+// Leave removes a connection from the group. The group is removed once it
+// has no member left.
+// It returns false if the connection wasn't a member.
+func (g *Group) Leave(c *Connection) bool {
+	g.l.Lock()
+	member := g.c[c]
+	delete(g.c, c)
+	if len(g.c) == 0 && !g.removed {
+		g.gm.remove(g)
+	}
+	g.l.Unlock()
+	return member
+}
+
+// ForAll executes v once for every member.
+func (g *Group) ForAll(v func(c *Connection)) {
+	g.l.RLock()
+	defer g.l.RUnlock()
+	for c := range g.c {
+		if !c.isClosed() {
+			v(c)
+		}
+	}
+}
+
+func onGroup(c *Connection, n, option, _ []byte, d *Dispatcher) {
+	if c.User() == ssmp.Anonymous || n[0] == GroupPrefix {
+		c.Write(respNotAllowed)
+		return
+	}
+	if len(option) == 0 {
+		g, added := d.groups.join(n, c)
+		if !added {
+			c.Write(respConflict)
+			return
+		}
+		c.join(g)
+	} else if ssmp.Equal(option, ssmp.LEAVE) {
+		g := d.groups.GetGroup(n)
+		if g == nil || !g.Leave(c) {
+			c.Write(respNotFound)
+			return
+		}
+		c.leave(g)
+	} else {
+		c.Write(respBadRequest)
+		return
+	}
+	c.Write(respOk)
+}
+
+// ucastGroup delivers a UCAST event to all members of a group, except the
+// sender. It returns false if the group doesn't exist.
+func (d *Dispatcher) ucastGroup(c *Connection, name []byte, event []byte) bool {
+	g := d.groups.GetGroup(name)
+	if g == nil {
+		return false
+	}
+	g.ForAll(func(cc *Connection) {
+		if cc != c {
+			cc.Write(event)
+		}
+	})
+	return true
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"crypto/tls"
+	"github.com/aerofs/lipwig/ssmp"
+	"time"
+)
+
+// default bound on the time between accepting a connection and receiving a
+// valid LOGIN request
+const defaultHandshakeTimeout = 10 * time.Second
+
+// WithHandshakeTimeout bounds the time between accepting a connection and
+// the end of the login, including the TLS handshake if any. Connections
+// that take longer are closed. The default is 10s.
+func WithHandshakeTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.handshakeTimeout = d
+	}
+}
+
+// default bounds on the fields of LOGIN, RELOGIN and REAUTH requests
+const (
+	defaultMaxUserLength       = ssmp.MaxIdentifierLength
+	defaultMaxSchemeLength     = 16
+	defaultMaxCredentialLength = 512
+)
+
+// WithMaxUserLength bounds the length of the user of LOGIN and RELOGIN
+// requests. The default is ssmp.MaxIdentifierLength.
+func WithMaxUserLength(n int) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.maxUserLength = n
+	}
+}
+
+// WithMaxSchemeLength bounds the length of the auth scheme of LOGIN, RELOGIN
+// and REAUTH requests. The default is 16.
+func WithMaxSchemeLength(n int) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.maxSchemeLength = n
+	}
+}
+
+// WithMaxCredentialLength bounds the length of the credentials of LOGIN,
+// RELOGIN and REAUTH requests. The default is 512, which leaves room for
+// typical HMAC and JWT credentials.
+func WithMaxCredentialLength(n int) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.maxCredentialLength = n
+	}
+}
+
+// validLogin checks login fields against the configured bounds, before they
+// are given to the Authenticator. Users cannot start with GroupPrefix, since
+// UCAST would address a group instead.
+func (d *Dispatcher) validLogin(user, scheme, cred []byte) bool {
+	return (len(user) == 0 || user[0] != GroupPrefix) &&
+		len(user) <= d.maxUserLength &&
+		len(scheme) <= d.maxSchemeLength &&
+		len(cred) <= d.maxCredentialLength
+}
+
+// WithTLSHandshakeTimeout bounds the TLS handshake more tightly than the
+// handshake timeout, which then only leaves the rest for the LOGIN request.
+// By default, the TLS handshake is only bounded by the handshake timeout.
+func WithTLSHandshakeTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.tlsHandshakeTimeout = d
+	}
+}
+
+// handshake performs the TLS handshake of a connection whose deadline is
+// already set for the whole login.
+func (s *Server) handshake(c *tls.Conn, deadline time.Time) error {
+	if s.tlsHandshakeTimeout > 0 {
+		if d := time.Now().Add(s.tlsHandshakeTimeout); d.Before(deadline) {
+			c.SetDeadline(d)
+			defer c.SetDeadline(deadline)
+		}
+	}
+	return c.Handshake()
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"github.com/aerofs/lipwig/ssmp"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// features accepted by default in response to HELLO
+var defaultFeatures = []string{ssmp.LEASE, ssmp.REAUTH, ssmp.ECHO}
+
+// how long the server waits for the first request to find out whether it is
+// HELLO, before waiting for LOGIN until the handshake deadline
+const helloTimeout = time.Second
+
+// WithFeatures sets the optional features the server accepts when a client
+// negotiates them with a HELLO request, among COMPRESS, LEASE, REAUTH and
+// ECHO. The default is LEASE, REAUTH and ECHO.
+func WithFeatures(features ...string) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.features = features
+	}
+}
+
+// negotiate answers the optional HELLO request that precedes LOGIN:
+//
+//	HELLO <version> [<feature> ...]
+//
+// with the version used for the session, the lowest of both peers, and the
+// requested features that the server accepts:
+//
+//	HELLO <version> [<feature> ...]
+//
+// If the first request isn't HELLO, or doesn't arrive within helloTimeout,
+// the decoder is rewound for LOGIN to be decoded before the deadline and the
+// client gets the base protocol, without features. Servers with a
+// PreLoginHandler leave HELLO to the handler.
+func (d *Dispatcher) negotiate(c net.Conn, r *ssmp.Decoder, deadline time.Time) ([]string, error) {
+	if t := time.Now().Add(helloTimeout); t.Before(deadline) {
+		c.SetReadDeadline(t)
+	}
+	verb, err := r.DecodeVerb()
+	c.SetReadDeadline(deadline)
+	if err != nil || !ssmp.Equal(verb, ssmp.HELLO) {
+		r.Rewind()
+		return nil, nil
+	}
+	v, err := r.DecodeId()
+	if err != nil {
+		return nil, ErrInvalidLogin
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil || version < 1 {
+		c.Write(respBadRequest)
+		return nil, ErrInvalidLogin
+	}
+	if version > ssmp.ProtocolVersion {
+		version = ssmp.ProtocolVersion
+	}
+	var requested []byte
+	if !r.AtEnd() {
+		if requested, err = r.DecodePayload(); err != nil {
+			return nil, ErrInvalidLogin
+		}
+	}
+	features := []string{}
+	for _, f := range bytes.Fields(requested) {
+		if contains(d.features, string(f)) && !contains(features, string(f)) {
+			features = append(features, string(f))
+		}
+	}
+	r.Reset()
+	resp := ssmp.NewMessage().Verb(ssmp.HELLO).Id(strconv.Itoa(version))
+	if len(features) > 0 {
+		resp.Payload(strings.Join(features, " "))
+	}
+	if _, err = c.Write(resp.MustBuild()); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+// Features returns the optional features negotiated by the HELLO request of
+// the connection, if any.
+func (c *Connection) Features() []string {
+	return c.features
+}
+
+// HasFeature reports whether a feature was negotiated by the connection.
+func (c *Connection) HasFeature(f string) bool {
+	return contains(c.features, f)
+}
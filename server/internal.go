@@ -0,0 +1,151 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"net"
+	"sync"
+	"time"
+)
+
+// InternalHandler is called for every MCAST message received by an internal
+// subscription.
+type InternalHandler func(from string, payload []byte)
+
+// InternalSubscription allows the server process itself to receive the
+// messages sent to a Topic, without a loopback network connection.
+type InternalSubscription struct {
+	t  *Topic
+	c  *Connection
+	ic *internalConn
+}
+
+// number of events buffered between publishers and the handler
+const internalQueueSize = 64
+
+var ErrInvalidTopic error = fmt.Errorf("invalid topic")
+
+// SubscribeInternal subscribes a synthetic connection to a topic, creating
+// the topic if needed. The handler is called from a dedicated goroutine, in
+// the order in which messages were published.
+func (s *TopicManager) SubscribeInternal(topic string, h InternalHandler) (*InternalSubscription, error) {
+	if !ssmp.IsValidIdentifier(topic) {
+		return nil, ErrInvalidTopic
+	}
+	ic := &internalConn{
+		localConn: newLocalConn(),
+		events:    make(chan internalEvent, internalQueueSize),
+	}
+	c := newLocalConnection(ic, ssmp.Anonymous)
+	t, err := s.subscribe([]byte(topic), c, 0)
+	if err != nil {
+		return nil, err
+	}
+	go ic.dispatch(h)
+	return &InternalSubscription{t: t, c: c, ic: ic}, nil
+}
+
+// Close unsubscribes from the topic.
+// Messages already received are still passed to the handler.
+func (s *InternalSubscription) Close() {
+	s.t.Unsubscribe(s.c)
+	s.c.Close()
+}
+
+type internalEvent struct {
+	from    string
+	payload []byte
+}
+
+// internalConn decodes incoming events and queues MCAST messages for
+// delivery to an InternalHandler.
+type internalConn struct {
+	*localConn
+	events chan internalEvent
+}
+
+func (ic *internalConn) dispatch(h InternalHandler) {
+	for {
+		select {
+		case e := <-ic.events:
+			h(e.from, e.payload)
+		case <-ic.done:
+			for {
+				select {
+				case e := <-ic.events:
+					h(e.from, e.payload)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ic *internalConn) Write(b []byte) (int, error) {
+	m, err := ssmp.ParseMessage(b)
+	if err != nil {
+		return 0, err
+	}
+	if m.Code != ssmp.CodeEvent || !ssmp.Equal(m.Verb, ssmp.MCAST) {
+		// presence and eviction events are of no interest
+		return len(b), nil
+	}
+	e := internalEvent{
+		from:    string(m.From),
+		payload: append([]byte(nil), m.Payload...),
+	}
+	select {
+	case ic.events <- e:
+		return len(b), nil
+	case <-ic.done:
+		return 0, errConnectionClosed
+	}
+}
+
+// newLocalConnection creates a Connection without read goroutine, for use
+// with a localConn.
+func newLocalConnection(c net.Conn, user string) *Connection {
+	cc := &Connection{
+		c:  c,
+		p:  ssmp.NewProtocol(c),
+		id: newConnectionID(),
+	}
+	cc.setUser(user)
+	return cc
+}
+
+// localConn is the base of net.Conn implementations that are local to the
+// server process and never read from.
+type localConn struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func newLocalConn() *localConn {
+	return &localConn{done: make(chan struct{})}
+}
+
+func (lc *localConn) Read(b []byte) (int, error) {
+	<-lc.done
+	return 0, errConnectionClosed
+}
+
+func (lc *localConn) Close() error {
+	lc.once.Do(func() { close(lc.done) })
+	return nil
+}
+
+type internalAddr struct{}
+
+func (internalAddr) Network() string { return "internal" }
+func (internalAddr) String() string  { return "internal" }
+
+func (lc *localConn) LocalAddr() net.Addr                { return internalAddr{} }
+func (lc *localConn) RemoteAddr() net.Addr               { return internalAddr{} }
+func (lc *localConn) SetDeadline(t time.Time) error      { return nil }
+func (lc *localConn) SetReadDeadline(t time.Time) error  { return nil }
+func (lc *localConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,166 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"github.com/aerofs/lipwig/ssmp"
+	"strconv"
+	"time"
+)
+
+// default interval between two scans of subscription leases
+const defaultLeaseScanInterval = time.Second
+
+// WithLeaseScanInterval sets the interval at which expired subscription
+// leases are reaped. Subscriptions may therefore outlive their lease by up to
+// that interval. Zero disables reaping. The default is 1s.
+func WithLeaseScanInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.leaseScanInterval = d
+	}
+}
+
+// parseLease extracts the LEASE <ttl> option, in seconds, from the options
+// of a SUBSCRIBE request. It returns the remaining options, a zero ttl if
+// there is no lease, and false if the option is malformed.
+func parseLease(option []byte) ([]byte, time.Duration, bool) {
+	fields := bytes.Split(option, []byte{' '})
+	for i, o := range fields {
+		if !ssmp.Equal(o, ssmp.LEASE) {
+			continue
+		}
+		if i+1 == len(fields) {
+			return nil, 0, false
+		}
+		ttl, err := strconv.Atoi(string(fields[i+1]))
+		if err != nil || ttl <= 0 {
+			return nil, 0, false
+		}
+		rest := append(fields[:i:i], fields[i+2:]...)
+		return bytes.Join(rest, []byte{' '}), time.Duration(ttl) * time.Second, true
+	}
+	return option, 0, true
+}
+
+// setLease makes the subscription of a connection expire at the given time,
+// unless renewed. It returns false if the connection isn't subscribed.
+func (t *Topic) setLease(c *Connection, expiry time.Time) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if _, subscribed := t.c[c]; !subscribed {
+		return false
+	}
+	if t.leases == nil {
+		t.leases = make(map[*Connection]time.Time)
+	}
+	t.leases[c] = expiry
+	return true
+}
+
+// renewLease extends the lease of a subscription, and returns false if the
+// connection isn't subscribed with a lease.
+func (t *Topic) renewLease(c *Connection, expiry time.Time) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if _, ok := t.leases[c]; !ok {
+		return false
+	}
+	t.leases[c] = expiry
+	return true
+}
+
+// expiredLeases returns the subscribers whose lease expired before now.
+func (t *Topic) expiredLeases(now time.Time) []*Connection {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	var l []*Connection
+	for c, expiry := range t.leases {
+		if expiry.Before(now) {
+			l = append(l, c)
+		}
+	}
+	return l
+}
+
+// expireLease unsubscribes a connection if its lease is still expired, i.e.
+// it wasn't renewed since expiredLeases.
+func (t *Topic) expireLease(c *Connection, now time.Time) bool {
+	t.l.Lock()
+	expiry, ok := t.leases[c]
+	if !ok || !expiry.Before(now) {
+		t.l.Unlock()
+		return false
+	}
+	_, n := t.unsubscribe(c)
+	t.l.Unlock()
+	t.notifyCount(n)
+	return true
+}
+
+// ReapLeases unsubscribes all connections whose subscription lease expired,
+// as if they had sent an UNSUBSCRIBE request. The evicted connections also
+// receive an UNSUBSCRIBE event from the anonymous user, as on Topic.Drain.
+// It returns the number of removed subscriptions.
+func (d *Dispatcher) ReapLeases() int {
+	now := d.now()
+	n := 0
+	d.topics.ForEach(func(_ string, t *Topic) {
+		for _, c := range t.expiredLeases(now) {
+			if t.expireLease(c, now) {
+				d.leaseExpired(c, t)
+				n++
+			}
+		}
+	})
+	return n
+}
+
+func (d *Dispatcher) leaseExpired(c *Connection, t *Topic) {
+	c.unsubscribeFrom(t)
+	d.save(c.User(), []byte(t.Name), 0, true)
+	event := []byte(respEvent + c.User() + " " + ssmp.UNSUBSCRIBE + " " + t.Name + "\n")
+	t.ForAll(func(cc *Connection, flags SubscriberFlags) {
+		if flags.Has(Presence) {
+			cc.Write(event)
+		}
+	})
+	d.logEvent(ssmp.UNSUBSCRIBE, c, []byte(t.Name), nil)
+	c.Write([]byte(respEvent + ssmp.Anonymous + " " + ssmp.UNSUBSCRIBE + " " + t.Name + "\n"))
+}
+
+// startLeaseReaper starts the goroutine that periodically reaps expired
+// subscription leases.
+func (s *Server) startLeaseReaper() {
+	if s.leaseScanInterval <= 0 || s.leaseStop != nil {
+		return
+	}
+	s.leaseStop = make(chan struct{})
+	s.leaseDone = make(chan struct{})
+	go s.leaseReaper(s.leaseScanInterval)
+}
+
+// stopLeaseReaper waits for the goroutine started by startLeaseReaper to
+// exit.
+func (s *Server) stopLeaseReaper() {
+	if s.leaseStop == nil {
+		return
+	}
+	close(s.leaseStop)
+	<-s.leaseDone
+}
+
+func (s *Server) leaseReaper(interval time.Duration) {
+	defer close(s.leaseDone)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.dispatcher.ReapLeases()
+		case <-s.leaseStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// ConnectLoopback connects an in-process client to the server through a
+// net.Pipe, without network round trip nor authentication: the LOGIN request
+// sent on the returned connection is always accepted.
+// The returned channel is closed once the connection is registered with the
+// server, or rejected, see ssmptest.NewLoopbackClient.
+func (s *Server) ConnectLoopback() (net.Conn, <-chan struct{}) {
+	sc, cc := net.Pipe()
+	var c net.Conn = sc
+	if s.byteMetrics {
+		c = NewStatsConn(sc)
+	}
+	connected := make(chan struct{})
+	go func() {
+		s.connectWith(c, loopbackAuth{}, time.Now().Add(s.dispatcher.handshakeTimeout))
+		close(connected)
+	}()
+	return cc, connected
+}
+
+// loopbackAuth trusts in-process clients.
+type loopbackAuth struct{}
+
+func (loopbackAuth) Auth(_ net.Conn, _, _, _ []byte) bool {
+	return true
+}
+
+func (loopbackAuth) Unauthorized() []byte {
+	return respUnauthorized
+}
+
+func (loopbackAuth) inProcess() {}
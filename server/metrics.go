@@ -0,0 +1,51 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// WriteMetrics writes the per-verb dispatch counters in the Prometheus text
+// exposition format:
+//
+//	ssmp_payload_bytes_histogram{verb}    size of request payloads
+//	ssmp_message_parse_errors_total{verb} malformed requests
+func (d *Dispatcher) WriteMetrics(w io.Writer) error {
+	st := d.Stats()
+	verbs := make([]string, 0, len(st.Errors))
+	for verb := range st.Errors {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+
+	var err error
+	printf := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+	printf("# HELP ssmp_payload_bytes_histogram Size of request payloads.\n")
+	printf("# TYPE ssmp_payload_bytes_histogram histogram\n")
+	for _, verb := range verbs {
+		h, ok := st.PayloadSizes[verb]
+		if !ok {
+			continue
+		}
+		for i, bound := range PayloadBuckets {
+			printf("ssmp_payload_bytes_histogram_bucket{verb=%q,le=\"%d\"} %d\n", verb, bound, h.Buckets[i])
+		}
+		printf("ssmp_payload_bytes_histogram_bucket{verb=%q,le=\"+Inf\"} %d\n", verb, h.Count)
+		printf("ssmp_payload_bytes_histogram_sum{verb=%q} %d\n", verb, h.Sum)
+		printf("ssmp_payload_bytes_histogram_count{verb=%q} %d\n", verb, h.Count)
+	}
+	printf("# HELP ssmp_message_parse_errors_total Malformed requests.\n")
+	printf("# TYPE ssmp_message_parse_errors_total counter\n")
+	for _, verb := range verbs {
+		printf("ssmp_message_parse_errors_total{verb=%q} %d\n", verb, st.Errors[verb])
+	}
+	return err
+}
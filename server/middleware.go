@@ -0,0 +1,119 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// A DispatchMiddleware is invoked in place of a verb handler, after the
+// request is parsed and validated. It may inspect or modify the fields,
+// respond directly to c, and decides whether to call next.
+// The Dispatcher argument of next is ignored and may be nil.
+type DispatchMiddleware func(c *Connection, verb []byte, to, payload, raw []byte, next HandlerFunc)
+
+// Use appends middleware to the chain wrapping every verb handler.
+// The first middleware added is the outermost one.
+// This method is not safe to call once the server has started.
+func (d *Dispatcher) Use(mw ...DispatchMiddleware) {
+	d.handler.Lock()
+	defer d.handler.Unlock()
+	d.middleware = append(d.middleware, mw...)
+	d.rewrap()
+}
+
+// useFirst makes mw the outermost middleware.
+func (d *Dispatcher) useFirst(mw DispatchMiddleware) {
+	d.handler.Lock()
+	defer d.handler.Unlock()
+	d.middleware = append([]DispatchMiddleware{mw}, d.middleware...)
+	d.rewrap()
+}
+
+func (d *Dispatcher) rewrap() {
+	for verb, h := range d.handlers {
+		h.w = d.wrap(verb, h.h)
+		d.handlers[verb] = h
+	}
+}
+
+// wrap builds the middleware chain for a verb once, so that dispatching
+// doesn't allocate.
+func (d *Dispatcher) wrap(verb string, h HandlerFunc) HandlerFunc {
+	v := []byte(verb)
+	for i := len(d.middleware) - 1; i >= 0; i-- {
+		mw, inner := d.middleware[i], h
+		next := func(c *Connection, to, payload, raw []byte, _ *Dispatcher) {
+			inner(c, to, payload, raw, d)
+		}
+		h = func(c *Connection, to, payload, raw []byte, _ *Dispatcher) {
+			mw(c, v, to, payload, raw, next)
+		}
+	}
+	return h
+}
+
+// The Logger interface is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LoggingMiddleware logs every request along with its processing time.
+// Secret fields, e.g. the session token of RESUME, are redacted.
+func LoggingMiddleware(l Logger) DispatchMiddleware {
+	return func(c *Connection, verb []byte, to, payload, raw []byte, next HandlerFunc) {
+		start := time.Now()
+		next(c, to, payload, raw, nil)
+		if c.d != nil {
+			to = redactTo(c.d.fields(verb), to)
+		}
+		l.Printf("%s %s %s %v", c.User(), verb, to, time.Since(start))
+	}
+}
+
+// stdoutLogger is the Logger used when none is provided.
+type stdoutLogger struct{}
+
+func (stdoutLogger) Printf(format string, v ...interface{}) {
+	fmt.Printf(format+"\n", v...)
+}
+
+// RecoveryMiddleware recovers from panics in inner middleware and handlers.
+// The panic is logged with a stack trace, the request is answered with a 501
+// response and the connection keeps being served, from the next request.
+func RecoveryMiddleware(l Logger) DispatchMiddleware {
+	return func(c *Connection, verb []byte, to, payload, raw []byte, next HandlerFunc) {
+		defer func() {
+			if r := recover(); r != nil {
+				l.Printf("panic in %s handler for %s: %v\n%s", verb, c.User(), r, debug.Stack())
+				if c.r != nil {
+					c.r.ForceReset()
+				}
+				c.Write(respNotImplemented)
+			}
+		}()
+		next(c, to, payload, raw, nil)
+	}
+}
+
+// A Span is a traced operation.
+type Span interface {
+	End()
+}
+
+// The Tracer interface abstracts a tracing library.
+type Tracer interface {
+	Start(name string) Span
+}
+
+// TracingMiddleware wraps every request in a span named after its verb.
+func TracingMiddleware(t Tracer) DispatchMiddleware {
+	return func(c *Connection, verb []byte, to, payload, raw []byte, next HandlerFunc) {
+		s := t.Start(string(verb))
+		defer s.End()
+		next(c, to, payload, raw, nil)
+	}
+}
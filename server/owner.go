@@ -0,0 +1,213 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrNotOwner error = fmt.Errorf("not the topic owner")
+
+// upper bound of the History of a topic
+const maxHistory = 100
+
+// topicSettings are the options set by a CONFIGURE request. Nil fields are
+// left unchanged.
+type topicSettings struct {
+	maxSubscribers *int
+	rateLimit      *int
+	history        *int
+}
+
+// parseTopicSettings parses the space-separated key=value pairs of a
+// CONFIGURE request. Keys are case-insensitive. It returns false if any key
+// is unknown or any value is invalid.
+func parseTopicSettings(payload []byte) (topicSettings, bool) {
+	var s topicSettings
+	for _, kv := range bytes.Fields(payload) {
+		i := bytes.IndexByte(kv, '=')
+		if i == -1 {
+			return s, false
+		}
+		v, err := strconv.Atoi(string(kv[i+1:]))
+		if err != nil || v < 0 {
+			return s, false
+		}
+		switch k := string(kv[:i]); {
+		case strings.EqualFold(k, "MaxSubscribers"):
+			s.maxSubscribers = &v
+		case strings.EqualFold(k, "RateLimit"):
+			s.rateLimit = &v
+		case strings.EqualFold(k, "History") && v <= maxHistory:
+			s.history = &v
+		default:
+			return s, false
+		}
+	}
+	return s, true
+}
+
+// configureAs applies settings on behalf of a user, and returns ErrNotOwner
+// if the user doesn't own the topic.
+func (t *Topic) configureAs(user string, s topicSettings) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.owner != user {
+		return ErrNotOwner
+	}
+	if s.maxSubscribers != nil {
+		t.maxSubscribers = *s.maxSubscribers
+	}
+	if s.rateLimit != nil {
+		t.rateLimit = *s.rateLimit
+	}
+	if s.history != nil {
+		t.historySize = *s.history
+		t.trimHistory()
+	}
+	return nil
+}
+
+// MaxSubscribers returns the maximum number of subscribers, zero meaning
+// unlimited.
+func (t *Topic) MaxSubscribers() int {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.maxSubscribers
+}
+
+// Owner returns the user allowed to CONFIGURE the topic: its first
+// subscriber, then, when the owner unsubscribes, the remaining subscriber
+// that comes first in alphabetical order. Anonymous and internal subscribers
+// never own a topic, and neither does anyone a topic configured by
+// TopicManager.Import.
+// An empty string is returned if the topic has no owner.
+func (t *Topic) Owner() string {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.owner
+}
+
+// RateLimit returns the maximum number of MCAST per second, zero meaning
+// unlimited. MCAST exceeding it are rejected with 429.
+func (t *Topic) RateLimit() int {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.rateLimit
+}
+
+// History returns the number of recent MCAST events sent to new subscribers,
+// after the response to SUBSCRIBE.
+func (t *Topic) History() int {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.historySize
+}
+
+// canOwn reports whether a subscriber may become the owner of the topic.
+// It must be called with the lock held.
+func (t *Topic) canOwn(c *Connection) bool {
+	return !t.configured && c.User() != ssmp.Anonymous
+}
+
+// nextOwner returns the subscriber allowed to own the topic that comes first
+// in alphabetical order, or an empty string if there is none.
+// It must be called with the lock held.
+func (t *Topic) nextOwner() string {
+	owner := ""
+	for c := range t.c {
+		if t.canOwn(c) && (owner == "" || c.User() < owner) {
+			owner = c.User()
+		}
+	}
+	return owner
+}
+
+// allowPublish reports whether a message may be published without exceeding
+// the RateLimit of the topic, and counts it if so.
+func (t *Topic) allowPublish(now time.Time) bool {
+	t.l.RLock()
+	limited := t.rateLimit > 0
+	t.l.RUnlock()
+	if !limited {
+		return true
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.rateLimit <= 0 {
+		return true
+	}
+	if sec := now.Unix(); sec != t.rateSecond {
+		t.rateSecond = sec
+		t.rateCount = 0
+	}
+	if t.rateCount >= t.rateLimit {
+		return false
+	}
+	t.rateCount++
+	return true
+}
+
+// record keeps a copy of a published event if the topic has a History.
+func (t *Topic) record(event []byte) {
+	t.l.RLock()
+	enabled := t.historySize > 0
+	t.l.RUnlock()
+	if !enabled {
+		return
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.historySize <= 0 {
+		return
+	}
+	t.history = append(t.history, append([]byte(nil), event...))
+	t.trimHistory()
+}
+
+// trimHistory drops the events exceeding the History of the topic.
+// It must be called with the lock held.
+func (t *Topic) trimHistory() {
+	if n := len(t.history) - t.historySize; n > 0 {
+		t.history = append(t.history[:0:0], t.history[n:]...)
+	}
+}
+
+// recentEvents returns the events kept by record, oldest first.
+func (t *Topic) recentEvents() [][]byte {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.history
+}
+
+// onConfigure changes the options of a topic: CONFIGURE <topic> <key>=<value>...
+// Only the owner of the topic is allowed to configure it, see Topic.Owner.
+func onConfigure(c *Connection, n, payload, _ []byte, d *Dispatcher) {
+	if c.User() == ssmp.Anonymous {
+		c.Write(respNotAllowed)
+		return
+	}
+	s, ok := parseTopicSettings(payload)
+	if !ok {
+		fmt.Println("invalid topic settings:", string(payload))
+		c.Write(respBadRequest)
+		return
+	}
+	t := d.topics.GetTopic(n)
+	if t == nil {
+		c.Write(respNotFound)
+		return
+	}
+	if err := t.configureAs(c.User(), s); err != nil {
+		c.Write(respNotAllowed)
+		return
+	}
+	d.logEvent(ssmp.CONFIGURE, c, n, payload)
+	c.Write(respOk)
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"sync"
+)
+
+// StoredSubscription is a subscription saved by a TopicPersister.
+type StoredSubscription struct {
+	User     string
+	Topic    string
+	Presence bool
+}
+
+// The TopicPersister interface is used to save subscriptions to external
+// storage so they can be restored after a restart.
+//
+// Subscriptions are saved on SUBSCRIBE and deleted on UNSUBSCRIBE. Closing
+// a connection does not delete its subscriptions: their topics are recreated
+// when the server is started, and they are restored when the user logs in
+// again.
+//
+// Changes are saved asynchronously, in a single goroutine. Changes made to
+// the same subscription while the persister is busy are coalesced, so that
+// only the latest one is saved.
+type TopicPersister interface {
+	SaveSubscription(user, topic string, presence bool)
+	DeleteSubscription(user, topic string)
+	LoadSubscriptions() ([]StoredSubscription, error)
+}
+
+// WithPersister saves subscriptions to p and restores them when the
+// server is started.
+func WithPersister(p TopicPersister) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.persister = p
+	}
+}
+
+type persistKey struct {
+	user  string
+	topic string
+}
+
+type persistOp struct {
+	sub    StoredSubscription
+	delete bool
+}
+
+// subscriptions loaded at startup, waiting for their users to login
+type pendingSubscriptions struct {
+	l    sync.Mutex
+	subs map[string][]StoredSubscription
+}
+
+// changes waiting to be saved by the persister goroutine, the latest one for
+// each subscription
+type persistQueue struct {
+	l       sync.Mutex
+	ops     map[persistKey]persistOp
+	running bool
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// startPersister loads stored subscriptions, recreates their topics and
+// starts the goroutine that asynchronously saves changes.
+func (d *Dispatcher) startPersister() {
+	if d.persister == nil {
+		return
+	}
+	subs, err := d.persister.LoadSubscriptions()
+	if err != nil {
+		fmt.Println("failed to load subscriptions:", err)
+	}
+	d.pending.l.Lock()
+	d.pending.subs = make(map[string][]StoredSubscription)
+	for _, sub := range subs {
+		d.topics.GetOrCreateTopic([]byte(sub.Topic))
+		d.pending.subs[sub.User] = append(d.pending.subs[sub.User], sub)
+	}
+	d.pending.l.Unlock()
+
+	q := &d.persist
+	q.l.Lock()
+	q.ops = make(map[persistKey]persistOp)
+	q.running = true
+	q.wake = make(chan struct{}, 1)
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+	go d.persistLoop(q.wake, q.stop, q.done)
+	q.l.Unlock()
+}
+
+// stopPersister waits for all pending persister operations to complete.
+// Changes made afterwards are saved synchronously.
+func (d *Dispatcher) stopPersister() {
+	q := &d.persist
+	q.l.Lock()
+	if !q.running {
+		q.l.Unlock()
+		return
+	}
+	q.running = false
+	stop, done := q.stop, q.done
+	q.l.Unlock()
+	close(stop)
+	<-done
+}
+
+func (d *Dispatcher) persistLoop(wake, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-wake:
+			d.applyPending()
+		case <-stop:
+			// no change is queued once stopped
+			d.applyPending()
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) applyPending() {
+	q := &d.persist
+	for {
+		q.l.Lock()
+		ops := q.ops
+		q.ops = make(map[persistKey]persistOp)
+		q.l.Unlock()
+		if len(ops) == 0 {
+			return
+		}
+		for _, op := range ops {
+			d.apply(op)
+		}
+	}
+}
+
+func (d *Dispatcher) apply(op persistOp) {
+	if op.delete {
+		d.persister.DeleteSubscription(op.sub.User, op.sub.Topic)
+	} else {
+		d.persister.SaveSubscription(op.sub.User, op.sub.Topic, op.sub.Presence)
+	}
+}
+
+// save queues a change for the persister goroutine, replacing any pending
+// change of the same subscription, without blocking the caller.
+func (d *Dispatcher) save(user string, topic []byte, flags SubscriberFlags, delete bool) {
+	if d.persister == nil {
+		return
+	}
+	op := persistOp{
+		sub: StoredSubscription{
+			User:     user,
+			Topic:    string(topic),
+			Presence: flags.Has(Presence),
+		},
+		delete: delete,
+	}
+	q := &d.persist
+	q.l.Lock()
+	if !q.running {
+		done := q.done
+		q.l.Unlock()
+		if done != nil {
+			// let pending changes be saved first
+			<-done
+		}
+		d.apply(op)
+		return
+	}
+	q.ops[persistKey{user: user, topic: op.sub.Topic}] = op
+	q.l.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// restore subscribes a new connection to the topics stored for its user, as
+// if it sent the SUBSCRIBE requests itself, except that no response is sent.
+// It is called from the read goroutine of the connection, or before it is
+// started.
+func (d *Dispatcher) restore(c *Connection) {
+	if d.persister == nil {
+		return
+	}
+	d.pending.l.Lock()
+	subs := d.pending.subs[c.User()]
+	delete(d.pending.subs, c.User())
+	d.pending.l.Unlock()
+	for _, sub := range subs {
+		var flags SubscriberFlags
+		if sub.Presence {
+			flags = Presence
+		}
+		n := []byte(sub.Topic)
+		t, err := d.topics.subscribe(n, c, flags)
+		if err != nil {
+			continue
+		}
+		c.Subscribe(t)
+		option := formatSubscriberFlags(flags)
+		d.logEvent(ssmp.SUBSCRIBE, c, n, option)
+		s := []byte(ssmp.SUBSCRIBE + " " + sub.Topic)
+		if len(option) > 0 {
+			s = append(append(s, ' '), option...)
+		}
+		d.subscribed(c, t, n, flags, append(s, '\n'), nil)
+	}
+}
+
+// InMemoryPersister is a TopicPersister keeping subscriptions in memory.
+// It is mostly useful for testing.
+type InMemoryPersister struct {
+	l    sync.Mutex
+	subs map[string]map[string]bool
+}
+
+func NewInMemoryPersister() *InMemoryPersister {
+	return &InMemoryPersister{
+		subs: make(map[string]map[string]bool),
+	}
+}
+
+func (p *InMemoryPersister) SaveSubscription(user, topic string, presence bool) {
+	p.l.Lock()
+	if p.subs[user] == nil {
+		p.subs[user] = make(map[string]bool)
+	}
+	p.subs[user][topic] = presence
+	p.l.Unlock()
+}
+
+func (p *InMemoryPersister) DeleteSubscription(user, topic string) {
+	p.l.Lock()
+	delete(p.subs[user], topic)
+	if len(p.subs[user]) == 0 {
+		delete(p.subs, user)
+	}
+	p.l.Unlock()
+}
+
+func (p *InMemoryPersister) LoadSubscriptions() ([]StoredSubscription, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	var subs []StoredSubscription
+	for user, topics := range p.subs {
+		for topic, presence := range topics {
+			subs = append(subs, StoredSubscription{
+				User:     user,
+				Topic:    topic,
+				Presence: presence,
+			})
+		}
+	}
+	return subs, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"net"
+)
+
+// A PreLoginHandler replaces the decoding of the LOGIN request of new
+// connections, to allow custom handshakes before it, e.g. a banner or a
+// capability negotiation.
+//
+// Handle may read from r and write to c until the LOGIN request is received,
+// and returns its fields, typically with DecodeLogin. The decoder must be
+// reset between messages and left at the end of the LOGIN request. The
+// returned fields are checked and authenticated as usual, and a non-nil error
+// rejects the connection with a 400 response.
+// The whole handshake is bounded by the handshake timeout, see
+// WithHandshakeTimeout. HELLO requests are not answered by the server. As
+// clients send them by default, the handler must answer them, or clients be
+// created with client.WithHello(false).
+type PreLoginHandler interface {
+	Handle(c net.Conn, r *ssmp.Decoder) (user, scheme, cred []byte, err error)
+}
+
+// The PreLoginHandlerFunc type is an adapter to allow the use of ordinary
+// functions as PreLoginHandler.
+type PreLoginHandlerFunc func(c net.Conn, r *ssmp.Decoder) (user, scheme, cred []byte, err error)
+
+func (f PreLoginHandlerFunc) Handle(c net.Conn, r *ssmp.Decoder) ([]byte, []byte, []byte, error) {
+	return f(c, r)
+}
+
+// SetPreLoginHandler sets the handler of new connections up to their LOGIN
+// request. In-process connections, i.e. loopback clients and those made by
+// Dispatcher.Connect, are not affected. A nil handler
+// restores the default behavior.
+// This method is not safe to call once the server accepts connections, see
+// WithPreLoginHandler.
+func (d *Dispatcher) SetPreLoginHandler(h PreLoginHandler) {
+	d.preLogin = h
+}
+
+// WithPreLoginHandler sets the PreLoginHandler of the Dispatcher, see
+// Dispatcher.SetPreLoginHandler.
+func WithPreLoginHandler(h PreLoginHandler) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.SetPreLoginHandler(h)
+	}
+}
+
+// isValidLogin checks the fields returned by a PreLoginHandler, and that the
+// decoder can be reset.
+func isValidLogin(r *ssmp.Decoder, user, scheme []byte) bool {
+	return r.AtEnd() && len(user) > 0 && len(scheme) > 0 &&
+		ssmp.IsValidIdentifier(string(user)) && ssmp.IsValidIdentifier(string(scheme))
+}
+
+// DecodeLogin decodes a LOGIN request:
+//
+//	LOGIN <user> <scheme> [<cred>]
+//
+// ErrInvalidLogin is returned if the request is malformed. The credentials
+// are empty if absent.
+func DecodeLogin(r *ssmp.Decoder) (user, scheme, cred []byte, err error) {
+	verb, err := r.DecodeVerb()
+	if err != nil || !ssmp.Equal(verb, ssmp.LOGIN) {
+		return nil, nil, nil, ErrInvalidLogin
+	}
+	if user, err = r.DecodeId(); err != nil {
+		return nil, nil, nil, ErrInvalidLogin
+	}
+	if scheme, err = r.DecodeId(); err != nil {
+		return nil, nil, nil, ErrInvalidLogin
+	}
+	if r.AtEnd() {
+		cred = []byte{}
+	} else if cred, err = r.DecodePayload(); err != nil {
+		return nil, scheme, nil, ErrInvalidLogin
+	}
+	return user, scheme, cred, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"time"
+)
+
+// WithCredentialExpiry closes named connections that have not presented
+// fresh credentials with a REAUTH request within maxAge of their last
+// successful authentication. Expired connections receive a CLOSE event from
+// the anonymous user before being closed.
+// By default credentials never expire.
+func WithCredentialExpiry(maxAge time.Duration) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.credentialExpiry = maxAge
+	}
+}
+
+// WithClock replaces time.Now as the clock against which credential expiry
+// and subscription leases are checked, e.g. to test WithCredentialExpiry
+// without waiting.
+func WithClock(now func() time.Time) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.now = now
+	}
+}
+
+// credentialDeadline returns the time at which the credentials of the
+// connection expire, and false if they never do.
+func (c *Connection) credentialDeadline(d *Dispatcher) (time.Time, bool) {
+	if d.credentialExpiry <= 0 || c.lastAuth.IsZero() {
+		return time.Time{}, false
+	}
+	return c.lastAuth.Add(d.credentialExpiry), true
+}
+
+func (c *Connection) credentialsExpired(d *Dispatcher) bool {
+	exp, ok := c.credentialDeadline(d)
+	return ok && !d.now().Before(exp)
+}
+
+// expireCredentials closes the connection if its credentials expired, as
+// with ForceClose so that its session cannot be resumed to renew them.
+// It returns false if the credentials are still valid.
+func (c *Connection) expireCredentials(d *Dispatcher) bool {
+	if !c.credentialsExpired(d) {
+		return false
+	}
+	fmt.Println("credentials expired", c.User())
+	c.forceClose()
+	return true
+}
+
+// onReauth re-validates the credentials of a named connection:
+//
+//	REAUTH <scheme> [<cred>]
+//
+// The credentials are checked by the same Authenticator as LOGIN, for the
+// user of the connection. Rejected credentials close the connection.
+func onReauth(c *Connection, _, payload, _ []byte, d *Dispatcher) {
+	if c.User() == ssmp.Anonymous {
+		c.Write(respNotAllowed)
+		return
+	}
+	scheme, cred := split(payload)
+	if len(scheme) == 0 || !ssmp.IsValidIdentifier(string(scheme)) {
+		c.Write(respBadRequest)
+		return
+	}
+	if cred == nil {
+		cred = []byte{}
+	}
+	if !d.validLogin(nil, scheme, cred) {
+		c.Write(respBadRequest)
+		return
+	}
+	if d.auth == nil {
+		c.Write(respNotImplemented)
+		return
+	}
+	if !d.auth.Auth(c.c, []byte(c.User()), scheme, cred) {
+		fmt.Println("reauth rejected", c.User())
+		c.Write(d.unauthorizedResponse(scheme))
+		c.Close()
+		return
+	}
+	c.lastAuth = d.now()
+	if d.sessions != nil {
+		d.sessions.authenticated(c)
+	}
+	c.Write(respOk)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"github.com/aerofs/lipwig/ssmp"
+)
+
+// parseMsgid extracts the message ID of a MCAST payload of the form
+//
+//	<msgid>:<payload>
+//
+// It returns an empty ID if the payload has no valid message ID prefix.
+func parseMsgid(payload []byte) string {
+	i := bytes.IndexByte(payload, ':')
+	if i <= 0 || !ssmp.IsValidIdentifier(string(payload[:i])) {
+		return ""
+	}
+	return string(payload[:i])
+}
+
+// sendReceipt notifies the sender of a MCAST that it was delivered to a
+// subscriber with the Receipt flag:
+//
+//	000 <msgid> RECEIPT <subscriber>
+//
+// Receipts are sent before the response to the MCAST request.
+func sendReceipt(sender *Connection, msgid string, subscriber string) {
+	sender.Write([]byte(respEvent + msgid + " " + ssmp.RECEIPT + " " + subscriber + "\n"))
+}
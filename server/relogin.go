@@ -0,0 +1,61 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+)
+
+// onRelogin upgrades an anonymous connection to a named one:
+//
+//	RELOGIN <user> <scheme> [<cred>]
+//
+// The credentials are checked by the same Authenticator as LOGIN. Named
+// connections cannot RELOGIN.
+func onRelogin(c *Connection, user, payload, _ []byte, d *Dispatcher) {
+	if c.User() != ssmp.Anonymous {
+		fmt.Println("attempted re-login")
+		c.Write(respNotAllowed)
+		return
+	}
+	scheme, cred := split(payload)
+	if ssmp.Equal(user, ssmp.Anonymous) || len(scheme) == 0 || !ssmp.IsValidIdentifier(string(scheme)) {
+		c.Write(respBadRequest)
+		return
+	}
+	if cred == nil {
+		cred = []byte{}
+	}
+	if !d.validLogin(user, scheme, cred) {
+		c.Write(respBadRequest)
+		return
+	}
+	if d.auth == nil {
+		c.Write(respNotImplemented)
+		return
+	}
+	if !d.auth.Auth(c.c, user, scheme, cred) {
+		c.Write(d.unauthorizedResponse(scheme))
+		return
+	}
+	d.connections.upgrade(c, string(user))
+	c.lastAuth = d.now()
+	d.restore(c)
+	c.Write(respOk)
+}
+
+// upgrade moves an anonymous connection to the set of named connections.
+// Any existing connection for the same user is closed, as on LOGIN.
+func (s *ConnectionManager) upgrade(c *Connection, user string) {
+	s.connection.Lock()
+	delete(s.anonymous, c)
+	old := s.connections[user]
+	s.connections[user] = c
+	c.setUser(user)
+	s.connection.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"sync/atomic"
+)
+
+// A Replica mirrors the UCAST and MCAST events processed by a primary
+// server to the local recipients of a standby server.
+//
+// Events are buffered in a log consumed by a dedicated goroutine, so that
+// events processed by the primary before it fails are still replayed to the
+// standby.
+type Replica struct {
+	Primary *Server
+	Standby *Server
+
+	log     chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// NewReplica creates a Replica with a log of the given size.
+// The primary must be configured with EnableReplication and the replica
+// started with Start.
+func NewReplica(primary, standby *Server, size int) *Replica {
+	return &Replica{
+		Primary: primary,
+		Standby: standby,
+		log:     make(chan []byte, size),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// EnableReplication appends all UCAST and MCAST events processed by the
+// server to the log of the given Replica.
+// This method is not safe to call once the server has started.
+func (s *Server) EnableReplication(r *Replica) {
+	s.dispatcher.replica = r
+}
+
+// Start starts replaying the log to the standby in a new goroutine.
+func (r *Replica) Start() *Replica {
+	go r.replay()
+	return r
+}
+
+// Stop stops replaying the log once all buffered events have been replayed.
+func (r *Replica) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// Dropped returns the number of events not replicated because the log
+// was full.
+func (r *Replica) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// append adds a copy of an event to the log, without blocking.
+func (r *Replica) append(event []byte) {
+	select {
+	case r.log <- append([]byte(nil), event...):
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+func (r *Replica) replay() {
+	defer close(r.done)
+	for {
+		select {
+		case event := <-r.log:
+			r.apply(event)
+		case <-r.stop:
+			for {
+				select {
+				case event := <-r.log:
+					r.apply(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// apply delivers an event to the local recipients of the standby.
+func (r *Replica) apply(event []byte) {
+	from, b := split(event[len(respEvent) : len(event)-1])
+	verb, b := split(b)
+	to, _ := split(b)
+	if len(to) == 0 {
+		return
+	}
+	d := r.Standby.dispatcher
+	if ssmp.Equal(verb, ssmp.UCAST) {
+		if to[0] == GroupPrefix {
+			d.ucastGroup(nil, to[1:], event)
+		} else if c := d.connections.GetConnection(to); c != nil {
+			c.Write(event)
+		}
+	} else if ssmp.Equal(verb, ssmp.MCAST) {
+		if t := d.topics.GetTopic(to); t != nil {
+			t.ForAll(func(c *Connection, flags SubscriberFlags) {
+				if c.User() != string(from) || flags.Has(Echo) {
+					c.Write(event)
+				}
+			})
+		}
+	}
+}
+
+// replicate appends an event to the replication log, if any.
+func (d *Dispatcher) replicate(event []byte) {
+	if d.replica != nil {
+		d.replica.append(event)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maximum number of retries of a write failing with a temporary error, with
+// exponential backoff starting at 1ms
+const maxWriteRetries = 3
+
+// WithWriteTimeout bounds the time spent retrying a write that failed with
+// a temporary error, e.g. EAGAIN on a momentarily full send buffer.
+// By default, up to 3 retries are made, for a total of 7ms.
+func WithWriteTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.writeTimeout = d
+	}
+}
+
+// retryConn retries writes failing with a temporary error.
+// As it sits below the Protocol, retries are not interleaved with other
+// writes.
+type retryConn struct {
+	net.Conn
+	timeout time.Duration
+	retries atomic.Uint64
+}
+
+func (rc *retryConn) Write(b []byte) (int, error) {
+	var waited time.Duration
+	n, err := rc.Conn.Write(b)
+	for i := 0; err != nil && isTemporary(err) && i < maxWriteRetries; i++ {
+		backoff := time.Millisecond << i
+		if rc.timeout > 0 && waited+backoff > rc.timeout {
+			break
+		}
+		time.Sleep(backoff)
+		waited += backoff
+		rc.retries.Add(1)
+		var m int
+		m, err = rc.Conn.Write(b[n:])
+		n += m
+	}
+	return n, err
+}
+
+func isTemporary(err error) bool {
+	if errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	nerr, ok := err.(net.Error)
+	return ok && !nerr.Timeout() && nerr.Temporary()
+}
+
+// WriteRetries returns the number of writes retried after a temporary error.
+func (c *Connection) WriteRetries() uint64 {
+	if c.rc == nil {
+		return 0
+	}
+	return c.rc.retries.Load()
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ListenReusePortUnix creates a Unix domain socket listener at path, taking
+// over any socket already bound there, e.g. by the previous instance of a
+// rolling deployment. Unix sockets cannot share a path with SO_REUSEPORT:
+// the new socket is bound to a temporary path in the same directory and
+// atomically renamed over the existing one. New connections then reach the
+// new listener, while the old one keeps serving the connections it already
+// accepted.
+//
+// Since another process may own the path, the socket file isn't removed when
+// the listener is closed.
+func ListenReusePortUnix(path string) (net.Listener, error) {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+strconv.Itoa(os.Getpid()))
+	os.Remove(tmp)
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	if err = os.Rename(tmp, path); err != nil {
+		ul.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &renamedListener{UnixListener: ul, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// renamedListener reports the path to which its socket was renamed.
+type renamedListener struct {
+	*net.UnixListener
+	addr net.Addr
+}
+
+func (l *renamedListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Relisten binds a new socket to the same path, see Relistener.
+func (l *renamedListener) Relisten() (net.Listener, error) {
+	return ListenReusePortUnix(l.addr.String())
+}
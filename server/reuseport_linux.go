@@ -0,0 +1,49 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// ListenReusePort creates a TCP listener with SO_REUSEPORT, so that several
+// processes can listen on the same address, e.g. during a rolling
+// deployment where the new instance must accept connections before the old
+// one is fully drained. The kernel spreads incoming connections across all
+// the listeners bound to the address. On platforms other than Linux, it is
+// equivalent to net.Listen.
+func ListenReusePort(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				// syscall doesn't define SO_REUSEPORT on Linux
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &reusePortListener{l}, nil
+}
+
+// reusePortListener keeps SO_REUSEPORT when re-created by the watchdog.
+type reusePortListener struct {
+	net.Listener
+}
+
+// Relisten binds a new listener to the same address, see Relistener.
+func (l *reusePortListener) Relisten() (net.Listener, error) {
+	return ListenReusePort(l.Addr().String())
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build !linux
+
+package server
+
+import (
+	"net"
+)
+
+// ListenReusePort is equivalent to net.Listen on this platform, see the
+// Linux implementation.
+func ListenReusePort(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
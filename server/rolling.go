@@ -0,0 +1,79 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// number of one-second buckets of a RollingStats
+const rollingWindow = 60
+
+// RollingStats counts events over a rolling one-minute window, in one-second
+// buckets. Buckets are rotated lazily, as time passes between calls, so that
+// idle counters cost nothing.
+//
+// All methods can be safely called from multiple goroutines simultaneously.
+type RollingStats struct {
+	now func() time.Time
+
+	l       sync.Mutex
+	buckets [rollingWindow]uint64
+	// second of the most recent bucket
+	last int64
+}
+
+// NewRollingStats creates a RollingStats reading the time from the given
+// clock, or time.Now if nil.
+func NewRollingStats(clock func() time.Time) *RollingStats {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &RollingStats{now: clock, last: clock().Unix()}
+}
+
+// advance clears the buckets of the seconds elapsed since the last call.
+// It must be called with the lock held.
+func (s *RollingStats) advance() int64 {
+	sec := s.now().Unix()
+	if sec-s.last >= rollingWindow {
+		s.buckets = [rollingWindow]uint64{}
+	} else {
+		for i := s.last + 1; i <= sec; i++ {
+			s.buckets[i%rollingWindow] = 0
+		}
+	}
+	if sec > s.last {
+		s.last = sec
+	}
+	return s.last
+}
+
+// Record adds n events to the current second.
+func (s *RollingStats) Record(n uint64) {
+	s.l.Lock()
+	sec := s.advance()
+	s.buckets[sec%rollingWindow] += n
+	s.l.Unlock()
+}
+
+// CountLastMinute returns the number of events recorded over the last 60
+// seconds, including the current one.
+func (s *RollingStats) CountLastMinute() uint64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.advance()
+	var n uint64
+	for _, b := range s.buckets {
+		n += b
+	}
+	return n
+}
+
+// RateLastMinute returns the number of events per second, averaged over the
+// last 60 seconds.
+func (s *RollingStats) RateLastMinute() float64 {
+	return float64(s.CountLastMinute()) / rollingWindow
+}
@@ -4,12 +4,15 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"github.com/aerofs/lipwig/ssmp"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // A ConnectionManager manages a set of Connection.
@@ -18,13 +21,23 @@ type ConnectionManager struct {
 	connection  sync.Mutex
 	anonymous   map[*Connection]*Connection
 	connections map[string]*Connection
+	// in-process connections, which don't replace the connection of their
+	// user, see Dispatcher.Connect
+	secondary map[*Connection]bool
+	connected notifier
 }
 
 // A TopicManager manages a set of Topic.
 // All methods are safe to call from multiple goroutines simultaneously.
 type TopicManager struct {
-	topic  sync.Mutex
-	topics map[string]*Topic
+	topic      sync.Mutex
+	topics     map[string]*Topic
+	subscribed notifier
+
+	maxSubscribers int
+
+	// see Import
+	configs map[string]TopicConfig
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -33,24 +46,112 @@ type TopicManager struct {
 type Server struct {
 	ConnectionManager
 	TopicManager
+	GroupManager
 
-	l    *net.TCPListener
-	cfg  *tls.Config
-	auth Authenticator
+	// guards l, which may be replaced by the watchdog, see StartWithWatchdog
+	listen   sync.Mutex
+	l        net.Listener
+	cfg      *tls.Config
+	auth     Authenticator
+	stopping chan struct{}
+	stopOnce sync.Once
+	// set on every accepted connection, see WithWatchdog
+	accepted atomic.Bool
 
 	// used to cleanly Stop the goroutine spawned by Start
 	w sync.WaitGroup
 
 	dispatcher *Dispatcher
+
+	byteMetrics bool
+
+	// see WithTLSHandshakeTimeout
+	tlsHandshakeTimeout time.Duration
+
+	// see WithGCInterval
+	gcInterval time.Duration
+	gcStop     chan struct{}
+	gcDone     chan struct{}
+
+	// see WithLeaseScanInterval
+	leaseScanInterval time.Duration
+	leaseStop         chan struct{}
+	leaseDone         chan struct{}
+
+	// see WithWatchdog
+	watchdog            bool
+	watchdogDelay       time.Duration
+	watchdogMaxRestarts int
+	watchdogWindow      time.Duration
+}
+
+// A ServerOption configures optional behavior of a Server.
+type ServerOption func(*Server)
+
+// WithWriteQueue gives each connection an outbound queue of the given size,
+// drained by a dedicated goroutine.
+// By default writes are synchronous.
+func WithWriteQueue(size int) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.writeQueue = size
+	}
+}
+
+// WithMaxSubscriptions limits the number of topics each connection may
+// subscribe to. Requests exceeding the limit get a 429 response.
+// By default the number of subscriptions is unlimited.
+func WithMaxSubscriptions(n int) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.maxSubscriptions = n
+	}
+}
+
+// WithByteMetrics enables counting of bytes sent and received on each
+// connection, at the network level (i.e. including TLS overhead, if any).
+func WithByteMetrics(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.byteMetrics = enabled
+	}
+}
+
+// WithRecovery makes RecoveryMiddleware the outermost middleware, logging
+// to stdout, so that a panicking handler doesn't crash the server.
+func WithRecovery(enabled bool) ServerOption {
+	return func(s *Server) {
+		if enabled {
+			s.dispatcher.useFirst(RecoveryMiddleware(stdoutLogger{}))
+		}
+	}
+}
+
+// ConnectionInfo describes an active Connection.
+type ConnectionInfo struct {
+	User          string
+	RemoteAddr    string
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// TopicInfo describes an active Topic.
+type TopicInfo struct {
+	Name            string
+	Subscribers     int
+	MessageCount    uint64
+	DroppedMessages uint64
+	// MessagesPerSecond is the publication rate over the last minute.
+	MessagesPerSecond float64
 }
 
-// NewServer creates a new SSMP server from a TCP Listener, an Authenticator
+// NewServer creates a new SSMP server from a Listener, an Authenticator
 // and a TLS configuration.
-func NewServer(l net.Listener, auth Authenticator, cfg *tls.Config) *Server {
+// The Listener is typically a TCP listener but any stream-oriented transport
+// will do, in which case TLS may be handled by the transport itself.
+func NewServer(l net.Listener, auth Authenticator, cfg *tls.Config, opts ...ServerOption) *Server {
 	s := &Server{
-		l:    l.(*net.TCPListener),
-		cfg:  cfg,
-		auth: auth,
+		l:        l,
+		cfg:      cfg,
+		auth:     auth,
+		stopping: make(chan struct{}),
 		ConnectionManager: ConnectionManager{
 			anonymous:   make(map[*Connection]*Connection),
 			connections: make(map[string]*Connection),
@@ -58,14 +159,32 @@ func NewServer(l net.Listener, auth Authenticator, cfg *tls.Config) *Server {
 		TopicManager: TopicManager{
 			topics: make(map[string]*Topic),
 		},
+		gcInterval:          defaultGCInterval,
+		leaseScanInterval:   defaultLeaseScanInterval,
+		watchdogMaxRestarts: defaultWatchdogMaxRestarts,
+		watchdogWindow:      defaultWatchdogWindow,
 	}
 	s.dispatcher = NewDispatcher(&s.TopicManager, &s.ConnectionManager)
+	s.dispatcher.groups = &s.GroupManager
+	s.dispatcher.auth = auth
+	s.dispatcher.unauthorized = auth.Unauthorized()
+	for _, opt := range opts {
+		opt(s)
+	}
 	return s
 }
 
+// Dispatcher returns the Dispatcher used to process requests.
+func (s *Server) Dispatcher() *Dispatcher {
+	return s.dispatcher
+}
+
 // Serve accept connections in the calling goroutine and only returns
 // in case of error.
 func (s *Server) Serve() error {
+	s.dispatcher.startPersister()
+	s.startGC()
+	s.startLeaseReaper()
 	s.w.Add(1)
 	return s.serve()
 }
@@ -73,21 +192,42 @@ func (s *Server) Serve() error {
 // Start accepts connection in a new goroutine and returns the Server
 // This allows the following terse idiom:
 //		defer s.Start().Stop()
+// With WithWatchdog, Start is equivalent to StartWithWatchdog.
 func (s *Server) Start() *Server {
+	if s.watchdog {
+		return s.StartWithWatchdog(s.watchdogDelay)
+	}
+	s.dispatcher.startPersister()
+	s.startGC()
+	s.startLeaseReaper()
 	s.w.Add(1)
 	go s.serve()
 	return s
 }
 
-// ListeningPort returns the TCP port to which the underlying Listener is bound.
+// ListeningPort returns the TCP or UDP port to which the underlying Listener
+// is bound, or zero for other transports.
 func (s *Server) ListeningPort() int {
-	return s.l.Addr().(*net.TCPAddr).Port
+	switch a := s.listener().Addr().(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
 }
 
 // Stop stops accepting new connections and immediately closes all existing
 // connections. Serve
 func (s *Server) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Server) stop() {
+	s.listen.Lock()
+	close(s.stopping)
 	s.l.Close()
+	s.listen.Unlock()
 	s.connection.Lock()
 	for _, c := range s.connections {
 		c.Close()
@@ -95,8 +235,14 @@ func (s *Server) Stop() {
 	for c := range s.anonymous {
 		c.Close()
 	}
+	for c := range s.secondary {
+		c.Close()
+	}
 	s.connection.Unlock()
 	s.w.Wait()
+	s.dispatcher.stopPersister()
+	s.stopGC()
+	s.stopLeaseReaper()
 }
 
 // DumpStats writes some internal stats to the given Writer.
@@ -109,59 +255,128 @@ func (s *Server) DumpStats(w io.Writer) {
 	}
 	fmt.Fprintf(w, "%5d named connections\n", len(s.connections))
 	for u, c := range s.connections {
-		fmt.Fprintf(w, "\t%p %v %s %s\n", c, c.c.RemoteAddr(), u, c.User)
-		// FIXME: synchronization to prevent race with SUB/UNSUB handling
-		for n, t := range c.sub {
+		fmt.Fprintf(w, "\t%p %v %s %s\n", c, c.c.RemoteAddr(), u, c.User())
+		for n, t := range c.subscriptions() {
 			fmt.Fprintf(w, "\t\t%s %p\n", n, t)
 		}
 	}
 	s.connection.Unlock()
-	s.topic.Lock()
-	fmt.Fprintf(w, "%5d active topics\n", len(s.topics))
-	for n, t := range s.topics {
-		fmt.Fprintf(w, "\t%p %s %s\n", t, n, t.Name)
-		for c, p := range t.c {
-			fmt.Fprintf(w, "\t\t%p %v %s\n", c, p, c.User)
-		}
-	}
-	s.topic.Unlock()
+	var b bytes.Buffer
+	n := 0
+	s.ForEach(func(name string, t *Topic) {
+		n++
+		fmt.Fprintf(&b, "\t%p %s %s %d\n", t, name, t.Name, t.MessageCount())
+		t.ForAll(func(c *Connection, p SubscriberFlags) {
+			fmt.Fprintf(&b, "\t\t%p %v %s\n", c, p, c.User())
+		})
+	})
+	fmt.Fprintf(w, "%5d active topics\n", n)
+	b.WriteTo(w)
 	io.WriteString(w, "----------------------------\n")
 }
 
 func (s *Server) serve() error {
 	defer s.w.Done()
+	return s.accept()
+}
+
+// listener returns the current Listener.
+func (s *Server) listener() net.Listener {
+	s.listen.Lock()
+	defer s.listen.Unlock()
+	return s.l
+}
+
+func (s *Server) accept() error {
+	l := s.listener()
 	for {
-		c, err := s.l.AcceptTCP()
+		c, err := l.Accept()
 		if err != nil {
 			// TODO: handle "too many open files"?
 			return err
 		}
-		go s.connect(s.configure(c))
+		s.accepted.Store(true)
+		if tc, ok := c.(*net.TCPConn); ok {
+			s.HandleTCP(tc)
+		} else {
+			s.Handle(c)
+		}
 	}
 }
 
-func (s *Server) configure(c *net.TCPConn) net.Conn {
-	c.SetNoDelay(true)
+// Handle serves a connection accepted outside of the Server, e.g. when
+// multiplexing multiple protocols on a single listener.
+// The connection is served in a new goroutine.
+func (s *Server) Handle(c net.Conn) {
+	go s.connect(s.configure(c))
+}
+
+// HandleTCP is like Handle but for TCP connections, which are configured
+// with the same options as those accepted by the Server itself.
+func (s *Server) HandleTCP(c *net.TCPConn) {
+	c.SetKeepAlive(true)
+	s.Handle(c)
+}
+
+func (s *Server) configure(c net.Conn) net.Conn {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(true)
+	}
+	nc := c
+	if s.byteMetrics {
+		nc = NewStatsConn(c)
+	}
 	if s.cfg == nil {
-		return c
+		return nc
 	}
-	return tls.Server(c, s.cfg)
+	return tls.Server(nc, s.cfg)
 }
 
 func (s *Server) connect(c net.Conn) {
-	cc, err := NewConnection(c, s.auth, s.dispatcher)
+	deadline := time.Now().Add(s.dispatcher.handshakeTimeout)
+	c.SetDeadline(deadline)
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := s.handshake(tc, deadline); err != nil {
+			fmt.Println("TLS handshake failed:", err)
+			c.Close()
+			return
+		}
+	}
+	s.connectWith(c, s.auth, deadline)
+}
+
+func (s *Server) connectWith(c net.Conn, a Authenticator, deadline time.Time) {
+	cc, scheme, err := newConnection(c, a, s.dispatcher, deadline)
 	if err != nil {
 		fmt.Println("connect rejected:", err)
 		if err == ErrUnauthorized {
-			c.Write(s.auth.Unauthorized())
+			// the loopback Authenticator never rejects
+			c.Write(s.dispatcher.unauthorizedResponse(scheme))
 		} else if err == ErrInvalidLogin {
 			c.Write(respBadRequest)
 		}
 		c.Close()
 		return
 	}
+	s.register(cc)
+}
+
+// registerSecondary adds an in-process connection to the ConnectionManager,
+// alongside any connection of the same user.
+func (s *ConnectionManager) registerSecondary(cc *Connection) {
+	s.connection.Lock()
+	if s.secondary == nil {
+		s.secondary = make(map[*Connection]bool)
+	}
+	s.secondary[cc] = true
+	s.connection.Unlock()
+}
+
+// register adds a new connection to the ConnectionManager. Any existing
+// connection of the same user is closed.
+func (s *ConnectionManager) register(cc *Connection) {
 	var old *Connection
-	u := cc.User
+	u := cc.User()
 	s.connection.Lock()
 	if u == ssmp.Anonymous {
 		s.anonymous[cc] = cc
@@ -170,6 +385,7 @@ func (s *Server) connect(c net.Conn) {
 		s.connections[u] = cc
 	}
 	s.connection.Unlock()
+	s.connected.notify()
 	if old != nil {
 		old.Close()
 	}
@@ -182,14 +398,53 @@ func (s *ConnectionManager) GetConnection(user []byte) *Connection {
 	return c
 }
 
+// ListConnections returns a snapshot of all active connections.
+func (s *ConnectionManager) ListConnections() []ConnectionInfo {
+	s.connection.Lock()
+	l := make([]ConnectionInfo, 0, len(s.connections)+len(s.anonymous)+len(s.secondary))
+	for _, c := range s.connections {
+		l = append(l, c.info())
+	}
+	for c := range s.anonymous {
+		l = append(l, c.info())
+	}
+	for c := range s.secondary {
+		l = append(l, c.info())
+	}
+	s.connection.Unlock()
+	return l
+}
+
+// TotalBytesSent returns the number of bytes sent over all active connections.
+// It is always zero unless byte metrics are enabled.
+func (s *ConnectionManager) TotalBytesSent() uint64 {
+	var n uint64
+	for _, ci := range s.ListConnections() {
+		n += ci.BytesSent
+	}
+	return n
+}
+
+// TotalBytesReceived returns the number of bytes received over all active
+// connections. It is always zero unless byte metrics are enabled.
+func (s *ConnectionManager) TotalBytesReceived() uint64 {
+	var n uint64
+	for _, ci := range s.ListConnections() {
+		n += ci.BytesReceived
+	}
+	return n
+}
+
 func (s *ConnectionManager) RemoveConnection(c *Connection) {
 	s.connection.Lock()
-	if c.User == ssmp.Anonymous {
+	if s.secondary[c] {
+		delete(s.secondary, c)
+	} else if c.User() == ssmp.Anonymous {
 		delete(s.anonymous, c)
-	} else if s.connections[c.User] == c {
-		delete(s.connections, c.User)
+	} else if s.connections[c.User()] == c {
+		delete(s.connections, c.User())
 	} else {
-		fmt.Println("mismatching connection closed", c.User)
+		fmt.Println("mismatching connection closed", c.User())
 	}
 	s.connection.Unlock()
 }
@@ -198,13 +453,36 @@ func (s *TopicManager) GetOrCreateTopic(name []byte) *Topic {
 	s.topic.Lock()
 	t := s.topics[string(name)]
 	if t == nil {
-		t = NewTopic(string(name), s)
+		t = NewTopic(string(name), s, WithMaxSubscribers(s.maxSubscribers))
+		if cfg, ok := s.configs[string(name)]; ok {
+			t.configure(cfg)
+		}
 		s.topics[string(name)] = t
 	}
 	s.topic.Unlock()
 	return t
 }
 
+// subscribe subscribes a connection to a topic, creating the topic if needed.
+// The topic may be removed between its creation and the subscription, e.g. by
+// GCEmptyTopics, in which case it is created again.
+func (s *TopicManager) subscribe(name []byte, c *Connection, flags SubscriberFlags) (*Topic, error) {
+	for {
+		t := s.GetOrCreateTopic(name)
+		if err := t.Subscribe(c, flags); err != ErrTopicRemoved {
+			return t, err
+		}
+	}
+}
+
+// SetDefaultMaxSubscribers limits the number of subscribers of all topics
+// created from now on. Zero means unlimited.
+func (s *TopicManager) SetDefaultMaxSubscribers(n int) {
+	s.topic.Lock()
+	s.maxSubscribers = n
+	s.topic.Unlock()
+}
+
 func (s *TopicManager) GetTopic(name []byte) *Topic {
 	s.topic.Lock()
 	t := s.topics[string(name)]
@@ -212,8 +490,150 @@ func (s *TopicManager) GetTopic(name []byte) *Topic {
 	return t
 }
 
+// ForEach calls f for every active topic, without holding the lock of the
+// TopicManager, so that f may create or remove topics. Topics created during
+// the iteration may not be visited, and topics removed before their turn are
+// skipped.
+func (s *TopicManager) ForEach(f func(name string, t *Topic)) {
+	type entry struct {
+		name string
+		t    *Topic
+	}
+	s.topic.Lock()
+	l := make([]entry, 0, len(s.topics))
+	for n, t := range s.topics {
+		l = append(l, entry{n, t})
+	}
+	s.topic.Unlock()
+	for _, e := range l {
+		s.topic.Lock()
+		t := s.topics[e.name]
+		s.topic.Unlock()
+		// removed, or replaced by a new topic of the same name
+		if t == e.t {
+			f(e.name, t)
+		}
+	}
+}
+
+// ListTopics returns a snapshot of all active topics.
+func (s *TopicManager) ListTopics() []TopicInfo {
+	l := make([]TopicInfo, 0)
+	s.ForEach(func(_ string, t *Topic) {
+		t.l.RLock()
+		name, n := t.Name, len(t.c)
+		t.l.RUnlock()
+		l = append(l, TopicInfo{
+			Name:              name,
+			Subscribers:       n,
+			MessageCount:      t.MessageCount(),
+			DroppedMessages:   t.DroppedMessages(),
+			MessagesPerSecond: t.MessagesPerSecond(),
+		})
+	})
+	return l
+}
+
+// DrainTopic evicts all subscribers from a topic, see Topic.Drain.
+// It returns the number of evicted subscribers, and false if the topic
+// doesn't exist.
+func (s *TopicManager) DrainTopic(name string) (int, bool) {
+	t := s.GetTopic([]byte(name))
+	if t == nil {
+		return 0, false
+	}
+	return t.Drain(), true
+}
+
+// RenameTopic moves a topic and its subscribers to a new name.
+// Subscribers interested in presence receive an UNSUBSCRIBE event for the old
+// name followed by a SUBSCRIBE event for the new one, both from the anonymous
+// user, and persisted subscriptions are moved to the new name.
+// Topic names are immutable: the topic is replaced by a new Topic, which
+// takes over its subscribers and options, and the old one must no longer be
+// used.
+// ErrTopicNotFound is returned if the topic doesn't exist, ErrTopicExists if
+// the new name is taken, and ErrInvalidTopic if it is not a valid identifier.
+func (s *TopicManager) RenameTopic(oldName, newName string) error {
+	if len(newName) == 0 || !ssmp.IsValidIdentifier(newName) {
+		return ErrInvalidTopic
+	}
+	t := s.GetTopic([]byte(oldName))
+	if t == nil {
+		return ErrTopicNotFound
+	}
+	nt := NewTopic(newName, s)
+	// same lock order as Topic.Unsubscribe
+	t.l.Lock()
+	s.topic.Lock()
+	var err error
+	if s.topics[oldName] != t {
+		// harvested in the meantime
+		err = ErrTopicNotFound
+	} else if s.topics[newName] != nil {
+		err = ErrTopicExists
+	} else {
+		t.moveTo(nt)
+		delete(s.topics, oldName)
+		s.topics[newName] = nt
+	}
+	s.topic.Unlock()
+	t.l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	unsub := []byte(respEvent + ssmp.Anonymous + " " + ssmp.UNSUBSCRIBE + " " + oldName + "\n")
+	sub := []byte(respEvent + ssmp.Anonymous + " " + ssmp.SUBSCRIBE + " " + newName + "\n")
+	nt.l.RLock()
+	subscribers := make(map[*Connection]SubscriberFlags, len(nt.c))
+	for c, flags := range nt.c {
+		subscribers[c] = flags
+	}
+	nt.l.RUnlock()
+	for c, flags := range subscribers {
+		c.renameSubscription(t, nt)
+		if c.d != nil {
+			c.d.save(c.User(), []byte(oldName), 0, true)
+			c.d.save(c.User(), []byte(newName), flags, false)
+		}
+		if flags.Has(Presence) {
+			c.Write(unsub)
+			c.Write(sub)
+		}
+	}
+	return nil
+}
+
+// RemoveTopic removes a topic without notifying its subscribers, see
+// DrainTopic. Nobody may subscribe to the removed Topic anymore.
 func (s *TopicManager) RemoveTopic(name string) {
+	if t := s.GetTopic([]byte(name)); t != nil {
+		t.l.Lock()
+		s.remove(t)
+		t.l.Unlock()
+	}
+}
+
+// harvest removes a topic whose last subscriber left, unless it was imported.
+// It must be called with the lock of the topic held.
+func (s *TopicManager) harvest(t *Topic) {
 	s.topic.Lock()
-	delete(s.topics, name)
+	if !s.isConfigured(t.Name) && s.topics[t.Name] == t {
+		delete(s.topics, t.Name)
+		t.removed = true
+	}
+	s.topic.Unlock()
+}
+
+// remove removes a topic, unless it was already replaced by another one of
+// the same name.
+// It must be called with the lock of the topic held.
+func (s *TopicManager) remove(t *Topic) {
+	s.topic.Lock()
+	if s.topics[t.Name] == t {
+		delete(s.topics, t.Name)
+	}
+	t.removed = true
 	s.topic.Unlock()
 }
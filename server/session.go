@@ -0,0 +1,239 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"sync"
+	"time"
+)
+
+// SessionState is what a session preserves between the closing of a named
+// connection and its resumption from a new one.
+type SessionState struct {
+	// Subscriptions maps topic names to subscription options.
+	Subscriptions map[string]SubscriberFlags
+
+	// Buffered holds the MCAST events received while detached, in order.
+	Buffered [][]byte
+}
+
+// maximum number of events buffered by a detached session, newer events are
+// dropped
+const maxSessionBuffer = 256
+
+// WithSessions makes the LOGIN response of named connections carry a session
+// token:
+//
+//	200 session:<token>
+//
+// After a disconnection, a new anonymous connection may send
+//
+//	RESUME <token>
+//
+// to take over the subscriptions of the session and receive the MCAST events
+// sent to them in the meantime. Each token may only be used once, the RESUME
+// response carries a new one. Sessions expire after ttl without a connection.
+func WithSessions(ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.sessions = &sessionStore{ttl: ttl}
+	}
+}
+
+type sessionStore struct {
+	ttl time.Duration
+	m   sync.Map
+}
+
+type session struct {
+	l     sync.Mutex
+	token string
+	user  string
+	// time of the last successful authentication, restored on RESUME so
+	// that it doesn't renew expiring credentials, see WithCredentialExpiry
+	lastAuth time.Time
+
+	// attached connection, nil once detached
+	c *Connection
+
+	// holds the subscriptions while detached
+	buffer *Connection
+	bc     *bufferConn
+	timer  *time.Timer
+}
+
+// newSessionToken returns 32 random bytes, hex-encoded.
+func newSessionToken() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// create starts a new session for a named connection and returns the
+// response carrying its token.
+func (s *sessionStore) create(c *Connection) []byte {
+	ss := &session{token: newSessionToken(), user: c.User(), c: c, lastAuth: c.lastAuth}
+	c.session = ss.token
+	s.m.Store(ss.token, ss)
+	return ssmp.NewMessage().Code(ssmp.CodeOk).Payload(ssmp.SessionPrefix + ss.token).MustBuild()
+}
+
+// authenticated records a successful REAUTH of the connection attached to
+// a session.
+func (s *sessionStore) authenticated(c *Connection) {
+	v, ok := s.m.Load(c.session)
+	if !ok {
+		return
+	}
+	ss := v.(*session)
+	ss.l.Lock()
+	if ss.c == c {
+		ss.lastAuth = c.lastAuth
+	}
+	ss.l.Unlock()
+}
+
+// detach moves the subscriptions of a closing connection to a local
+// connection buffering MCAST events, so that neither the topics nor the
+// presence of the user are affected until the session expires.
+// It returns false if c has no session, in which case sub is left untouched.
+func (s *sessionStore) detach(c *Connection, sub map[string]*Topic) bool {
+	v, ok := s.m.Load(c.session)
+	if !ok {
+		return false
+	}
+	ss := v.(*session)
+	ss.l.Lock()
+	defer ss.l.Unlock()
+	if ss.c != c {
+		// already resumed
+		return false
+	}
+	ss.c = nil
+	ss.bc = &bufferConn{localConn: newLocalConn()}
+	ss.buffer = newLocalConnection(ss.bc, c.User())
+	for _, t := range sub {
+		if t.replace(c, ss.buffer) {
+			ss.buffer.Subscribe(t)
+		}
+	}
+	ss.timer = time.AfterFunc(s.ttl, func() {
+		if s.m.CompareAndDelete(ss.token, ss) {
+			fmt.Println("session expired", ss.user)
+			// regular cleanup, with presence events
+			ss.buffer.Cleanup()
+			ss.buffer.Close()
+		}
+	})
+	return true
+}
+
+// resume invalidates a session, logs c in as its user and moves its
+// subscriptions to c. The response carrying a new session token is written
+// first, followed by the events buffered while detached.
+// If the session is still attached, the previous connection is closed.
+// The resumed state is returned, and false if the token is unknown or
+// expired.
+func (s *sessionStore) resume(token string, c *Connection, d *Dispatcher) (SessionState, bool) {
+	v, ok := s.m.LoadAndDelete(token)
+	if !ok {
+		return SessionState{}, false
+	}
+	ss := v.(*session)
+	ss.l.Lock()
+	defer ss.l.Unlock()
+
+	old := ss.c
+	if old == nil {
+		ss.timer.Stop()
+		old = ss.buffer
+	}
+	ss.c = nil
+	d.connections.upgrade(c, ss.user)
+	c.lastAuth = ss.lastAuth
+	c.Write(s.create(c))
+
+	state := SessionState{Subscriptions: make(map[string]SubscriberFlags)}
+	if ss.bc != nil {
+		state.Buffered = ss.bc.forward(c)
+	}
+	for n, t := range old.subscriptions() {
+		flags, _ := t.flags(old)
+		if t.replace(old, c) {
+			old.Unsubscribe([]byte(n))
+			c.Subscribe(t)
+			state.Subscriptions[n] = flags
+		}
+	}
+	old.Close()
+	return state, true
+}
+
+// onResume takes over the session of a previous connection:
+//
+//	RESUME <token>
+//
+// Only anonymous connections can RESUME.
+func onResume(c *Connection, token, _, _ []byte, d *Dispatcher) {
+	if c.User() != ssmp.Anonymous {
+		c.Write(respNotAllowed)
+		return
+	}
+	if d.sessions == nil {
+		c.Write(respNotImplemented)
+		return
+	}
+	state, ok := d.sessions.resume(string(token), c, d)
+	if !ok {
+		c.Write(respNotFound)
+		return
+	}
+	fmt.Println("resumed", c.User(), len(state.Subscriptions), len(state.Buffered))
+}
+
+// bufferConn keeps the MCAST events received by a detached session until
+// they can be forwarded to a new connection.
+type bufferConn struct {
+	*localConn
+	l   sync.Mutex
+	buf [][]byte
+	fwd *Connection
+}
+
+func (bc *bufferConn) Write(b []byte) (int, error) {
+	m, err := ssmp.ParseMessage(b)
+	if err != nil {
+		return 0, err
+	}
+	if m.Code != ssmp.CodeEvent || !ssmp.Equal(m.Verb, ssmp.MCAST) {
+		// presence events are stale by the time the session is resumed
+		return len(b), nil
+	}
+	bc.l.Lock()
+	defer bc.l.Unlock()
+	if bc.fwd != nil {
+		return len(b), bc.fwd.Write(b)
+	}
+	if len(bc.buf) < maxSessionBuffer {
+		bc.buf = append(bc.buf, append([]byte(nil), b...))
+	}
+	return len(b), nil
+}
+
+// forward writes the buffered events to c, as well as any event received
+// from then on, and returns the buffered events.
+func (bc *bufferConn) forward(c *Connection) [][]byte {
+	bc.l.Lock()
+	defer bc.l.Unlock()
+	for _, b := range bc.buf {
+		c.Write(b)
+	}
+	bc.fwd = c
+	return bc.buf
+}
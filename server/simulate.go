@@ -0,0 +1,170 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"sync"
+)
+
+// SimStep is a request sent by a simulated connection, see Simulate.
+type SimStep struct {
+	// User is the user of the connection sending the request.
+	User string `yaml:"user"`
+
+	// Line is the request, without trailing newline, e.g. "MCAST chat hi".
+	Line string `yaml:"line"`
+}
+
+// SimEvent is an event received by a simulated connection.
+type SimEvent struct {
+	// User is the user of the receiving connection.
+	User    string
+	From    string
+	Verb    string
+	To      string
+	Payload string
+}
+
+// SimResult is the outcome of a SimStep.
+type SimResult struct {
+	// Code is the code of the response to the request.
+	Code int
+	// Message is the payload of the response, if any.
+	Message string
+	// Events are all the events caused by the request, in delivery order.
+	Events []SimEvent
+}
+
+// Simulate dispatches a script of requests over in-process connections, one
+// per distinct user, and reports the outcome of each request.
+//
+// Connections are registered as if logged in when first used and closed once
+// the script completes. Requests are processed synchronously, so results are
+// deterministic. Simulated users replace any real connection of the same
+// user, this is meant for testing.
+func (d *Dispatcher) Simulate(script []SimStep) []SimResult {
+	sim := &simulation{}
+	conns := make(map[string]*Connection)
+	defer func() {
+		for _, c := range conns {
+			c.Cleanup()
+			d.connections.RemoveConnection(c)
+			c.Close()
+		}
+	}()
+	results := make([]SimResult, 0, len(script))
+	for _, step := range script {
+		c := conns[step.User]
+		if c == nil {
+			c = sim.connect(d, step.User)
+			conns[step.User] = c
+		}
+		sim.reset()
+		c.r = ssmp.NewDecoder(strings.NewReader(step.Line + "\n"))
+		var r SimResult
+		verb, err := c.r.DecodeVerb()
+		if err != nil || !d.Dispatch(c, verb) {
+			r.Code = ssmp.CodeBadRequest
+		} else if resp, ok := sim.response(c); ok {
+			r.Code = resp.Code
+			r.Message = string(resp.Payload)
+		}
+		r.Events = sim.events
+		results = append(results, r)
+	}
+	return results
+}
+
+// SimulateFromYAML is like Simulate for a script encoded as a YAML sequence
+// of steps:
+//
+//   - user: foo
+//     line: SUBSCRIBE chat
+//   - user: bar
+//     line: MCAST chat hello
+func (d *Dispatcher) SimulateFromYAML(data []byte) ([]SimResult, error) {
+	var script []SimStep
+	if err := yaml.Unmarshal(data, &script); err != nil {
+		return nil, err
+	}
+	return d.Simulate(script), nil
+}
+
+// simulation records the messages written to simulated connections during
+// a step.
+type simulation struct {
+	l         sync.Mutex
+	events    []SimEvent
+	responses map[*Connection]ssmp.Message
+}
+
+func (sim *simulation) reset() {
+	sim.l.Lock()
+	sim.events = nil
+	sim.responses = make(map[*Connection]ssmp.Message)
+	sim.l.Unlock()
+}
+
+func (sim *simulation) response(c *Connection) (ssmp.Message, bool) {
+	sim.l.Lock()
+	defer sim.l.Unlock()
+	m, ok := sim.responses[c]
+	return m, ok
+}
+
+// connect creates and registers a simulated connection.
+func (sim *simulation) connect(d *Dispatcher, user string) *Connection {
+	sc := &simConn{localConn: newLocalConn(), sim: sim}
+	c := newLocalConnection(sc, user)
+	c.d = d
+	sc.c = c
+	s := d.connections
+	s.connection.Lock()
+	var old *Connection
+	if user == ssmp.Anonymous {
+		s.anonymous[c] = c
+	} else {
+		old = s.connections[user]
+		s.connections[user] = c
+	}
+	s.connection.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return c
+}
+
+// simConn decodes the messages written to a simulated connection.
+type simConn struct {
+	*localConn
+	sim *simulation
+	c   *Connection
+}
+
+func (sc *simConn) Write(b []byte) (int, error) {
+	// buffered writes may carry several messages
+	l, err := ssmp.ParseMessages(b)
+	if err != nil {
+		return 0, err
+	}
+	sc.sim.l.Lock()
+	defer sc.sim.l.Unlock()
+	for _, m := range l {
+		if m.Code != ssmp.CodeEvent {
+			sc.sim.responses[sc.c] = m
+			continue
+		}
+		sc.sim.events = append(sc.sim.events, SimEvent{
+			User:    sc.c.User(),
+			From:    string(m.From),
+			Verb:    string(m.Verb),
+			To:      string(m.To),
+			Payload: string(m.Payload),
+		})
+	}
+	return len(b), nil
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"sync/atomic"
+)
+
+// TopicStats is a snapshot of the counters of a Topic.
+type TopicStats struct {
+	Name string
+
+	SubscriberCount int
+	// subscribers with the Presence flag
+	PresenceSubscribers int
+	// subscribers whose connection has an outbound queue, see WithWriteQueue
+	QueueSubscribers int
+
+	// MessageCount is the number of messages published to the topic,
+	// regardless of the number of subscribers they were delivered to.
+	MessageCount uint64
+	// BytesDelivered is the total size of the MCAST events written to
+	// subscribers.
+	BytesDelivered uint64
+}
+
+// Stats returns a snapshot of the counters of all active topics.
+func (s *TopicManager) Stats() []TopicStats {
+	l := make([]TopicStats, 0)
+	s.ForEach(func(_ string, t *Topic) {
+		l = append(l, t.stats())
+	})
+	return l
+}
+
+func (t *Topic) stats() TopicStats {
+	t.l.RLock()
+	st := TopicStats{
+		Name:            t.Name,
+		SubscriberCount: len(t.c),
+	}
+	for c, flags := range t.c {
+		if flags.Has(Presence) {
+			st.PresenceSubscribers++
+		}
+		if c.q != nil {
+			st.QueueSubscribers++
+		}
+	}
+	t.l.RUnlock()
+	st.MessageCount = t.published.Load()
+	st.BytesDelivered = t.bytesDelivered.Load()
+	return st
+}
+
+// maximum number of verbs for which dispatch counters are maintained
+const maxVerbs = 32
+
+// PayloadBuckets are the upper bounds, in bytes, of the buckets of the
+// payload size histograms. The largest is ssmp.MaxPayloadLength.
+var PayloadBuckets = [...]int{16, 64, 128, 256, 512, 1024}
+
+// DispatcherStats is a snapshot of per-verb dispatch counters.
+type DispatcherStats struct {
+	// Counts maps verbs to the number of successfully dispatched requests.
+	Counts map[string]uint64
+
+	// Errors maps verbs to the number of malformed requests.
+	Errors map[string]uint64
+
+	// PayloadSizes maps verbs carrying a payload to the distribution of the
+	// size of the payloads of well-formed requests.
+	PayloadSizes map[string]PayloadHistogram
+}
+
+// PayloadHistogram is a distribution of payload sizes.
+type PayloadHistogram struct {
+	// Buckets holds, for each bound of PayloadBuckets, the number of
+	// payloads no larger than the bound.
+	Buckets [len(PayloadBuckets)]uint64
+	// Count is the total number of payloads.
+	Count uint64
+	// Sum is the total size of the payloads, in bytes.
+	Sum uint64
+}
+
+type verbCounters struct {
+	n      atomic.Int32
+	byVerb map[string]int
+	verbs  [maxVerbs]string
+	counts [maxVerbs]atomic.Uint64
+	errors [maxVerbs]atomic.Uint64
+
+	// payload sizes, non-cumulative
+	payloads     [maxVerbs][len(PayloadBuckets)]atomic.Uint64
+	payloadCount [maxVerbs]atomic.Uint64
+	payloadBytes [maxVerbs]atomic.Uint64
+}
+
+// fixed mapping of built-in verbs to counter index
+var builtinVerbs = []string{
+	ssmp.SUBSCRIBE,
+	ssmp.UNSUBSCRIBE,
+	ssmp.UCAST,
+	ssmp.MCAST,
+	ssmp.BCAST,
+	ssmp.PING,
+	ssmp.PONG,
+	ssmp.CLOSE,
+	ssmp.GROUP,
+	ssmp.USERS,
+	ssmp.RELOGIN,
+	ssmp.RESUME,
+	ssmp.REAUTH,
+	ssmp.ACK,
+	ssmp.CONFIGURE,
+}
+
+// index assigns a counter index to a verb, or -1 if all are already in use.
+// Previously indexed verbs keep their index.
+// This method is not safe to call from multiple goroutines simultaneously.
+func (s *verbCounters) index(verb string) int {
+	if i, ok := s.byVerb[verb]; ok {
+		return i
+	}
+	n := int(s.n.Load())
+	if n == maxVerbs {
+		return -1
+	}
+	if s.byVerb == nil {
+		s.byVerb = make(map[string]int)
+	}
+	s.byVerb[verb] = n
+	s.verbs[n] = verb
+	s.n.Store(int32(n + 1))
+	return n
+}
+
+func (s *verbCounters) record(i int, ok bool) {
+	if i < 0 {
+		return
+	}
+	if ok {
+		s.counts[i].Add(1)
+	} else {
+		s.errors[i].Add(1)
+	}
+}
+
+func (s *verbCounters) recordPayload(i int, size int) {
+	if i < 0 {
+		return
+	}
+	s.payloadCount[i].Add(1)
+	s.payloadBytes[i].Add(uint64(size))
+	for j, bound := range PayloadBuckets {
+		if size <= bound {
+			s.payloads[i][j].Add(1)
+			return
+		}
+	}
+}
+
+func (s *verbCounters) payloadHistogram(i int) PayloadHistogram {
+	h := PayloadHistogram{
+		Count: s.payloadCount[i].Load(),
+		Sum:   s.payloadBytes[i].Load(),
+	}
+	var n uint64
+	for j := range PayloadBuckets {
+		n += s.payloads[i][j].Load()
+		h.Buckets[j] = n
+	}
+	return h
+}
+
+// Stats returns a snapshot of the per-verb dispatch counters.
+func (d *Dispatcher) Stats() DispatcherStats {
+	st := DispatcherStats{
+		Counts:       make(map[string]uint64),
+		Errors:       make(map[string]uint64),
+		PayloadSizes: make(map[string]PayloadHistogram),
+	}
+	n := int(d.stats.n.Load())
+	for i := 0; i < n; i++ {
+		st.Counts[d.stats.verbs[i]] = d.stats.counts[i].Load()
+		st.Errors[d.stats.verbs[i]] = d.stats.errors[i].Load()
+		if d.stats.payloadCount[i].Load() > 0 {
+			st.PayloadSizes[d.stats.verbs[i]] = d.stats.payloadHistogram(i)
+		}
+	}
+	return st
+}
+
+// ResetStats resets all per-verb dispatch counters to zero.
+func (d *Dispatcher) ResetStats() {
+	n := int(d.stats.n.Load())
+	for i := 0; i < n; i++ {
+		d.stats.counts[i].Store(0)
+		d.stats.errors[i].Store(0)
+		for j := range PayloadBuckets {
+			d.stats.payloads[i][j].Store(0)
+		}
+		d.stats.payloadCount[i].Store(0)
+		d.stats.payloadBytes[i].Store(0)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+)
+
+// StatsConn wraps a net.Conn and counts bytes sent and received.
+type StatsConn struct {
+	net.Conn
+
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+// NewStatsConn wraps c to count bytes sent and received.
+func NewStatsConn(c net.Conn) *StatsConn {
+	return &StatsConn{Conn: c}
+}
+
+func (c *StatsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *StatsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+// ConnectionState allows certificate authentication of connections with
+// built-in TLS, e.g. QUIC streams, or upgraded by an HTTPS server, see
+// CertAuth.
+func (c *StatsConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.Conn.(tlsConn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// BytesSent returns the number of bytes written so far.
+func (c *StatsConn) BytesSent() uint64 {
+	return c.bytesSent.Load()
+}
+
+// BytesReceived returns the number of bytes read so far.
+func (c *StatsConn) BytesReceived() uint64 {
+	return c.bytesReceived.Load()
+}
+
+// statsOf returns the StatsConn underlying c, if any.
+func statsOf(c net.Conn) *StatsConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	sc, _ := c.(*StatsConn)
+	return sc
+}
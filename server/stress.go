@@ -0,0 +1,100 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build lipwig_stress
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StressResult summarizes the requests made by StressTest.
+type StressResult struct {
+	MessagesPerSec float64
+	AvgLatency     time.Duration
+	P99Latency     time.Duration
+	Errors         int
+}
+
+// StressTest connects the given number of loopback clients to s and has each
+// of them send UCAST to itself as fast as possible for the given duration.
+// Latency is measured from the time a request is made to the receipt of its
+// response, non-2xx responses count as errors.
+//
+// This is only compiled with the lipwig_stress build tag.
+func (d *Dispatcher) StressTest(s *Server, duration time.Duration, workers int) StressResult {
+	var l sync.Mutex
+	var samples []time.Duration
+	var errors int
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(duration)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			lat, errs := stressLoopback(s, user, deadline)
+			l.Lock()
+			samples = append(samples, lat...)
+			errors += errs
+			l.Unlock()
+		}("stress-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	b := summarize(samples)
+	return StressResult{
+		MessagesPerSec: float64(b.N) / elapsed.Seconds(),
+		AvgLatency:     b.Mean,
+		P99Latency:     b.P99,
+		Errors:         errors,
+	}
+}
+
+// stressLoopback logs in as user on a loopback connection and sends UCAST
+// requests to itself until the deadline. It returns the latency of each
+// request and the number of errors.
+func stressLoopback(s *Server, user string, deadline time.Time) ([]time.Duration, int) {
+	c, connected := s.ConnectLoopback()
+	defer c.Close()
+	p := ssmp.NewProtocol(c)
+	request := func(req []byte) (int, error) {
+		if _, err := p.Write(req); err != nil {
+			return 0, err
+		}
+		for {
+			m, err := p.ReadMessage()
+			if err != nil {
+				return 0, err
+			}
+			// skip the UCAST events sent to ourselves
+			if m.Code != ssmp.CodeEvent {
+				return m.Code, nil
+			}
+		}
+	}
+	if code, err := request([]byte(ssmp.LOGIN + " " + user + " loopback\n")); err != nil || code != ssmp.CodeOk {
+		return nil, 1
+	}
+	<-connected
+	var lat []time.Duration
+	errs := 0
+	ucast := []byte(ssmp.UCAST + " " + user + " stress\n")
+	for time.Now().Before(deadline) {
+		t := time.Now()
+		code, err := request(ucast)
+		lat = append(lat, time.Since(t))
+		if err != nil {
+			errs++
+			break
+		} else if code/100 != 2 {
+			errs++
+		}
+	}
+	return lat, errs
+}
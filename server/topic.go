@@ -4,10 +4,72 @@
 package server
 
 import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type TopicVisitor func(c *Connection, wantsPresence bool)
+type TopicVisitor func(c *Connection, flags SubscriberFlags)
+
+// A TopicFilter is called for every MCAST message published to a Topic, to
+// transform or drop its payload before delivery, e.g. to sanitize or
+// timestamp it. An empty payload leaves the message unchanged.
+type TopicFilter func(from string, payload []byte) (newPayload []byte, drop bool)
+
+// SubscriberFlags holds the options of a subscription.
+type SubscriberFlags uint8
+
+const (
+	// Presence indicates that the subscriber is interested in receiving
+	// presence events about other subscribers.
+	Presence SubscriberFlags = 1 << iota
+
+	// NoSelf indicates that the subscriber does not want to receive
+	// multicast messages sent by its own user, from any connection.
+	NoSelf
+
+	// Echo indicates that the subscriber wants to receive its own multicast
+	// messages, as an acknowledgement of their distribution.
+	Echo
+
+	// Count indicates that the subscriber is interested in receiving COUNT
+	// events whenever the number of subscribers changes.
+	Count
+
+	// Receipt indicates that the senders of multicast messages with a
+	// message ID want to be notified of their delivery to the subscriber.
+	Receipt
+)
+
+// Has reports whether all flags in f2 are set in f.
+func (f SubscriberFlags) Has(f2 SubscriberFlags) bool {
+	return f&f2 == f2
+}
+
+// A LagPolicy determines how MCAST delivery treats subscribers that do not
+// keep up with the rate of messages.
+type LagPolicy int32
+
+const (
+	// BlockOnLagging waits for every subscriber to accept the message.
+	BlockOnLagging LagPolicy = iota
+
+	// DropLagging skips subscribers whose outbound queue is full.
+	// It has no effect on connections without an outbound queue.
+	DropLagging
+)
+
+var (
+	ErrAlreadySubscribed error = fmt.Errorf("already subscribed")
+	ErrTopicFull         error = fmt.Errorf("topic full")
+	ErrTopicNotFound     error = fmt.Errorf("no such topic")
+	ErrTopicExists       error = fmt.Errorf("topic already exists")
+	ErrTopicRemoved      error = fmt.Errorf("topic removed")
+)
 
 // Topic represents a SSMP multicast topic.
 //
@@ -16,33 +78,102 @@ type Topic struct {
 	Name string
 	tm   *TopicManager
 	l    sync.RWMutex
-	c    map[*Connection]bool
+	c    map[*Connection]SubscriberFlags
+
+	// see MaxSubscribers, Owner, RateLimit and History
+	maxSubscribers int
+	owner          string
+	rateLimit      int
+	historySize    int
+	// set for topics configured by TopicManager.Import, which have no owner
+	configured bool
+	// the topic that replaced this one on rename, see moveTo
+	movedTo *Topic
+	// set once the topic is removed from its TopicManager, after which
+	// nobody may subscribe to it
+	removed bool
+
+	rateSecond int64
+	rateCount  int
+	history    [][]byte
+
+	lag            atomic.Int32
+	dropped        atomic.Uint64
+	msgCount       atomic.Uint64
+	published      atomic.Uint64
+	bytesDelivered atomic.Uint64
+	rolling        *RollingStats
+
+	// see SetFilter
+	filterFunc atomic.Pointer[TopicFilter]
+
+	// expiry of leased subscriptions, see ReapLeases
+	leases map[*Connection]time.Time
+}
+
+// A TopicOption configures optional behavior of a Topic.
+type TopicOption func(*Topic)
+
+// WithMaxSubscribers limits the number of subscribers of a Topic.
+func WithMaxSubscribers(n int) TopicOption {
+	return func(t *Topic) {
+		t.maxSubscribers = n
+	}
+}
+
+// WithFilter sets the TopicFilter of a Topic, see Topic.SetFilter.
+func WithFilter(f TopicFilter) TopicOption {
+	return func(t *Topic) {
+		t.SetFilter(f)
+	}
 }
 
 // NewTopic creates a new Topic with a given name.
 // The topic keeps track of the TopicManager to self-harvest when the last
 // subscriber set becomes empty.
-func NewTopic(name string, tm *TopicManager) *Topic {
-	return &Topic{
+func NewTopic(name string, tm *TopicManager, opts ...TopicOption) *Topic {
+	t := &Topic{
 		Name: name,
 		tm:   tm,
-		c:    make(map[*Connection]bool),
+		c:    make(map[*Connection]SubscriberFlags),
 	}
+	t.rolling = NewRollingStats(nil)
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
 // Subscribe adds a connection to the set of subscribers.
-// The presence flag indicates whether the connection is interested in
-// receiving presence events about other subscribers.
-// It returns true if a new subscription was made, or false if the
-// connection was already subscribed to the topic.
-func (t *Topic) Subscribe(c *Connection, presence bool) bool {
+// The flags specify the options of the subscription.
+// It returns ErrAlreadySubscribed if the connection was already subscribed
+// to the topic, ErrTopicFull if the topic has reached MaxSubscribers, or
+// ErrTopicRemoved if the topic was removed from its TopicManager, e.g. by
+// GCEmptyTopics, in which case it should be looked up again.
+// The first subscriber becomes the Owner of the topic, unless it is anonymous
+// or the topic was imported.
+func (t *Topic) Subscribe(c *Connection, flags SubscriberFlags) error {
 	t.l.Lock()
-	_, subscribed := t.c[c]
-	if !subscribed {
-		t.c[c] = presence
+	var err error
+	if t.removed || t.movedTo != nil {
+		err = ErrTopicRemoved
+	} else if _, subscribed := t.c[c]; subscribed {
+		err = ErrAlreadySubscribed
+	} else if t.maxSubscribers > 0 && len(t.c) >= t.maxSubscribers {
+		err = ErrTopicFull
+	} else {
+		t.c[c] = flags
+		if t.owner == "" && t.canOwn(c) {
+			t.owner = c.User()
+		}
 	}
+	n := len(t.c)
 	t.l.Unlock()
-	return !subscribed
+	if err == nil {
+		t.tm.subscribed.notify()
+		t.notifyCount(n)
+	}
+	return err
 }
 
 // Unsubscribe removes a connection from the set of subscribers.
@@ -50,22 +181,278 @@ func (t *Topic) Subscribe(c *Connection, presence bool) bool {
 // wasn't subscribed to the topic.
 func (t *Topic) Unsubscribe(c *Connection) bool {
 	t.l.Lock()
+	subscribed, n := t.unsubscribe(c)
+	t.l.Unlock()
+	if subscribed {
+		t.notifyCount(n)
+	}
+	return subscribed
+}
+
+// unsubscribe is Unsubscribe without locking or COUNT events. It also returns
+// the number of remaining subscribers.
+func (t *Topic) unsubscribe(c *Connection) (bool, int) {
 	_, subscribed := t.c[c]
 	delete(t.c, c)
-	if len(t.c) == 0 {
-		t.tm.RemoveTopic(t.Name)
+	delete(t.leases, c)
+	if subscribed && c.User() == t.owner {
+		t.owner = t.nextOwner()
+	}
+	n := len(t.c)
+	if n == 0 {
+		t.tm.harvest(t)
 	}
+	return subscribed, n
+}
+
+// notifyCount sends a COUNT event to subscribers with the Count flag.
+func (t *Topic) notifyCount(n int) {
+	var event []byte
+	t.ForAll(func(c *Connection, flags SubscriberFlags) {
+		if !flags.Has(Count) {
+			return
+		}
+		if event == nil {
+			event = []byte(respEvent + t.Name + " " + ssmp.COUNT + " " + strconv.Itoa(n) + "\n")
+		}
+		c.Write(event)
+	})
+}
+
+// Drain removes all subscribers and removes the topic from its TopicManager.
+// Every evicted subscriber receives an UNSUBSCRIBE event from the anonymous
+// user, and the topic is removed from its subscription list and from the
+// persisted subscriptions, so that it no longer counts towards the
+// subscription limit.
+// It returns the number of evicted subscribers.
+func (t *Topic) Drain() int {
+	t.l.Lock()
+	evicted := make([]*Connection, 0, len(t.c))
+	for c := range t.c {
+		evicted = append(evicted, c)
+	}
+	t.c = make(map[*Connection]SubscriberFlags)
+	t.leases = nil
+	t.owner = ""
+	t.tm.remove(t)
 	t.l.Unlock()
+
+	event := []byte(respEvent + ssmp.Anonymous + " " + ssmp.UNSUBSCRIBE + " " + t.Name + "\n")
+	for _, c := range evicted {
+		c.Write(event)
+		c.unsubscribeFrom(t)
+		if c.d != nil {
+			c.d.save(c.User(), []byte(t.Name), 0, true)
+		}
+	}
+	return len(evicted)
+}
+
+// moveTo transfers the subscribers, options and counters of the topic to nt,
+// which replaces it under a new name, see TopicManager.RenameTopic.
+// It must be called with the lock held, before nt is shared.
+func (t *Topic) moveTo(nt *Topic) {
+	nt.c, t.c = t.c, make(map[*Connection]SubscriberFlags)
+	nt.leases, t.leases = t.leases, nil
+	nt.maxSubscribers = t.maxSubscribers
+	nt.owner = t.owner
+	nt.rateLimit = t.rateLimit
+	nt.historySize = t.historySize
+	nt.configured = t.configured
+	nt.rateSecond = t.rateSecond
+	nt.rateCount = t.rateCount
+	nt.history = t.history
+	nt.lag.Store(t.lag.Load())
+	nt.dropped.Store(t.dropped.Load())
+	nt.msgCount.Store(t.msgCount.Load())
+	nt.published.Store(t.published.Load())
+	nt.bytesDelivered.Store(t.bytesDelivered.Load())
+	nt.rolling = t.rolling
+	nt.filterFunc.Store(t.filterFunc.Load())
+	t.movedTo = nt
+}
+
+// current returns the topic that replaced this one after any number of
+// renames, or the topic itself.
+func (t *Topic) current() *Topic {
+	for {
+		t.l.RLock()
+		next := t.movedTo
+		t.l.RUnlock()
+		if next == nil {
+			return t
+		}
+		t = next
+	}
+}
+
+// replace moves the subscription of a connection to another one, keeping
+// its options. It returns false if old wasn't subscribed to the topic or if
+// c already was.
+func (t *Topic) replace(old, c *Connection) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	flags, subscribed := t.c[old]
+	if !subscribed {
+		return false
+	}
+	if _, subscribed = t.c[c]; subscribed {
+		return false
+	}
+	delete(t.c, old)
+	t.c[c] = flags
+	if expiry, ok := t.leases[old]; ok {
+		delete(t.leases, old)
+		t.leases[c] = expiry
+	}
+	return true
+}
+
+// has reports whether a connection is subscribed to the topic.
+func (t *Topic) has(c *Connection) bool {
+	_, subscribed := t.flags(c)
 	return subscribed
 }
 
+// flags returns the options of the subscription of a connection, and false
+// if it isn't subscribed to the topic.
+func (t *Topic) flags(c *Connection) (SubscriberFlags, bool) {
+	t.l.RLock()
+	flags, subscribed := t.c[c]
+	t.l.RUnlock()
+	return flags, subscribed
+}
+
 // ForAll executes v once for every subscribers.
 func (t *Topic) ForAll(v TopicVisitor) {
 	t.l.RLock()
 	defer t.l.RUnlock()
-	for c, presence := range t.c {
+	for c, flags := range t.c {
 		if !c.isClosed() {
-			v(c, presence)
+			v(c, flags)
 		}
 	}
 }
+
+// ForAllSorted is like ForAll but visits subscribers in lexicographic order
+// of user name, e.g. for presence events to be delivered in a deterministic
+// order. The visitor is called on a snapshot of the subscribers, without
+// holding the lock of the topic.
+func (t *Topic) ForAllSorted(v TopicVisitor) {
+	type subscriber struct {
+		c     *Connection
+		flags SubscriberFlags
+	}
+	t.l.RLock()
+	l := make([]subscriber, 0, len(t.c))
+	for c, flags := range t.c {
+		if !c.isClosed() {
+			l = append(l, subscriber{c, flags})
+		}
+	}
+	t.l.RUnlock()
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].c.User() < l[j].c.User()
+	})
+	for _, s := range l {
+		v(s.c, s.flags)
+	}
+}
+
+// SubscriberCount returns the number of subscribers.
+func (t *Topic) SubscriberCount() int {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return len(t.c)
+}
+
+// MessagesPerSecond returns the rate of messages published to the topic,
+// averaged over the last minute.
+func (t *Topic) MessagesPerSecond() float64 {
+	return t.rolling.RateLastMinute()
+}
+
+// publish delivers a MCAST event to all subscribers, according to their
+// flags and the LagPolicy. The sender may be nil for server-initiated events.
+// If msgid isn't empty, the sender receives a receipt for every subscriber
+// with the Receipt flag that the message was delivered to.
+func (t *Topic) publish(sender *Connection, from string, msg []byte, msgid string) {
+	drop := t.LagPolicy() == DropLagging
+	var n atomic.Uint64
+	t.published.Add(1)
+	t.rolling.Record(1)
+	t.record(msg)
+	// the lock of the topic isn't held during delivery, and the message
+	// reaches every recipient before the next one from the same sender
+	deliverBatches(t.recipients(sender, from), func(l []recipient) {
+		var delivered uint64
+		for _, r := range l {
+			var err error
+			if !drop {
+				err = r.c.Write(msg)
+			} else if err = r.c.TryWrite(msg); err == ErrWriteQueueFull {
+				t.dropped.Add(1)
+			}
+			if err == nil {
+				delivered++
+				if msgid != "" && sender != nil && r.flags.Has(Receipt) {
+					sendReceipt(sender, msgid, r.c.User())
+				}
+			}
+		}
+		n.Add(delivered)
+	})
+	t.msgCount.Add(n.Load())
+	t.bytesDelivered.Add(n.Load() * uint64(len(msg)))
+}
+
+// SetFilter changes the TopicFilter applied to published messages. A nil
+// filter delivers messages as is. The filter should be set before any
+// subscription is made.
+func (t *Topic) SetFilter(f TopicFilter) {
+	if f == nil {
+		t.filterFunc.Store(nil)
+	} else {
+		t.filterFunc.Store(&f)
+	}
+}
+
+// filter applies the TopicFilter, if any, to a published payload.
+func (t *Topic) filter(from string, payload []byte) ([]byte, bool) {
+	f := t.filterFunc.Load()
+	if f == nil {
+		return payload, false
+	}
+	p, drop := (*f)(from, payload)
+	if len(p) == 0 {
+		p = payload
+	}
+	return p, drop
+}
+
+// LagPolicy returns the policy applied to lagging subscribers.
+func (t *Topic) LagPolicy() LagPolicy {
+	return LagPolicy(t.lag.Load())
+}
+
+// SetLagPolicy changes the policy applied to lagging subscribers.
+func (t *Topic) SetLagPolicy(p LagPolicy) {
+	t.lag.Store(int32(p))
+}
+
+// DroppedMessages returns the number of messages not delivered to lagging
+// subscribers.
+func (t *Topic) DroppedMessages() uint64 {
+	return t.dropped.Load()
+}
+
+// MessageCount returns the number of messages delivered to subscribers.
+// A message delivered to n subscribers counts n times.
+func (t *Topic) MessageCount() uint64 {
+	return t.msgCount.Load()
+}
+
+// ResetMessageCount resets the delivered messages counter to zero.
+func (t *Topic) ResetMessageCount() {
+	t.msgCount.Store(0)
+}
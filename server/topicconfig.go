@@ -0,0 +1,136 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"gopkg.in/yaml.v3"
+	"io"
+	"sort"
+)
+
+// TopicConfig holds the options of a topic, see TopicManager.Import.
+type TopicConfig struct {
+	Name string `yaml:"name"`
+	// MaxSubscribers limits the number of subscribers, zero means unlimited.
+	MaxSubscribers int `yaml:"maxSubscribers,omitempty"`
+	// DropLagging sets the DropLagging policy instead of BlockOnLagging.
+	DropLagging bool `yaml:"dropLagging,omitempty"`
+	// RateLimit and History, see Topic.
+	RateLimit int `yaml:"rateLimit,omitempty"`
+	History   int `yaml:"history,omitempty"`
+}
+
+// Import reads a YAML or JSON list of topic definitions, e.g.
+//
+//	# topics.yaml
+//	- name: chat
+//	  maxSubscribers: 1000
+//	- name: ticker
+//	  dropLagging: true
+//
+// The topics are created if they don't exist, and configured otherwise.
+// Imported topics are not removed when they have no subscribers and their
+// options are reapplied if they are ever re-created, e.g. after being drained.
+// They have no Owner, so that their options cannot be changed by CONFIGURE.
+// Nothing is imported if any definition is invalid, including unknown
+// options.
+func (s *TopicManager) Import(r io.Reader) error {
+	var l []TopicConfig
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&l); err != nil && err != io.EOF {
+		return err
+	}
+	for _, cfg := range l {
+		if !ssmp.IsValidIdentifier(cfg.Name) {
+			return fmt.Errorf("%w: %q", ErrInvalidTopic, cfg.Name)
+		}
+		if cfg.MaxSubscribers < 0 {
+			return fmt.Errorf("invalid maxSubscribers for %s: %d", cfg.Name, cfg.MaxSubscribers)
+		}
+		if cfg.RateLimit < 0 {
+			return fmt.Errorf("invalid rateLimit for %s: %d", cfg.Name, cfg.RateLimit)
+		}
+		if cfg.History < 0 || cfg.History > maxHistory {
+			return fmt.Errorf("invalid history for %s: %d", cfg.Name, cfg.History)
+		}
+	}
+	for _, cfg := range l {
+		s.topic.Lock()
+		if s.configs == nil {
+			s.configs = make(map[string]TopicConfig)
+		}
+		s.configs[cfg.Name] = cfg
+		s.topic.Unlock()
+		s.GetOrCreateTopic([]byte(cfg.Name)).configure(cfg)
+	}
+	return nil
+}
+
+// Export writes the configuration of all active and imported topics, in the
+// format read by Import. Subscribers are not exported.
+func (s *TopicManager) Export(w io.Writer) error {
+	s.topic.Lock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, t := range s.topics {
+		topics = append(topics, t)
+	}
+	byName := make(map[string]TopicConfig, len(s.configs)+len(topics))
+	for n, cfg := range s.configs {
+		byName[n] = cfg
+	}
+	s.topic.Unlock()
+	for _, t := range topics {
+		cfg := t.config()
+		byName[cfg.Name] = cfg
+	}
+	l := make([]TopicConfig, 0, len(byName))
+	for _, cfg := range byName {
+		l = append(l, cfg)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// isConfigured reports whether a topic was imported.
+// It must be called with the manager lock held.
+func (s *TopicManager) isConfigured(name string) bool {
+	_, ok := s.configs[name]
+	return ok
+}
+
+func (t *Topic) configure(cfg TopicConfig) {
+	t.l.Lock()
+	t.configured = true
+	t.owner = ""
+	t.maxSubscribers = cfg.MaxSubscribers
+	t.rateLimit = cfg.RateLimit
+	t.historySize = cfg.History
+	t.trimHistory()
+	t.l.Unlock()
+	if cfg.DropLagging {
+		t.SetLagPolicy(DropLagging)
+	} else {
+		t.SetLagPolicy(BlockOnLagging)
+	}
+}
+
+func (t *Topic) config() TopicConfig {
+	t.l.RLock()
+	cfg := TopicConfig{
+		Name:           t.Name,
+		MaxSubscribers: t.maxSubscribers,
+		RateLimit:      t.rateLimit,
+		History:        t.historySize,
+	}
+	t.l.RUnlock()
+	cfg.DropLagging = t.LagPolicy() == DropLagging
+	return cfg
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"github.com/aerofs/lipwig/ssmp"
+	"sync"
+	"time"
+)
+
+// TraceEntry describes a request received inside a TRACE request.
+type TraceEntry struct {
+	TraceID string
+	From    string
+	Verb    string
+	To      string
+	Time    time.Time
+}
+
+// TraceStore keeps the most recent traced requests in memory.
+// All methods are safe to call from multiple goroutines simultaneously.
+type TraceStore struct {
+	l    sync.Mutex
+	e    []TraceEntry
+	next int
+	full bool
+}
+
+// NewTraceStore creates a TraceStore holding up to size entries.
+// Older entries are overwritten.
+func NewTraceStore(size int) *TraceStore {
+	return &TraceStore{e: make([]TraceEntry, size)}
+}
+
+// WithTraceStore records requests wrapped in TRACE requests:
+//
+//	TRACE <traceID> <verb> [<fields>]
+//
+// Traced requests are dispatched regardless, a UCAST recipient receives a
+// TRACED event before the message itself:
+//
+//	000 <from> TRACED <traceID>
+func WithTraceStore(ts *TraceStore) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.traces = ts
+	}
+}
+
+// Record adds an entry to the store.
+func (ts *TraceStore) Record(e TraceEntry) {
+	if len(ts.e) == 0 {
+		return
+	}
+	ts.l.Lock()
+	ts.e[ts.next] = e
+	ts.next++
+	if ts.next == len(ts.e) {
+		ts.next = 0
+		ts.full = true
+	}
+	ts.l.Unlock()
+}
+
+// Entries returns the recorded entries, oldest first.
+func (ts *TraceStore) Entries() []TraceEntry {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	if !ts.full {
+		return append([]TraceEntry(nil), ts.e[:ts.next]...)
+	}
+	return append(append([]TraceEntry(nil), ts.e[ts.next:]...), ts.e[:ts.next]...)
+}
+
+// Lookup returns the recorded entries for a trace ID, oldest first.
+func (ts *TraceStore) Lookup(traceID string) []TraceEntry {
+	var l []TraceEntry
+	for _, e := range ts.Entries() {
+		if e.TraceID == traceID {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// dispatchTraced unwraps a TRACE request and dispatches the inner one.
+func (d *Dispatcher) dispatchTraced(c *Connection) bool {
+	id, err := c.r.DecodeId()
+	if err != nil {
+		return false
+	}
+	c.r.DiscardPrefix()
+	verb, err := c.r.DecodeVerb()
+	if err != nil || ssmp.Equal(verb, ssmp.TRACE) {
+		return false
+	}
+	c.trace = string(id)
+	defer func() { c.trace = "" }()
+	return d.Dispatch(c, verb)
+}
+
+// traced records a request received inside a TRACE request.
+func (d *Dispatcher) traced(c *Connection, verb, to []byte) {
+	if d.traces == nil {
+		return
+	}
+	d.traces.Record(TraceEntry{
+		TraceID: c.trace,
+		From:    c.User(),
+		Verb:    string(verb),
+		To:      string(to),
+		Time:    time.Now(),
+	})
+}
+
+// tracedEvent builds the event preceding the delivery of a traced message.
+func tracedEvent(c *Connection) []byte {
+	return []byte(respEvent + c.User() + " " + ssmp.TRACED + " " + c.trace + "\n")
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UpgradeProtocol is the value of the Upgrade header of HTTP requests
+// switching to SSMP.
+const UpgradeProtocol = "ssmp"
+
+var upgradeResponse []byte = []byte("HTTP/1.1 101 Switching Protocols\r\n" +
+	"Upgrade: " + UpgradeProtocol + "\r\n" +
+	"Connection: Upgrade\r\n\r\n")
+
+// ServeHTTP switches HTTP/1.1 connections to SSMP, from any origin, see
+// NewUpgrader.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrade(s, nil, w, r)
+}
+
+// NewUpgrader returns an HTTP handler switching HTTP/1.1 connections to SSMP,
+// for deployments where only HTTP traffic is allowed. Requests must carry the
+// headers:
+//
+//	Connection: Upgrade
+//	Upgrade: ssmp
+//
+// and are otherwise rejected with 400. If origins is not empty, requests
+// carrying an Origin header that isn't listed are rejected with 403.
+//
+// Upgraded connections are served like those accepted by the Server itself,
+// starting with the LOGIN request. TLS, if any, is handled by the HTTP server
+// and the Server must therefore not be given its own TLS configuration.
+func NewUpgrader(s *Server, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrade(s, origins, w, r)
+	})
+}
+
+func upgrade(s *Server, origins []string, w http.ResponseWriter, r *http.Request) {
+	if !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", UpgradeProtocol) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", UpgradeProtocol)
+		http.Error(w, "SSMP upgrade required", http.StatusBadRequest)
+		return
+	}
+	if origin := r.Header.Get("Origin"); len(origin) > 0 && len(origins) > 0 && !contains(origins, origin) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "upgrade failed", http.StatusInternalServerError)
+		return
+	}
+	// the handshake deadline is set by the Server
+	c.SetDeadline(time.Time{})
+	if _, err = c.Write(upgradeResponse); err != nil {
+		c.Close()
+		return
+	}
+	if rw.Reader.Buffered() > 0 {
+		// the client didn't wait for the response to start the session
+		c = &bufferedConn{Conn: c, r: rw.Reader}
+	}
+	s.Handle(c)
+}
+
+// hasToken reports whether a comma-separated header contains a token, in a
+// case-insensitive way.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn reads data buffered by the HTTP server before the rest of
+// the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// ConnectionState allows certificate authentication of connections upgraded
+// by an HTTPS server, see CertAuth.
+func (bc *bufferedConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := bc.Conn.(tlsConn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// NetConn returns the connection underlying TLS, if any, like
+// tls.Conn.NetConn.
+func (bc *bufferedConn) NetConn() net.Conn {
+	if tc, ok := bc.Conn.(*tls.Conn); ok {
+		return tc.NetConn()
+	}
+	return bc.Conn
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"github.com/aerofs/lipwig/ssmp"
+	"sort"
+	"strings"
+)
+
+// marks the pagination token in a USERS request
+const usersAfter = '>'
+
+// ListUsers returns the sorted list of connected named users whose
+// identifier starts with the given prefix.
+func (s *ConnectionManager) ListUsers(prefix string) []string {
+	s.connection.Lock()
+	users := make([]string, 0, len(s.connections))
+	for u := range s.connections {
+		if strings.HasPrefix(u, prefix) {
+			users = append(users, u)
+		}
+	}
+	s.connection.Unlock()
+	sort.Strings(users)
+	return users
+}
+
+// onUsers handles USERS requests:
+//
+//	USERS [prefix] [>after]
+//
+// The response lists connected named users, sorted, starting with prefix and
+// strictly greater than after. If the list does not fit in a single payload
+// the response code is 206 and the request should be repeated with the last
+// user as pagination token.
+func onUsers(c *Connection, _, option, _ []byte, d *Dispatcher) {
+	var prefix, after []byte
+	for _, f := range bytes.Fields(option) {
+		if f[0] == usersAfter && after == nil {
+			after = f[1:]
+		} else if f[0] != usersAfter && prefix == nil {
+			prefix = f
+		} else {
+			c.Write(respBadRequest)
+			return
+		}
+	}
+	users := d.connections.ListUsers(string(prefix))
+	i := sort.SearchStrings(users, string(after))
+	if i < len(users) && users[i] == string(after) {
+		i++
+	}
+	code := ssmp.CodeOk
+	var list bytes.Buffer
+	for _, u := range users[i:] {
+		if list.Len()+1+len(u) > ssmp.MaxPayloadLength {
+			code = ssmp.CodePartial
+			break
+		}
+		if list.Len() > 0 {
+			list.WriteByte(' ')
+		}
+		list.WriteString(u)
+	}
+	m := ssmp.NewMessage().Code(code)
+	if list.Len() > 0 {
+		m.Payload(list.String())
+	}
+	c.Write(m.MustBuild())
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"unicode/utf8"
+)
+
+// The PayloadValidator interface is used to reject requests based on their
+// payload, after the message has been parsed but before it is dispatched.
+type PayloadValidator interface {
+	// Validate returns a non-nil error if the payload of the given verb
+	// should be rejected.
+	// By default a 400 response is sent, unless the error implements CodeError.
+	Validate(verb string, payload []byte) error
+}
+
+// PayloadValidatorFunc is an adapter to use ordinary functions as PayloadValidator.
+type PayloadValidatorFunc func(string, []byte) error
+
+func (f PayloadValidatorFunc) Validate(verb string, payload []byte) error {
+	return f(verb, payload)
+}
+
+// CodeError is an error carrying a specific SSMP response code.
+type CodeError interface {
+	error
+	Code() int
+}
+
+var ErrInvalidPayload error = fmt.Errorf("invalid payload")
+
+// MaxPayloadSizeValidator rejects payloads larger than maxBytes.
+func MaxPayloadSizeValidator(maxBytes int) PayloadValidator {
+	return PayloadValidatorFunc(func(_ string, payload []byte) error {
+		if len(payload) > maxBytes {
+			return ErrInvalidPayload
+		}
+		return nil
+	})
+}
+
+// JSONPayloadValidator rejects payloads that are not valid UTF-8 JSON.
+func JSONPayloadValidator() PayloadValidator {
+	return PayloadValidatorFunc(func(_ string, payload []byte) error {
+		if !utf8.Valid(payload) || !json.Valid(payload) {
+			return ErrInvalidPayload
+		}
+		return nil
+	})
+}
+
+// errorResponse builds the response to send when a request is rejected by
+// a PayloadValidator.
+func errorResponse(err error) []byte {
+	if cerr, ok := err.(CodeError); ok {
+		// codes that can't be encoded, e.g. 0 or 1000, fall back to 400
+		if resp, err := ssmp.NewMessage().Code(cerr.Code()).Build(); err == nil {
+			return resp
+		}
+	}
+	return respBadRequest
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+)
+
+var ErrAlreadyConnected error = fmt.Errorf("user already connected")
+
+// RegisterVirtual registers a connection for a user that isn't backed by a
+// network connection, e.g. a bot implemented by server-side hooks. Every
+// message written to the connection, such as UCAST events sent to the user,
+// is passed to write as an encoded frame, which is only valid for the duration
+// of the call. An error returned by write closes the connection, which remains
+// registered until DeregisterVirtual is called.
+//
+// ErrAlreadyConnected is returned if the user is already connected.
+func (s *ConnectionManager) RegisterVirtual(user string, write func([]byte) error) (*Connection, error) {
+	if user == ssmp.Anonymous || !ssmp.IsValidIdentifier(user) || user[0] == GroupPrefix {
+		return nil, ErrInvalidLogin
+	}
+	c := newLocalConnection(&virtualConn{localConn: newLocalConn(), write: write}, user)
+	s.connection.Lock()
+	defer s.connection.Unlock()
+	if s.connections[user] != nil {
+		return nil, ErrAlreadyConnected
+	}
+	s.connections[user] = c
+	s.connected.notify()
+	return c, nil
+}
+
+// DeregisterVirtual closes and unregisters the virtual connection of a user.
+// ErrUserNotFound is returned if the user doesn't have a virtual connection.
+func (s *ConnectionManager) DeregisterVirtual(user string) error {
+	s.connection.Lock()
+	c := s.connections[user]
+	if c == nil {
+		s.connection.Unlock()
+		return ErrUserNotFound
+	}
+	if _, ok := c.c.(*virtualConn); !ok {
+		s.connection.Unlock()
+		return ErrUserNotFound
+	}
+	delete(s.connections, user)
+	s.connection.Unlock()
+	c.Close()
+	// no read goroutine to do it
+	c.Cleanup()
+	return nil
+}
+
+// virtualConn hands the messages written to a virtual connection to a
+// function.
+type virtualConn struct {
+	*localConn
+	write func([]byte) error
+}
+
+func (vc *virtualConn) Write(b []byte) (int, error) {
+	select {
+	case <-vc.done:
+		return 0, errConnectionClosed
+	default:
+	}
+	if err := vc.write(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrTimeout error = fmt.Errorf("timed out")
+
+// A notifier wakes up goroutines waiting for a condition to change.
+// The zero value is ready to use.
+type notifier struct {
+	l   sync.Mutex
+	c   *sync.Cond
+	gen uint64
+}
+
+func (n *notifier) cond() *sync.Cond {
+	if n.c == nil {
+		n.c = sync.NewCond(&n.l)
+	}
+	return n.c
+}
+
+// notify wakes up all waiters to re-evaluate their condition.
+func (n *notifier) notify() {
+	n.l.Lock()
+	n.gen++
+	n.cond().Broadcast()
+	n.l.Unlock()
+}
+
+// waitUntil blocks until ok returns true or the timeout expires.
+// ok is evaluated without holding the notifier lock, so it is free to
+// acquire other locks.
+func (n *notifier) waitUntil(ok func() bool, timeout time.Duration) error {
+	expired := false
+	t := time.AfterFunc(timeout, func() {
+		n.l.Lock()
+		expired = true
+		n.cond().Broadcast()
+		n.l.Unlock()
+	})
+	defer t.Stop()
+	n.l.Lock()
+	for {
+		gen := n.gen
+		n.l.Unlock()
+		if ok() {
+			return nil
+		}
+		n.l.Lock()
+		// skip waiting if a notification was missed while evaluating ok
+		for gen == n.gen && !expired {
+			n.cond().Wait()
+		}
+		if expired {
+			n.l.Unlock()
+			return ErrTimeout
+		}
+	}
+}
+
+// WaitForConnections blocks until at least n authenticated users are
+// connected. It returns ErrTimeout if that doesn't happen within the given
+// timeout.
+func (s *ConnectionManager) WaitForConnections(n int, timeout time.Duration) error {
+	return s.connected.waitUntil(func() bool {
+		s.connection.Lock()
+		defer s.connection.Unlock()
+		return len(s.connections) >= n
+	}, timeout)
+}
+
+// WaitForTopic blocks until the named topic has at least n subscribers.
+// It returns ErrTimeout if that doesn't happen within the given timeout.
+func (s *TopicManager) WaitForTopic(name string, n int, timeout time.Duration) error {
+	return s.subscribed.waitUntil(func() bool {
+		t := s.GetTopic([]byte(name))
+		if t == nil {
+			return false
+		}
+		t.l.RLock()
+		defer t.l.RUnlock()
+		return len(t.c) >= n
+	}, timeout)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// A Relistener is a net.Listener that the watchdog re-creates with the same
+// options, e.g. dual-stack, SO_REUSEPORT or QUIC, see StartWithWatchdog.
+type Relistener interface {
+	net.Listener
+	// Relisten creates a new Listener bound to the same address, once this
+	// one is closed.
+	Relisten() (net.Listener, error)
+}
+
+// default limits of the watchdog, see WithWatchdog
+const (
+	defaultWatchdogMaxRestarts = 5
+	defaultWatchdogWindow      = time.Minute
+)
+
+// WithWatchdog makes Start behave like StartWithWatchdog with the given
+// restart delay. The watchdog gives up after maxRestarts consecutive
+// restarts within window, i.e. without any connection accepted in between,
+// zero or less meaning that it never gives up. The default limit is 5
+// consecutive restarts per minute.
+func WithWatchdog(delay time.Duration, maxRestarts int, window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.watchdog = true
+		s.watchdogDelay = delay
+		s.watchdogMaxRestarts = maxRestarts
+		s.watchdogWindow = window
+	}
+}
+
+// StartWithWatchdog is like Start but recovers from panics in the goroutine
+// accepting connections. After a panic, the Listener is closed and, after
+// restartDelay, a new one is bound to the same address and accepting
+// resumes. Existing connections are unaffected.
+//
+// Once too many restarts happen within a short period, see WithWatchdog, the
+// watchdog gives up and no new connection is accepted until Stop.
+// Listeners implementing Relistener are re-created by their Relisten method,
+// other ones require an address that net.Listen can bind, e.g. a TCP port or
+// a unix socket path.
+func (s *Server) StartWithWatchdog(restartDelay time.Duration) *Server {
+	s.dispatcher.startPersister()
+	s.startGC()
+	s.startLeaseReaper()
+	s.w.Add(1)
+	go s.watch(restartDelay)
+	return s
+}
+
+func (s *Server) watch(delay time.Duration) {
+	defer s.w.Done()
+	var restarts []time.Time
+	for s.acceptRecovered() {
+		if s.accepted.Swap(false) {
+			// only consecutive restarts count towards the limit
+			restarts = restarts[:0]
+		}
+		for {
+			restarts = s.allowRestart(restarts, time.Now())
+			if restarts == nil {
+				fmt.Println("watchdog: too many restarts, giving up")
+				return
+			}
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-s.stopping:
+				t.Stop()
+				return
+			}
+			err := s.relisten()
+			if err == nil {
+				break
+			}
+			if err == errStopped {
+				return
+			}
+			fmt.Println("watchdog: listen failed:", err)
+		}
+	}
+}
+
+var errStopped error = fmt.Errorf("server stopped")
+
+// acceptRecovered accepts connections until the Listener fails, and reports
+// whether accepting stopped because of a panic.
+func (s *Server) acceptRecovered() (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("watchdog: panic while accepting connections: %v\n%s", r, debug.Stack())
+			panicked = true
+		}
+	}()
+	s.accept()
+	return false
+}
+
+// allowRestart records a restart at the given time, among the previous ones
+// still within the watchdog window. It returns nil if the restart exceeds
+// the limit.
+func (s *Server) allowRestart(restarts []time.Time, now time.Time) []time.Time {
+	if s.watchdogWindow > 0 {
+		i := 0
+		for i < len(restarts) && now.Sub(restarts[i]) > s.watchdogWindow {
+			i++
+		}
+		restarts = restarts[i:]
+	}
+	if s.watchdogMaxRestarts > 0 && len(restarts) >= s.watchdogMaxRestarts {
+		return nil
+	}
+	return append(restarts, now)
+}
+
+// relisten replaces the Listener by a new one bound to the same address,
+// created by Relisten if the Listener is a Relistener.
+func (s *Server) relisten() error {
+	s.listen.Lock()
+	defer s.listen.Unlock()
+	select {
+	case <-s.stopping:
+		return errStopped
+	default:
+	}
+	a := s.l.Addr()
+	// the address must be released before it can be bound again
+	s.l.Close()
+	var l net.Listener
+	var err error
+	if r, ok := s.l.(Relistener); ok {
+		l, err = r.Relisten()
+	} else {
+		l, err = net.Listen(a.Network(), a.String())
+	}
+	if err != nil {
+		return err
+	}
+	s.l = l
+	return nil
+}
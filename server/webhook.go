@@ -0,0 +1,107 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// A UcastFallback attempts to deliver a UCAST payload to a user that is not
+// connected, e.g. through a push notification service.
+// It returns nil if the payload was delivered.
+type UcastFallback func(from, to, payload string) error
+
+// WithUcastFallback calls f for UCAST to users that are neither connected
+// locally nor reachable through the Forwarder, if any. The sender gets a 200
+// response if f succeeds, and a 404 response otherwise.
+// The fallback is called from the read goroutine of the sender and should
+// therefore be bounded in time.
+func WithUcastFallback(f UcastFallback) ServerOption {
+	return func(s *Server) {
+		s.dispatcher.ucastFallback = f
+	}
+}
+
+// default bound on the duration of a webhook call
+const defaultWebhookTimeout = 5 * time.Second
+
+var ErrWebhookFailed error = fmt.Errorf("webhook failed")
+
+// A WebhookOption configures optional behavior of WebhookFallback.
+type WebhookOption func(*webhook)
+
+// WebhookFallbackTimeout bounds the duration of each webhook call.
+// The default is 5 seconds.
+func WebhookFallbackTimeout(d time.Duration) WebhookOption {
+	return func(w *webhook) {
+		w.timeout = d
+	}
+}
+
+type webhook struct {
+	endpoint string
+	client   *http.Client
+	timeout  time.Duration
+}
+
+type webhookBody struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Payload string `json:"payload"`
+}
+
+// WebhookFallback returns a UcastFallback POSTing the message to an HTTP
+// endpoint, as a JSON object with from, to and payload fields.
+// Any 2xx status counts as a successful delivery.
+// A nil client uses http.DefaultClient.
+func WebhookFallback(endpoint string, client *http.Client, opts ...WebhookOption) UcastFallback {
+	w := &webhook{
+		endpoint: endpoint,
+		client:   client,
+		timeout:  defaultWebhookTimeout,
+	}
+	if w.client == nil {
+		w.client = http.DefaultClient
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w.post
+}
+
+func (w *webhook) post(from, to, payload string) error {
+	b, err := json.Marshal(webhookBody{From: from, To: to, Payload: payload})
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain body to allow reuse of the connection
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ErrWebhookFailed
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"bytes"
+	"strconv"
+)
+
+type fieldKind int
+
+const (
+	kindVerb fieldKind = iota
+	kindId
+	kindPayload
+	kindCode
+)
+
+type field struct {
+	kind   fieldKind
+	data   []byte
+	binary bool
+}
+
+// A MessageBuilder assembles a SSMP message field by field.
+//
+// The fields are validated by Build, which accepts the following sequences:
+//
+//	request:  Verb [Id] [Payload]
+//	response: Code [Payload]               (Code != 0)
+//	event:    Code Id Verb [Id] [Payload]  (Code == 0)
+type MessageBuilder struct {
+	fields []field
+}
+
+// NewMessage creates an empty MessageBuilder.
+func NewMessage() *MessageBuilder {
+	return &MessageBuilder{}
+}
+
+func (b *MessageBuilder) add(kind fieldKind, data []byte) *MessageBuilder {
+	b.fields = append(b.fields, field{kind: kind, data: data})
+	return b
+}
+
+// Verb appends a VERB field.
+func (b *MessageBuilder) Verb(v string) *MessageBuilder {
+	return b.add(kindVerb, []byte(v))
+}
+
+// Id appends an IDENTIFIER field.
+func (b *MessageBuilder) Id(id string) *MessageBuilder {
+	return b.add(kindId, []byte(id))
+}
+
+// Payload appends a text PAYLOAD field.
+func (b *MessageBuilder) Payload(p string) *MessageBuilder {
+	return b.add(kindPayload, []byte(p))
+}
+
+// BinaryPayload appends a PAYLOAD field, with a length prefix.
+func (b *MessageBuilder) BinaryPayload(p []byte) *MessageBuilder {
+	var d []byte
+	if len(p) > 0 && len(p) <= MaxPayloadLength {
+		n := len(p) - 1
+		d = make([]byte, 0, BinaryPayloadPrefix+len(p))
+		d = append(d, byte(n>>8), byte(n))
+		d = append(d, p...)
+	}
+	b.add(kindPayload, d)
+	b.fields[len(b.fields)-1].binary = true
+	return b
+}
+
+// Code appends a response CODE field.
+func (b *MessageBuilder) Code(code int) *MessageBuilder {
+	if code < 0 || code > 999 {
+		return b.add(kindCode, nil)
+	}
+	s := strconv.Itoa(code)
+	for len(s) < CodeLength {
+		s = "0" + s
+	}
+	return b.add(kindCode, []byte(s))
+}
+
+// Build validates the sequence of fields and returns the encoded message,
+// including the trailing newline.
+// ErrInvalidMessage is returned if any field is invalid or if the sequence
+// of fields does not match any known message type.
+func (b *MessageBuilder) Build() ([]byte, error) {
+	if !b.isValidSequence() {
+		return nil, ErrInvalidMessage
+	}
+	var buf bytes.Buffer
+	for i, f := range b.fields {
+		if !f.isValid() {
+			return nil, ErrInvalidMessage
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.Write(f.data)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// MustBuild is like Build but panics if the message is invalid.
+func (b *MessageBuilder) MustBuild() []byte {
+	m, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (b *MessageBuilder) isValidSequence() bool {
+	f := b.fields
+	if len(f) == 0 {
+		return false
+	}
+	i := 1
+	switch f[0].kind {
+	case kindVerb:
+		if i < len(f) && f[i].kind == kindId {
+			i++
+		}
+	case kindCode:
+		if string(f[0].data) != "000" {
+			break
+		}
+		// event: origin and verb of the forwarded request
+		if len(f) < 3 || f[1].kind != kindId || f[2].kind != kindVerb {
+			return false
+		}
+		i = 3
+		if i < len(f) && f[i].kind == kindId {
+			i++
+		}
+	default:
+		return false
+	}
+	if i < len(f) && f[i].kind == kindPayload {
+		i++
+	}
+	return i == len(f)
+}
+
+func (f field) isValid() bool {
+	switch f.kind {
+	case kindVerb:
+		return isValid(f.data, MaxVerbLength, VERB_CHARSET)
+	case kindId:
+		return isValid(f.data, MaxIdentifierLength, ID_CHARSET)
+	case kindCode:
+		return f.data != nil
+	case kindPayload:
+		if f.binary {
+			return f.data != nil
+		}
+		return len(f.data) > 0 && len(f.data) <= MaxPayloadLength &&
+			f.data[0] > 3 && bytes.IndexByte(f.data, '\n') == -1
+	}
+	return false
+}
+
+func isValid(b []byte, max int, charset *ByteSet) bool {
+	if len(b) == 0 || len(b) > max {
+		return false
+	}
+	for _, c := range b {
+		if !charset.Contains(c) {
+			return false
+		}
+	}
+	return true
+}
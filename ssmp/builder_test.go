@@ -0,0 +1,72 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestMessageBuilder_should_build_request(t *testing.T) {
+	m, err := NewMessage().Verb(UCAST).Id("foo").Payload("hello world").Build()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("UCAST foo hello world\n"), m)
+
+	m, err = NewMessage().Verb(PING).Build()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("PING\n"), m)
+}
+
+func TestMessageBuilder_should_build_response(t *testing.T) {
+	assert.Equal(t, []byte("200\n"), NewMessage().Code(200).MustBuild())
+	assert.Equal(t, []byte("400 oops\n"), NewMessage().Code(400).Payload("oops").MustBuild())
+}
+
+func TestMessageBuilder_should_build_event(t *testing.T) {
+	m, err := NewMessage().Code(CodeEvent).Id("foo").Verb(MCAST).Id("chat").Payload("hi").Build()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("000 foo MCAST chat hi\n"), m)
+}
+
+func TestMessageBuilder_should_build_decodable_binary_payload(t *testing.T) {
+	p := []byte{0, 1, 2, '\n', 255}
+	m, err := NewMessage().Verb(BCAST).BinaryPayload(p).Build()
+	assert.Nil(t, err)
+
+	r := newReader(io.EOF, string(m))
+	expectData(t, BCAST, u(r.DecodeVerb()))
+	expectData(t, string(p), u(r.DecodePayload()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestMessageBuilder_should_reject_invalid_sequence(t *testing.T) {
+	for _, b := range []*MessageBuilder{
+		NewMessage(),
+		NewMessage().Id("foo"),
+		NewMessage().Verb(UCAST).Payload("a").Id("foo"),
+		NewMessage().Code(200).Id("foo"),
+		NewMessage().Code(CodeEvent).Verb(UCAST),
+		NewMessage().Verb(UCAST).Verb(UCAST),
+	} {
+		_, err := b.Build()
+		assert.Equal(t, ErrInvalidMessage, err)
+	}
+}
+
+func TestMessageBuilder_should_reject_invalid_field(t *testing.T) {
+	for _, b := range []*MessageBuilder{
+		NewMessage().Verb("ucast"),
+		NewMessage().Verb(UCAST).Id("foo$"),
+		NewMessage().Verb(UCAST).Id("foo").Payload("a\nb"),
+		NewMessage().Verb(UCAST).Id("foo").Payload("\x01ab"),
+		NewMessage().Verb(BCAST).Payload(""),
+		NewMessage().Verb(BCAST).BinaryPayload(nil),
+		NewMessage().Code(1000),
+	} {
+		_, err := b.Build()
+		assert.Equal(t, ErrInvalidMessage, err)
+	}
+	assert.Panics(t, func() { NewMessage().Code(-1).MustBuild() })
+}
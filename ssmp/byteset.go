@@ -3,6 +3,12 @@
 
 package ssmp
 
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
 // A ByteSet is a compact representation of an immutable set of bytes,
 // which offers constant-time membership queries.
 type ByteSet struct {
@@ -39,8 +45,8 @@ func All(cs string) ByteSetInitializer {
 // Initializer for a range of bytes.
 func Range(a, b byte) ByteSetInitializer {
 	return func(s *ByteSet) {
-		for c := a; c <= b; c++ {
-			s.set(c)
+		for c := int(a); c <= int(b); c++ {
+			s.set(byte(c))
 		}
 	}
 }
@@ -53,3 +59,153 @@ func (s *ByteSet) set(c byte) {
 func (s *ByteSet) Contains(c byte) bool {
 	return (s.s[c/64] & (uint64(1) << (c & 63))) != 0
 }
+
+// ContainsAll reports whether all bytes of str are in the set.
+func (s *ByteSet) ContainsAll(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if !s.Contains(str[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns a new set of the bytes in either s or o.
+func (s *ByteSet) Union(o *ByteSet) *ByteSet {
+	n := &ByteSet{}
+	for i := range n.s {
+		n.s[i] = s.s[i] | o.s[i]
+	}
+	return n
+}
+
+// Intersect returns a new set of the bytes in both s and o.
+func (s *ByteSet) Intersect(o *ByteSet) *ByteSet {
+	n := &ByteSet{}
+	for i := range n.s {
+		n.s[i] = s.s[i] & o.s[i]
+	}
+	return n
+}
+
+// Minus returns a new set of the bytes in s but not in o.
+func (s *ByteSet) Minus(o *ByteSet) *ByteSet {
+	n := &ByteSet{}
+	for i := range n.s {
+		n.s[i] = s.s[i] &^ o.s[i]
+	}
+	return n
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func sameClass(a, b byte) bool {
+	return (a <= '9') == (b <= '9') && (a <= 'Z') == (b <= 'Z')
+}
+
+func appendByte(b []byte, c byte) []byte {
+	if c > ' ' && c < 0x7f && c != '\\' {
+		return append(b, c)
+	}
+	return append(b, fmt.Sprintf("\\x%02x", c)...)
+}
+
+// MarshalText encodes the set as a space-separated list of tokens.
+// Runs of at least three consecutive letters or digits are encoded as ranges
+// (e.g. "a-z"), all other bytes are listed in a single trailing token, with
+// any '-' first to avoid confusion with ranges. Non-printable bytes, space
+// and backslash are escaped as \xHH.
+func (s *ByteSet) MarshalText() ([]byte, error) {
+	var b, others []byte
+	for i := 0; i < 256; i++ {
+		c := byte(i)
+		if !s.Contains(c) {
+			continue
+		}
+		if !isAlnum(c) {
+			if c == '-' {
+				others = append([]byte{'-'}, others...)
+			} else {
+				others = appendByte(others, c)
+			}
+			continue
+		}
+		j := i
+		for j < 255 && s.Contains(byte(j+1)) && isAlnum(byte(j+1)) && sameClass(c, byte(j+1)) {
+			j++
+		}
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		if j-i >= 2 {
+			b = append(appendByte(b, c), '-')
+			b = appendByte(b, byte(j))
+		} else {
+			for k := i; k <= j; k++ {
+				b = appendByte(b, byte(k))
+			}
+		}
+		i = j
+	}
+	if len(others) > 0 {
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, others...)
+	}
+	return b, nil
+}
+
+var ErrInvalidByteSet error = fmt.Errorf("invalid byte set")
+
+// UnmarshalText replaces the content of the set with the bytes described by
+// the given text, in the format produced by MarshalText.
+// A token made of exactly two bytes separated by '-' is a range, any other
+// token is a list of bytes.
+func (s *ByteSet) UnmarshalText(text []byte) error {
+	var n ByteSet
+	for _, tok := range bytes.Fields(text) {
+		first, i, err := parseByte(tok, 0)
+		if err != nil {
+			return err
+		}
+		if i < len(tok) && tok[i] == '-' && i+1 < len(tok) {
+			last, j, err := parseByte(tok, i+1)
+			if err != nil {
+				return err
+			}
+			if j == len(tok) {
+				if last < first {
+					return ErrInvalidByteSet
+				}
+				Range(first, last)(&n)
+				continue
+			}
+		}
+		for i = 0; i < len(tok); {
+			var c byte
+			if c, i, err = parseByte(tok, i); err != nil {
+				return err
+			}
+			n.set(c)
+		}
+	}
+	*s = n
+	return nil
+}
+
+func parseByte(tok []byte, i int) (byte, int, error) {
+	if tok[i] != '\\' {
+		return tok[i], i + 1, nil
+	}
+	if i+4 > len(tok) || tok[i+1] != 'x' {
+		return 0, i, ErrInvalidByteSet
+	}
+	v, err := strconv.ParseUint(string(tok[i+2:i+4]), 16, 8)
+	if err != nil {
+		return 0, i, ErrInvalidByteSet
+	}
+	return byte(v), i + 4, nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestByteSet_should_marshal_id_charset(t *testing.T) {
+	b, err := ID_CHARSET.MarshalText()
+	require.Nil(t, err)
+	assert.Equal(t, "0-9 A-Z a-z -+./:=@_~", string(b))
+}
+
+func TestByteSet_should_round_trip(t *testing.T) {
+	for _, s := range []*ByteSet{
+		ID_CHARSET,
+		VERB_CHARSET,
+		NewByteSet(),
+		NewByteSet(Range(0, 255)),
+		NewByteSet(All("ab-\\ "), Range('x', 'z')),
+		NewByteSet(Byte('-'), Byte('.'), Byte('/')),
+	} {
+		b, err := s.MarshalText()
+		require.Nil(t, err)
+		var d ByteSet
+		require.Nil(t, d.UnmarshalText(b))
+		assert.Equal(t, *s, d, string(b))
+	}
+}
+
+func TestByteSet_should_compose(t *testing.T) {
+	s := ID_CHARSET.Union(NewByteSet(Byte('%')))
+	assert.True(t, s.Contains('%'))
+	assert.True(t, s.ContainsAll("foo%40bar"))
+	assert.False(t, ID_CHARSET.ContainsAll("foo%40bar"))
+	assert.False(t, ID_CHARSET.Contains('%'))
+
+	assert.Equal(t, *NewByteSet(), *NewByteSet(Range('a', 'z')).Intersect(NewByteSet(Range('0', '9'))))
+	assert.Equal(t, *NewByteSet(Range('a', 'f')), *ID_CHARSET.Intersect(NewByteSet(Range('a', 'f'), Byte(' '))))
+
+	alpha := ID_CHARSET.Minus(NewByteSet(Range('0', '9'), All("-+./:=@_~")))
+	assert.Equal(t, *NewByteSet(Range('A', 'Z'), Range('a', 'z')), *alpha)
+	assert.True(t, alpha.ContainsAll("Foo"))
+	assert.False(t, alpha.ContainsAll("foo1"))
+	assert.True(t, alpha.ContainsAll(""))
+}
+
+func TestByteSet_should_unmarshal(t *testing.T) {
+	var s ByteSet
+	require.Nil(t, s.UnmarshalText([]byte("a-z A-Z 0-9 .:@/-_+=~")))
+	assert.Equal(t, *ID_CHARSET, s)
+	require.Nil(t, s.UnmarshalText([]byte(`\x00-\x03 %`)))
+	assert.Equal(t, *NewByteSet(Range(0, 3), Byte('%')), s)
+}
+
+func TestByteSet_should_reject_invalid_text(t *testing.T) {
+	var s ByteSet
+	assert.Equal(t, ErrInvalidByteSet, s.UnmarshalText([]byte("z-a")))
+	assert.Equal(t, ErrInvalidByteSet, s.UnmarshalText([]byte(`\x4`)))
+	assert.Equal(t, ErrInvalidByteSet, s.UnmarshalText([]byte(`\y41`)))
+}
+
+func TestByteSet_should_reject_framing_charset(t *testing.T) {
+	assert.Equal(t, ErrInvalidCharset, SetIDCharset(NewByteSet(Range('a', 'z'), Byte(' '))))
+	assert.Equal(t, ErrInvalidCharset, SetIDCharset(NewByteSet(Range('a', 'z'), Byte('\n'))))
+	assert.Equal(t, ErrInvalidCharset, SetIDCharset(NewByteSet(Range('a', 'z'), Byte(2))))
+}
+
+func TestByteSet_should_set_id_charset(t *testing.T) {
+	old := ID_CHARSET
+	defer SetIDCharset(old)
+
+	r := newReader(io.EOF, "foo%20bar\n")
+	expectError(t, ErrInvalidMessage, u(r.DecodeId()))
+
+	var s ByteSet
+	require.Nil(t, s.UnmarshalText([]byte("a-z A-Z 0-9 .:@/-_+=~%")))
+	require.Nil(t, SetIDCharset(&s))
+
+	r = newReader(io.EOF, "foo%20bar\n")
+	expectData(t, "foo%20bar", u(r.DecodeId()))
+	assert.True(t, IsValidIdentifier("foo%20bar"))
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"context"
+	"io"
+)
+
+// NewDecoderContext creates a Decoder whose reads are interrupted when ctx is
+// done, in which case decoding methods return ctx.Err().
+//
+// Reads from rd happen in a separate goroutine which may outlive the
+// cancellation until the underlying read returns, e.g. when rd is closed.
+func NewDecoderContext(ctx context.Context, rd io.Reader) *Decoder {
+	return NewDecoder(&ctxReader{ctx: ctx, rd: rd})
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+// ctxReader reads into its own buffer so that an abandoned read never
+// touches the caller's buffer.
+type ctxReader struct {
+	ctx context.Context
+	rd  io.Reader
+
+	buf     []byte
+	left    []byte
+	err     error
+	pending chan readResult
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if len(r.left) > 0 {
+		n := copy(p, r.left)
+		r.left = r.left[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.pending == nil {
+		if cap(r.buf) < len(p) {
+			r.buf = make([]byte, len(p))
+		}
+		buf := r.buf[:len(p)]
+		ch := make(chan readResult, 1)
+		go func() {
+			n, err := r.rd.Read(buf)
+			ch <- readResult{n, err}
+		}()
+		r.pending = ch
+	}
+	select {
+	case res := <-r.pending:
+		r.pending = nil
+		r.err = res.err
+		n := copy(p, r.buf[:res.n])
+		r.left = r.buf[n:res.n]
+		if n < res.n {
+			return n, nil
+		}
+		return n, res.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
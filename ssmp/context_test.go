@@ -0,0 +1,55 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecoderContext_should_return_deadline_exceeded(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := NewDecoderContext(ctx, a)
+
+	start := time.Now()
+	expectError(t, context.DeadlineExceeded, u(r.DecodeVerb()))
+	assert.True(t, time.Since(start) < time.Second)
+	expectError(t, context.DeadlineExceeded, u(r.DecodeVerb()))
+}
+
+func TestDecoderContext_should_decode_before_deadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r := NewDecoderContext(ctx, &testReader{
+		reads: []string{"UCA", "ST foo", " hello\n"},
+		err:   io.EOF,
+	})
+	expectData(t, "UCAST", u(r.DecodeVerb()))
+	expectData(t, "foo", u(r.DecodeId()))
+	expectData(t, "hello", u(r.DecodePayload()))
+	assert.True(t, r.AtEnd())
+	r.Reset()
+	expectError(t, io.EOF, u(r.DecodeVerb()))
+}
+
+func TestDecoderContext_should_return_canceled(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewDecoderContext(ctx, a)
+	go func() {
+		b.Write([]byte("PI"))
+		cancel()
+	}()
+	expectError(t, context.Canceled, u(r.DecodeVerb()))
+}
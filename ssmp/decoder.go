@@ -4,6 +4,7 @@
 package ssmp
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -28,10 +29,12 @@ const (
 	CodeLength          = 3
 	MaxVerbLength       = 16
 	MaxIdentifierLength = 64
-	MaxPayloadLength    = 1024
-	BinaryPayloadPrefix = 2
+	// comma-separated IDENTIFIER fields, e.g. in a multi-topic SUBSCRIBE
+	MaxIdentifierListLength = 4 * MaxIdentifierLength
+	MaxPayloadLength        = 1024
+	BinaryPayloadPrefix     = 2
 
-	MaxMessageLength = CodeLength + 5 + MaxVerbLength + 2*MaxIdentifierLength + BinaryPayloadPrefix + MaxPayloadLength
+	MaxMessageLength = CodeLength + 5 + MaxVerbLength + MaxIdentifierLength + MaxIdentifierListLength + BinaryPayloadPrefix + MaxPayloadLength
 
 	bufferSize = 2048
 )
@@ -49,6 +52,28 @@ var ID_CHARSET *ByteSet = NewByteSet(
 	All(".:@/-_+=~"),
 )
 
+// framing bytes that can never be part of an IDENTIFIER field
+var framingCharset *ByteSet = NewByteSet(
+	Range(0, 3),
+	All(" \n"),
+)
+
+var ErrInvalidCharset error = fmt.Errorf("charset includes framing bytes")
+
+// SetIDCharset replaces ID_CHARSET, e.g. to allow '%' in URL-encoded
+// identifiers. The new charset may not include space, newline or bytes
+// 0 to 3 which would break message framing.
+// This function is not safe to call concurrently with decoding.
+func SetIDCharset(s *ByteSet) error {
+	for c := 0; c < 256; c++ {
+		if s.Contains(byte(c)) && framingCharset.Contains(byte(c)) {
+			return ErrInvalidCharset
+		}
+	}
+	ID_CHARSET = s
+	return nil
+}
+
 func (d *Decoder) ensureBuffered(n int) error {
 	var read int
 	err := d.lastErr
@@ -83,6 +108,63 @@ func (d *Decoder) Reset() {
 	d.s = d.r
 }
 
+// SkipMessage discards the remainder of the current message, up to and
+// including the next newline, e.g. after a decoding error.
+// Reset may be called afterwards to decode the next message. The raw message
+// is not available if it didn't fit in the buffer.
+func (d *Decoder) SkipMessage() error {
+	if d.AtEnd() {
+		return nil
+	}
+	for {
+		if i := bytes.IndexByte(d.buf[d.r:d.w], '\n'); i != -1 {
+			d.r += i + 1
+			return nil
+		}
+		d.r = d.w
+		if d.w == len(d.buf) {
+			// drop the oversized message
+			d.s, d.r, d.w = 0, 0, 0
+		}
+		if err := d.ensureBuffered(1); err != nil {
+			return err
+		}
+	}
+}
+
+// ForceReset discards the remainder of the current message, if partially
+// decoded, and prepares for decoding the next one. Unlike Reset, it may be
+// called at any point, e.g. to recover from a failure. It does nothing if
+// no field was decoded since the last reset.
+func (d *Decoder) ForceReset() error {
+	if d.r == d.s {
+		return nil
+	}
+	if err := d.SkipMessage(); err != nil {
+		return err
+	}
+	d.Reset()
+	return nil
+}
+
+// Rewind goes back to the start of the current message, to decode it again,
+// e.g. after peeking at its verb.
+func (d *Decoder) Rewind() {
+	d.r = d.s
+}
+
+// CanReset reports whether Reset may be called, i.e. whether the current
+// message was entirely decoded.
+func (d *Decoder) CanReset() bool {
+	return d.AtEnd()
+}
+
+// DiscardPrefix drops the fields decoded so far from the raw message, for
+// requests wrapping another one, see TRACE.
+func (d *Decoder) DiscardPrefix() {
+	d.s = d.r
+}
+
 func (d *Decoder) RawMessage() []byte {
 	if !d.AtEnd() {
 		panic("not a full message")
@@ -117,6 +199,41 @@ func (d *Decoder) DecodeCode() (int, error) {
 	return code, nil
 }
 
+// DecodeResponse decodes the code of a response and its payload, which is
+// empty if the response has none.
+// For events, only the code is decoded and the payload is nil, the rest of
+// the event being left for DecodeEvent.
+func (d *Decoder) DecodeResponse() (int, []byte, error) {
+	code, err := d.DecodeCode()
+	if err != nil {
+		return -1, nil, err
+	}
+	if code == CodeEvent {
+		return code, nil, nil
+	}
+	if d.AtEnd() {
+		return code, d.buf[d.r:d.r], nil
+	}
+	payload, err := d.DecodePayload()
+	if err != nil {
+		return -1, nil, err
+	}
+	return code, payload, nil
+}
+
+// DecodeEvent decodes the origin and verb of an event, after its code.
+func (d *Decoder) DecodeEvent() ([]byte, []byte, error) {
+	from, err := d.DecodeId()
+	if err != nil {
+		return nil, nil, err
+	}
+	verb, err := d.DecodeVerb()
+	if err != nil {
+		return nil, nil, err
+	}
+	return from, verb, nil
+}
+
 func (d *Decoder) DecodeVerb() ([]byte, error) {
 	if d.AtEnd() {
 		return nil, ErrInvalidMessage
@@ -165,6 +282,40 @@ func (d *Decoder) DecodeId() ([]byte, error) {
 	return nil, ErrInvalidMessage
 }
 
+// DecodeIdList decodes a comma-separated list of IDENTIFIER fields.
+// A single IDENTIFIER is a valid list. The list is returned as is, see
+// SplitIdList.
+func (d *Decoder) DecodeIdList() ([]byte, error) {
+	if d.AtEnd() {
+		return nil, ErrInvalidMessage
+	}
+	n, l := 0, 0
+	for n <= MaxIdentifierListLength {
+		if err := d.ensureBuffered(n + 1); err != nil {
+			return nil, err
+		}
+		c := d.buf[d.r+n]
+		n++
+		if c == ' ' || c == '\n' {
+			if l == 0 {
+				break
+			}
+			d.r += n
+			return d.buf[d.r-n : d.r-1], nil
+		} else if c == IdListSeparator {
+			if l == 0 {
+				break
+			}
+			l = 0
+		} else if !ID_CHARSET.Contains(c) || l == MaxIdentifierLength {
+			break
+		} else {
+			l++
+		}
+	}
+	return nil, ErrInvalidMessage
+}
+
 func (d *Decoder) DecodePayload() ([]byte, error) {
 	if d.AtEnd() {
 		return nil, ErrInvalidMessage
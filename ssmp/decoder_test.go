@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -107,6 +108,17 @@ func TestDecoder_should_decode_verb_atend(t *testing.T) {
 	assert.True(t, r.AtEnd())
 }
 
+func TestDecoder_should_rewind_message(t *testing.T) {
+	r := newReader(io.EOF, "LOGIN foo none\n")
+	expectData(t, "LOGIN", u(r.DecodeVerb()))
+	expectData(t, "foo", u(r.DecodeId()))
+	r.Rewind()
+	expectData(t, "LOGIN", u(r.DecodeVerb()))
+	expectData(t, "foo", u(r.DecodeId()))
+	expectData(t, "none", u(r.DecodeId()))
+	assert.True(t, r.AtEnd())
+}
+
 func TestDecoder_should_decode_verb_split(t *testing.T) {
 	r := newReader(io.EOF, "VE", "RB", " ")
 	expectData(t, "VERB", u(r.DecodeVerb()))
@@ -258,3 +270,204 @@ func TestDecoder_should_decode_binary_payload_split(t *testing.T) {
 	expectData(t, string(d[2:258]), u(r.DecodePayload()))
 	assert.True(t, r.AtEnd())
 }
+
+func expectResponse(t *testing.T, code int, payload string, h []interface{}) {
+	assert.Nil(t, h[2])
+	assert.Equal(t, code, h[0])
+	assert.Equal(t, []byte(payload), h[1])
+}
+
+func TestDecoder_should_decode_response(t *testing.T) {
+	r := newReader(io.EOF, "404 not found\n")
+	expectResponse(t, 404, "not found", u(r.DecodeResponse()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_decode_response_without_payload(t *testing.T) {
+	r := newReader(io.EOF, "200\n")
+	h := u(r.DecodeResponse())
+	expectResponse(t, 200, "", h)
+	assert.NotNil(t, h[1])
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_decode_response_binary_payload(t *testing.T) {
+	r := newReader(io.EOF, "200 \x00\x02a\nb\n")
+	expectResponse(t, 200, "a\nb", u(r.DecodeResponse()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_decode_response_split(t *testing.T) {
+	r := newReader(io.EOF, "2", "00 o", "k\n")
+	expectResponse(t, 200, "ok", u(r.DecodeResponse()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_stop_response_at_event(t *testing.T) {
+	r := newReader(io.EOF, "000 foo MCAST chat hi\n")
+	h := u(r.DecodeResponse())
+	assert.Nil(t, h[2])
+	assert.Equal(t, CodeEvent, h[0])
+	assert.Nil(t, h[1])
+	assert.False(t, r.AtEnd())
+}
+
+func TestDecoder_should_reject_response(t *testing.T) {
+	for _, m := range []string{"\n", "20\n", "2000\n", "OK\n", "200 \n", "200 \x00\x01ab!\n"} {
+		r := newReader(io.EOF, m)
+		h := u(r.DecodeResponse())
+		assert.Equal(t, ErrInvalidMessage, h[2], "%q", m)
+		assert.Equal(t, -1, h[0], "%q", m)
+		assert.Nil(t, h[1], "%q", m)
+	}
+}
+
+func TestDecoder_should_return_err_incomplete_response(t *testing.T) {
+	r := newReader(errArbitrary, "200 pay")
+	assert.Equal(t, errArbitrary, u(r.DecodeResponse())[2])
+	r = newReader(io.EOF)
+	assert.Equal(t, io.EOF, u(r.DecodeResponse())[2])
+}
+
+func expectEvent(t *testing.T, from, verb string, h []interface{}) {
+	assert.Nil(t, h[2])
+	assert.Equal(t, []byte(from), h[0])
+	assert.Equal(t, []byte(verb), h[1])
+}
+
+func TestDecoder_should_decode_event(t *testing.T) {
+	r := newReader(io.EOF, "000 foo MCAST chat hi\n")
+	expectInt(t, CodeEvent, u(r.DecodeCode()))
+	expectEvent(t, "foo", "MCAST", u(r.DecodeEvent()))
+	expectData(t, "chat", u(r.DecodeId()))
+	expectData(t, "hi", u(r.DecodePayload()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_decode_event_atend(t *testing.T) {
+	r := newReader(io.EOF, "000 . PING\n")
+	expectInt(t, CodeEvent, u(r.DecodeCode()))
+	expectEvent(t, ".", "PING", u(r.DecodeEvent()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_decode_event_split(t *testing.T) {
+	r := newReader(io.EOF, "000 f", "oo PI", "NG\n")
+	expectInt(t, CodeEvent, u(r.DecodeCode()))
+	expectEvent(t, "foo", "PING", u(r.DecodeEvent()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_reject_event(t *testing.T) {
+	for _, m := range []string{"000 foo\n", "000 foo mcast\n", "000 f!o PING\n", "000  PING\n"} {
+		r := newReader(io.EOF, m)
+		expectInt(t, CodeEvent, u(r.DecodeCode()))
+		h := u(r.DecodeEvent())
+		assert.Equal(t, ErrInvalidMessage, h[2], "%q", m)
+		assert.Nil(t, h[0], "%q", m)
+		assert.Nil(t, h[1], "%q", m)
+	}
+}
+
+func TestDecoder_should_return_err_incomplete_event(t *testing.T) {
+	r := newReader(errArbitrary, "000 foo")
+	expectInt(t, CodeEvent, u(r.DecodeCode()))
+	assert.Equal(t, errArbitrary, u(r.DecodeEvent())[2])
+	r = newReader(errArbitrary, "000 foo MCA")
+	expectInt(t, CodeEvent, u(r.DecodeCode()))
+	assert.Equal(t, errArbitrary, u(r.DecodeEvent())[2])
+}
+
+func TestDecoder_should_decode_id_list(t *testing.T) {
+	r := newReader(io.EOF, "foo,bar,baz ")
+	expectData(t, "foo,bar,baz", u(r.DecodeIdList()))
+	assert.False(t, r.AtEnd())
+}
+
+func TestDecoder_should_decode_id_list_single(t *testing.T) {
+	r := newReader(io.EOF, "foo\n")
+	expectData(t, "foo", u(r.DecodeIdList()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_reject_id_list(t *testing.T) {
+	long := strings.Repeat("a", MaxIdentifierLength+1)
+	for _, m := range []string{",foo\n", "foo,\n", "foo,,bar\n", "foo,b!r\n", "foo," + long + "\n"} {
+		r := newReader(io.EOF, m)
+		expectError(t, ErrInvalidMessage, u(r.DecodeIdList()))
+	}
+}
+
+func TestDecoder_should_split_id_list(t *testing.T) {
+	assert.Equal(t, [][]byte{[]byte("foo"), []byte("bar")}, SplitIdList([]byte("foo,bar")))
+}
+
+func TestDecoder_should_skip_message(t *testing.T) {
+	r := newReader(io.EOF, "UCAST f!o hello\nPING\n")
+	expectData(t, "UCAST", u(r.DecodeVerb()))
+	expectError(t, ErrInvalidMessage, u(r.DecodeId()))
+	assert.Nil(t, r.SkipMessage())
+	assert.True(t, r.AtEnd())
+	r.Reset()
+	expectData(t, "PING", u(r.DecodeVerb()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_skip_message_atend(t *testing.T) {
+	r := newReader(io.EOF, "PING\nPONG\n")
+	expectData(t, "PING", u(r.DecodeVerb()))
+	assert.Nil(t, r.SkipMessage())
+	r.Reset()
+	expectData(t, "PONG", u(r.DecodeVerb()))
+}
+
+func TestDecoder_should_skip_oversized_message(t *testing.T) {
+	r := newReader(io.EOF, "BCAST ", strings.Repeat("a", 3*bufferSize), "\nPING\n")
+	expectData(t, "BCAST", u(r.DecodeVerb()))
+	expectError(t, ErrInvalidMessage, u(r.DecodePayload()))
+	assert.Nil(t, r.SkipMessage())
+	r.Reset()
+	expectData(t, "PING", u(r.DecodeVerb()))
+	assert.True(t, r.AtEnd())
+}
+
+func TestDecoder_should_return_err_skip_incomplete(t *testing.T) {
+	r := newReader(errArbitrary, "UCAST f!o hel")
+	expectData(t, "UCAST", u(r.DecodeVerb()))
+	expectError(t, ErrInvalidMessage, u(r.DecodeId()))
+	assert.Equal(t, errArbitrary, r.SkipMessage())
+}
+
+func TestDecoder_should_discard_prefix(t *testing.T) {
+	r := newReader(io.EOF, "TRACE t1 UCAST foo hello\nPING\n")
+	expectData(t, "TRACE", u(r.DecodeVerb()))
+	expectData(t, "t1", u(r.DecodeId()))
+	r.DiscardPrefix()
+	expectData(t, "UCAST", u(r.DecodeVerb()))
+	expectData(t, "foo", u(r.DecodeId()))
+	expectData(t, "hello", u(r.DecodePayload()))
+	assert.Equal(t, "UCAST foo hello\n", string(r.RawMessage()))
+	r.Reset()
+	expectData(t, "PING", u(r.DecodeVerb()))
+	assert.Equal(t, "PING\n", string(r.RawMessage()))
+}
+
+func TestDecoder_should_force_reset_mid_message(t *testing.T) {
+	r := newReader(io.EOF, "UCAST foo hel", "lo\nPING\n")
+	expectData(t, "UCAST", u(r.DecodeVerb()))
+	expectData(t, "foo", u(r.DecodeId()))
+	assert.False(t, r.CanReset())
+	assert.Nil(t, r.ForceReset())
+	// nothing decoded since: no-op
+	assert.Nil(t, r.ForceReset())
+	expectData(t, "PING", u(r.DecodeVerb()))
+	assert.True(t, r.CanReset())
+	assert.Nil(t, r.ForceReset())
+	assert.Equal(t, io.EOF, r.ensureBuffered(1))
+}
+
+func TestDecoder_should_return_err_force_reset_incomplete(t *testing.T) {
+	r := newReader(errArbitrary, "UCAST foo hel")
+	expectData(t, "UCAST", u(r.DecodeVerb()))
+	assert.Equal(t, errArbitrary, r.ForceReset())
+}
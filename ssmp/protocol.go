@@ -0,0 +1,239 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+// Field flags of a verb.
+const (
+	// FieldTo indicates a mandatory IDENTIFIER field
+	FieldTo = 1
+	// FieldPayload indicates a mandatory PAYLOAD field
+	FieldPayload = 2
+	// FieldOption indicates an optional PAYLOAD field
+	FieldOption = 6
+)
+
+// VerbFields maps builtin verbs, except LOGIN, to the fields they carry, in
+// both requests and events.
+var VerbFields map[string]int = map[string]int{
+	SUBSCRIBE:   FieldTo | FieldOption,
+	UNSUBSCRIBE: FieldTo,
+	UCAST:       FieldTo | FieldPayload,
+	MCAST:       FieldTo | FieldPayload,
+	BCAST:       FieldPayload,
+	PING:        0,
+	PONG:        0,
+	CLOSE:       0,
+	GROUP:       FieldTo | FieldOption,
+	USERS:       FieldOption,
+	RELOGIN:     FieldTo | FieldOption,
+	RESUME:      FieldTo,
+	TRACE:       FieldTo | FieldPayload, // PAYLOAD is the traced request
+	TRACED:      FieldTo,
+	EXPIRES:     FieldTo | FieldPayload, // PAYLOAD is the expiring request
+	REAUTH:      FieldOption,
+	COUNT:       FieldPayload,           // FROM is the topic, PAYLOAD the subscriber count
+	ACK:         FieldTo | FieldOption,  // OPTION is the sender, in requests
+	RELIABLE:    FieldTo | FieldPayload, // PAYLOAD is the reliable request
+	RECEIPT:     FieldTo,                // FROM is the message ID, IDENTIFIER the subscriber
+	CONFIGURE:   FieldTo | FieldPayload,
+	HELLO:       FieldTo | FieldOption, // IDENTIFIER is the protocol version
+}
+
+// NoCode is the Code of request messages.
+const NoCode = -1
+
+// Message is a decoded SSMP message.
+//
+// Requests have a Verb and Code set to NoCode. Responses have a Code and a
+// Payload, empty if absent. Events have Code set to CodeEvent, a From field
+// and the fields of the request that triggered them.
+//
+// Other absent fields are nil. The fields of a LOGIN request are the user in To
+// and the scheme and credentials, if any, in Payload.
+type Message struct {
+	Code    int
+	From    []byte
+	Verb    []byte
+	To      []byte
+	Payload []byte
+}
+
+// Protocol is a full-duplex SSMP session over a network connection.
+//
+// Reads are not safe to call from multiple goroutines simultaneously but
+// writes are, and may happen concurrently with reads.
+type Protocol struct {
+	c       net.Conn
+	r       *Decoder
+	pending bool
+
+	writeMu sync.Mutex
+}
+
+func NewProtocol(c net.Conn) *Protocol {
+	return &Protocol{
+		c: c,
+		r: NewDecoder(c),
+	}
+}
+
+// Decoder gives direct access to the underlying Decoder, for callers that
+// need to decode messages field by field.
+func (p *Protocol) Decoder() *Decoder {
+	return p.r
+}
+
+// ReadMessage reads the next message.
+// The fields of the returned Message are slices of the input buffer which
+// are only valid until the next read.
+func (p *Protocol) ReadMessage() (Message, error) {
+	m := Message{Code: NoCode}
+	if p.pending {
+		p.r.Reset()
+		p.pending = false
+	}
+	if err := p.r.ensureBuffered(1); err != nil {
+		return m, err
+	}
+	var err error
+	if c := p.r.buf[p.r.r]; c >= '0' && c <= '9' {
+		err = p.readResponse(&m)
+	} else {
+		err = p.readRequest(&m)
+	}
+	if err == nil && !p.r.AtEnd() {
+		err = ErrInvalidMessage
+	}
+	if err != nil {
+		return m, err
+	}
+	p.pending = true
+	return m, nil
+}
+
+// ParseMessage decodes a single encoded message.
+// The fields of the returned Message are slices of b.
+// ErrInvalidMessage is returned if b holds anything past the first message.
+func ParseMessage(b []byte) (Message, error) {
+	p := &Protocol{r: NewDecoder(bytes.NewReader(b))}
+	m, err := p.ReadMessage()
+	if err == nil && p.r.r != len(b) {
+		err = ErrInvalidMessage
+	}
+	return m, err
+}
+
+// ParseMessages decodes a sequence of encoded messages, e.g. several events
+// written at once. The fields of the returned Messages are not slices of b
+// and remain valid.
+func ParseMessages(b []byte) ([]Message, error) {
+	var l []Message
+	for len(b) > 0 {
+		p := &Protocol{r: NewDecoder(bytes.NewReader(b))}
+		m, err := p.ReadMessage()
+		if err != nil {
+			return l, err
+		}
+		l = append(l, m)
+		b = b[p.r.r:]
+	}
+	return l, nil
+}
+
+func (p *Protocol) readResponse(m *Message) error {
+	var err error
+	if m.Code, m.Payload, err = p.r.DecodeResponse(); err != nil || m.Code != CodeEvent {
+		return err
+	}
+	if m.From, m.Verb, err = p.r.DecodeEvent(); err != nil {
+		return err
+	}
+	return p.readFields(m)
+}
+
+func (p *Protocol) readRequest(m *Message) error {
+	var err error
+	if m.Verb, err = p.r.DecodeVerb(); err != nil {
+		return err
+	}
+	return p.readFields(m)
+}
+
+func (p *Protocol) readFields(m *Message) error {
+	var err error
+	if Equal(m.Verb, LOGIN) {
+		if m.To, err = p.r.DecodeId(); err != nil {
+			return err
+		}
+		m.Payload, err = p.r.DecodeCompat()
+		return err
+	}
+	fields, ok := VerbFields[string(m.Verb)]
+	if !ok {
+		// unknown verb: keep remaining fields as opaque payload
+		m.Payload, err = p.r.DecodeCompat()
+		return err
+	}
+	if m.Code == NoCode && Equal(m.Verb, SUBSCRIBE) {
+		// requests may subscribe to a list of topics
+		if m.To, err = p.r.DecodeIdList(); err != nil {
+			return err
+		}
+	} else if (fields & FieldTo) != 0 {
+		if m.To, err = p.r.DecodeId(); err != nil {
+			return err
+		}
+	}
+	if (fields & FieldOption) == FieldOption {
+		m.Payload = []byte{}
+		if !p.r.AtEnd() {
+			m.Payload, err = p.r.DecodePayload()
+		}
+	} else if (fields & FieldPayload) != 0 {
+		m.Payload, err = p.r.DecodePayload()
+	}
+	return err
+}
+
+// WriteMessage encodes and writes a message.
+func (p *Protocol) WriteMessage(m Message) error {
+	b := NewMessage()
+	if m.Code != NoCode {
+		b.Code(m.Code)
+		if m.Code == CodeEvent {
+			b.Id(string(m.From)).Verb(string(m.Verb))
+		}
+	} else {
+		b.Verb(string(m.Verb))
+	}
+	if len(m.To) > 0 {
+		b.Id(string(m.To))
+	}
+	if len(m.Payload) > 0 {
+		if m.Payload[0] <= 3 || bytes.IndexByte(m.Payload, '\n') != -1 {
+			b.BinaryPayload(m.Payload)
+		} else {
+			b.Payload(string(m.Payload))
+		}
+	}
+	msg, err := b.Build()
+	if err != nil {
+		return err
+	}
+	_, err = p.Write(msg)
+	return err
+}
+
+// Write writes an encoded message as is.
+func (p *Protocol) Write(msg []byte) (int, error) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.c.Write(msg)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestProtocol_should_round_trip_messages(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	pa, pb := NewProtocol(a), NewProtocol(b)
+
+	messages := []Message{
+		{Code: NoCode, Verb: []byte(UCAST), To: []byte("foo"), Payload: []byte("hello world")},
+		{Code: NoCode, Verb: []byte(SUBSCRIBE), To: []byte("chat"), Payload: []byte{}},
+		{Code: NoCode, Verb: []byte(BCAST), Payload: []byte{0, '\n', 255}},
+		{Code: NoCode, Verb: []byte(PING)},
+		{Code: CodeOk, Payload: []byte{}},
+		{Code: CodeNotFound, Payload: []byte("nope")},
+		{Code: CodeEvent, From: []byte("bar"), Verb: []byte(MCAST), To: []byte("chat"), Payload: []byte("hi")},
+	}
+	go func() {
+		for _, m := range messages {
+			pa.WriteMessage(m)
+		}
+	}()
+	for _, expected := range messages {
+		m, err := pb.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, expected, m)
+	}
+}
+
+func TestProtocol_should_read_login(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go a.Write([]byte("LOGIN foo cert\n"))
+
+	m, err := NewProtocol(b).ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, []byte(LOGIN), m.Verb)
+	assert.Equal(t, []byte("foo"), m.To)
+	assert.Equal(t, []byte("cert"), m.Payload)
+}
+
+func TestProtocol_should_parse_several_messages(t *testing.T) {
+	l, err := ParseMessages([]byte("000 foo TRACED t1\n000 foo UCAST bar hello\n200\n"))
+	require.Nil(t, err)
+	assert.Equal(t, []Message{
+		{Code: CodeEvent, From: []byte("foo"), Verb: []byte(TRACED), To: []byte("t1")},
+		{Code: CodeEvent, From: []byte("foo"), Verb: []byte(UCAST), To: []byte("bar"), Payload: []byte("hello")},
+		{Code: CodeOk, Payload: []byte{}},
+	}, l)
+
+	_, err = ParseMessages([]byte("200\nFOO"))
+	assert.NotNil(t, err)
+}
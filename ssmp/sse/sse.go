@@ -0,0 +1,156 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package sse bridges SSMP topics to web browsers using server-sent events.
+package sse
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/server"
+	"github.com/aerofs/lipwig/ssmp"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// AuthFunc authenticates an HTTP request and returns the corresponding user.
+type AuthFunc func(r *http.Request) (user string, err error)
+
+// Event is the JSON representation of a SSMP event in a SSE frame.
+type Event struct {
+	From    string `json:"from"`
+	Name    string `json:"name"`
+	To      string `json:"to,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// Handler returns an http.Handler streaming events of the topics listed in
+// the "topics" query parameter (comma-separated or repeated) as SSE frames.
+//
+// Each request is bridged to the dispatcher through an in-memory SSMP
+// connection, see server.Dispatcher.Connect, which is closed when the request
+// context is cancelled. Streams don't disconnect other connections of the
+// same user.
+// SSE being one-way, there is no way for the browser to publish messages.
+func Handler(auth AuthFunc, d *server.Dispatcher) http.Handler {
+	return &handler{auth: auth, d: d}
+}
+
+type handler struct {
+	auth AuthFunc
+	d    *server.Dispatcher
+}
+
+// the HTTP request is authenticated before the SSMP connection is created
+type preAuthenticated struct{}
+
+func (preAuthenticated) Auth(_ net.Conn, _, _, _ []byte) bool { return true }
+func (preAuthenticated) Unauthorized() []byte                 { return []byte("401\n") }
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := h.auth(r)
+	if err != nil || user == ssmp.Anonymous || !ssmp.IsValidIdentifier(user) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var topics []string
+	for _, v := range r.URL.Query()["topics"] {
+		for _, t := range strings.Split(v, ",") {
+			if len(t) > 0 {
+				topics = append(topics, t)
+			}
+		}
+	}
+	if len(topics) == 0 {
+		http.Error(w, "no topics", http.StatusBadRequest)
+		return
+	}
+
+	sc, cc := net.Pipe()
+	go func() {
+		if _, err := h.d.Connect(sc, preAuthenticated{}); err != nil {
+			sc.Close()
+		}
+	}()
+	fw := &frameWriter{w: w, f: f}
+	c := client.NewClient(cc, fw)
+	defer c.Close()
+	if resp, err := c.Login(user, "sse", ""); err != nil || !resp.IsOK() {
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	for _, t := range topics {
+		if resp, err := c.Subscribe(t); err != nil || !resp.IsOK() {
+			http.Error(w, "invalid topic: "+t, http.StatusBadRequest)
+			return
+		}
+	}
+
+	fw.start()
+	<-r.Context().Done()
+	fw.stop()
+}
+
+// frameWriter writes events as SSE frames. Events received before the stream
+// is started, i.e. while subscribing to the requested topics, are buffered.
+type frameWriter struct {
+	l       sync.Mutex
+	w       http.ResponseWriter
+	f       http.Flusher
+	pending bytes.Buffer
+	started bool
+	stopped bool
+}
+
+func (fw *frameWriter) start() {
+	fw.l.Lock()
+	fw.w.Header().Set("Content-Type", "text/event-stream")
+	fw.w.Header().Set("Cache-Control", "no-cache")
+	fw.w.WriteHeader(http.StatusOK)
+	fw.w.Write(fw.pending.Bytes())
+	fw.pending = bytes.Buffer{}
+	fw.f.Flush()
+	fw.started = true
+	fw.l.Unlock()
+}
+
+func (fw *frameWriter) stop() {
+	fw.l.Lock()
+	fw.stopped = true
+	fw.l.Unlock()
+}
+
+func (fw *frameWriter) HandleEvent(ev client.Event) {
+	b, err := json.Marshal(Event{
+		From:    string(ev.From),
+		Name:    string(ev.Name),
+		To:      string(ev.To),
+		Payload: string(ev.Payload),
+	})
+	if err != nil {
+		return
+	}
+	fw.l.Lock()
+	defer fw.l.Unlock()
+	if fw.stopped {
+		return
+	}
+	if !fw.started {
+		fw.pending.WriteString("data: ")
+		fw.pending.Write(b)
+		fw.pending.WriteString("\n\n")
+		return
+	}
+	fw.w.Write([]byte("data: "))
+	fw.w.Write(b)
+	fw.w.Write([]byte("\n\n"))
+	fw.f.Flush()
+}
@@ -4,6 +4,10 @@
 // Package ssmp provides constants and utilities shared between client and server.
 package ssmp
 
+import (
+	"bytes"
+)
+
 // Requests
 const (
 	LOGIN       = "LOGIN"
@@ -15,25 +19,75 @@ const (
 	PING        = "PING"
 	PONG        = "PONG"
 	CLOSE       = "CLOSE"
+	GROUP       = "GROUP"
+	USERS       = "USERS"
+	RELOGIN     = "RELOGIN"
+	RESUME      = "RESUME"
+	TRACE       = "TRACE"
+	EXPIRES     = "EXPIRES"
+	REAUTH      = "REAUTH"
+	ACK         = "ACK"
+	RELIABLE    = "RELIABLE"
+	CONFIGURE   = "CONFIGURE"
+	// HELLO optionally precedes LOGIN to negotiate protocol features:
+	// HELLO <version> [<feature> ...]
+	HELLO = "HELLO"
+)
+
+// ProtocolVersion is the version of SSMP announced by HELLO requests.
+const ProtocolVersion = 1
+
+// Events
+const (
+	// TRACED precedes an event caused by a TRACE request
+	TRACED = "TRACED"
 )
 
 // Options
 const (
 	PRESENCE = "PRESENCE"
+	LEAVE    = "LEAVE"
+	NOSELF   = "NOSELF"
+	ECHO     = "ECHO"
+	// COUNT is also the verb of the events sent to subscribers with this
+	// option, from the topic itself: 000 <topic> COUNT <n>
+	COUNT = "COUNT"
+	// RECEIPT is also the verb of the events sent to the sender of a MCAST
+	// with a message ID, for every subscriber with this option that it was
+	// delivered to: 000 <msgid> RECEIPT <subscriber>
+	RECEIPT = "RECEIPT"
+	// LEASE is followed by a lease duration in seconds
+	LEASE = "LEASE"
+	// COMPRESS is a feature that may be negotiated by HELLO, along with
+	// LEASE, ECHO and REAUTH
+	COMPRESS = "COMPRESS"
 )
 
 // Response codes
 const (
-	CodeEvent        = 0
-	CodeOk           = 200
-	CodeBadRequest   = 400
-	CodeUnauthorized = 401
-	CodeNotFound     = 404
+	CodeEvent          = 0
+	CodeOk             = 200
+	CodePartial        = 206
+	CodeBadRequest     = 400
+	CodeUnauthorized   = 401
+	CodeNotFound       = 404
+	CodeNotAllowed     = 405
+	CodeRequestTimeout = 408
+	CodeConflict       = 409
+
+	// CodeTooManyRequests is returned when a quota or rate limit is exceeded.
+	CodeTooManyRequests = 429
+	// Deprecated: use CodeTooManyRequests.
+	CodeTooManySubscriptions = CodeTooManyRequests
 )
 
 // Reserved identifier for anonymous login.
 const Anonymous = "."
 
+// Prefix of the payload of a successful LOGIN or RESUME response carrying a
+// session token.
+const SessionPrefix = "session:"
+
 // IsValidIdentifier reports whether s is a valid SSMP IDENTIFIER field.
 func IsValidIdentifier(s string) bool {
 	if len(s) > MaxIdentifierLength {
@@ -47,6 +101,14 @@ func IsValidIdentifier(s string) bool {
 	return true
 }
 
+// IdListSeparator separates the IDENTIFIER fields of a list.
+const IdListSeparator = ','
+
+// SplitIdList splits a list of IDENTIFIER fields decoded by DecodeIdList.
+func SplitIdList(b []byte) [][]byte {
+	return bytes.Split(b, []byte{IdListSeparator})
+}
+
 // Equal compares a byte array to a string, to avoid unecessary
 // conversions.
 func Equal(b []byte, s string) bool {
@@ -0,0 +1,61 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+// Role is the side of a SSMP session from which a message originates.
+type Role int
+
+const (
+	// RoleClient messages are requests.
+	RoleClient Role = iota
+	// RoleServer messages are responses and events.
+	RoleServer
+)
+
+// ValidateMessage checks that msg is exactly one well-formed message sent
+// by the given role, e.g. before retransmitting a stored message.
+// Requests and events must use a builtin verb.
+// ErrInvalidMessage is returned if the message is not valid.
+func ValidateMessage(msg []byte, role Role) error {
+	_, err := validate(msg, role)
+	return err
+}
+
+func validate(msg []byte, role Role) (Message, error) {
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return m, ErrInvalidMessage
+	}
+	switch role {
+	case RoleClient:
+		if m.Code != NoCode {
+			return m, ErrInvalidMessage
+		}
+		if _, ok := VerbFields[string(m.Verb)]; !ok && !Equal(m.Verb, LOGIN) {
+			return m, ErrInvalidMessage
+		}
+	case RoleServer:
+		if m.Code == NoCode {
+			return m, ErrInvalidMessage
+		}
+		if _, ok := VerbFields[string(m.Verb)]; m.Code == CodeEvent && !ok {
+			return m, ErrInvalidMessage
+		}
+	default:
+		return m, ErrInvalidMessage
+	}
+	return m, nil
+}
+
+// IsValidEvent reports whether msg is a valid event.
+func IsValidEvent(msg []byte) bool {
+	m, err := validate(msg, RoleServer)
+	return err == nil && m.Code == CodeEvent
+}
+
+// IsValidResponse reports whether msg is a valid response, other than an event.
+func IsValidResponse(msg []byte) bool {
+	m, err := validate(msg, RoleServer)
+	return err == nil && m.Code != CodeEvent
+}
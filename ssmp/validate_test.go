@@ -0,0 +1,109 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var validRequests []string = []string{
+	"LOGIN foo none\n",
+	"LOGIN . none\n",
+	"LOGIN foo secret s3cr3t\n",
+	"LOGIN foo cert\n",
+	"SUBSCRIBE chat\n",
+	"SUBSCRIBE chat PRESENCE\n",
+	"SUBSCRIBE chat NOSELF ECHO\n",
+	"SUBSCRIBE topic0,topic1,topic2\n",
+	"UNSUBSCRIBE chat\n",
+	"UCAST foo hello world\n",
+	"UCAST @team hello\n",
+	"UCAST foo \x00\x02a\nb\n",
+	"MCAST chat hello\n",
+	"BCAST hello\n",
+	"PING\n",
+	"PONG\n",
+	"CLOSE\n",
+	"GROUP team\n",
+	"GROUP team LEAVE\n",
+	"USERS\n",
+	"USERS foo >foo1\n",
+	"RELOGIN foo secret s3cr3t\n",
+}
+
+var validResponses []string = []string{
+	"200\n",
+	"200 3\n",
+	"206 foo bar\n",
+	"400\n",
+	"401\n",
+	"404\n",
+	"405\n",
+	"409\n",
+	"501\n",
+}
+
+var validEvents []string = []string{
+	"000 . PING\n",
+	"000 . PONG\n",
+	"000 foo UCAST bar hello\n",
+	"000 foo MCAST chat hello\n",
+	"000 foo MCAST chat \x00\x02a\nb\n",
+	"000 foo BCAST hello\n",
+	"000 foo SUBSCRIBE chat\n",
+	"000 foo SUBSCRIBE chat PRESENCE\n",
+	"000 foo UNSUBSCRIBE chat\n",
+	"000 . UNSUBSCRIBE chat\n",
+}
+
+func TestValidateMessage_should_accept_requests(t *testing.T) {
+	for _, m := range validRequests {
+		assert.Nil(t, ValidateMessage([]byte(m), RoleClient), "%q", m)
+		assert.Equal(t, ErrInvalidMessage, ValidateMessage([]byte(m), RoleServer), "%q", m)
+	}
+}
+
+func TestValidateMessage_should_accept_responses(t *testing.T) {
+	for _, m := range validResponses {
+		assert.Nil(t, ValidateMessage([]byte(m), RoleServer), "%q", m)
+		assert.Equal(t, ErrInvalidMessage, ValidateMessage([]byte(m), RoleClient), "%q", m)
+		assert.True(t, IsValidResponse([]byte(m)), "%q", m)
+		assert.False(t, IsValidEvent([]byte(m)), "%q", m)
+	}
+}
+
+func TestValidateMessage_should_accept_events(t *testing.T) {
+	for _, m := range validEvents {
+		assert.Nil(t, ValidateMessage([]byte(m), RoleServer), "%q", m)
+		assert.Equal(t, ErrInvalidMessage, ValidateMessage([]byte(m), RoleClient), "%q", m)
+		assert.True(t, IsValidEvent([]byte(m)), "%q", m)
+		assert.False(t, IsValidResponse([]byte(m)), "%q", m)
+	}
+}
+
+func TestValidateMessage_should_reject_invalid(t *testing.T) {
+	for _, m := range []string{
+		"",
+		"\n",
+		"PING",
+		"PING\nPING\n",
+		"FOO bar\n",
+		"UCAST foo\n",
+		"MCAST chat\n",
+		"UNSUBSCRIBE a,b\n",
+		"UCAST f!o hello\n",
+		"UCAST foo \x00\x05ab\n",
+		"000 foo\n",
+		"000 foo FOO bar\n",
+		"000 foo LOGIN bar none\n",
+		"000 foo MCAST chat\n",
+		"20\n",
+	} {
+		assert.Equal(t, ErrInvalidMessage, ValidateMessage([]byte(m), RoleClient), "%q", m)
+		assert.Equal(t, ErrInvalidMessage, ValidateMessage([]byte(m), RoleServer), "%q", m)
+		assert.False(t, IsValidEvent([]byte(m)), "%q", m)
+		assert.False(t, IsValidResponse([]byte(m)), "%q", m)
+	}
+}
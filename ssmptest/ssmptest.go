@@ -0,0 +1,168 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package ssmptest provides utilities for SSMP server testing.
+package ssmptest
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/server"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/stretchr/testify/require"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout is the initial Timeout of a TestServer.
+const DefaultTimeout = time.Second
+
+var ErrLoginFailed error = fmt.Errorf("LOGIN failed")
+
+// scheme of the LOGIN requests of loopback clients, which are not
+// authenticated
+const loopbackScheme = "loopback"
+
+// A TestServer is a Server listening on a random loopback port, with
+// assertions on its state.
+type TestServer struct {
+	*server.Server
+
+	// Endpoint is the address at which the server accepts connections.
+	Endpoint string
+
+	// Timeout bounds the time assertions wait for the expected state to be
+	// reached, since connections and subscriptions change asynchronously.
+	Timeout time.Duration
+
+	t          testing.TB
+	goroutines int
+}
+
+// NewServer creates and starts a TestServer. A nil Authenticator accepts
+// any user.
+func NewServer(t testing.TB, auth server.Authenticator, opts ...server.ServerOption) *TestServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	if auth == nil {
+		auth = acceptAll{}
+	}
+	s := &TestServer{
+		Server:     server.NewServer(l, auth, nil, opts...),
+		Timeout:    DefaultTimeout,
+		t:          t,
+		goroutines: runtime.NumGoroutine(),
+	}
+	s.Endpoint = "127.0.0.1:" + strconv.Itoa(s.ListeningPort())
+	s.Start()
+	return s
+}
+
+// T returns the test with which the server was created.
+func (s *TestServer) T() testing.TB {
+	return s.t
+}
+
+// ConnectClient returns a loopback client logged in as the given user, see
+// NewLoopbackClient.
+func (s *TestServer) ConnectClient(t testing.TB, user string) client.Client {
+	t.Helper()
+	c, err := NewLoopbackClient(s.Server, user)
+	require.Nil(t, err, "failed to connect %s", user)
+	return c
+}
+
+// NewLoopbackClient connects an in-process client to the server, see
+// server.Server.ConnectLoopback.
+// It returns once the client is logged in as the given user and the
+// connection is registered with the server. The client discards events until
+// an EventHandler is set.
+func NewLoopbackClient(s *server.Server, user string) (client.Client, error) {
+	c, connected := s.ConnectLoopback()
+	cl := client.NewClient(c, client.Discard)
+	r, err := cl.Login(user, loopbackScheme, "")
+	if err != nil {
+		cl.Close()
+		return nil, err
+	}
+	if r.Code != ssmp.CodeOk {
+		cl.Close()
+		return nil, ErrLoginFailed
+	}
+	<-connected
+	return cl, nil
+}
+
+// AssertTopicSubscribers asserts that the named topic has exactly n
+// subscribers. A topic that doesn't exist has none.
+func (s *TestServer) AssertTopicSubscribers(t testing.TB, topic string, n int) {
+	t.Helper()
+	count := func() int {
+		if tp := s.GetTopic([]byte(topic)); tp != nil {
+			return tp.SubscriberCount()
+		}
+		return 0
+	}
+	s.eventually(t, func() bool { return count() == n }, func() string {
+		return fmt.Sprintf("topic %s has %d subscribers, expected %d", topic, count(), n)
+	})
+}
+
+// AssertUserConnected asserts that the given user has an active connection.
+func (s *TestServer) AssertUserConnected(t testing.TB, user string) {
+	t.Helper()
+	s.eventually(t, func() bool { return s.GetConnection([]byte(user)) != nil }, func() string {
+		return "user " + user + " not connected"
+	})
+}
+
+// AssertUserNotConnected asserts that the given user has no active
+// connection.
+func (s *TestServer) AssertUserNotConnected(t testing.TB, user string) {
+	t.Helper()
+	s.eventually(t, func() bool { return s.GetConnection([]byte(user)) == nil }, func() string {
+		return "user " + user + " still connected"
+	})
+}
+
+// Close stops the server and asserts that all connections are gone and that
+// no goroutine started since the server was created is left behind.
+func (s *TestServer) Close(t testing.TB) {
+	t.Helper()
+	s.Stop()
+	s.eventually(t, func() bool { return len(s.ListConnections()) == 0 }, func() string {
+		return fmt.Sprintf("%d connections left after Stop", len(s.ListConnections()))
+	})
+	s.eventually(t, func() bool { return runtime.NumGoroutine() <= s.goroutines }, func() string {
+		return fmt.Sprintf("%d goroutines leaked", runtime.NumGoroutine()-s.goroutines)
+	})
+}
+
+// eventually fails the test with the message returned by failure if ok
+// doesn't return true within the server Timeout.
+func (s *TestServer) eventually(t testing.TB, ok func() bool, failure func() string) {
+	t.Helper()
+	deadline := time.Now().Add(s.Timeout)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal(failure())
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// acceptAll is the Authenticator used when none is provided.
+type acceptAll struct{}
+
+func (acceptAll) Auth(_ net.Conn, _, _, _ []byte) bool {
+	return true
+}
+
+func (acceptAll) Unauthorized() []byte {
+	return []byte("401\n")
+}
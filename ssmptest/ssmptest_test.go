@@ -0,0 +1,123 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package ssmptest
+
+import (
+	"fmt"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeT records failures instead of reporting them.
+type fakeT struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Name() string {
+	return "fake"
+}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.failed = true
+	t.msg = fmt.Sprintf(format, args...)
+}
+
+func (t *fakeT) Fatal(args ...interface{}) {
+	t.failed = true
+	t.msg = fmt.Sprint(args...)
+	runtime.Goexit()
+}
+
+func (t *fakeT) FailNow() {
+	t.failed = true
+	runtime.Goexit()
+}
+
+// fails reports whether f fails the test it is given.
+func fails(f func(t testing.TB)) bool {
+	t := &fakeT{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(t)
+	}()
+	<-done
+	return t.failed
+}
+
+func TestServer_should_assert_connected_users(t *testing.T) {
+	s := NewServer(t, nil)
+	s.Timeout = 50 * time.Millisecond
+	c := s.ConnectClient(t, "foo")
+
+	s.AssertUserConnected(t, "foo")
+	s.AssertUserNotConnected(t, "bar")
+	require.True(t, fails(func(t testing.TB) { s.AssertUserConnected(t, "bar") }))
+	require.True(t, fails(func(t testing.TB) { s.AssertUserNotConnected(t, "foo") }))
+
+	c.Close()
+	s.AssertUserNotConnected(t, "foo")
+	s.Close(t)
+}
+
+func TestServer_should_assert_topic_subscribers(t *testing.T) {
+	s := NewServer(t, nil)
+	s.Timeout = 50 * time.Millisecond
+	foo := s.ConnectClient(t, "foo")
+	bar := s.ConnectClient(t, "bar")
+
+	s.AssertTopicSubscribers(t, "chat", 0)
+	r, err := foo.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	r, err = bar.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	s.AssertTopicSubscribers(t, "chat", 2)
+	require.True(t, fails(func(t testing.TB) { s.AssertTopicSubscribers(t, "chat", 1) }))
+	require.True(t, fails(func(t testing.TB) { s.AssertTopicSubscribers(t, "news", 1) }))
+
+	foo.Close()
+	s.AssertTopicSubscribers(t, "chat", 1)
+	bar.Close()
+	s.Close(t)
+}
+
+func TestServer_should_connect_client(t *testing.T) {
+	s := NewServer(t, nil)
+	require.Equal(t, t, s.T())
+	c := s.ConnectClient(t, "foo")
+	r, err := c.Ucast("foo", "hello")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	c.Close()
+	s.Close(t)
+}
+
+func TestServer_should_fail_to_connect_invalid_user(t *testing.T) {
+	s := NewServer(t, nil)
+	require.True(t, fails(func(t testing.TB) { s.ConnectClient(t, "!nvalid") }))
+	s.Close(t)
+}
+
+func TestServer_should_detect_leaked_goroutines(t *testing.T) {
+	s := NewServer(t, nil)
+	s.Timeout = 50 * time.Millisecond
+	leak := make(chan struct{})
+	go func() { <-leak }()
+	require.True(t, fails(func(t testing.TB) { s.Close(t) }))
+	close(leak)
+
+	s = NewServer(t, nil)
+	s.ConnectClient(t, "foo")
+	// the client is closed by the server
+	s.Close(t)
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+//go:build lipwig_stress
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestServer_should_sustain_ucast_load(t *testing.T) {
+	s := NewTestServer(t)
+	defer s.Close(t)
+
+	r := s.Dispatcher().StressTest(s.Server, 2*time.Second, runtime.NumCPU())
+	t.Logf("%.0f msg/s, avg %v, p99 %v", r.MessagesPerSec, r.AvgLatency, r.P99Latency)
+	assert.Equal(t, 0, r.Errors)
+	if !raceEnabled {
+		assert.True(t, r.MessagesPerSec > 50000, "%.0f msg/s", r.MessagesPerSec)
+	}
+}
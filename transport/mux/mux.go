@@ -0,0 +1,403 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package mux carries multiple SSMP sessions over a single net.Conn.
+//
+// Data is exchanged in frames made of a 2-byte stream ID, a 2-byte length and
+// up to 65535 bytes of data, all integers being big-endian. An empty frame
+// closes the stream in the direction of the sender. Streams are opened
+// implicitly by the first frame carrying their ID, in any order.
+//
+// Each stream is exposed as a net.Conn, so that the regular client and server
+// libraries can be used unchanged. One end of the connection opens streams
+// with MuxConn.OpenStream, the other accepts them with the net.Listener
+// returned by NewMuxListener.
+//
+// There is no flow control: data received for a stream is buffered until it
+// is read, and a stream whose session is not read in a timely fashion can
+// grow without bounds.
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MaxStreams is the maximum number of streams opened over a connection.
+// Stream IDs are never reused.
+const MaxStreams = 65535
+
+// size of the frame header: stream ID and data length
+const headerSize = 4
+
+// maximum amount of data carried by a single frame
+const maxFrameSize = 65535
+
+var ErrTooManyStreams error = fmt.Errorf("too many streams")
+
+// MuxConn multiplexes streams over a net.Conn.
+type MuxConn struct {
+	c net.Conn
+
+	writeMu sync.Mutex
+
+	l       sync.Mutex
+	streams map[uint16]*stream
+	// last stream ID opened
+	last uint16
+	// stream IDs accepted, which are never accepted again
+	seen map[uint16]bool
+	// error that terminated the read loop
+	err error
+
+	// whether streams opened by the other end are accepted
+	accepting bool
+	// streams waiting for Accept, queued so that the read loop never blocks
+	pending []*stream
+	// signalled whenever a stream is queued
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// NewMuxConn starts multiplexing streams over c, for the end that opens them.
+// Streams opened by the other end are ignored.
+func NewMuxConn(c net.Conn) *MuxConn {
+	return newMuxConn(c, false)
+}
+
+func newMuxConn(c net.Conn, accepting bool) *MuxConn {
+	m := &MuxConn{
+		c:         c,
+		streams:   make(map[uint16]*stream),
+		seen:      make(map[uint16]bool),
+		accepting: accepting,
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// OpenStream opens a new stream.
+// ErrTooManyStreams is returned once MaxStreams streams have been opened.
+func (m *MuxConn) OpenStream() (net.Conn, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.last == MaxStreams {
+		return nil, ErrTooManyStreams
+	}
+	m.last++
+	s := newStream(m, m.last)
+	m.streams[s.id] = s
+	return s, nil
+}
+
+// Close closes the underlying connection, and therefore all streams.
+func (m *MuxConn) Close() error {
+	return m.c.Close()
+}
+
+func (m *MuxConn) readLoop() {
+	var hdr [headerSize]byte
+	var err error
+	for {
+		if _, err = io.ReadFull(m.c, hdr[:]); err != nil {
+			break
+		}
+		id := binary.BigEndian.Uint16(hdr[0:2])
+		n := int(binary.BigEndian.Uint16(hdr[2:4]))
+		var data []byte
+		if n > 0 {
+			data = make([]byte, n)
+			if _, err = io.ReadFull(m.c, data); err != nil {
+				break
+			}
+		}
+		s := m.stream(id, n > 0)
+		if s == nil {
+			continue
+		}
+		if n == 0 {
+			s.closeRead(io.EOF)
+		} else {
+			s.push(data)
+		}
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	m.l.Lock()
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint16]*stream)
+	m.l.Unlock()
+	for _, s := range streams {
+		s.closeRead(err)
+	}
+	m.c.Close()
+	close(m.done)
+}
+
+// stream returns the stream with the given ID, if any. On the accepting end,
+// a new stream is created and queued for Accept if the frame carries data
+// and the ID was never seen before. Streams may be accepted out of order, as
+// the opening end doesn't send anything until a stream is written to.
+func (m *MuxConn) stream(id uint16, data bool) *stream {
+	m.l.Lock()
+	defer m.l.Unlock()
+	s := m.streams[id]
+	if s != nil || !m.accepting || !data || m.seen[id] {
+		return s
+	}
+	m.seen[id] = true
+	s = newStream(m, id)
+	m.streams[id] = s
+	m.pending = append(m.pending, s)
+	m.signal()
+	return s
+}
+
+// signal wakes up a pending Accept. It must be called with the lock held.
+func (m *MuxConn) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MuxConn) remove(id uint16) {
+	m.l.Lock()
+	delete(m.streams, id)
+	m.l.Unlock()
+}
+
+// writeFrames writes b as a sequence of frames, or a single empty frame if b
+// is empty. Frames of concurrent writers are never interleaved.
+func (m *MuxConn) writeFrames(id uint16, b []byte) (int, error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	n := 0
+	for {
+		l := len(b) - n
+		if l > maxFrameSize {
+			l = maxFrameSize
+		}
+		f := make([]byte, headerSize+l)
+		binary.BigEndian.PutUint16(f[0:2], id)
+		binary.BigEndian.PutUint16(f[2:4], uint16(l))
+		copy(f[headerSize:], b[n:n+l])
+		if _, err := m.c.Write(f); err != nil {
+			return n, err
+		}
+		n += l
+		if n == len(b) {
+			return n, nil
+		}
+	}
+}
+
+// Listener accepts the streams opened by the other end of a connection.
+type Listener struct {
+	m *MuxConn
+}
+
+// NewMuxListener starts multiplexing streams over c, for the end that accepts
+// them. The returned net.Listener can be given to server.NewServer.
+func NewMuxListener(c net.Conn) net.Listener {
+	return &Listener{m: newMuxConn(c, true)}
+}
+
+// Accept waits for the next stream.
+func (l *Listener) Accept() (net.Conn, error) {
+	m := l.m
+	for {
+		m.l.Lock()
+		if len(m.pending) > 0 {
+			s := m.pending[0]
+			m.pending = m.pending[1:]
+			if len(m.pending) > 0 {
+				// wake up concurrent callers
+				m.signal()
+			}
+			m.l.Unlock()
+			return s, nil
+		}
+		m.l.Unlock()
+		select {
+		case <-m.ready:
+		case <-m.done:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// Close closes the underlying connection, and therefore all streams.
+func (l *Listener) Close() error {
+	return l.m.Close()
+}
+
+// Addr returns the local address of the underlying connection.
+func (l *Listener) Addr() net.Addr {
+	return l.m.c.LocalAddr()
+}
+
+// stream is a virtual connection carried by a MuxConn.
+type stream struct {
+	m  *MuxConn
+	id uint16
+
+	l   sync.Mutex
+	buf bytes.Buffer
+	// error returned by Read once buf is drained, set on remote close
+	rerr error
+	// set on local close
+	closed    bool
+	rdeadline time.Time
+	wdeadline time.Time
+
+	// signalled whenever any of the above changes
+	notify chan struct{}
+}
+
+func newStream(m *MuxConn, id uint16) *stream {
+	return &stream{m: m, id: id, notify: make(chan struct{}, 1)}
+}
+
+func (s *stream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) push(data []byte) {
+	s.l.Lock()
+	if !s.closed && s.rerr == nil {
+		s.buf.Write(data)
+	}
+	s.l.Unlock()
+	s.signal()
+}
+
+func (s *stream) closeRead(err error) {
+	s.l.Lock()
+	if s.rerr == nil {
+		s.rerr = err
+	}
+	s.l.Unlock()
+	s.signal()
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	for {
+		s.l.Lock()
+		if s.closed {
+			s.l.Unlock()
+			return 0, net.ErrClosed
+		}
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.l.Unlock()
+			return n, nil
+		}
+		if s.rerr != nil {
+			err := s.rerr
+			s.l.Unlock()
+			return 0, err
+		}
+		deadline := s.rdeadline
+		s.l.Unlock()
+
+		if deadline.IsZero() {
+			<-s.notify
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-s.notify:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	s.l.Lock()
+	closed, deadline := s.closed, s.wdeadline
+	s.l.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(b) == 0 {
+		// empty frames are reserved to close streams
+		return 0, nil
+	}
+	return s.m.writeFrames(s.id, b)
+}
+
+// Close closes the stream in both directions. The other end reads EOF once
+// it has consumed all data previously written.
+func (s *stream) Close() error {
+	s.l.Lock()
+	if s.closed {
+		s.l.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.buf.Reset()
+	s.l.Unlock()
+	s.signal()
+	s.m.remove(s.id)
+	_, err := s.m.writeFrames(s.id, nil)
+	return err
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	return s.m.c.LocalAddr()
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	return s.m.c.RemoteAddr()
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.l.Lock()
+	s.rdeadline = t
+	s.wdeadline = t
+	s.l.Unlock()
+	s.signal()
+	return nil
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.l.Lock()
+	s.rdeadline = t
+	s.l.Unlock()
+	s.signal()
+	return nil
+}
+
+// SetWriteDeadline only fails writes started after the deadline, as writes
+// to the underlying connection are shared by all streams.
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.l.Lock()
+	s.wdeadline = t
+	s.l.Unlock()
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package mux
+
+import (
+	"bytes"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/server"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type eventQueue chan client.Event
+
+func (q eventQueue) HandleEvent(ev client.Event) {
+	q <- ev
+}
+
+var auth server.Authenticator = &server.MultiSchemeAuthenticator{
+	Schemes: map[string]server.AuthenticatorFunc{
+		"none": func(_ net.Conn, _, _, _ []byte) bool { return true },
+	},
+}
+
+func TestMux_should_isolate_sessions(t *testing.T) {
+	a, b := net.Pipe()
+	s := server.NewServer(NewMuxListener(b), auth, nil)
+	defer s.Start().Stop()
+	m := NewMuxConn(a)
+
+	const n = 10
+	clients := make([]client.Client, n)
+	queues := make([]eventQueue, n)
+	for i := 0; i < n; i++ {
+		c, err := m.OpenStream()
+		require.Nil(t, err)
+		queues[i] = make(eventQueue, 10)
+		clients[i] = client.NewClient(c, queues[i])
+		defer clients[i].Close()
+		r, err := clients[i].Login("user"+strconv.Itoa(i), "none", "")
+		require.Nil(t, err)
+		require.Equal(t, ssmp.CodeOk, r.Code)
+	}
+	for i := 0; i < n; i++ {
+		r, err := clients[i].Ucast("user"+strconv.Itoa((i+1)%n), "hello from "+strconv.Itoa(i))
+		require.Nil(t, err)
+		require.Equal(t, ssmp.CodeOk, r.Code)
+	}
+	for i := 0; i < n; i++ {
+		from := (i + n - 1) % n
+		select {
+		case ev := <-queues[i]:
+			require.Equal(t, ssmp.UCAST, string(ev.Name))
+			require.Equal(t, "user"+strconv.Itoa(from), string(ev.From))
+			require.Equal(t, "hello from "+strconv.Itoa(from), string(ev.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+	for i := 0; i < n; i++ {
+		require.Len(t, queues[i], 0)
+	}
+
+	// closing a session leaves the others untouched
+	clients[0].Close()
+	r, err := clients[1].Ucast("user2", "still there")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	r, err = clients[1].Ucast("user0", "gone")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeNotFound, r.Code)
+}
+
+func TestMux_should_split_large_writes(t *testing.T) {
+	a, b := net.Pipe()
+	l := NewMuxListener(b)
+	defer l.Close()
+	m := NewMuxConn(a)
+
+	c, err := m.OpenStream()
+	require.Nil(t, err)
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	go func() {
+		c.Write(data)
+		c.Close()
+	}()
+
+	sc, err := l.Accept()
+	require.Nil(t, err)
+	got, err := io.ReadAll(sc)
+	require.Nil(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestMux_should_accept_streams_out_of_order(t *testing.T) {
+	a, b := net.Pipe()
+	l := NewMuxListener(b)
+	defer l.Close()
+	m := NewMuxConn(a)
+
+	c1, err := m.OpenStream()
+	require.Nil(t, err)
+	c2, err := m.OpenStream()
+	require.Nil(t, err)
+
+	for _, w := range []struct {
+		c    net.Conn
+		data string
+	}{{c2, "second"}, {c1, "first"}} {
+		go w.c.Write([]byte(w.data))
+		sc, err := l.Accept()
+		require.Nil(t, err)
+		got := make([]byte, len(w.data))
+		_, err = io.ReadFull(sc, got)
+		require.Nil(t, err)
+		require.Equal(t, w.data, string(got))
+	}
+}
+
+func TestMux_should_read_while_streams_await_accept(t *testing.T) {
+	a, b := net.Pipe()
+	l := NewMuxListener(b)
+	m := NewMuxConn(a)
+
+	c1, err := m.OpenStream()
+	require.Nil(t, err)
+	go c1.Write([]byte("first"))
+	sc1, err := l.Accept()
+	require.Nil(t, err)
+
+	// a stream nobody accepts yet doesn't hold back the others
+	c2, err := m.OpenStream()
+	require.Nil(t, err)
+	_, err = c2.Write([]byte("second"))
+	require.Nil(t, err)
+	go c1.Write([]byte("again"))
+	sc1.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, len("firstagain"))
+	_, err = io.ReadFull(sc1, got)
+	require.Nil(t, err)
+	require.Equal(t, "firstagain", string(got))
+
+	sc2, err := l.Accept()
+	require.Nil(t, err)
+	got = make([]byte, len("second"))
+	_, err = io.ReadFull(sc2, got)
+	require.Nil(t, err)
+	require.Equal(t, "second", string(got))
+
+	l.Close()
+	_, err = l.Accept()
+	require.Equal(t, net.ErrClosed, err)
+}
+
+func TestMux_should_time_out_reads(t *testing.T) {
+	a, b := net.Pipe()
+	l := NewMuxListener(b)
+	defer l.Close()
+	m := NewMuxConn(a)
+
+	c, err := m.OpenStream()
+	require.Nil(t, err)
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, nerr.Timeout())
+}
+
+func TestMux_should_close_streams_with_connection(t *testing.T) {
+	a, b := net.Pipe()
+	l := NewMuxListener(b)
+	m := NewMuxConn(a)
+
+	c, err := m.OpenStream()
+	require.Nil(t, err)
+	l.Close()
+	_, err = c.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	_, err = l.Accept()
+	require.Equal(t, net.ErrClosed, err)
+	_, err = m.OpenStream()
+	require.NotNil(t, err)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+// Package quic carries SSMP sessions over QUIC streams.
+//
+// Each QUIC stream carries one SSMP session and is exposed as a net.Conn, so
+// that the regular client and server libraries can be used unchanged. TLS is
+// built into QUIC and the server must therefore not be given its own TLS
+// configuration.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/aerofs/lipwig/server"
+	quicgo "github.com/quic-go/quic-go"
+	"net"
+	"sync"
+	"time"
+)
+
+// NextProto is the ALPN protocol negotiated by default.
+const NextProto = "ssmp"
+
+// keep dialed QUIC connections alive between SSMP pings. Servers don't, so
+// that connections without any stream are closed once idle.
+const keepAlivePeriod = 15 * time.Second
+
+var dialConfig *quicgo.Config = &quicgo.Config{
+	KeepAlivePeriod: keepAlivePeriod,
+}
+
+var ErrNoTLSConfig error = fmt.Errorf("QUIC server requires a TLS configuration")
+
+// Listener accepts QUIC streams as net.Conn.
+// It implements net.Listener and can therefore be given to server.NewServer.
+type Listener struct {
+	l       *quicgo.Listener
+	cfg     *tls.Config
+	streams chan net.Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	conns map[*quicgo.Conn]bool
+}
+
+// NewQUICServer creates a SSMP server accepting QUIC streams on the given
+// UDP address. The server's ListeningPort is the UDP port.
+func NewQUICServer(addr string, auth server.Authenticator, cfg *tls.Config, opts ...server.ServerOption) (*server.Server, error) {
+	l, err := Listen(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewServer(l, auth, nil, opts...), nil
+}
+
+// Listen creates a QUIC Listener on the given UDP address.
+// If cfg doesn't specify any ALPN protocol, NextProto is used.
+// ErrNoTLSConfig is returned if cfg is nil.
+func Listen(addr string, cfg *tls.Config) (*Listener, error) {
+	if cfg == nil {
+		return nil, ErrNoTLSConfig
+	}
+	l, err := quicgo.ListenAddr(addr, withNextProto(cfg), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ql := &Listener{
+		l:       l,
+		cfg:     cfg,
+		streams: make(chan net.Conn),
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[*quicgo.Conn]bool),
+	}
+	go ql.acceptConns()
+	return ql, nil
+}
+
+// Dial opens a QUIC connection and a single stream over it.
+// Closing the returned net.Conn closes the whole QUIC connection.
+// A nil cfg verifies the server against the system roots.
+func Dial(ctx context.Context, addr string, cfg *tls.Config) (net.Conn, error) {
+	c, err := quicgo.DialAddr(ctx, addr, withNextProto(cfg), dialConfig)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		c.CloseWithError(0, "")
+		return nil, err
+	}
+	return &streamConn{Stream: s, c: c, dialed: true}, nil
+}
+
+func withNextProto(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		return &tls.Config{NextProtos: []string{NextProto}}
+	}
+	if len(cfg.NextProtos) > 0 {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{NextProto}
+	return cfg
+}
+
+func (l *Listener) acceptConns() {
+	for {
+		c, err := l.l.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.conns[c] = true
+		l.mu.Unlock()
+		go l.acceptStreams(c)
+	}
+}
+
+func (l *Listener) acceptStreams(c *quicgo.Conn) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, c)
+		l.mu.Unlock()
+	}()
+	for {
+		s, err := c.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &streamConn{Stream: s, c: c}:
+		case <-l.ctx.Done():
+			s.CancelRead(0)
+			s.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for the next stream, from any QUIC connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.streams:
+		return c, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams and closes all QUIC connections.
+func (l *Listener) Close() error {
+	l.cancel()
+	err := l.l.Close()
+	l.mu.Lock()
+	for c := range l.conns {
+		c.CloseWithError(0, "")
+	}
+	l.mu.Unlock()
+	return err
+}
+
+// Relisten creates a new Listener on the same UDP address, with the same TLS
+// configuration, see server.Relistener.
+func (l *Listener) Relisten() (net.Listener, error) {
+	return Listen(l.Addr().String(), l.cfg)
+}
+
+// Addr returns the UDP address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// streamConn adapts a QUIC stream to net.Conn.
+type streamConn struct {
+	*quicgo.Stream
+	c *quicgo.Conn
+
+	// whether the QUIC connection is owned by this stream
+	dialed bool
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.c.LocalAddr()
+}
+
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.c.RemoteAddr()
+}
+
+// ConnectionState allows certificate authentication, see server.CertAuth.
+func (s *streamConn) ConnectionState() tls.ConnectionState {
+	return s.c.ConnectionState().TLS
+}
+
+func (s *streamConn) Close() error {
+	s.CancelRead(0)
+	err := s.Stream.Close()
+	if s.dialed {
+		s.c.CloseWithError(0, "")
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2015, Air Computing Inc. <oss@aerofs.com>
+// All rights reserved.
+
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/aerofs/lipwig/client"
+	"github.com/aerofs/lipwig/server"
+	"github.com/aerofs/lipwig/ssmp"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type eventQueue chan client.Event
+
+func (q eventQueue) HandleEvent(ev client.Event) {
+	q <- ev
+}
+
+func newCert(t *testing.T, cn string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func selfSigned(t *testing.T) (*tls.Config, *tls.Config) {
+	cert, roots := newCert(t, "localhost", x509.ExtKeyUsageServerAuth)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, &tls.Config{
+		RootCAs: roots,
+	}
+}
+
+func newClient(t *testing.T, port int, cfg *tls.Config, user string) (client.Client, eventQueue) {
+	return newClientWithScheme(t, port, cfg, user, "none")
+}
+
+func newClientWithScheme(t *testing.T, port int, cfg *tls.Config, user, scheme string) (client.Client, eventQueue) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, "127.0.0.1:"+strconv.Itoa(port), cfg)
+	require.Nil(t, err)
+	q := make(eventQueue, 10)
+	cc := client.NewClient(c, q)
+	r, err := cc.Login(user, scheme, "")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	return cc, q
+}
+
+func TestQUIC_should_multicast(t *testing.T) {
+	serverCfg, clientCfg := selfSigned(t)
+	auth := &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"none": func(_ net.Conn, _, _, _ []byte) bool { return true },
+		},
+	}
+	s, err := NewQUICServer("127.0.0.1:0", auth, serverCfg)
+	require.Nil(t, err)
+	defer s.Start().Stop()
+	require.NotZero(t, s.ListeningPort())
+
+	foo, _ := newClient(t, s.ListeningPort(), clientCfg, "foo")
+	defer foo.Close()
+	bar, q := newClient(t, s.ListeningPort(), clientCfg, "bar")
+	defer bar.Close()
+
+	r, err := foo.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	r, err = bar.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	r, err = foo.Mcast("chat", "hello")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+
+	select {
+	case ev := <-q:
+		require.Equal(t, ssmp.MCAST, string(ev.Name))
+		require.Equal(t, "foo", string(ev.From))
+		require.Equal(t, "chat", string(ev.To))
+		require.Equal(t, "hello", string(ev.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestQUIC_should_authenticate_cert_with_byte_metrics(t *testing.T) {
+	serverCfg, clientCfg := selfSigned(t)
+	clientCert, clientRoots := newCert(t, "foo", x509.ExtKeyUsageClientAuth)
+	serverCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	serverCfg.ClientCAs = clientRoots
+	clientCfg.Certificates = []tls.Certificate{clientCert}
+	auth := &server.MultiSchemeAuthenticator{
+		Schemes: map[string]server.AuthenticatorFunc{
+			"cert": server.CertAuth,
+		},
+	}
+	s, err := NewQUICServer("127.0.0.1:0", auth, serverCfg, server.WithByteMetrics(true))
+	require.Nil(t, err)
+	defer s.Start().Stop()
+
+	foo, _ := newClientWithScheme(t, s.ListeningPort(), clientCfg, "foo", "cert")
+	defer foo.Close()
+	r, err := foo.Subscribe("chat")
+	require.Nil(t, err)
+	require.Equal(t, ssmp.CodeOk, r.Code)
+	require.NotZero(t, s.TotalBytesReceived())
+}
+
+func TestQUIC_should_require_tls_config(t *testing.T) {
+	_, err := Listen("127.0.0.1:0", nil)
+	require.Equal(t, ErrNoTLSConfig, err)
+	require.Equal(t, []string{NextProto}, withNextProto(nil).NextProtos)
+}